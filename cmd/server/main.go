@@ -1,41 +1,303 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/devaloi/chatterbox/internal/broadcast"
+	"github.com/devaloi/chatterbox/internal/client"
 	"github.com/devaloi/chatterbox/internal/config"
+	"github.com/devaloi/chatterbox/internal/deadletter"
+	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/handler"
 	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/metrics"
 	"github.com/devaloi/chatterbox/internal/middleware"
+	"github.com/devaloi/chatterbox/internal/relay"
 	"github.com/devaloi/chatterbox/internal/store"
 )
 
 func main() {
 	cfg := config.Load()
 
-	s, err := store.NewSQLite(cfg.DBPath)
+	logger, err := newLogger(cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
-		log.Fatalf("store: %v", err)
+		log.Fatalf("config: %v", err)
 	}
-	defer s.Close()
+	slog.SetDefault(logger)
 
-	h := hub.New(s, cfg.MaxRooms, cfg.MaxHistory)
+	var st store.Store
+	switch cfg.StoreBackend {
+	case "sqlite":
+		checkpointMode, err := store.ParseCheckpointMode(cfg.CheckpointMode)
+		if err != nil {
+			fatal("config", err)
+		}
+		st, err = store.NewSQLite(cfg.DBPath,
+			store.WithBusyTimeout(time.Duration(cfg.DBBusyTimeoutMS)*time.Millisecond),
+			store.WithCheckpoint(time.Duration(cfg.CheckpointIntervalMS)*time.Millisecond, checkpointMode),
+			store.WithEditHistory(cfg.EditHistory),
+			store.WithRetention(time.Duration(cfg.RetentionDays)*24*time.Hour, time.Duration(cfg.RetentionSweepMS)*time.Millisecond),
+			store.WithWriteBatch(cfg.WriteBatchSize, time.Duration(cfg.WriteBatchMS)*time.Millisecond),
+		)
+		if err != nil {
+			fatal("open store", err)
+		}
+	case "postgres":
+		// Retention and write batching are SQLite features; refuse them
+		// rather than let them silently do nothing.
+		if cfg.RetentionDays > 0 {
+			fatal("config", errors.New("RETENTION_DAYS is not supported with STORE_BACKEND=postgres"))
+		}
+		if cfg.WriteBatchSize > 1 {
+			fatal("config", errors.New("WRITE_BATCH_SIZE is not supported with STORE_BACKEND=postgres"))
+		}
+		st, err = store.NewPostgres(cfg.DatabaseURL)
+		if err != nil {
+			fatal("open store", err)
+		}
+	default:
+		fatal("config", fmt.Errorf("unknown STORE_BACKEND %q (want sqlite or postgres)", cfg.StoreBackend))
+	}
+
+	if cfg.HistoryCacheMS > 0 {
+		st = store.NewCachedStore(st, time.Duration(cfg.HistoryCacheMS)*time.Millisecond)
+	}
+	defer st.Close()
+
+	serverID := cfg.ServerID
+	if serverID == "" {
+		serverID = relay.NewServerID()
+	}
+
+	joinOrder, err := hub.ParseJoinOrder(cfg.JoinOrder)
+	if err != nil {
+		fatal("config", err)
+	}
+	roomHistory, err := hub.ParseRoomHistory(cfg.RoomHistory)
+	if err != nil {
+		fatal("config", err)
+	}
+	eviction, err := hub.ParseRoomEviction(cfg.RoomEviction)
+	if err != nil {
+		fatal("config", err)
+	}
+	deleteMode, err := hub.ParseDeleteMode(cfg.DeleteMode)
+	if err != nil {
+		fatal("config", err)
+	}
+	filterMode, err := domain.ParseFilterMode(cfg.FilterMode)
+	if err != nil {
+		fatal("config", err)
+	}
+	var wordFilter []domain.MessageStage
+	if cfg.FilterWordsFile != "" {
+		f, err := os.Open(cfg.FilterWordsFile)
+		if err != nil {
+			fatal("word filter", err)
+		}
+		words, err := domain.ParseWordList(f)
+		f.Close()
+		if err != nil {
+			fatal("word filter", err)
+		}
+		wordFilter = append(wordFilter, domain.WordFilterStage(domain.NewWordFilter(words), filterMode))
+		slog.Info("filtering words", "words", len(words), "mode", filterMode)
+	}
+
+	var fanout broadcast.Broadcaster = broadcast.Local{}
+	var redis *broadcast.Redis
+	if cfg.RedisURL != "" {
+		redis, err = broadcast.NewRedis(cfg.RedisURL, serverID)
+		if err != nil {
+			fatal("config", err)
+		}
+		fanout = redis
+	}
+
+	roomMetrics := metrics.NewRoomLabels(cfg.MetricsMaxRooms)
+	roomMetrics.Start(time.Duration(cfg.MetricsRefreshMS) * time.Millisecond)
+	defer roomMetrics.Stop()
+
+	var deadLetters deadletter.Sink
+	if cfg.DeadLetterFile != "" {
+		dl, err := deadletter.NewFileSink(cfg.DeadLetterFile, cfg.DeadLetterMax)
+		if err != nil {
+			fatal("dead letters", err)
+		}
+		defer dl.Close()
+		deadLetters = dl
+	}
+
+	h := hub.New(st, cfg.MaxRooms, cfg.MaxHistory,
+		// Re-check length in the hub so relayed messages are held to it too.
+		hub.WithPipeline(domain.ValidateStage(cfg.MaxTextLen)),
+		hub.WithTextNormalization(cfg.NormalizeText),
+		// After normalization, so the filter sees the text as stored.
+		hub.WithPipeline(wordFilter...),
+		hub.WithServerID(serverID),
+		hub.WithReactionLimits(cfg.MaxReactionEmoji, cfg.MaxUserReactions),
+		hub.WithTypePolicy(domain.TypePolicy{
+			Persist: domain.ParseTypeSet(cfg.PersistTypes),
+			History: domain.ParseTypeSet(cfg.HistoryTypes),
+		}),
+		hub.WithJoinOrder(joinOrder),
+		hub.WithRoomHistory(roomHistory, cfg.MaxRoomHistory),
+		hub.WithRoomEviction(eviction),
+		hub.WithDeleteMode(deleteMode),
+		hub.WithPresenceConnections(cfg.PresenceConnections),
+		hub.WithUniqueNames(cfg.UniqueNames),
+		hub.WithMaxRoomUsers(cfg.MaxRoomUsers),
+		hub.WithRoomRateLimit(cfg.MaxRoomMsgsPerSec),
+		hub.WithKickBan(time.Duration(cfg.KickBanMS)*time.Millisecond),
+		hub.WithLoadShedding(cfg.ShedQueueHigh, cfg.ShedQueueLow, cfg.ShedConnHigh, cfg.ShedConnLow),
+		hub.WithMaxPendingRegistrations(cfg.MaxPendingJoins),
+		hub.WithMaxConnections(cfg.MaxConnections),
+		hub.WithRoomMetrics(roomMetrics),
+		hub.WithBroadcaster(fanout),
+		hub.WithDeadLetters(deadLetters),
+	)
+	if err := h.RestoreRooms(); err != nil {
+		fatal("restore rooms", err)
+	}
 	go h.Run()
 	defer h.Stop()
 
+	if redis != nil {
+		redis.Start(h.DeliverRemote)
+		defer redis.Stop()
+		slog.Info("fanning out broadcasts through redis", "server_id", serverID)
+	}
+
+	peers, err := relay.ParsePeers(cfg.RelayPeers)
+	if err != nil {
+		fatal("relay", err)
+	}
+	for _, p := range peers {
+		p.Token = cfg.RelayToken
+		sink := relay.NewSink(h, serverID, p)
+		sink.Start()
+		defer sink.Stop()
+		slog.Info("relaying room", "room", p.Room, "peer", p.URL)
+	}
+
+	writeWait := time.Duration(cfg.WriteWaitMS) * time.Millisecond
+	pingWriteWait := time.Duration(cfg.PingWriteWaitMS) * time.Millisecond
+	pongWait := time.Duration(cfg.PongWaitMS) * time.Millisecond
+	if err := client.ValidateWriteDeadlines(writeWait, pingWriteWait, pongWait); err != nil {
+		fatal("config", err)
+	}
+
+	clientOpts := []client.Option{
+		client.WithWriteDeadlines(writeWait, pingWriteWait),
+		client.WithPongWait(pongWait),
+		client.WithHandshake(cfg.RequireHello),
+		client.WithMaxTextLen(cfg.MaxTextLen),
+		client.WithProtocolErrorLimit(cfg.MaxProtocolErrors, time.Duration(cfg.ProtocolErrorWindowMS)*time.Millisecond),
+		client.WithAckWindow(cfg.AckWindow),
+		client.WithRateLimit(cfg.MaxMsgsPerSec),
+		client.WithIdleTimeout(time.Duration(cfg.IdleTimeoutMS) * time.Millisecond),
+		client.WithMaxSendDrops(cfg.MaxSendDrops),
+		client.WithSendBuffer(cfg.SendBufferSize),
+		client.WithMaxFrameSize(cfg.MaxFrameSize),
+		client.WithGuestRoomCreation(cfg.GuestCreateRooms),
+	}
+	if cfg.ProtocolLog {
+		clientOpts = append(clientOpts, client.WithProtocolLog(logger))
+	}
+	if deadLetters != nil {
+		clientOpts = append(clientOpts, client.WithDeadLetters(deadLetters))
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", handler.Health())
 	mux.HandleFunc("/api/rooms", handler.ListRooms(h))
+	mux.HandleFunc("POST /api/rooms", handler.CreateRoom(h, cfg.AdminToken))
+	mux.HandleFunc("DELETE /api/rooms/{name}", handler.DeleteRoom(h, st, cfg.AdminToken))
+	mux.HandleFunc("POST /api/announce", handler.Announce(h, cfg.AdminToken, cfg.MaxTextLen))
 	mux.HandleFunc("/api/rooms/", handler.RoomInfo(h))
-	mux.HandleFunc("/ws", handler.ServeWS(h))
-	mux.Handle("/", http.FileServer(http.Dir("static")))
+	mux.HandleFunc("GET /api/rooms/all", handler.AllRooms(h))
+	mux.HandleFunc("/api/rooms/{name}/history", handler.RoomHistory(h, st))
+	mux.HandleFunc("GET /api/history", handler.MultiHistory(h, st))
+	mux.HandleFunc("GET /api/rooms/{name}/thread/{id}", handler.RoomThread(h, st))
+	mux.HandleFunc("POST /api/rooms/{name}/messages", handler.PostMessage(h, cfg.MaxTextLen))
+	mux.HandleFunc("GET /api/rooms/{name}/search", handler.SearchRoom(h, st))
+	mux.HandleFunc("/api/rooms/{name}/poll", handler.PollRoom(h, time.Duration(cfg.PollTimeoutMS)*time.Millisecond))
+	mux.HandleFunc("GET /api/messages/{id}/edits", handler.MessageEdits(st, cfg.AdminToken))
+	mux.HandleFunc("/api/stats", handler.Stats(h))
+	mux.HandleFunc("/metrics", handler.Metrics(roomMetrics))
+	mux.HandleFunc("/api/users", handler.ListUsers(h))
+	mux.HandleFunc("GET /api/users/{name}/lastseen", handler.UserLastSeen(h))
+	wsCfg := handler.WSConfig{
+		AllowGuests:   cfg.AllowGuests,
+		TrustProxy:    cfg.TrustProxy,
+		MaxConnsPerIP: cfg.MaxConnsPerIP,
+		AdminToken:    cfg.AdminToken,
+		RelayToken:    cfg.RelayToken,
+	}
+	mux.HandleFunc("/ws", handler.ServeWSConfig(h, wsCfg, clientOpts...))
+	mux.Handle("/", handler.Static(cfg.StaticDir))
 
-	wrapped := middleware.Logging(middleware.CORS(mux))
+	wrapped := middleware.RequestID(middleware.Logging(middleware.CORS(middleware.Gzip(cfg.GzipMinSize)(mux))))
 
 	addr := ":" + cfg.Port
-	log.Printf("chatterbox listening on %s", addr)
-	if err := http.ListenAndServe(addr, wrapped); err != nil {
-		log.Fatalf("server error: %v", err)
+	srv := &http.Server{Addr: addr, Handler: wrapped}
+	go func() {
+		slog.Info("chatterbox listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("serve", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutMS)*time.Millisecond)
+	defer cancel()
+	h.Announce("server shutting down")
+
+	// Stop accepting connections while WebSocket clients drain; stopping the
+	// hub also releases pending long polls so the HTTP shutdown can finish.
+	srvDone := make(chan error, 1)
+	go func() { srvDone <- srv.Shutdown(ctx) }()
+	if err := h.Shutdown(ctx); err != nil {
+		slog.Warn("shutdown: some connections were force-closed", "err", err)
+	}
+	if err := <-srvDone; err != nil {
+		slog.Warn("shutdown: http server", "err", err)
 	}
 }
+
+// newLogger builds the server's logger from LOG_LEVEL (debug, info, warn or
+// error) and LOG_FORMAT (text or json).
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL %q: want debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid LOG_FORMAT %q: want text or json", format)
+}
+
+// fatal logs an error that stops startup and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
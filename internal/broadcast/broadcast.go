@@ -0,0 +1,19 @@
+// Package broadcast carries room broadcasts to room members, either within
+// one process or across every chatterbox instance sharing a Redis server.
+package broadcast
+
+// Broadcaster fans a room broadcast out to the room's members. deliver
+// queues data on the members connected to this instance; a Broadcaster
+// spanning several instances calls it for local members and hands data to
+// the other instances itself.
+type Broadcaster interface {
+	Broadcast(room string, data []byte, deliver func([]byte))
+}
+
+// Local delivers broadcasts to this instance's members only.
+type Local struct{}
+
+// Broadcast delivers data locally.
+func (Local) Broadcast(_ string, data []byte, deliver func([]byte)) {
+	deliver(data)
+}
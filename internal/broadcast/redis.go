@@ -0,0 +1,287 @@
+package broadcast
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// channelPrefix namespaces room channels; a room's broadcasts are
+	// published to channelPrefix + name.
+	channelPrefix = "room:"
+	// redialDelay is how long a connection waits before reconnecting.
+	redialDelay = 2 * time.Second
+	dialTimeout = 5 * time.Second
+	// publishBuffer bounds broadcasts queued for Redis; further broadcasts
+	// still reach local members but are not published.
+	publishBuffer = 1024
+)
+
+// envelope wraps a published broadcast with the instance that sent it, so
+// an instance can ignore its own broadcasts coming back from Redis.
+type envelope struct {
+	Origin string          `json:"origin"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type publication struct {
+	channel string
+	payload []byte
+}
+
+// Redis delivers broadcasts locally and publishes them to the Redis channel
+// room:<name>, and delivers broadcasts other instances publish to this
+// instance's members. It speaks just enough of the Redis protocol for
+// PUBLISH and PSUBSCRIBE, one connection each, redialing after failures.
+type Redis struct {
+	addr     string
+	username string
+	password string
+	origin   string
+
+	pub      chan publication
+	quit     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewRedis returns a Redis broadcaster for the server at rawURL, in the
+// form redis://[[user]:password@]host[:port]. origin identifies this
+// instance and must differ between instances. Call Start to connect.
+func NewRedis(rawURL, origin string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid redis url %q: want redis://host:port", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	r := &Redis{
+		addr:   addr,
+		origin: origin,
+		pub:    make(chan publication, publishBuffer),
+		quit:   make(chan struct{}),
+		conns:  make(map[net.Conn]bool),
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	return r, nil
+}
+
+// Broadcast delivers data to local members and queues it for the other
+// instances.
+func (r *Redis) Broadcast(room string, data []byte, deliver func([]byte)) {
+	deliver(data)
+	payload, err := json.Marshal(envelope{Origin: r.origin, Data: data})
+	if err != nil {
+		slog.Error("encode broadcast", "room", room, "err", err)
+		return
+	}
+	select {
+	case r.pub <- publication{channel: channelPrefix + room, payload: payload}:
+	default:
+		slog.Warn("redis publish queue full", "room", room)
+	}
+}
+
+// Start connects to Redis and delivers broadcasts from other instances by
+// calling deliver with the room name and frame.
+func (r *Redis) Start(deliver func(room string, data []byte)) {
+	r.wg.Add(2)
+	go r.loop("publish", r.publish)
+	go r.loop("subscribe", func(conn net.Conn, br *bufio.Reader) error {
+		return r.subscribe(conn, br, deliver)
+	})
+}
+
+// Stop closes the Redis connections. Broadcasts still queued are dropped.
+func (r *Redis) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+	})
+}
+
+// loop runs fn on a fresh connection until the broadcaster stops.
+func (r *Redis) loop(name string, fn func(net.Conn, *bufio.Reader) error) {
+	defer r.wg.Done()
+	for {
+		if err := r.session(fn); err != nil {
+			slog.Warn("redis "+name, "addr", r.addr, "err", err)
+		}
+		select {
+		case <-r.quit:
+			return
+		case <-time.After(redialDelay):
+		}
+	}
+}
+
+func (r *Redis) session(fn func(net.Conn, *bufio.Reader) error) error {
+	conn, err := net.DialTimeout("tcp", r.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	select {
+	case <-r.quit:
+		r.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	r.conns[conn] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	br := bufio.NewReader(conn)
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := command(conn, br, args...); err != nil {
+			return err
+		}
+	}
+	err = fn(conn, br)
+	select {
+	case <-r.quit:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (r *Redis) publish(conn net.Conn, br *bufio.Reader) error {
+	for {
+		select {
+		case <-r.quit:
+			return nil
+		case p := <-r.pub:
+			if _, err := command(conn, br, "PUBLISH", p.channel, string(p.payload)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Redis) subscribe(conn net.Conn, br *bufio.Reader, deliver func(room string, data []byte)) error {
+	if err := writeCommand(conn, "PSUBSCRIBE", channelPrefix+"*"); err != nil {
+		return err
+	}
+	for {
+		reply, err := readReply(br)
+		if err != nil {
+			return err
+		}
+		// Pattern messages arrive as [pmessage, pattern, channel, payload].
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+			continue
+		}
+		channel, _ := parts[2].(string)
+		payload, _ := parts[3].(string)
+		var env envelope
+		if err := json.Unmarshal([]byte(payload), &env); err != nil {
+			slog.Warn("decode broadcast", "channel", channel, "err", err)
+			continue
+		}
+		if env.Origin == r.origin {
+			continue
+		}
+		deliver(strings.TrimPrefix(channel, channelPrefix), env.Data)
+	}
+}
+
+// command sends a command and reads its reply, turning a Redis error reply
+// into an error.
+func command(conn net.Conn, br *bufio.Reader, args ...string) (any, error) {
+	if err := writeCommand(conn, args...); err != nil {
+		return nil, err
+	}
+	return readReply(br)
+}
+
+// writeCommand writes args as a RESP array of bulk strings.
+func writeCommand(conn net.Conn, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := conn.Write([]byte(b.String()))
+	return err
+}
+
+// readReply reads one RESP reply. Simple and bulk strings become string,
+// integers int64, arrays []any, and a nil bulk string or array nil.
+func readReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
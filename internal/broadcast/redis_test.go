@@ -0,0 +1,71 @@
+//go:build redis
+
+package broadcast
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type deliveries struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (d *deliveries) add(room string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.msgs = append(d.msgs, room+" "+string(data))
+}
+
+func (d *deliveries) get() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.msgs...)
+}
+
+func TestRedisFanOut(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		url = "redis://localhost:6379"
+	}
+	a, err := NewRedis(url, "a")
+	if err != nil {
+		t.Fatalf("new redis: %v", err)
+	}
+	b, err := NewRedis(url, "b")
+	if err != nil {
+		t.Fatalf("new redis: %v", err)
+	}
+	var remoteA, remoteB deliveries
+	a.Start(remoteA.add)
+	defer a.Stop()
+	b.Start(remoteB.add)
+	defer b.Stop()
+
+	// Keep publishing until b's subscription is in place.
+	var local int
+	deadline := time.Now().Add(5 * time.Second)
+	for len(remoteB.get()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no broadcast reached the other instance; is redis running?")
+		}
+		a.Broadcast("general", []byte(`{"type":"chat"}`), func([]byte) { local++ })
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, m := range remoteB.get() {
+		if m != `general {"type":"chat"}` {
+			t.Errorf("unexpected delivery on b: %q", m)
+		}
+	}
+	if local == 0 {
+		t.Error("expected local delivery on a")
+	}
+	if got := remoteA.get(); len(got) != 0 {
+		t.Errorf("expected a to skip its own broadcasts, got %v", got)
+	}
+}
@@ -0,0 +1,375 @@
+// Package chatclient is a Go client for the chatterbox WebSocket protocol,
+// for bots, tools and tests that would otherwise hand-roll dialing and JSON.
+package chatclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// closeWait bounds how long Close waits for the server to answer the
+	// close frame.
+	closeWait = time.Second
+	// bufferSize is the default number of decoded messages held for Messages.
+	bufferSize = 256
+)
+
+var (
+	// ErrClosed is returned by sends after Close.
+	ErrClosed = errors.New("chatclient: connection closed")
+	// ErrNotConnected is returned by sends while reconnecting.
+	ErrNotConnected = errors.New("chatclient: not connected")
+)
+
+// Option configures a Conn.
+type Option func(*Conn)
+
+// WithReconnect redials after the connection drops, waiting initial before
+// the first attempt and doubling the wait up to max. Joined rooms are
+// rejoined with the id of the last message seen, so history only replays
+// what was missed. Without it, a dropped connection ends Messages.
+func WithReconnect(initial, max time.Duration) Option {
+	return func(c *Conn) {
+		if initial <= 0 || initial > max {
+			initial = max
+		}
+		c.backoff = initial
+		c.maxBackoff = max
+	}
+}
+
+// WithBufferSize sets how many decoded messages Messages holds before the
+// reader waits for the caller to catch up.
+func WithBufferSize(n int) Option {
+	return func(c *Conn) {
+		c.msgs = make(chan domain.Message, n)
+	}
+}
+
+// Conn is a client connection to a chatterbox server. Its methods are safe
+// for concurrent use.
+type Conn struct {
+	url        string
+	backoff    time.Duration
+	maxBackoff time.Duration
+	msgs       chan domain.Message
+
+	mu     sync.Mutex
+	ws     *websocket.Conn
+	rooms  map[string]string // joined room -> id of the last message seen
+	closed bool
+	err    error
+
+	writeMu  sync.Mutex
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Dial connects to the server's /ws endpoint as user, for example
+// Dial("ws://localhost:8080/ws", "alice").
+func Dial(rawURL, user string, opts ...Option) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("user", user)
+	u.RawQuery = q.Encode()
+
+	c := &Conn{
+		url:   u.String(),
+		rooms: make(map[string]string),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.msgs == nil {
+		c.msgs = make(chan domain.Message, bufferSize)
+	}
+	ws, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.ws = ws
+	go c.run(ws)
+	return c, nil
+}
+
+// Messages delivers decoded server frames in order. History frames are
+// unpacked into their messages; error frames arrive with Type "error" and
+// the reason in Text. The channel is closed once the connection ends for
+// good, after which Err reports why.
+func (c *Conn) Messages() <-chan domain.Message {
+	return c.msgs
+}
+
+// Err returns the error that ended the connection, or nil after Close.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Join joins room.
+func (c *Conn) Join(room string) error {
+	if err := c.Send(domain.Message{Type: domain.MsgJoin, Room: room}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if _, ok := c.rooms[room]; !ok {
+		c.rooms[room] = ""
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Leave leaves room.
+func (c *Conn) Leave(room string) error {
+	c.mu.Lock()
+	delete(c.rooms, room)
+	c.mu.Unlock()
+	return c.Send(domain.Message{Type: domain.MsgLeave, Room: room})
+}
+
+// SendChat sends text to room.
+func (c *Conn) SendChat(room, text string) error {
+	return c.Send(domain.Message{Type: domain.MsgChat, Room: room, Text: text})
+}
+
+// SendDM sends text directly to user.
+func (c *Conn) SendDM(to, text string) error {
+	return c.Send(domain.Message{Type: domain.MsgDM, To: to, Text: text})
+}
+
+// Send writes any protocol message, for frames without a helper.
+func (c *Conn) Send(msg domain.Message) error {
+	data, err := domain.Encode(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	ws, closed := c.ws, c.closed
+	c.mu.Unlock()
+	switch {
+	case closed:
+		return ErrClosed
+	case ws == nil:
+		return ErrNotConnected
+	}
+	return c.write(ws, websocket.TextMessage, data)
+}
+
+// Close sends a normal close frame, waits briefly for the server to answer,
+// and releases the connection. Messages is closed when it returns.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		<-c.done
+		return nil
+	}
+	c.closed = true
+	ws := c.ws
+	c.mu.Unlock()
+
+	if ws != nil {
+		c.write(ws, websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+	select {
+	case <-c.done:
+	case <-time.After(closeWait):
+	}
+	c.stop()
+	<-c.done
+	return nil
+}
+
+// stop ends the run loop and closes the current socket.
+func (c *Conn) stop() {
+	c.stopOnce.Do(func() {
+		close(c.quit)
+		c.mu.Lock()
+		if c.ws != nil {
+			c.ws.Close()
+		}
+		c.mu.Unlock()
+	})
+}
+
+func (c *Conn) write(ws *websocket.Conn, messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return ws.WriteMessage(messageType, data)
+}
+
+func (c *Conn) dial() (*websocket.Conn, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	return ws, nil
+}
+
+// run reads from ws, redialing on failure when reconnection is enabled,
+// until the connection ends for good.
+func (c *Conn) run(ws *websocket.Conn) {
+	defer close(c.done)
+	defer close(c.msgs)
+	for {
+		err := c.read(ws)
+		ws.Close()
+
+		c.mu.Lock()
+		c.ws = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if closed || c.maxBackoff <= 0 {
+			if !closed {
+				c.setErr(err)
+			}
+			return
+		}
+		if ws = c.redial(); ws == nil {
+			return
+		}
+	}
+}
+
+// read pumps frames from ws into Messages and pings the server until ws
+// fails or the client stops.
+func (c *Conn) read(ws *websocket.Conn) error {
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go c.ping(ws, pingDone)
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		for _, msg := range c.decode(data) {
+			select {
+			case c.msgs <- msg:
+			case <-c.quit:
+				return ErrClosed
+			}
+		}
+	}
+}
+
+func (c *Conn) ping(ws *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// decode turns one frame into the messages it carries and records the last
+// message id seen per joined room for rejoining.
+func (c *Conn) decode(data []byte) []domain.Message {
+	msg, err := domain.DecodeMessage(data)
+	if err != nil {
+		return nil
+	}
+	var msgs []domain.Message
+	switch msg.Type {
+	case domain.MsgHistory:
+		var h domain.HistoryMessage
+		if json.Unmarshal(data, &h) != nil {
+			return nil
+		}
+		msgs = h.Messages
+	case domain.MsgError:
+		var e domain.ErrorMessage
+		if json.Unmarshal(data, &e) != nil {
+			return nil
+		}
+		msgs = []domain.Message{{Type: domain.MsgError, Text: e.Message}}
+	default:
+		msgs = []domain.Message{msg}
+	}
+
+	c.mu.Lock()
+	for _, m := range msgs {
+		if m.ID == "" || m.Room == "" {
+			continue
+		}
+		if _, ok := c.rooms[m.Room]; ok {
+			c.rooms[m.Room] = m.ID
+		}
+	}
+	c.mu.Unlock()
+	return msgs
+}
+
+// redial reconnects with exponential backoff and rejoins every joined room.
+// It returns nil if the client is closed first.
+func (c *Conn) redial() *websocket.Conn {
+	wait := c.backoff
+	for {
+		select {
+		case <-c.quit:
+			return nil
+		case <-time.After(wait):
+		}
+		if ws, err := c.dial(); err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				ws.Close()
+				return nil
+			}
+			c.ws = ws
+			rejoin := make([]domain.Message, 0, len(c.rooms))
+			for room, last := range c.rooms {
+				rejoin = append(rejoin, domain.Message{Type: domain.MsgJoin, Room: room, SinceID: last})
+			}
+			c.mu.Unlock()
+			for _, msg := range rejoin {
+				data, _ := domain.Encode(msg)
+				c.write(ws, websocket.TextMessage, data)
+			}
+			return ws
+		}
+		wait *= 2
+		if wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+	}
+}
+
+func (c *Conn) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
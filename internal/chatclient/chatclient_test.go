@@ -0,0 +1,265 @@
+package chatclient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/handler"
+	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+func setupServer(t *testing.T) string {
+	t.Helper()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	server := httptest.NewServer(handler.ServeWS(h))
+	t.Cleanup(func() {
+		server.Close()
+		h.Stop()
+		s.Close()
+	})
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url, user string, opts ...Option) *Conn {
+	t.Helper()
+	c, err := Dial(url, user, opts...)
+	if err != nil {
+		t.Fatalf("dial %s: %v", user, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// next returns the next message of type typ, skipping others.
+func next(t *testing.T, c *Conn, typ string) domain.Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("connection ended waiting for %s: %v", typ, c.Err())
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", typ)
+		}
+	}
+}
+
+func TestChatBetweenClients(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+
+	alice.Join("general")
+	next(t, alice, domain.MsgPresence)
+	bob.Join("general")
+	next(t, bob, domain.MsgPresence)
+
+	if err := bob.SendChat("general", "hi alice"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg := next(t, alice, domain.MsgChat)
+	if msg.User != "bob" || msg.Room != "general" || msg.Text != "hi alice" {
+		t.Errorf("unexpected chat: %+v", msg)
+	}
+}
+
+func TestHistoryIsUnpacked(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	alice := dial(t, url, "alice")
+	alice.Join("general")
+	next(t, alice, domain.MsgPresence)
+	alice.SendChat("general", "first")
+	alice.SendChat("general", "second")
+	next(t, alice, domain.MsgChat)
+	next(t, alice, domain.MsgChat)
+
+	bob := dial(t, url, "bob")
+	bob.Join("general")
+	for _, want := range []string{"first", "second"} {
+		if msg := next(t, bob, domain.MsgChat); msg.Text != want {
+			t.Errorf("expected history %q, got %q", want, msg.Text)
+		}
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+	// Wait until bob is known to the server.
+	bob.Join("general")
+	next(t, bob, domain.MsgPresence)
+
+	alice.SendDM("bob", "psst")
+	msg := next(t, bob, domain.MsgDM)
+	if msg.User != "alice" || msg.Text != "psst" {
+		t.Errorf("unexpected dm: %+v", msg)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	alice := dial(t, url, "alice")
+
+	alice.Join("not a room!")
+	if msg := next(t, alice, domain.MsgError); msg.Text == "" {
+		t.Error("expected the error reason in Text")
+	}
+}
+
+func TestCloseEndsMessages(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	alice := dial(t, url, "alice")
+
+	if err := alice.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	for range alice.Messages() {
+	}
+	if err := alice.Err(); err != nil {
+		t.Errorf("expected no error after Close, got %v", err)
+	}
+	if err := alice.SendChat("general", "late"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestDropEndsMessagesWithoutReconnect(t *testing.T) {
+	t.Parallel()
+	p := newProxy(t, setupServer(t))
+	alice := dial(t, p.url, "alice")
+
+	p.drop()
+	select {
+	case <-waitClosed(alice):
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Messages to close after the connection dropped")
+	}
+	if alice.Err() == nil {
+		t.Error("expected Err to report the dropped connection")
+	}
+}
+
+func TestReconnectRejoinsWithoutReplay(t *testing.T) {
+	t.Parallel()
+	url := setupServer(t)
+	p := newProxy(t, url)
+	alice := dial(t, p.url, "alice", WithReconnect(20*time.Millisecond, 100*time.Millisecond))
+	bob := dial(t, url, "bob")
+
+	alice.Join("general")
+	next(t, alice, domain.MsgPresence)
+	bob.Join("general")
+	bob.SendChat("general", "one")
+	if msg := next(t, alice, domain.MsgChat); msg.Text != "one" {
+		t.Fatalf("expected one, got %q", msg.Text)
+	}
+
+	p.drop()
+	bob.SendChat("general", "two")
+
+	// "two" arrives live or in the rejoin history; "one" is not replayed.
+	if msg := next(t, alice, domain.MsgChat); msg.Text != "two" {
+		t.Fatalf("expected two after reconnecting, got %q", msg.Text)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := alice.SendChat("general", "back"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Bob's own messages echo back to him first.
+	for {
+		msg := next(t, bob, domain.MsgChat)
+		if msg.User == "alice" {
+			if msg.Text != "back" {
+				t.Errorf("expected back from alice, got %q", msg.Text)
+			}
+			break
+		}
+	}
+}
+
+func waitClosed(c *Conn) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for range c.Messages() {
+		}
+		close(done)
+	}()
+	return done
+}
+
+// proxy forwards TCP connections to a server and can drop them all, to
+// simulate a network failure.
+type proxy struct {
+	url     string
+	backend string
+	mu      sync.Mutex
+	conns   []net.Conn
+}
+
+func newProxy(t *testing.T, wsURL string) *proxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &proxy{
+		url:     "ws://" + ln.Addr().String(),
+		backend: strings.TrimPrefix(wsURL, "ws://"),
+	}
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", p.backend)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mu.Unlock()
+			go io.Copy(server, client)
+			go io.Copy(client, server)
+		}
+	}()
+	return p
+}
+
+func (p *proxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
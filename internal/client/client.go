@@ -1,58 +1,470 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
+	"github.com/devaloi/chatterbox/internal/deadletter"
 	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/ratelimit"
 )
 
 const (
-	// writeWait is the time allowed to write a message to the peer.
+	// writeWait is the default time allowed to write a data message or a
+	// control frame (ping, close) to the peer. See WithWriteDeadlines.
 	writeWait = 10 * time.Second
 
-	// pongWait is the time allowed to read the next pong message from the peer.
-	// If no pong is received within this window, the connection is considered dead.
+	// pongWait is the default time allowed to read the next pong message from
+	// the peer. If no pong is received within this window, the connection is
+	// considered dead. See WithPongWait.
 	pongWait = 60 * time.Second
 
-	// pingPeriod is the interval for sending pings to the peer. Must be less than
-	// pongWait so that a missed pong is detected before the next ping is due.
-	pingPeriod = (pongWait * 9) / 10
+	// maxMessageSize is the default maximum message size allowed from peer
+	// (bytes). It leaves room for a chat at the default MAX_TEXT_LEN of 2000
+	// runes even when every rune takes four bytes, so the text limit, not
+	// the frame size, decides what is too long. See WithMaxFrameSize.
+	maxMessageSize = 16384
 
-	// maxMessageSize is the maximum message size allowed from peer (bytes).
-	maxMessageSize = 4096
+	// oversizeFactor sets the WebSocket library's own read limit as a
+	// multiple of the frame size limit. Frames up to it are read and
+	// answered with a message_too_large error; bigger ones are cut off
+	// unread with a bare close code 1009.
+	oversizeFactor = 4
 
-	// sendBufferSize is the channel buffer for outgoing messages per client.
+	// sendBufferSize is the default channel buffer for outgoing messages
+	// per client.
 	sendBufferSize = 256
+
+	// maxJoinRooms bounds the rooms one join message may name.
+	maxJoinRooms = 50
+
+	// maxEmojiRunes bounds a single reaction; long enough for ZWJ sequences
+	// and skin-tone modifiers but not for arbitrary text.
+	maxEmojiRunes = 16
 )
 
+// Conn is the subset of a WebSocket connection used by Client.
+// *websocket.Conn satisfies it; tests and alternative transports can
+// provide their own implementation.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	SetReadLimit(limit int64)
+	Close() error
+}
+
 // Client is a WebSocket client connected to the hub.
 type Client struct {
-	hub      *hub.Hub
-	conn     *websocket.Conn
-	send     chan []byte
-	done     chan struct{} // closed on disconnect to signal Send to stop
-	username string
-	rooms    map[string]bool
-	mu       sync.RWMutex // protects rooms map
+	hub       *hub.Hub
+	conn      Conn
+	send      chan frame
+	done      chan struct{} // closed on disconnect to signal Send to stop
+	username  string
+	rooms     map[string]bool
+	display   string       // display name set by rename, empty for none
+	status    string       // presence status, empty for online
+	mu        sync.RWMutex // protects rooms, display, and status
 	closeOnce sync.Once
+
+	requireHello bool
+	greeted      bool // only accessed from ReadPump
+	deadLetters  deadletter.Sink
+	maxTextLen   int
+
+	maxFrameSize int          // largest frame accepted from the peer, in bytes
+	sendBuffer   int          // capacity of send, fixed at construction
+	maxSendDrops int          // consecutive overflow drops before disconnecting; 0 is off
+	sendDrops    atomic.Int32 // current run of consecutive drops
+
+	codec domain.Codec // wire format negotiated at connect time
+
+	guest            bool // connected without a username; one was generated
+	guestCreateRooms bool // guests may create rooms by joining them
+	moderator        bool // authenticated as a moderator at upgrade time
+	relay            bool // authenticated as a peer's relay at upgrade time
+
+	remoteIP string
+	origin   string // Origin header of the upgrade request
+	onClose  func() // called once both pumps have exited; may be nil
+
+	dataWriteWait time.Duration // deadline for writing data messages
+	pingWriteWait time.Duration // deadline for writing pings and close frames
+	pongWait      time.Duration // read deadline extended by each pong
+	pingPeriod    time.Duration // interval between pings, always below pongWait
+
+	// Ack flow control: WritePump stops taking from send once ackWindow
+	// frames are unacknowledged. sentSeq is only advanced by WritePump;
+	// ReadPump reads it to ignore acks for frames not sent yet.
+	ackWindow uint64
+	sentSeq   atomic.Uint64
+	ackedSeq  atomic.Uint64
+	acked     chan struct{} // signals WritePump that ackedSeq advanced
+
+	protoLog *slog.Logger      // per-frame trace of message types, nil when off
+	limiter  *ratelimit.Bucket // chat and dm rate limit, nil when unlimited
+
+	idleTimeout time.Duration // disconnect after this long without messages; 0 is off
+	lastActive  atomic.Int64  // unix nanos of the last message read
+
+	maxProtocolErrors int
+	protocolWindow    time.Duration
+	protocolErrors    []time.Time // only accessed from ReadPump
+
+	closeFrame atomic.Pointer[[]byte] // close frame flush sends; nil for a bare close
+
+	pumps   int32         // running pumps started by Start
+	exited  chan struct{} // closed once both pumps have exited
+	untrack func()        // releases the hub's connection tracking
+}
+
+// Option configures optional Client behavior.
+type Option func(*Client)
+
+// WithHandshake requires the first message on the connection to be a hello.
+// The server answers with a welcome; any other first message is rejected and
+// the connection closed.
+func WithHandshake(required bool) Option {
+	return func(c *Client) {
+		c.requireHello = required
+	}
+}
+
+// WithGuest marks the client as a guest whose username was generated.
+// Guests may only join rooms that already exist unless
+// WithGuestRoomCreation allows otherwise.
+func WithGuest() Option {
+	return func(c *Client) {
+		c.guest = true
+	}
+}
+
+// WithModerator grants the client moderator rights, such as kicking users.
+// Only set it for a connection that authenticated as one; the username alone
+// is chosen by the client and proves nothing.
+func WithModerator() Option {
+	return func(c *Client) {
+		c.moderator = true
+	}
+}
+
+// WithRelay marks the client as a federated peer's relay (see hub.Relay):
+// it watches the rooms it joins rather than becoming a member. Only set it
+// for a connection that authenticated as one.
+func WithRelay() Option {
+	return func(c *Client) {
+		c.relay = true
+	}
+}
+
+// WithGuestRoomCreation lets guest clients create rooms by joining them.
+// It has no effect on other clients.
+func WithGuestRoomCreation(allowed bool) Option {
+	return func(c *Client) {
+		c.guestCreateRooms = allowed
+	}
+}
+
+// WithRemote records the connection's remote IP address and Origin header,
+// which are logged when the client connects and disconnects.
+func WithRemote(ip, origin string) Option {
+	return func(c *Client) {
+		c.remoteIP = ip
+		c.origin = origin
+	}
+}
+
+// WithOnClose calls fn once the connection has closed and both pumps
+// started by Start have exited.
+func WithOnClose(fn func()) Option {
+	return func(c *Client) {
+		c.onClose = fn
+	}
+}
+
+// WithDeadLetters records messages dropped for this client to sink.
+func WithDeadLetters(sink deadletter.Sink) Option {
+	return func(c *Client) {
+		c.deadLetters = sink
+	}
+}
+
+// WithMaxTextLen limits chat text to n runes. Zero means unlimited.
+func WithMaxTextLen(n int) Option {
+	return func(c *Client) {
+		c.maxTextLen = n
+	}
+}
+
+// WithProtocolErrorLimit disconnects a client that triggers max protocol
+// errors (malformed or disallowed messages) within window. The client gets a
+// final error followed by a close frame. Zero max never disconnects.
+func WithProtocolErrorLimit(max int, window time.Duration) Option {
+	return func(c *Client) {
+		c.maxProtocolErrors = max
+		c.protocolWindow = window
+	}
+}
+
+// WithWriteDeadlines sets how long a single data message write and a single
+// ping or close frame write may take before the client is treated as too
+// slow and disconnected. A short data deadline detects stalled readers
+// quickly; a longer one tolerates high-latency links. Validate values with
+// ValidateWriteDeadlines; zero keeps the default.
+func WithWriteDeadlines(data, ping time.Duration) Option {
+	return func(c *Client) {
+		if data > 0 {
+			c.dataWriteWait = data
+		}
+		if ping > 0 {
+			c.pingWriteWait = ping
+		}
+	}
+}
+
+// WithRateLimit caps the chat and direct messages a client may send to
+// perSec a second, allowing bursts of up to perSec. Messages over the limit
+// are dropped and answered with a rate_limited error. Zero means unlimited.
+func WithRateLimit(perSec int) Option {
+	return func(c *Client) {
+		if perSec > 0 {
+			c.limiter = ratelimit.New(perSec)
+		}
+	}
+}
+
+// WithIdleTimeout disconnects a client that sends no messages for d, with a
+// going-away close frame. Pongs and acks do not count as activity. Zero
+// disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.idleTimeout = d
+	}
+}
+
+// WithSendBuffer sets how many outgoing messages may be queued for the
+// client before further ones are dropped. Each queued message holds its
+// encoded frame, so memory grows with the buffer times the connection
+// count. Values below one keep the default of 256.
+func WithSendBuffer(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.sendBuffer = n
+		}
+	}
+}
+
+// WithMaxFrameSize sets the largest frame, in bytes, accepted from the peer.
+// A bigger frame is answered with a message_too_large error and the
+// connection closed with code 1009. Values below one keep the default of
+// 16384.
+func WithMaxFrameSize(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.maxFrameSize = n
+		}
+	}
+}
+
+// WithMaxSendDrops disconnects a client once n messages in a row have been
+// dropped because its send buffer was full, so it reconnects and reloads
+// history instead of silently missing messages. Zero only drops.
+func WithMaxSendDrops(n int) Option {
+	return func(c *Client) {
+		c.maxSendDrops = n
+	}
+}
+
+// WithProtocolLog traces every message the client sends and every message
+// queued for it to l at debug level, one line per frame with the username,
+// message type and room. Message bodies are never logged. A nil logger, or
+// one with debug disabled, turns the trace off.
+func WithProtocolLog(l *slog.Logger) Option {
+	return func(c *Client) {
+		if l != nil && !l.Enabled(context.Background(), slog.LevelDebug) {
+			l = nil
+		}
+		c.protoLog = l
+	}
+}
+
+// WithAckWindow enables receiver-driven flow control: every frame sent to the
+// client carries a "seq" number, and at most n frames may be unacknowledged
+// at once. The client acks with {"type":"ack","seq":N}. While the window is
+// full, messages wait in the send buffer and, once that is full, are dropped
+// like any other overflow. Zero disables flow control.
+func WithAckWindow(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.ackWindow = uint64(n)
+		}
+	}
+}
+
+// WithCodec sets the wire format the client speaks. Frames are still built
+// as JSON and shared between room members; each is re-encoded just before it
+// is written to a client using another codec. Binary codecs are sent as
+// binary WebSocket messages. The default is domain.JSON.
+func WithCodec(codec domain.Codec) Option {
+	return func(c *Client) {
+		c.codec = codec
+	}
+}
+
+// WithPongWait sets how long the client may go without a pong (or any other
+// frame) before the connection is considered dead. Pings are sent every nine
+// tenths of d, so a missed pong is detected before the next ping is due.
+// Longer waits suit high-latency mobile networks. Zero keeps the default.
+func WithPongWait(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.pongWait = d
+			c.pingPeriod = pingPeriodFor(d)
+		}
+	}
+}
+
+// pingPeriodFor returns the ping interval for a pong wait.
+func pingPeriodFor(pong time.Duration) time.Duration {
+	return pong * 9 / 10
+}
+
+// ValidateWriteDeadlines checks values for WithWriteDeadlines and
+// WithPongWait. All must be positive, the ping interval derived from the pong
+// wait must be too, and a ping write may not take longer than the pong wait
+// it is meant to keep alive.
+func ValidateWriteDeadlines(data, ping, pong time.Duration) error {
+	if data <= 0 || ping <= 0 {
+		return fmt.Errorf("write deadlines must be positive (data %v, ping %v)", data, ping)
+	}
+	if pingPeriodFor(pong) <= 0 {
+		return fmt.Errorf("pong wait %v is too short", pong)
+	}
+	if ping >= pong {
+		return fmt.Errorf("ping write deadline %v must be less than pong wait %v", ping, pong)
+	}
+	return nil
+}
+
+// serverCapabilities lists the optional protocol features this server can
+// negotiate during the hello/welcome handshake. ack_window is only agreed
+// when the connection has flow control enabled.
+var serverCapabilities = map[string]bool{
+	"ack_window":    true,
+	"receipts":      true,
+	"msgpack":       true,
+	"multi_join":    true,
+	"since_id":      true,
+	"reply_to":      true,
+	"reactions":     true,
+	"edits":         true,
+	"presence_diff": true,
 }
 
 // New creates a new Client.
-func New(h *hub.Hub, conn *websocket.Conn, username string) *Client {
-	return &Client{
+func New(h *hub.Hub, conn Conn, username string, opts ...Option) *Client {
+	c := &Client{
 		hub:      h,
 		conn:     conn,
-		send:     make(chan []byte, sendBufferSize),
 		done:     make(chan struct{}),
 		username: username,
 		rooms:    make(map[string]bool),
+		exited:   make(chan struct{}),
+		codec:    domain.JSON,
+
+		sendBuffer:   sendBufferSize,
+		maxFrameSize: maxMessageSize,
+
+		dataWriteWait: writeWait,
+		pingWriteWait: writeWait,
+		pongWait:      pongWait,
+		pingPeriod:    pingPeriodFor(pongWait),
+		acked:         make(chan struct{}, 1),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.send = make(chan frame, c.sendBuffer)
+	c.lastActive.Store(time.Now().UnixNano())
+	return c
+}
+
+// Start runs ReadPump and WritePump in their own goroutines and tracks the
+// connection with the hub, so Hub.Shutdown can close it and wait until both
+// pumps have exited.
+func (c *Client) Start() {
+	slog.Info("client connected", "user", c.username, "ip", c.remoteIP, "origin", c.origin, "guest", c.guest)
+	c.untrack = c.hub.TrackConn(c)
+	c.pumps = 2
+	go func() {
+		defer c.pumpExited()
+		c.ReadPump()
+	}()
+	go func() {
+		defer c.pumpExited()
+		c.WritePump()
+	}()
+}
+
+func (c *Client) pumpExited() {
+	if atomic.AddInt32(&c.pumps, -1) == 0 {
+		c.untrack()
+		close(c.exited)
+		slog.Info("client disconnected", "user", c.username, "ip", c.remoteIP, "origin", c.origin)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	}
+}
+
+// Close closes the underlying connection, causing both pumps to exit.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Drain stops the client from taking new messages; WritePump then writes
+// whatever is already queued, sends a going-away close frame, and closes the
+// connection.
+func (c *Client) Drain() {
+	c.Disconnect(websocket.CloseGoingAway, "server shutting down")
+}
+
+// Disconnect is Drain with the given close code and reason.
+func (c *Client) Disconnect(code int, reason string) {
+	c.setCloseReason(code, reason)
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// setCloseReason records the code and reason of the close frame sent once
+// the client stops. The first reason recorded wins.
+func (c *Client) setCloseReason(code int, reason string) {
+	frame := websocket.FormatCloseMessage(code, reason)
+	c.closeFrame.CompareAndSwap(nil, &frame)
+}
+
+// JoinRejected forgets a room the hub refused to let the client join, so a
+// later leave or disconnect does not unregister it a second time.
+func (c *Client) JoinRejected(room string) {
+	c.mu.Lock()
+	delete(c.rooms, room)
+	c.mu.Unlock()
 }
 
 // Username returns the client's username.
@@ -60,25 +472,166 @@ func (c *Client) Username() string {
 	return c.username
 }
 
+// RemoteIP returns the client's IP address, or "" if it was not recorded.
+func (c *Client) RemoteIP() string {
+	return c.remoteIP
+}
+
+// Origin returns the Origin header the client connected with.
+func (c *Client) Origin() string {
+	return c.origin
+}
+
+// IsGuest reports whether the client connected as a guest.
+func (c *Client) IsGuest() bool {
+	return c.guest
+}
+
+// IsModerator reports whether the client has moderator rights (see
+// WithModerator).
+func (c *Client) IsModerator() bool {
+	return c.moderator
+}
+
+// IsRelay reports whether the client is a peer's relay (see WithRelay).
+func (c *Client) IsRelay() bool {
+	return c.relay
+}
+
+// DisplayName returns the name set by the client's last rename, or "" if
+// it goes by its username.
+func (c *Client) DisplayName() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.display
+}
+
+// SetDisplayName records the client's display name. It is called by the hub
+// once a rename has been validated.
+func (c *Client) SetDisplayName(name string) {
+	c.mu.Lock()
+	c.display = name
+	c.mu.Unlock()
+}
+
+// Status returns the client's presence status, or "" if it is online.
+func (c *Client) Status() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// SetStatus records the client's presence status. It is called by the hub
+// once the status has been validated.
+func (c *Client) SetStatus(state string) {
+	c.mu.Lock()
+	c.status = state
+	c.mu.Unlock()
+}
+
+// frame is a queued outgoing message: its JSON, and the same message in the
+// client's codec when the sender has already encoded it.
+type frame struct {
+	data    []byte
+	encoded []byte
+}
+
 // Send queues a message to be sent to the WebSocket client.
 // Safe to call concurrently; returns silently if the client is disconnected.
 func (c *Client) Send(data []byte) {
+	c.queue(frame{data: data})
+}
+
+// SendEncoded is Send for a message already encoded in the client's codec,
+// which is written as is. It implements hub.FrameEncoder.
+func (c *Client) SendEncoded(data, encoded []byte) {
+	c.queue(frame{data: data, encoded: encoded})
+}
+
+// Codec returns the codec the client's frames are written in.
+func (c *Client) Codec() domain.Codec {
+	return c.codec
+}
+
+func (c *Client) queue(f frame) {
+	data := f.data
+	if c.protoLog != nil {
+		var envelope struct {
+			Type string `json:"type"`
+			Room string `json:"room"`
+		}
+		json.Unmarshal(data, &envelope)
+		c.logFrame("out", envelope.Type, envelope.Room)
+	}
 	select {
-	case c.send <- data:
+	case c.send <- f:
+		if c.maxSendDrops > 0 {
+			c.sendDrops.Store(0)
+		}
 	case <-c.done:
 		// Client disconnected, drop message.
 	default:
 		// Client send buffer full, drop message.
-		log.Printf("client %s: send buffer full, dropping message", c.username)
+		slog.Warn("send buffer full, dropping message", "user", c.username)
+		c.deadLetter(deadletter.ReasonSendBufferFull, data)
+		if c.maxSendDrops > 0 && int(c.sendDrops.Add(1)) == c.maxSendDrops {
+			c.disconnectSlow()
+		}
 	}
 }
 
+// disconnectSlow closes the connection of a client that has fallen too far
+// behind. Closing the conn rather than draining also unblocks a WritePump
+// stuck writing to the peer.
+func (c *Client) disconnectSlow() {
+	slog.Warn("disconnecting slow client", "user", c.username, "drops", c.maxSendDrops)
+	c.closeOnce.Do(func() { close(c.done) })
+	c.conn.Close()
+}
+
+// logFrame writes one protocol trace line if tracing is enabled.
+func (c *Client) logFrame(dir, msgType, room string) {
+	if c.protoLog == nil {
+		return
+	}
+	c.protoLog.Debug("frame", "user", c.username, "dir", dir, "type", msgType, "room", room)
+}
+
+// deadLetter records a dropped message if a dead-letter sink is configured.
+func (c *Client) deadLetter(reason string, data []byte) {
+	if c.deadLetters == nil {
+		return
+	}
+	// Only the room is needed, so decode into a minimal struct.
+	var envelope struct {
+		Room string `json:"room"`
+	}
+	json.Unmarshal(data, &envelope)
+	c.recordDeadLetter(reason, envelope.Room, len(data))
+}
+
+func (c *Client) recordDeadLetter(reason, room string, size int) {
+	if c.deadLetters == nil {
+		return
+	}
+	c.deadLetters.Record(deadletter.Record{
+		Reason:    reason,
+		Room:      room,
+		User:      c.username,
+		Size:      size,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
 // ReadPump reads messages from the WebSocket connection and routes them to the hub.
-// Each client runs one ReadPump goroutine. It unregisters from all rooms and
-// closes the send channel on disconnect to unblock WritePump.
+// Each client runs one ReadPump goroutine. On disconnect it closes done and
+// unregisters from all rooms; WritePump then flushes anything still queued
+// (such as a final error) and closes the connection.
 func (c *Client) ReadPump() {
 	defer func() {
-		// Signal Send() to stop accepting messages.
+		// Signal Send() to stop accepting messages and WritePump to finish.
+		// The send channel itself is never closed: rooms may still be calling
+		// Send concurrently, and sending on a closed channel panics.
 		c.closeOnce.Do(func() { close(c.done) })
 
 		// Unregister from all rooms on disconnect.
@@ -92,77 +645,351 @@ func (c *Client) ReadPump() {
 		for _, room := range rooms {
 			c.hub.Unregister(c, room)
 		}
-		// Close send channel to unblock WritePump, preventing goroutine leak.
-		close(c.send)
-		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(int64(c.maxFrameSize) * oversizeFactor)
+	c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
 		return nil
 	})
 
 	for {
 		_, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-				log.Printf("client %s: read error: %v", c.username, err)
+			switch {
+			case errors.Is(err, websocket.ErrReadLimit):
+				slog.Warn("frame over read limit", "user", c.username, "limit", c.maxFrameSize*oversizeFactor)
+			case isControlFrameError(err):
+				slog.Warn("control frame protocol error", "user", c.username, "err", err)
+				c.hub.RecordControlFrameError()
+			case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure):
+				slog.Warn("read error", "user", c.username, "err", err)
 			}
 			return
 		}
+		if len(data) > c.maxFrameSize {
+			slog.Warn("frame too large", "user", c.username, "size", len(data), "limit", c.maxFrameSize)
+			c.sendErrorCode(domain.ErrCodeMessageTooLarge, "message too large")
+			c.setCloseReason(websocket.CloseMessageTooBig, "message too large")
+			return
+		}
+		if c.requireHello && !c.greeted {
+			if !c.handleHello(data) {
+				c.setCloseReason(domain.CloseBadHandshake, "handshake failed")
+				return
+			}
+			continue
+		}
 		c.handleMessage(data)
+		if c.protocolErrorLimitReached() {
+			c.sendErrorCode(domain.ErrCodeTooManyErrors, "too many protocol errors")
+			c.setCloseReason(domain.CloseTooManyErrors, "too many protocol errors")
+			return
+		}
 	}
 }
 
+// isControlFrameError reports whether err is gorilla/websocket rejecting a
+// malformed ping, pong or close frame, such as one with a payload over 125
+// bytes or without FIN set. gorilla reports these as plain errors, so the
+// message text is the only way to tell them apart from data-frame errors.
+func isControlFrameError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "websocket: ") && strings.Contains(msg, " control")
+}
+
 // WritePump writes messages from the send channel to the WebSocket connection.
-// Each client runs one WritePump goroutine. It exits when the send channel is
-// closed (by ReadPump on disconnect) or a write error occurs.
+// Each client runs one WritePump goroutine. It exits when done is closed (by
+// ReadPump on disconnect), after flushing already-queued messages, or when a
+// write error occurs.
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingPeriod)
+	var idleCheck <-chan time.Time
+	if c.idleTimeout > 0 {
+		idle := time.NewTicker(c.idleTimeout / 4)
+		defer idle.Stop()
+		idleCheck = idle.C
+	}
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
 
 	for {
+		// A nil channel blocks, pausing delivery while the ack window is full.
+		send := c.send
+		if c.ackWindow > 0 && c.sentSeq.Load()-c.ackedSeq.Load() >= c.ackWindow {
+			send = nil
+		}
 		select {
-		case msg, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case f := <-send:
+			if c.ackWindow > 0 {
+				// The sequence number is per connection, so a shared
+				// encoding no longer fits.
+				f = frame{data: withSeq(f.data, c.sentSeq.Add(1))}
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			if err := c.writeFrame(f); err != nil {
 				return
 			}
+		case <-c.acked:
+		case <-c.done:
+			c.flush()
+			return
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.pingWriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+		case <-idleCheck:
+			if time.Since(time.Unix(0, c.lastActive.Load())) >= c.idleTimeout {
+				c.conn.SetWriteDeadline(time.Now().Add(c.pingWriteWait))
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(domain.CloseIdle, "idle timeout"))
+				return
+			}
 		}
 	}
 }
 
+// withSeq returns a copy of an encoded JSON object with a "seq" field added.
+// Frames are shared between every client in a room, so the number is spliced
+// in per connection rather than set before encoding.
+func withSeq(msg []byte, seq uint64) []byte {
+	if len(msg) < 2 || msg[0] != '{' {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	if msg[1] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, msg[1:]...)
+}
+
+// writeFrame writes one queued frame in the client's codec, encoding its
+// JSON unless that was done already.
+func (c *Client) writeFrame(f frame) error {
+	frameType := websocket.TextMessage
+	msg := f.data
+	if c.codec != domain.JSON {
+		msg = f.encoded
+		if msg == nil {
+			var err error
+			if msg, err = c.codec.Marshal(json.RawMessage(f.data)); err != nil {
+				slog.Error("encode", "user", c.username, "codec", c.codec.Name(), "err", err)
+				return nil
+			}
+		}
+		if c.codec.Binary() {
+			frameType = websocket.BinaryMessage
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.dataWriteWait))
+	return c.conn.WriteMessage(frameType, msg)
+}
+
+// ack records that the client has received frames up to seq and wakes
+// WritePump if it is waiting for window space. An ack for a frame not sent
+// yet is ignored; counting it would let the unacknowledged count wrap.
+func (c *Client) ack(seq uint64) {
+	if seq > c.sentSeq.Load() {
+		return
+	}
+	for {
+		cur := c.ackedSeq.Load()
+		if seq <= cur || c.ackedSeq.CompareAndSwap(cur, seq) {
+			break
+		}
+	}
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes whatever is still queued, followed by a close frame carrying
+// the reason recorded by setCloseReason, if any.
+func (c *Client) flush() {
+	for {
+		select {
+		case f := <-c.send:
+			if err := c.writeFrame(f); err != nil {
+				return
+			}
+		default:
+			c.conn.SetWriteDeadline(time.Now().Add(c.pingWriteWait))
+			frame := []byte{}
+			if f := c.closeFrame.Load(); f != nil {
+				frame = *f
+			}
+			c.conn.WriteMessage(websocket.CloseMessage, frame)
+			return
+		}
+	}
+}
+
+// joinRooms joins every room a join message lists in rooms (plus room, if
+// set), with its password and room mode; since_id applies to room only.
+// Each room joins as if requested alone, but refusals are gathered into one
+// join_failed error, sent once the hub has handled every join.
+func (c *Client) joinRooms(msg domain.Message) {
+	names := msg.Rooms
+	if msg.Room != "" {
+		names = append([]string{msg.Room}, names...)
+	}
+	if len(names) > maxJoinRooms {
+		c.protocolError(fmt.Sprintf("too many rooms: at most %d per join", maxJoinRooms))
+		return
+	}
+	if !domain.ValidRoomMode(msg.RoomMode) {
+		c.protocolError("invalid room mode")
+		return
+	}
+	// A message id belongs to one room, so since_id goes with room.
+	if msg.SinceID != "" && msg.Room == "" {
+		c.protocolError("since_id needs room, not rooms")
+		return
+	}
+
+	var (
+		mu      sync.Mutex
+		failed  = make(map[int]domain.RoomError) // by position in names
+		pending []chan struct{}
+	)
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		fail := func(room, code, message string) {
+			mu.Lock()
+			failed[i] = domain.RoomError{Room: room, Code: code, Message: message}
+			mu.Unlock()
+		}
+		room, err := domain.ValidateRoomName(name)
+		switch {
+		case err != nil:
+			fail(name, "", err.Error())
+			continue
+		case domain.IsDMRoom(room):
+			fail(room, "", "reserved room name")
+			continue
+		case seen[room]:
+			continue
+		}
+		seen[room] = true
+
+		c.mu.Lock()
+		if c.rooms[room] {
+			c.mu.Unlock()
+			continue
+		}
+		c.rooms[room] = true
+		c.mu.Unlock()
+		done := make(chan struct{})
+		req := hub.RegisterRequest{
+			Client: c, Room: room, Mode: msg.RoomMode, Password: msg.Password,
+			JoinOnly: c.guest && !c.guestCreateRooms,
+			OnReject: func(code, message string) { fail(room, code, message) },
+			Done:     done,
+		}
+		if i == 0 && msg.Room != "" {
+			req.SinceID = msg.SinceID
+		}
+		if err := c.hub.TryRegister(req); err != nil {
+			c.mu.Lock()
+			delete(c.rooms, room)
+			c.mu.Unlock()
+			fail(room, domain.ErrCodeServerBusy, err.Error())
+			continue
+		}
+		pending = append(pending, done)
+	}
+
+	report := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failed) == 0 {
+			return
+		}
+		errMsg := domain.ErrorMessage{
+			Type:    domain.MsgError,
+			Code:    domain.ErrCodeJoinFailed,
+			Message: fmt.Sprintf("could not join %d of %d rooms", len(failed), len(names)),
+		}
+		for _, i := range slices.Sorted(maps.Keys(failed)) {
+			errMsg.Rooms = append(errMsg.Rooms, failed[i])
+		}
+		data, err := domain.Encode(errMsg)
+		if err != nil {
+			slog.Error("encode", "user", c.username, "err", err)
+			return
+		}
+		c.Send(data)
+	}
+	if len(pending) == 0 {
+		report()
+		return
+	}
+	// Wait off the read loop; the hub answers joins in order.
+	go func() {
+		for _, done := range pending {
+			select {
+			case <-done:
+			case <-c.done:
+				return
+			}
+		}
+		report()
+	}()
+}
+
 func (c *Client) handleMessage(data []byte) {
 	var msg domain.Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		errMsg := domain.ErrorMessage{Type: domain.MsgError, Message: "invalid JSON"}
-		d, e := domain.Encode(errMsg)
-		if e != nil {
-			log.Printf("client %s: encode error: %v", c.username, e)
-			return
+	if err := c.codec.Unmarshal(data, &msg); err != nil {
+		if c.codec == domain.JSON {
+			c.protocolError("invalid JSON")
+		} else {
+			c.protocolError("invalid " + c.codec.Name())
 		}
-		c.Send(d)
 		return
 	}
+	c.logFrame("in", msg.Type, msg.Room)
+	if msg.Type != domain.MsgAck {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+
+	if c.limiter != nil && (msg.Type == domain.MsgChat || msg.Type == domain.MsgDM) && !c.limiter.Allow(time.Now()) {
+		c.recordDeadLetter(deadletter.ReasonRateLimited, msg.Room, len(data))
+		c.sendErrorCode(domain.ErrCodeRateLimited, "rate limit exceeded")
+		return
+	}
+
+	// Room names are case-insensitive; every handler below sees the
+	// canonical form.
+	if msg.Room != "" {
+		name, err := domain.ValidateRoomName(msg.Room)
+		if err != nil {
+			c.protocolError(err.Error())
+			return
+		}
+		msg.Room = name
+	}
 
 	switch msg.Type {
 	case domain.MsgJoin:
+		if len(msg.Rooms) > 0 {
+			c.joinRooms(msg)
+			return
+		}
 		if msg.Room == "" {
-			c.sendError("room name required")
+			c.protocolError("room name required")
+			return
+		}
+		if !domain.ValidRoomMode(msg.RoomMode) {
+			c.protocolError("invalid room mode")
+			return
+		}
+		if domain.IsDMRoom(msg.Room) {
+			c.protocolError("reserved room name")
 			return
 		}
 		// Prevent joining the same room twice.
@@ -173,11 +1000,20 @@ func (c *Client) handleMessage(data []byte) {
 		}
 		c.rooms[msg.Room] = true
 		c.mu.Unlock()
-		c.hub.Register(c, msg.Room)
+		req := hub.RegisterRequest{
+			Client: c, Room: msg.Room, Mode: msg.RoomMode, Password: msg.Password, SinceID: msg.SinceID,
+			JoinOnly: c.guest && !c.guestCreateRooms,
+		}
+		if err := c.hub.TryRegister(req); err != nil {
+			c.mu.Lock()
+			delete(c.rooms, msg.Room)
+			c.mu.Unlock()
+			c.sendErrorCode(domain.ErrCodeServerBusy, err.Error())
+		}
 
 	case domain.MsgLeave:
 		if msg.Room == "" {
-			c.sendError("room name required")
+			c.protocolError("room name required")
 			return
 		}
 		c.mu.Lock()
@@ -187,30 +1023,295 @@ func (c *Client) handleMessage(data []byte) {
 
 	case domain.MsgChat:
 		if msg.Room == "" || msg.Text == "" {
-			c.sendError("room and text required")
+			c.protocolError("room and text required")
 			return
 		}
 		c.mu.RLock()
 		inRoom := c.rooms[msg.Room]
 		c.mu.RUnlock()
 		if !inRoom {
-			c.sendError("not in room")
+			c.protocolError("not in room")
+			return
+		}
+		if err := domain.ValidateMessage(msg, c.maxTextLen); err != nil {
+			c.protocolError(err.Error())
 			return
 		}
+		msg.ID = uuid.NewString()
 		msg.User = c.username
+		msg.Name = c.DisplayName()
 		msg.Timestamp = time.Now().UTC()
+		// Sequence numbers are per connection and assigned on the way out;
+		// one set by the sender would reach every recipient.
+		msg.Seq = 0
 		c.hub.RouteMessage(msg, c)
 
+	case domain.MsgEdit, domain.MsgDelete:
+		if msg.Room == "" || msg.MessageID == "" || (msg.Type == domain.MsgEdit && msg.Text == "") {
+			c.protocolError("room and message_id required, and text for edits")
+			return
+		}
+		c.mu.RLock()
+		inRoom := c.rooms[msg.Room]
+		c.mu.RUnlock()
+		if !inRoom {
+			c.protocolError("not in room")
+			return
+		}
+		if err := domain.ValidateMessage(msg, c.maxTextLen); err != nil {
+			c.protocolError(err.Error())
+			return
+		}
+		// The hub checks that the sender wrote the message.
+		c.hub.RouteMessage(domain.Message{
+			Type:      msg.Type,
+			Room:      msg.Room,
+			User:      c.username,
+			MessageID: msg.MessageID,
+			Text:      msg.Text,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgDM:
+		if msg.To == "" || msg.Text == "" {
+			c.protocolError("to and text required")
+			return
+		}
+		if msg.To == c.username {
+			c.protocolError("cannot send a direct message to yourself")
+			return
+		}
+		if err := domain.ValidateMessage(msg, c.maxTextLen); err != nil {
+			c.protocolError(err.Error())
+			return
+		}
+		c.hub.RouteMessage(domain.Message{
+			ID:        uuid.NewString(),
+			Type:      domain.MsgDM,
+			User:      c.username,
+			Name:      c.DisplayName(),
+			To:        msg.To,
+			Text:      msg.Text,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgHistory:
+		if msg.To == "" {
+			c.protocolError("to required")
+			return
+		}
+		c.sendDMHistory(msg.To)
+
+	case domain.MsgReact:
+		if msg.Room == "" || msg.MessageID == "" || msg.Emoji == "" {
+			c.protocolError("room, message_id and emoji required")
+			return
+		}
+		if utf8.RuneCountInString(msg.Emoji) > maxEmojiRunes {
+			c.protocolError("invalid emoji")
+			return
+		}
+		c.mu.RLock()
+		inRoom := c.rooms[msg.Room]
+		c.mu.RUnlock()
+		if !inRoom {
+			c.protocolError("not in room")
+			return
+		}
+		c.hub.RouteMessage(domain.Message{
+			Type:      domain.MsgReact,
+			Room:      msg.Room,
+			User:      c.username,
+			MessageID: msg.MessageID,
+			Emoji:     msg.Emoji,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgLock, domain.MsgUnlock:
+		if msg.Room == "" {
+			c.protocolError("room name required")
+			return
+		}
+		// The hub checks that the sender is a moderator.
+		c.hub.RouteMessage(domain.Message{
+			Type:      msg.Type,
+			Room:      msg.Room,
+			User:      c.username,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgTopic:
+		if msg.Room == "" {
+			c.protocolError("room name required")
+			return
+		}
+		if err := domain.ValidateMessage(msg, c.maxTextLen); err != nil {
+			c.protocolError(err.Error())
+			return
+		}
+		// The hub checks that the sender is a moderator. An
+		// empty text clears the topic.
+		c.hub.RouteMessage(domain.Message{
+			Type:      domain.MsgTopic,
+			Room:      msg.Room,
+			User:      c.username,
+			Text:      msg.Text,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgKick:
+		if msg.Room == "" || msg.User == "" {
+			c.protocolError("room and user required")
+			return
+		}
+		// The hub checks that the sender is a moderator.
+		c.hub.RouteMessage(domain.Message{
+			Type:      domain.MsgKick,
+			Room:      msg.Room,
+			User:      c.username,
+			To:        msg.User,
+			Timestamp: time.Now().UTC(),
+		}, c)
+
+	case domain.MsgRename, domain.MsgNick:
+		switch err := c.hub.Rename(c, msg.Name); {
+		case errors.Is(err, domain.ErrNameTaken):
+			c.sendErrorCode(domain.ErrCodeNameTaken, err.Error())
+		case err != nil:
+			c.protocolError(err.Error())
+		}
+
+	case domain.MsgStatus:
+		if err := c.hub.SetStatus(c, msg.State); err != nil {
+			c.protocolError(err.Error())
+		}
+
+	case domain.MsgAck:
+		if c.ackWindow > 0 {
+			c.ack(msg.Seq)
+		}
+
+	case domain.MsgPing:
+		// Answered here, without the hub, so the round trip measures only
+		// the connection.
+		data, err := domain.Encode(domain.PongMessage{Type: domain.MsgPong, ID: msg.ID})
+		if err != nil {
+			slog.Error("encode", "user", c.username, "err", err)
+			return
+		}
+		c.Send(data)
+
+	case domain.MsgWhoami:
+		c.mu.RLock()
+		rooms := slices.Sorted(maps.Keys(c.rooms))
+		c.mu.RUnlock()
+		if rooms == nil {
+			rooms = []string{}
+		}
+		data, err := domain.Encode(domain.WhoamiMessage{Type: domain.MsgWhoami, User: c.username, Rooms: rooms})
+		if err != nil {
+			slog.Error("encode", "user", c.username, "err", err)
+			return
+		}
+		c.Send(data)
+
 	default:
-		c.sendError("unknown message type: " + msg.Type)
+		c.protocolError("unknown message type: " + msg.Type)
+	}
+}
+
+// sendDMHistory sends the client its direct messages with peer.
+func (c *Client) sendDMHistory(peer string) {
+	msgs, err := c.hub.DMHistory(c.username, peer)
+	if err != nil {
+		slog.Error("dm history", "user", c.username, "err", err)
+		c.sendError("history unavailable")
+		return
+	}
+	if msgs == nil {
+		msgs = []domain.Message{}
+	}
+	data, err := domain.Encode(domain.HistoryMessage{
+		Type:     domain.MsgHistory,
+		Room:     domain.DMRoom(c.username, peer),
+		Messages: msgs,
+	})
+	if err != nil {
+		slog.Error("encode", "user", c.username, "err", err)
+		return
+	}
+	c.Send(data)
+}
+
+// handleHello validates the handshake message and replies with a welcome.
+// It returns false if the connection should be closed.
+func (c *Client) handleHello(data []byte) bool {
+	var hello domain.HelloMessage
+	if err := c.codec.Unmarshal(data, &hello); err != nil || hello.Type != domain.MsgHello {
+		c.sendError("expected hello")
+		return false
+	}
+	if hello.Version < 1 || hello.Version > domain.ProtocolVersion {
+		c.sendError("unsupported protocol version")
+		return false
+	}
+
+	caps := make([]string, 0, len(hello.Capabilities))
+	for _, capability := range hello.Capabilities {
+		if serverCapabilities[capability] && (capability != "ack_window" || c.ackWindow > 0) {
+			caps = append(caps, capability)
+		}
+	}
+	welcome := domain.WelcomeMessage{
+		Type:         domain.MsgWelcome,
+		Version:      hello.Version,
+		Capabilities: caps,
+	}
+	data, err := domain.Encode(welcome)
+	if err != nil {
+		slog.Error("encode", "user", c.username, "err", err)
+		return false
+	}
+	c.Send(data)
+	c.greeted = true
+	return true
+}
+
+// protocolError reports a client mistake and records it against the
+// protocol error limit.
+func (c *Client) protocolError(message string) {
+	c.sendError(message)
+	if c.maxProtocolErrors > 0 {
+		c.protocolErrors = append(c.protocolErrors, time.Now())
 	}
 }
 
+// protocolErrorLimitReached drops errors older than the window and reports
+// whether the remaining ones reach the limit.
+func (c *Client) protocolErrorLimitReached() bool {
+	if c.maxProtocolErrors <= 0 {
+		return false
+	}
+	cutoff := time.Now().Add(-c.protocolWindow)
+	recent := c.protocolErrors[:0]
+	for _, t := range c.protocolErrors {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	c.protocolErrors = recent
+	return len(recent) >= c.maxProtocolErrors
+}
+
 func (c *Client) sendError(message string) {
-	errMsg := domain.ErrorMessage{Type: domain.MsgError, Message: message}
+	c.sendErrorCode("", message)
+}
+
+func (c *Client) sendErrorCode(code, message string) {
+	errMsg := domain.ErrorMessage{Type: domain.MsgError, Code: code, Message: message}
 	data, err := domain.Encode(errMsg)
 	if err != nil {
-		log.Printf("client %s: encode error: %v", c.username, err)
+		slog.Error("encode", "user", c.username, "err", err)
 		return
 	}
 	c.Send(data)
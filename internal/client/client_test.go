@@ -1,15 +1,26 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/devaloi/chatterbox/internal/deadletter"
+	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/hub"
 	"github.com/devaloi/chatterbox/internal/testutil"
 )
@@ -18,7 +29,7 @@ var testUpgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-func setupTestServer(h *hub.Hub) *httptest.Server {
+func setupTestServer(h *hub.Hub, opts ...Option) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		conn, err := testUpgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -28,9 +39,7 @@ func setupTestServer(h *hub.Hub) *httptest.Server {
 		if username == "" {
 			username = "test"
 		}
-		c := New(h, conn, username)
-		go c.ReadPump()
-		go c.WritePump()
+		New(h, conn, username, opts...).Start()
 	}))
 }
 
@@ -187,3 +196,1157 @@ func TestClientChatNotInRoom(t *testing.T) {
 		t.Errorf("expected error for chat without join, got: %v", msg)
 	}
 }
+
+func TestClientHandshakeWelcome(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithHandshake(true))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","version":1,"capabilities":["unknown","receipts","ack_window","multi_join"]}`))
+	msg := readMessage(t, conn)
+	if msg["type"] != "welcome" {
+		t.Fatalf("expected welcome, got: %v", msg)
+	}
+	// ack_window is not agreed without flow control, nor unknown at all.
+	if caps := fmt.Sprint(msg["capabilities"]); caps != "[receipts multi_join]" {
+		t.Errorf("expected receipts and multi_join negotiated, got %v", caps)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	msg = readMessage(t, conn)
+	if msg["type"] != "join" && msg["type"] != "presence" {
+		t.Errorf("expected join or presence after handshake, got: %v", msg)
+	}
+}
+
+func TestClientHandshakeRejectsNonHello(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithHandshake(true))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	msg := readMessage(t, conn)
+	if msg["type"] != "error" || msg["message"] != "expected hello" {
+		t.Fatalf("expected hello error, got: %v", msg)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, domain.CloseBadHandshake) {
+		t.Errorf("expected a bad-handshake close after rejected handshake, got %v", err)
+	}
+}
+
+func TestWithSendBufferSetsCapacity(t *testing.T) {
+	t.Parallel()
+	sink := &testutil.MockDeadLetterSink{}
+	c := New(nil, nil, "alice", WithSendBuffer(4), WithDeadLetters(sink))
+	if got := cap(c.send); got != 4 {
+		t.Fatalf("expected send buffer of 4, got %d", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Send([]byte(`{"type":"chat","room":"general","text":"x"}`))
+	}
+	if got := len(sink.Records()); got != 1 {
+		t.Errorf("expected the fifth message to be dropped, got %d dead letters", got)
+	}
+
+	if got := cap(New(nil, nil, "bob", WithSendBuffer(0)).send); got != sendBufferSize {
+		t.Errorf("expected default buffer %d for zero, got %d", sendBufferSize, got)
+	}
+}
+
+func TestClientSendOverflowDeadLetters(t *testing.T) {
+	t.Parallel()
+	sink := &testutil.MockDeadLetterSink{}
+	c := New(nil, nil, "alice", WithDeadLetters(sink))
+
+	for i := 0; i < sendBufferSize; i++ {
+		c.Send([]byte(`{"type":"chat","room":"general","text":"fill"}`))
+	}
+	c.Send([]byte(`{"type":"chat","room":"general","text":"dropped"}`))
+
+	records := sink.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(records))
+	}
+	r := records[0]
+	if r.Reason != deadletter.ReasonSendBufferFull {
+		t.Errorf("reason: got %q, want %q", r.Reason, deadletter.ReasonSendBufferFull)
+	}
+	if r.Room != "general" || r.User != "alice" {
+		t.Errorf("unexpected record: %+v", r)
+	}
+}
+
+func TestClientPumpsWithMockConn(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	readDone := make(chan struct{})
+	writeDone := make(chan struct{})
+	go func() { c.ReadPump(); close(readDone) }()
+	go func() { c.WritePump(); close(writeDone) }()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.WaitForFrames(2, 2*time.Second)
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"hello"}`))
+	frames := conn.WaitForFrames(3, 2*time.Second)
+
+	found := false
+	for _, f := range frames {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(f.Data, &msg); err == nil && msg["type"] == "chat" && msg["text"] == "hello" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected chat frame, got %d frames", len(frames))
+	}
+
+	conn.Close()
+	for _, done := range []chan struct{}{readDone, writeDone} {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("pumps did not exit after conn close")
+		}
+	}
+}
+
+func TestClientWritesPreEncodedFrames(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithCodec(domain.Msgpack))
+	if c.Codec() != domain.Msgpack {
+		t.Fatalf("expected msgpack codec, got %s", c.Codec().Name())
+	}
+	go c.WritePump()
+	defer conn.Close()
+
+	// A frame encoded by the fan-out is written as is; a plain one is
+	// encoded here.
+	c.SendEncoded([]byte(`{"type":"chat"}`), []byte{0xc0})
+	c.Send([]byte(`{"type":"pong"}`))
+	frames := conn.WaitForFrames(2, 2*time.Second)
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	if !bytes.Equal(frames[0].Data, []byte{0xc0}) {
+		t.Errorf("expected the shared encoding written unchanged, got % x", frames[0].Data)
+	}
+	var pong map[string]string
+	if err := domain.Msgpack.Unmarshal(frames[1].Data, &pong); err != nil || pong["type"] != "pong" {
+		t.Errorf("expected a msgpack pong, got % x, %v", frames[1].Data, err)
+	}
+}
+
+func TestClientAckWindowPausesDelivery(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithAckWindow(2))
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	// Presence and join fill the window.
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.WaitForFrames(2, 2*time.Second)
+	for i := 0; i < 3; i++ {
+		conn.Push([]byte(`{"type":"chat","room":"general","text":"hi"}`))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(conn.Written()); n != 2 {
+		t.Fatalf("expected delivery to pause at 2 frames, got %d", n)
+	}
+
+	conn.Push([]byte(`{"type":"ack","seq":2}`))
+	conn.WaitForFrames(4, 2*time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(conn.Written()); n != 4 {
+		t.Fatalf("expected 4 frames after first ack, got %d", n)
+	}
+
+	conn.Push([]byte(`{"type":"ack","seq":4}`))
+	frames := conn.WaitForFrames(5, 2*time.Second)
+	if len(frames) != 5 {
+		t.Fatalf("expected 5 frames after second ack, got %d", len(frames))
+	}
+	for i, f := range frames {
+		msg, err := domain.DecodeMessage(f.Data)
+		if err != nil || msg.Seq != uint64(i+1) {
+			t.Errorf("frame %d: expected seq %d, got %s", i, i+1, f.Data)
+		}
+	}
+}
+
+func TestClientIgnoresAckBeyondSent(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithAckWindow(2))
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.WaitForFrames(2, 2*time.Second)
+	// An ack for frames never sent must not open the window, and a seq
+	// in a chat must not reach recipients.
+	conn.Push([]byte(`{"type":"ack","seq":1000000}`))
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"hi","seq":1000000}`))
+	time.Sleep(100 * time.Millisecond)
+	if n := len(conn.Written()); n != 2 {
+		t.Fatalf("expected delivery to stay paused at 2 frames, got %d", n)
+	}
+
+	conn.Push([]byte(`{"type":"ack","seq":2}`))
+	frames := conn.WaitForFrames(3, 2*time.Second)
+	if len(frames) != 3 {
+		t.Fatalf("expected the chat after a valid ack, got %d frames", len(frames))
+	}
+	msg, err := domain.DecodeMessage(frames[2].Data)
+	if err != nil || msg.Seq != 3 {
+		t.Fatalf("expected seq 3 on the chat, got %s", frames[2].Data)
+	}
+
+	// Delivery keeps working with acks that follow.
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"again"}`))
+	conn.Push([]byte(`{"type":"ack","seq":3}`))
+	if frames := conn.WaitForFrames(4, 2*time.Second); len(frames) != 4 {
+		t.Fatalf("expected 4 frames, got %d", len(frames))
+	}
+}
+
+func TestClientRenameRejectsTakenNames(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50, hub.WithUniqueNames(true))
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h)
+	defer server.Close()
+
+	alice := dialWS(t, server.URL, "alice")
+	defer alice.Close()
+	bob := dialWS(t, server.URL, "bob")
+	defer bob.Close()
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"rename","name":"BOB"}`))
+	if msg := readMessage(t, alice); msg["code"] != domain.ErrCodeNameTaken {
+		t.Fatalf("expected name_taken for another user's username, got %v", msg)
+	}
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	readMessage(t, alice)
+	readMessage(t, alice)
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"nick","name":"Al"}`))
+	if msg := readMessage(t, alice); msg["type"] != domain.MsgRename || msg["name"] != "Al" {
+		t.Fatalf("expected rename notice, got %v", msg)
+	}
+	if msg := readMessage(t, alice); msg["type"] != domain.MsgSystem || msg["text"] != "alice is now known as Al" {
+		t.Fatalf("expected rename system message, got %v", msg)
+	}
+
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"rename","name":"al"}`))
+	if msg := readMessage(t, bob); msg["code"] != domain.ErrCodeNameTaken {
+		t.Fatalf("expected name_taken for another user's display name, got %v", msg)
+	}
+}
+
+// dropTime removes the timestamp from slog output so log lines compare
+// exactly.
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// lockedBuffer is a bytes.Buffer safe for a logger and a test to share.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestClientProtocolLog(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	var out lockedBuffer
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithProtocolLog(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: dropTime}))))
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.WaitForFrames(2, 2*time.Second)
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"secret words"}`))
+	conn.WaitForFrames(3, 2*time.Second)
+
+	want := []string{
+		"level=DEBUG msg=frame user=alice dir=in type=join room=general",
+		"level=DEBUG msg=frame user=alice dir=out type=presence room=general",
+		"level=DEBUG msg=frame user=alice dir=out type=join room=general",
+		"level=DEBUG msg=frame user=alice dir=in type=chat room=general",
+		"level=DEBUG msg=frame user=alice dir=out type=chat room=general",
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("expected %d log lines, got %q", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Error("protocol log must not include message bodies")
+	}
+
+	// Without debug logging the trace stays off.
+	quiet := New(h, conn, "bob", WithProtocolLog(slog.New(slog.NewTextHandler(&out, nil))))
+	if quiet.protoLog != nil {
+		t.Error("expected the protocol log disabled below debug level")
+	}
+}
+
+func TestClientDirectMessage(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h)
+	defer server.Close()
+
+	alice := dialWS(t, server.URL, "alice")
+	defer alice.Close()
+	bob := dialWS(t, server.URL, "bob")
+	defer bob.Close()
+	carol := dialWS(t, server.URL, "carol")
+	defer carol.Close()
+	// A round trip guarantees bob's connection is tracked by the hub.
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"lobby"}`))
+	readMessage(t, bob)
+	readMessage(t, bob)
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","to":"bob","text":"hi bob"}`))
+	for _, conn := range []*websocket.Conn{bob, alice} {
+		msg := readMessage(t, conn)
+		if msg["type"] != domain.MsgDM || msg["user"] != "alice" || msg["to"] != "bob" ||
+			msg["text"] != "hi bob" || msg["room"] != "dm:alice:bob" {
+			t.Fatalf("expected dm from alice, got %v", msg)
+		}
+	}
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"dm","to":"dave","text":"hi"}`))
+	if msg := readMessage(t, alice); msg["code"] != domain.ErrCodeUserOffline {
+		t.Fatalf("expected user_offline, got %v", msg)
+	}
+
+	// Only the participants' DM room holds the message, and it cannot be joined.
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"history","to":"alice"}`))
+	var hm domain.HistoryMessage
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := bob.ReadJSON(&hm); err != nil {
+		t.Fatalf("read history: %v", err)
+	}
+	if hm.Room != "dm:alice:bob" || len(hm.Messages) != 1 || hm.Messages[0].Text != "hi bob" {
+		t.Errorf("expected one stored dm, got %+v", hm)
+	}
+	carol.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"dm:alice:bob"}`))
+	if msg := readMessage(t, carol); msg["type"] != domain.MsgError {
+		t.Errorf("expected joining a dm room to fail, got %v", msg)
+	}
+}
+
+func TestClientRateLimitDropsBurst(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	sink := &testutil.MockDeadLetterSink{}
+	c := New(h, conn, "alice", WithRateLimit(3), WithDeadLetters(sink))
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.WaitForFrames(2, 2*time.Second)
+	for i := 0; i < 10; i++ {
+		conn.Push([]byte(`{"type":"chat","room":"general","text":"flood"}`))
+	}
+	frames := conn.WaitForFrames(12, 2*time.Second)
+	time.Sleep(50 * time.Millisecond)
+
+	chats, limited := 0, 0
+	for _, f := range frames[2:] {
+		msg, _ := domain.DecodeMessage(f.Data)
+		var em domain.ErrorMessage
+		json.Unmarshal(f.Data, &em)
+		switch {
+		case msg.Type == domain.MsgChat:
+			chats++
+		case em.Code == domain.ErrCodeRateLimited:
+			limited++
+		}
+	}
+	if chats != 3 || limited != 7 {
+		t.Errorf("expected 3 chats routed and 7 rate limited, got %d and %d", chats, limited)
+	}
+	records := sink.Records()
+	if len(records) != 7 {
+		t.Fatalf("expected 7 dead letters, got %d", len(records))
+	}
+	if r := records[0]; r.Reason != deadletter.ReasonRateLimited || r.Room != "general" || r.User != "alice" {
+		t.Errorf("unexpected dead letter: %+v", r)
+	}
+	if stored, _ := s.History("general", 50); len(stored) != 3 {
+		t.Errorf("expected 3 stored messages, got %d", len(stored))
+	}
+}
+
+func TestClientMaxTextLenCountsRunes(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithMaxTextLen(3))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	readMessage(t, conn)
+	readMessage(t, conn)
+
+	// Three emoji are 12 bytes but only 3 runes.
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"general","text":"😀🎉👋"}`))
+	msg := readMessage(t, conn)
+	if msg["type"] != "chat" || msg["text"] != "😀🎉👋" {
+		t.Fatalf("expected emoji chat to pass intact, got: %v", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"general","text":"😀🎉👋🚀"}`))
+	msg = readMessage(t, conn)
+	if msg["type"] != "error" || msg["message"] != "text too long" {
+		t.Errorf("expected text too long error, got: %v", msg)
+	}
+}
+
+func TestClientRoomNamesAreCaseInsensitive(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h)
+	defer server.Close()
+
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"General"}`))
+	if msg := readMessage(t, conn); msg["room"] != "general" {
+		t.Fatalf("expected the canonical room name, got %v", msg)
+	}
+	readMessage(t, conn)
+	if info := h.RoomInfo("general"); info == nil || info.UserCount != 1 {
+		t.Errorf("expected alice in general, got %+v", info)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"no spaces"}`))
+	if msg := readMessage(t, conn); msg["type"] != "error" || msg["message"] != domain.ErrRoomNameInvalid.Error() {
+		t.Errorf("expected invalid room name error, got %v", msg)
+	}
+}
+
+func TestClientMaxTextLenBoundary(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithMaxTextLen(2000))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	readMessage(t, conn)
+	readMessage(t, conn)
+
+	// 2000 four-byte runes fit in one frame and within the limit.
+	atLimit := strings.Repeat("😀", 2000)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"general","text":"`+atLimit+`"}`))
+	msg := readMessage(t, conn)
+	if msg["type"] != "chat" || msg["text"] != atLimit {
+		t.Fatalf("expected a chat at the limit to pass, got type %v", msg["type"])
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"general","text":"`+atLimit+`!"}`))
+	msg = readMessage(t, conn)
+	if msg["type"] != "error" || msg["message"] != "text too long" {
+		t.Errorf("expected text too long error one rune over, got: %v", msg)
+	}
+}
+
+func TestHubShutdownWaitsForClientPumps(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+
+	var clients []*Client
+	for _, name := range []string{"alice", "bob", "carol"} {
+		conn := testutil.NewMockConn()
+		c := New(h, conn, name)
+		c.Start()
+		conn.Push([]byte(`{"type":"join","room":"general"}`))
+		clients = append(clients, c)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for _, c := range clients {
+		select {
+		case <-c.exited:
+		default:
+			t.Errorf("client %s: pumps still running after Shutdown returned", c.username)
+		}
+	}
+}
+
+func TestHubShutdownFlushesAnnouncementBeforeClose(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	c.Start()
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	h.Announce("server shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	frames := conn.Written()
+	if len(frames) < 2 {
+		t.Fatalf("expected announcement and close frame, got %d frames", len(frames))
+	}
+	last := frames[len(frames)-1]
+	if last.Type != websocket.CloseMessage || closeCode(last.Data) != websocket.CloseGoingAway {
+		t.Errorf("last frame = %+v, want going-away close frame", last)
+	}
+	var msg domain.Message
+	if err := json.Unmarshal(frames[len(frames)-2].Data, &msg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if msg.Type != domain.MsgSystem || msg.Text != "server shutting down" {
+		t.Errorf("expected shutdown notice before close, got %+v", msg)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithIdleTimeout(200*time.Millisecond))
+	c.Start()
+
+	// A client that keeps talking stays connected past the timeout.
+	for i := 0; i < 6; i++ {
+		conn.Push([]byte(`{"type":"join","room":"general"}`))
+		time.Sleep(60 * time.Millisecond)
+	}
+	select {
+	case <-conn.Closed():
+		t.Fatal("active client was disconnected")
+	default:
+	}
+
+	// Once it goes quiet it is closed with an idle close frame.
+	select {
+	case <-conn.Closed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle client was not disconnected")
+	}
+	frames := conn.Written()
+	last := frames[len(frames)-1]
+	if last.Type != websocket.CloseMessage || closeCode(last.Data) != domain.CloseIdle {
+		t.Errorf("expected an idle close frame, got %+v", last)
+	}
+}
+
+// closeCode returns the status code of a close frame payload, or 0 if it
+// has none.
+func closeCode(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	return int(data[0])<<8 | int(data[1])
+}
+
+// blockedConn never finishes a write until it is closed, standing in for a
+// peer that has stopped reading.
+type blockedConn struct {
+	*testutil.MockConn
+}
+
+func (c blockedConn) WriteMessage(int, []byte) error {
+	<-c.Closed()
+	return testutil.ErrMockConnClosed
+}
+
+func TestClientDisconnectedAfterRepeatedOverflow(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := blockedConn{testutil.NewMockConn()}
+	c := New(h, conn, "alice", WithMaxSendDrops(3))
+	c.Start()
+
+	frame := []byte(`{"type":"chat","room":"general","text":"hi"}`)
+	for i := 0; i < sendBufferSize; i++ {
+		c.Send(frame)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-conn.Closed():
+		t.Fatal("client disconnected before its buffer overflowed")
+	default:
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Send(frame)
+	}
+	select {
+	case <-conn.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	select {
+	case <-c.exited:
+	case <-time.After(time.Second):
+		t.Error("pumps still running after disconnect")
+	}
+}
+
+func TestClientPingEchoesPong(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	c.Start()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"ping","id":"p-17"}`))
+	frames := conn.WaitForFrames(1, 500*time.Millisecond)
+	if len(frames) == 0 {
+		t.Fatal("expected a pong")
+	}
+	var pong domain.PongMessage
+	if err := json.Unmarshal(frames[0].Data, &pong); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if pong.Type != domain.MsgPong || pong.ID != "p-17" {
+		t.Errorf("expected pong for p-17, got %+v", pong)
+	}
+}
+
+func TestClientWhoamiListsRooms(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	c.Start()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"random"}`))
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	conn.Push([]byte(`{"type":"whoami"}`))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for n := 1; time.Now().Before(deadline); n++ {
+		for _, f := range conn.WaitForFrames(n, 100*time.Millisecond) {
+			var who domain.WhoamiMessage
+			if json.Unmarshal(f.Data, &who) != nil || who.Type != domain.MsgWhoami {
+				continue
+			}
+			if who.User != "alice" || !slices.Equal(who.Rooms, []string{"general", "random"}) {
+				t.Errorf("expected alice in general and random, got %+v", who)
+			}
+			return
+		}
+	}
+	t.Fatal("expected a whoami reply")
+}
+
+func TestClientJoinBusyWhenRegistrationsSaturated(t *testing.T) {
+	t.Parallel()
+	// The hub loop is not running, so the one allowed registration never drains.
+	h := hub.New(testutil.NewMockStore(), 100, 50, hub.WithMaxPendingRegistrations(1))
+	h.RegisterMode(testutil.NewMockClient("bob"), "general", domain.RoomModeDefault)
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	frames := conn.WaitForFrames(1, 2*time.Second)
+	if len(frames) == 0 {
+		t.Fatal("expected busy error, read loop stalled")
+	}
+	var em domain.ErrorMessage
+	if err := json.Unmarshal(frames[0].Data, &em); err != nil || em.Code != domain.ErrCodeServerBusy {
+		t.Fatalf("expected server_busy error, got %s", frames[0].Data)
+	}
+
+	// The refused join must not leave the client marked as a member.
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"hi"}`))
+	frames = conn.WaitForFrames(2, 2*time.Second)
+	if len(frames) < 2 || !strings.Contains(string(frames[1].Data), "not in room") {
+		t.Errorf("expected not in room error after refused join")
+	}
+}
+
+func TestClientJoinRejectedWhenRoomFull(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50, hub.WithMaxRoomUsers(1))
+	go h.Run()
+	defer h.Stop()
+	h.RegisterSync(testutil.NewMockClient("bob"), "general")
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	conn.Push([]byte(`{"type":"join","room":"general"}`))
+	frames := conn.WaitForFrames(1, 2*time.Second)
+	if len(frames) == 0 {
+		t.Fatal("expected room full error")
+	}
+	var em domain.ErrorMessage
+	if err := json.Unmarshal(frames[0].Data, &em); err != nil || em.Code != domain.ErrCodeRoomFull {
+		t.Fatalf("expected room_full error, got %s", frames[0].Data)
+	}
+
+	// The refused join must not leave the client marked as a member.
+	conn.Push([]byte(`{"type":"chat","room":"general","text":"hi"}`))
+	frames = conn.WaitForFrames(2, 2*time.Second)
+	if len(frames) < 2 || !strings.Contains(string(frames[1].Data), "not in room") {
+		t.Errorf("expected not in room error after refused join")
+	}
+}
+
+func TestClientJoinsSeveralRooms(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 4, 50, hub.WithMaxRoomUsers(1))
+	go h.Run()
+	defer h.Stop()
+	h.RegisterSync(testutil.NewMockClient("bob"), "full")
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	// "full" is at MAX_ROOM_USERS and "d" would be a fifth room.
+	conn.Push([]byte(`{"type":"join","room":"a","rooms":["B","full","bad name!","c","a","d"]}`))
+	var (
+		joined []string
+		em     domain.ErrorMessage
+	)
+	deadline := time.Now().Add(2 * time.Second)
+	for em.Type == "" && time.Now().Before(deadline) {
+		joined = joined[:0]
+		for _, f := range conn.WaitForFrames(1, 100*time.Millisecond) {
+			var msg domain.Message
+			json.Unmarshal(f.Data, &msg)
+			switch msg.Type {
+			case domain.MsgPresence:
+				joined = append(joined, msg.Room)
+			case domain.MsgError:
+				json.Unmarshal(f.Data, &em)
+			}
+		}
+	}
+	if !slices.Equal(joined, []string{"a", "b", "c"}) {
+		t.Errorf("expected presence for a, b and c, got %v", joined)
+	}
+	if em.Code != domain.ErrCodeJoinFailed {
+		t.Fatalf("expected one join_failed error, got %+v", em)
+	}
+	want := []domain.RoomError{
+		{Room: "full", Code: domain.ErrCodeRoomFull, Message: hub.ErrRoomFull.Error()},
+		{Room: "bad name!", Message: domain.ErrRoomNameInvalid.Error()},
+		{Room: "d", Message: "max rooms reached"},
+	}
+	if !slices.Equal(em.Rooms, want) {
+		t.Errorf("expected per-room errors %+v, got %+v", want, em.Rooms)
+	}
+
+	// Refused rooms are not left marked as joined.
+	conn.Push([]byte(`{"type":"chat","room":"full","text":"hi"}`))
+	time.Sleep(100 * time.Millisecond)
+	frames := conn.WaitForFrames(1, time.Second)
+	if last := frames[len(frames)-1]; !strings.Contains(string(last.Data), "not in room") {
+		t.Errorf("expected not in room error after refused join, got %s", last.Data)
+	}
+}
+
+func TestClientJoinsSeveralRoomsSinceID(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	for _, id := range []string{"m1", "m2", "m3"} {
+		s.Save(domain.Message{ID: id, Type: domain.MsgChat, Room: "a", User: "bob", Text: id})
+	}
+	s.Save(domain.Message{ID: "m4", Type: domain.MsgChat, Room: "b", User: "bob", Text: "m4"})
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice")
+	go c.ReadPump()
+	go c.WritePump()
+	defer conn.Close()
+
+	// since_id trims the history of room; the rooms list gets the latest.
+	conn.Push([]byte(`{"type":"join","room":"a","rooms":["b"],"since_id":"m2"}`))
+	history := make(map[string][]string)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(history) < 2 && time.Now().Before(deadline) {
+		for _, f := range conn.WaitForFrames(1, 100*time.Millisecond) {
+			var hm domain.HistoryMessage
+			if json.Unmarshal(f.Data, &hm) != nil || hm.Type != domain.MsgHistory {
+				continue
+			}
+			var ids []string
+			for _, m := range hm.Messages {
+				ids = append(ids, m.ID)
+			}
+			history[hm.Room] = ids
+		}
+	}
+	if !slices.Equal(history["a"], []string{"m3"}) || !slices.Equal(history["b"], []string{"m4"}) {
+		t.Errorf("expected a: [m3] and b: [m4], got %v", history)
+	}
+
+	// Without room there is no room the id could belong to.
+	conn.Push([]byte(`{"type":"join","rooms":["c"],"since_id":"m1"}`))
+	time.Sleep(100 * time.Millisecond)
+	frames := conn.WaitForFrames(1, time.Second)
+	if last := frames[len(frames)-1]; !strings.Contains(string(last.Data), "since_id needs room") {
+		t.Errorf("expected a since_id error, got %s", last.Data)
+	}
+}
+
+func TestClientRejectsOversizedFrame(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithMaxFrameSize(64))
+	defer server.Close()
+
+	// Just over the limit: a clear error, then a 1009 close with a reason.
+	conn := dialWS(t, server.URL, "alice")
+	defer conn.Close()
+	big := `{"type":"chat","room":"general","text":"` + strings.Repeat("x", 64) + `"}`
+	conn.WriteMessage(websocket.TextMessage, []byte(big))
+	msg := readMessage(t, conn)
+	if msg["type"] != "error" || msg["code"] != domain.ErrCodeMessageTooLarge || msg["message"] != "message too large" {
+		t.Fatalf("expected message too large error, got %v", msg)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseMessageTooBig || ce.Text != "message too large" {
+		t.Errorf("expected close 1009 with a reason, got %v", err)
+	}
+
+	// Far over it: the frame is cut off unread, still with code 1009.
+	conn2 := dialWS(t, server.URL, "bob")
+	defer conn2.Close()
+	conn2.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64*oversizeFactor+1)))
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn2.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected close 1009 for a huge frame, got %v", err)
+	}
+}
+
+func TestClientDisconnectsAfterProtocolErrors(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	conn := testutil.NewMockConn()
+	c := New(h, conn, "alice", WithProtocolErrorLimit(3, time.Minute))
+	readDone := make(chan struct{})
+	go func() { c.ReadPump(); close(readDone) }()
+	go c.WritePump()
+
+	for i := 0; i < 5; i++ {
+		conn.Push([]byte(`{not json`))
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not disconnected after repeated protocol errors")
+	}
+
+	// Three "invalid JSON" replies, the final error, then a close frame.
+	frames := conn.WaitForFrames(5, 2*time.Second)
+	if len(frames) != 5 {
+		t.Fatalf("expected 5 frames, got %d", len(frames))
+	}
+	var em domain.ErrorMessage
+	if err := json.Unmarshal(frames[3].Data, &em); err != nil || em.Code != domain.ErrCodeTooManyErrors {
+		t.Errorf("expected too_many_errors before close, got %s", frames[3].Data)
+	}
+	if frames[4].Type != websocket.CloseMessage || closeCode(frames[4].Data) != domain.CloseTooManyErrors {
+		t.Errorf("expected too-many-errors close frame last, got %+v", frames[4])
+	}
+}
+
+func TestClientProtocolErrorsOutsideWindowDoNotDisconnect(t *testing.T) {
+	t.Parallel()
+	c := New(nil, testutil.NewMockConn(), "alice", WithProtocolErrorLimit(2, 20*time.Millisecond))
+	c.protocolError("invalid JSON")
+	time.Sleep(30 * time.Millisecond)
+	c.protocolError("invalid JSON")
+	if c.protocolErrorLimitReached() {
+		t.Error("expected errors outside the window to be forgotten")
+	}
+	c.protocolError("invalid JSON")
+	if !c.protocolErrorLimitReached() {
+		t.Error("expected limit reached with two errors in the window")
+	}
+}
+
+// dialRaw performs a WebSocket handshake over a plain TCP connection so the
+// test can write hand-built frames that a well-behaved client would refuse to.
+func dialRaw(t *testing.T, serverURL string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	req := "GET /?user=mallory HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return conn
+}
+
+func TestClientOversizedControlFrameClassified(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h)
+	defer server.Close()
+
+	conn := dialRaw(t, server.URL)
+	defer conn.Close()
+
+	// A masked ping (FIN + opcode 0x9) with a 200-byte payload; control
+	// frames may carry at most 125 bytes.
+	const size = 200
+	frame := []byte{0x89, 0x80 | 126, byte(size >> 8), byte(size & 0xff), 0, 0, 0, 0}
+	frame = append(frame, make([]byte, size)...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Stats().ControlFrameErrors == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected control frame error to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIsControlFrameError(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("websocket: len > 125 for control"), true},
+		{errors.New("websocket: FIN not set on control"), true},
+		{errors.New("websocket: data before FIN"), false},
+		{errors.New("websocket: read limit exceeded"), false},
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+	}
+	for _, tt := range tests {
+		if got := isControlFrameError(tt.err); got != tt.want {
+			t.Errorf("isControlFrameError(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClientSlowReaderHitsDataWriteDeadline(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := setupTestServer(h, WithWriteDeadlines(5*time.Millisecond, time.Second))
+	defer server.Close()
+
+	// The peer joins and then never reads again.
+	conn := dialWS(t, server.URL, "slow")
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	// Flood the room until the socket buffers fill and a write blocks past
+	// the deadline, which should drop the slow client from the room.
+	sender := testutil.NewMockClient("sender")
+	text := strings.Repeat("x", 16*1024)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info := h.RoomInfo("general")
+		if info == nil || info.UserCount == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow client was not cleaned up after write deadline")
+		}
+		for i := 0; i < 64; i++ {
+			h.RouteMessage(domain.Message{Type: domain.MsgChat, Room: "general", User: "sender", Text: text}, sender)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestValidateWriteDeadlines(t *testing.T) {
+	t.Parallel()
+	if err := ValidateWriteDeadlines(time.Second, time.Second, pongWait); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ValidateWriteDeadlines(0, time.Second, pongWait) == nil {
+		t.Error("expected error for zero data deadline")
+	}
+	if ValidateWriteDeadlines(time.Second, pongWait, pongWait) == nil {
+		t.Error("expected error for ping deadline not below pong wait")
+	}
+	if ValidateWriteDeadlines(time.Second, 10*time.Second, 5*time.Second) == nil {
+		t.Error("expected error for a shortened pong wait below the ping deadline")
+	}
+	if ValidateWriteDeadlines(time.Second, time.Second, 0) == nil {
+		t.Error("expected error for zero pong wait")
+	}
+}
+
+func TestWithPongWaitKeepsPingPeriodBelowIt(t *testing.T) {
+	t.Parallel()
+	c := New(nil, testutil.NewMockConn(), "alice", WithPongWait(2*time.Minute))
+	if c.pongWait != 2*time.Minute || c.pingPeriod <= 0 || c.pingPeriod >= c.pongWait {
+		t.Errorf("expected ping period below pong wait 2m, got %v and %v", c.pingPeriod, c.pongWait)
+	}
+	c = New(nil, testutil.NewMockConn(), "alice")
+	if c.pongWait != pongWait || c.pingPeriod >= c.pongWait {
+		t.Errorf("expected default pong wait %v, got %v (ping every %v)", pongWait, c.pongWait, c.pingPeriod)
+	}
+}
@@ -7,19 +7,207 @@ import (
 
 // Config holds server configuration loaded from environment variables.
 type Config struct {
-	Port       string
-	DBPath     string
-	MaxRooms   int
-	MaxHistory int
+	Port           string
+	LogLevel       string
+	LogFormat      string
+	DBPath         string
+	StaticDir      string
+	MaxRooms       int
+	MaxRoomUsers   int
+	MaxHistory     int
+	NormalizeText  bool
+	RequireHello   bool
+	DeadLetterFile string
+	DeadLetterMax  int
+	ServerID       string
+	RelayPeers     string
+	RelayToken     string
+	HistoryCacheMS int
+	MaxTextLen     int
+
+	RoomHistory    string
+	MaxRoomHistory int
+
+	MaxReactionEmoji int
+	MaxUserReactions int
+	PersistTypes     string
+	HistoryTypes     string
+	JoinOrder        string
+	RoomEviction     string
+	ShedQueueHigh    int
+	ShedQueueLow     int
+	ShedConnHigh     int
+	ShedConnLow      int
+	MaxPendingJoins  int
+
+	MaxProtocolErrors     int
+	ProtocolErrorWindowMS int
+
+	DBBusyTimeoutMS int
+
+	CheckpointIntervalMS int
+	CheckpointMode       string
+
+	WriteBatchSize int
+	WriteBatchMS   int
+
+	RetentionDays    int
+	RetentionSweepMS int
+
+	EditHistory bool
+	DeleteMode  string
+
+	FilterWordsFile string
+	FilterMode      string
+
+	AdminToken string
+
+	PresenceConnections bool
+	UniqueNames         bool
+	KickBanMS           int
+
+	WriteWaitMS     int
+	PingWriteWaitMS int
+	PongWaitMS      int
+
+	AckWindow int
+
+	PollTimeoutMS int
+
+	ProtocolLog bool
+
+	MaxMsgsPerSec     int
+	MaxRoomMsgsPerSec int
+
+	IdleTimeoutMS int
+
+	MaxSendDrops   int
+	SendBufferSize int
+
+	ShutdownTimeoutMS int
+
+	StoreBackend string
+	DatabaseURL  string
+
+	RedisURL string
+
+	MetricsMaxRooms  int
+	MetricsRefreshMS int
+
+	AllowGuests      bool
+	GuestCreateRooms bool
+
+	TrustProxy    bool
+	MaxConnsPerIP int
+
+	MaxFrameSize int
+
+	GzipMinSize int
+
+	MaxConnections int
 }
 
 // Load reads configuration from environment variables with sensible defaults.
 func Load() Config {
 	return Config{
-		Port:       envOrDefault("PORT", "8080"),
-		DBPath:     envOrDefault("DB_PATH", "chatterbox.db"),
-		MaxRooms:   envOrDefaultInt("MAX_ROOMS", 100),
-		MaxHistory: envOrDefaultInt("MAX_HISTORY", 50),
+		Port:           envOrDefault("PORT", "8080"),
+		LogLevel:       envOrDefault("LOG_LEVEL", "info"),
+		LogFormat:      envOrDefault("LOG_FORMAT", "text"),
+		DBPath:         envOrDefault("DB_PATH", "chatterbox.db"),
+		StaticDir:      envOrDefault("STATIC_DIR", "static"),
+		MaxRooms:       envOrDefaultInt("MAX_ROOMS", 100),
+		MaxRoomUsers:   envOrDefaultInt("MAX_ROOM_USERS", 0),
+		MaxHistory:     envOrDefaultInt("MAX_HISTORY", 50),
+		NormalizeText:  envOrDefaultBool("NORMALIZE_TEXT", false),
+		RequireHello:   envOrDefaultBool("REQUIRE_HELLO", false),
+		DeadLetterFile: envOrDefault("DEAD_LETTER_FILE", ""),
+		DeadLetterMax:  envOrDefaultInt("DEAD_LETTER_MAX", 10000),
+		ServerID:       envOrDefault("SERVER_ID", ""),
+		RelayPeers:     envOrDefault("RELAY_PEERS", ""),
+		RelayToken:     envOrDefault("RELAY_TOKEN", ""),
+		HistoryCacheMS: envOrDefaultInt("HISTORY_CACHE_MS", 0),
+		MaxTextLen:     envOrDefaultInt("MAX_TEXT_LEN", 2000),
+
+		RoomHistory:    envOrDefault("ROOM_HISTORY", ""),
+		MaxRoomHistory: envOrDefaultInt("MAX_ROOM_HISTORY", 1000),
+
+		MaxReactionEmoji: envOrDefaultInt("MAX_REACTION_EMOJI", 20),
+		MaxUserReactions: envOrDefaultInt("MAX_USER_REACTIONS", 500),
+		PersistTypes:     envOrDefault("PERSIST_TYPES", "chat,dm"),
+		HistoryTypes:     envOrDefault("HISTORY_TYPES", ""),
+		JoinOrder:        envOrDefault("JOIN_ORDER", "presence-first"),
+		RoomEviction:     envOrDefault("ROOM_EVICTION", "none"),
+		ShedQueueHigh:    envOrDefaultInt("SHED_QUEUE_HIGH", 0),
+		ShedQueueLow:     envOrDefaultInt("SHED_QUEUE_LOW", 0),
+		ShedConnHigh:     envOrDefaultInt("SHED_CONN_HIGH", 0),
+		ShedConnLow:      envOrDefaultInt("SHED_CONN_LOW", 0),
+		MaxPendingJoins:  envOrDefaultInt("MAX_PENDING_JOINS", 0),
+
+		MaxProtocolErrors:     envOrDefaultInt("MAX_PROTOCOL_ERRORS", 0),
+		ProtocolErrorWindowMS: envOrDefaultInt("PROTOCOL_ERROR_WINDOW_MS", 10000),
+
+		DBBusyTimeoutMS: envOrDefaultInt("DB_BUSY_TIMEOUT_MS", 5000),
+
+		CheckpointIntervalMS: envOrDefaultInt("CHECKPOINT_INTERVAL_MS", 60000),
+		CheckpointMode:       envOrDefault("CHECKPOINT_MODE", "PASSIVE"),
+
+		WriteBatchSize: envOrDefaultInt("WRITE_BATCH_SIZE", 0),
+		WriteBatchMS:   envOrDefaultInt("WRITE_BATCH_MS", 50),
+
+		RetentionDays:    envOrDefaultInt("RETENTION_DAYS", 0),
+		RetentionSweepMS: envOrDefaultInt("RETENTION_SWEEP_MS", 3600000),
+
+		EditHistory: envOrDefaultBool("EDIT_HISTORY", true),
+		DeleteMode:  envOrDefault("DELETE_MODE", "soft"),
+
+		FilterWordsFile: envOrDefault("FILTER_WORDS_FILE", ""),
+		FilterMode:      envOrDefault("FILTER_MODE", "mask"),
+
+		AdminToken: envOrDefault("ADMIN_TOKEN", ""),
+
+		PresenceConnections: envOrDefaultBool("PRESENCE_CONNECTIONS", false),
+		UniqueNames:         envOrDefaultBool("UNIQUE_NAMES", false),
+		KickBanMS:           envOrDefaultInt("KICK_BAN_MS", 300000),
+
+		WriteWaitMS:     envOrDefaultInt("WRITE_WAIT_MS", 10000),
+		PingWriteWaitMS: envOrDefaultInt("PING_WRITE_WAIT_MS", 10000),
+		PongWaitMS:      envOrDefaultInt("PONG_WAIT_MS", 60000),
+
+		AckWindow: envOrDefaultInt("ACK_WINDOW", 0),
+
+		PollTimeoutMS: envOrDefaultInt("POLL_TIMEOUT_MS", 25000),
+
+		ProtocolLog: envOrDefaultBool("PROTOCOL_LOG", false),
+
+		MaxMsgsPerSec:     envOrDefaultInt("MAX_MSGS_PER_SEC", 0),
+		MaxRoomMsgsPerSec: envOrDefaultInt("MAX_ROOM_MSGS_PER_SEC", 0),
+
+		IdleTimeoutMS: envOrDefaultInt("IDLE_TIMEOUT_MS", 0),
+
+		MaxSendDrops:   envOrDefaultInt("MAX_SEND_DROPS", 0),
+		SendBufferSize: envOrDefaultInt("SEND_BUFFER_SIZE", 256),
+
+		ShutdownTimeoutMS: envOrDefaultInt("SHUTDOWN_TIMEOUT_MS", 10000),
+
+		StoreBackend: envOrDefault("STORE_BACKEND", "sqlite"),
+		DatabaseURL:  envOrDefault("DATABASE_URL", ""),
+
+		RedisURL: envOrDefault("REDIS_URL", ""),
+
+		MetricsMaxRooms:  envOrDefaultInt("METRICS_MAX_ROOMS", 20),
+		MetricsRefreshMS: envOrDefaultInt("METRICS_REFRESH_MS", 60000),
+
+		AllowGuests:      envOrDefaultBool("ALLOW_GUESTS", false),
+		GuestCreateRooms: envOrDefaultBool("GUEST_CREATE_ROOMS", false),
+
+		TrustProxy:    envOrDefaultBool("TRUST_PROXY", false),
+		MaxConnsPerIP: envOrDefaultInt("MAX_CONNS_PER_IP", 0),
+
+		MaxFrameSize: envOrDefaultInt("MAX_FRAME_SIZE", 16384),
+
+		GzipMinSize: envOrDefaultInt("GZIP_MIN_SIZE", 1024),
+
+		MaxConnections: envOrDefaultInt("MAX_CONNECTIONS", 0),
 	}
 }
 
@@ -41,3 +229,15 @@ func envOrDefaultInt(key string, fallback int) int {
 	}
 	return n
 }
+
+func envOrDefaultBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
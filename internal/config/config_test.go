@@ -20,6 +20,9 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.MaxHistory != 50 {
 		t.Errorf("expected default max history 50, got %d", cfg.MaxHistory)
 	}
+	if cfg.MaxTextLen != 2000 {
+		t.Errorf("expected default max text length 2000, got %d", cfg.MaxTextLen)
+	}
 }
 
 func TestLoadFromEnv(t *testing.T) {
@@ -27,6 +30,7 @@ func TestLoadFromEnv(t *testing.T) {
 	t.Setenv("DB_PATH", "/tmp/test.db")
 	t.Setenv("MAX_ROOMS", "50")
 	t.Setenv("MAX_HISTORY", "25")
+	t.Setenv("NORMALIZE_TEXT", "true")
 
 	cfg := Load()
 	if cfg.Port != "9090" {
@@ -41,6 +45,9 @@ func TestLoadFromEnv(t *testing.T) {
 	if cfg.MaxHistory != 25 {
 		t.Errorf("expected max history 25, got %d", cfg.MaxHistory)
 	}
+	if !cfg.NormalizeText {
+		t.Error("expected normalize text enabled")
+	}
 }
 
 func TestLoadInvalidInt(t *testing.T) {
@@ -52,3 +59,17 @@ func TestLoadInvalidInt(t *testing.T) {
 		t.Errorf("expected fallback max rooms 100, got %d", cfg.MaxRooms)
 	}
 }
+
+func TestLoadConnectionTimings(t *testing.T) {
+	cfg := Load()
+	if cfg.WriteWaitMS != 10000 || cfg.PingWriteWaitMS != 10000 || cfg.PongWaitMS != 60000 {
+		t.Errorf("expected default timings 10000/10000/60000, got %d/%d/%d", cfg.WriteWaitMS, cfg.PingWriteWaitMS, cfg.PongWaitMS)
+	}
+
+	t.Setenv("WRITE_WAIT_MS", "20000")
+	t.Setenv("PONG_WAIT_MS", "120000")
+	cfg = Load()
+	if cfg.WriteWaitMS != 20000 || cfg.PongWaitMS != 120000 {
+		t.Errorf("expected timings 20000/120000 from env, got %d/%d", cfg.WriteWaitMS, cfg.PongWaitMS)
+	}
+}
@@ -0,0 +1,74 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons a message can be dead-lettered.
+const (
+	ReasonSendBufferFull  = "send_buffer_full"
+	ReasonHubQueueFull    = "hub_queue_full"
+	ReasonRateLimited     = "rate_limited"
+	ReasonRoomRateLimited = "room_rate_limited"
+)
+
+// Record describes a message that was dropped instead of delivered.
+type Record struct {
+	Reason    string    `json:"reason"`
+	Room      string    `json:"room,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Size      int       `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sink receives dead-letter records. Implementations must be safe for
+// concurrent use and must not block the caller for long.
+type Sink interface {
+	Record(r Record)
+}
+
+// FileSink appends dead-letter records to a file as JSON lines. It stops
+// writing once maxRecords have been written so a drop storm can't fill the disk.
+type FileSink struct {
+	mu         sync.Mutex
+	f          *os.File
+	enc        *json.Encoder
+	maxRecords int
+	written    int
+}
+
+// NewFileSink opens (or creates) path for appending dead-letter records.
+// A maxRecords of zero or less means unbounded.
+func NewFileSink(path string, maxRecords int) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, enc: json.NewEncoder(f), maxRecords: maxRecords}, nil
+}
+
+// Record writes r to the file unless the record limit has been reached.
+func (s *FileSink) Record(r Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxRecords > 0 && s.written >= s.maxRecords {
+		return
+	}
+	if r.Timestamp.IsZero() {
+		r.Timestamp = time.Now().UTC()
+	}
+	if err := s.enc.Encode(r); err != nil {
+		return
+	}
+	s.written++
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
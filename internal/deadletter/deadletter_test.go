@@ -0,0 +1,65 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkWritesRecords(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	s, err := NewFileSink(path, 10)
+	if err != nil {
+		t.Fatalf("new file sink: %v", err)
+	}
+	s.Record(Record{Reason: ReasonSendBufferFull, Room: "general", User: "alice", Size: 42})
+	s.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	var r Record
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if r.Reason != ReasonSendBufferFull || r.Room != "general" || r.User != "alice" || r.Size != 42 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if r.Timestamp.IsZero() {
+		t.Error("expected timestamp to be set")
+	}
+}
+
+func TestFileSinkBounded(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	s, err := NewFileSink(path, 3)
+	if err != nil {
+		t.Fatalf("new file sink: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Record(Record{Reason: ReasonSendBufferFull})
+	}
+	s.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 records, got %d", lines)
+	}
+}
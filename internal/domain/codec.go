@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"encoding/json"
+)
+
+// Codec encodes and decodes protocol frames for one wire format.
+type Codec interface {
+	// Name is the value of the ?codec= query parameter that selects it.
+	Name() string
+	// Binary reports whether frames are sent as binary WebSocket messages.
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Codecs available to clients. JSON is the default.
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+)
+
+// CodecByName returns the codec selected by name, and false if there is
+// none. The empty name selects JSON.
+func CodecByName(name string) (Codec, bool) {
+	switch name {
+	case "", JSON.Name():
+		return JSON, true
+	case Msgpack.Name():
+		return Msgpack, true
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Binary() bool                       { return false }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec maps values through their JSON form, so field names and
+// omitempty rules match the JSON protocol exactly. Timestamps are RFC 3339
+// strings, as in JSON. Messages and frames already encoded as JSON, the bulk
+// of the traffic, are converted directly (see msgpack_direct.go); other
+// values go through encoding/json.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case Message:
+		return appendMessage(nil, &v), nil
+	case *Message:
+		return appendMessage(nil, v), nil
+	case json.RawMessage:
+		return transcodeJSON(nil, v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return transcodeJSON(nil, data)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(*Message); ok {
+		return decodeMessage(data, m)
+	}
+	generic, err := decodeMsgpack(data)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
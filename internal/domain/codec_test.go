@@ -0,0 +1,212 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	t.Parallel()
+	msg := Message{
+		ID:        "m1",
+		Type:      MsgChat,
+		Room:      "general",
+		User:      "alice",
+		Text:      strings.Repeat("héllo ", 20),
+		Timestamp: time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC),
+	}
+	presence := PresenceMessage{
+		Type:     MsgPresence,
+		Room:     "general",
+		Users:    []string{"alice", "bob"},
+		Statuses: map[string]string{"bob": StatusAway},
+	}
+
+	for _, name := range []string{"json", "msgpack"} {
+		codec, ok := CodecByName(name)
+		if !ok {
+			t.Fatalf("codec %q not found", name)
+		}
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Marshal(msg)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var gotMsg Message
+			if err := codec.Unmarshal(data, &gotMsg); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(gotMsg, msg) {
+				t.Errorf("message round trip: got %+v, want %+v", gotMsg, msg)
+			}
+
+			data, err = codec.Marshal(presence)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var gotPresence PresenceMessage
+			if err := codec.Unmarshal(data, &gotPresence); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(gotPresence, presence) {
+				t.Errorf("presence round trip: got %+v, want %+v", gotPresence, presence)
+			}
+		})
+	}
+}
+
+func TestMsgpackNumbers(t *testing.T) {
+	t.Parallel()
+	in := map[string]any{"a": -1, "b": 200, "c": -70000, "d": int64(1) << 40, "e": 1.5, "f": uint64(1) << 63}
+	data, err := Msgpack.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out map[string]float64
+	if err := Msgpack.Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	for k, v := range map[string]float64{"a": -1, "b": 200, "c": -70000, "d": 1 << 40, "e": 1.5, "f": 1 << 63} {
+		if out[k] != v {
+			t.Errorf("%s: got %v, want %v", k, out[k], v)
+		}
+	}
+}
+
+func TestMsgpackWireFormat(t *testing.T) {
+	t.Parallel()
+	data, err := Msgpack.Marshal(PongMessage{Type: MsgPong, ID: "7"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	// fixmap(2) "id" "7" "type" "pong"
+	want := []byte{0x82, 0xa2, 'i', 'd', 0xa1, '7', 0xa4, 't', 'y', 'p', 'e', 0xa4, 'p', 'o', 'n', 'g'}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+}
+
+func TestMsgpackRejectsMalformed(t *testing.T) {
+	t.Parallel()
+	for _, data := range [][]byte{
+		{},                             // empty
+		{0xa5, 'h', 'i'},               // string shorter than its length
+		{0xdd, 0xff, 0xff, 0xff, 0xff}, // huge array with no elements
+		{0x81, 0x01, 0x02},             // integer map key
+		{0xc0, 0xc0},                   // trailing data
+		{0xd4, 0x01, 0x02},             // extension type
+	} {
+		var v any
+		if err := Msgpack.Unmarshal(data, &v); err == nil {
+			t.Errorf("% x: expected error", data)
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	t.Parallel()
+	if c, ok := CodecByName(""); !ok || c != JSON {
+		t.Error("expected JSON as the default codec")
+	}
+	if _, ok := CodecByName("xml"); ok {
+		t.Error("expected unknown codec to be rejected")
+	}
+}
+
+func TestMsgpackMessageMatchesJSONFrame(t *testing.T) {
+	t.Parallel()
+	msg := Message{
+		ID: "m1", Type: MsgChat, Room: "general", User: "alice", Text: "say \"hi\"\n\u00e9",
+		Timestamp: time.Date(2026, 1, 15, 10, 30, 0, 123456789, time.UTC),
+		Receipt:   true, Seq: 1 << 40, Rooms: []string{"a", "b"}, ClientMsgID: "c1", ReplyTo: "m0",
+	}
+	direct, err := Msgpack.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	frame, _ := json.Marshal(msg)
+	transcoded, err := Msgpack.Marshal(json.RawMessage(frame))
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	if !reflect.DeepEqual(direct, transcoded) {
+		t.Errorf("direct and transcoded encodings differ:\n% x\n% x", direct, transcoded)
+	}
+	var got Message
+	if err := Msgpack.Unmarshal(direct, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("round trip: got %+v, want %+v", got, msg)
+	}
+}
+
+func TestMsgpackTranscodesJSON(t *testing.T) {
+	t.Parallel()
+	frame := `{"z": [1, -2, 3.5, true, null, {"b": "x", "a": "y\u0041"}], "a": {}, "m": []}`
+	data, err := Msgpack.Marshal(json.RawMessage(frame))
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	var got, want any
+	if err := Msgpack.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	json.Unmarshal([]byte(frame), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{`{"a":}`, `[1,`, `"open`, `{"a":1} x`, `tru`} {
+		if _, err := Msgpack.Marshal(json.RawMessage(bad)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestMsgpackMessageDecodesLikeJSON(t *testing.T) {
+	t.Parallel()
+	data, _ := Msgpack.Marshal(map[string]any{"Type": "chat", "TEXT": "hi", "extra": []int{1}, "user": nil})
+	msg := Message{User: "kept"}
+	if err := Msgpack.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if msg.Type != "chat" || msg.Text != "hi" || msg.User != "kept" {
+		t.Errorf("got %+v", msg)
+	}
+	bad, _ := Msgpack.Marshal(map[string]any{"type": 7})
+	if err := Msgpack.Unmarshal(bad, &msg); err == nil {
+		t.Error("expected an error for a number in a string field")
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	msg := Message{
+		ID: "5f0c2a9e-8d7b-4c1e-9f3a-2b6d8e1c4a70", Type: MsgChat, Room: "general", User: "alice",
+		Text: strings.Repeat("hello world ", 8), Timestamp: time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC),
+		Origin: "server-1", ClientMsgID: "m-7",
+	}
+	frame, _ := json.Marshal(msg)
+	for _, codec := range []Codec{JSON, Msgpack} {
+		encoded, _ := codec.Marshal(msg)
+		b.Run(codec.Name()+"/encode-frame", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := codec.Marshal(json.RawMessage(frame)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(codec.Name()+"/decode-message", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				var m Message
+				if err := codec.Unmarshal(encoded, &m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
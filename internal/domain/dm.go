@@ -0,0 +1,21 @@
+package domain
+
+import "strings"
+
+// dmRoomPrefix marks the synthetic rooms direct messages are stored under.
+// Clients cannot join these rooms.
+const dmRoomPrefix = "dm:"
+
+// DMRoom returns the synthetic room that direct messages between two users
+// are stored under. The names are sorted, so both users map to the same room.
+func DMRoom(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return dmRoomPrefix + a + ":" + b
+}
+
+// IsDMRoom reports whether room is a synthetic direct-message room.
+func IsDMRoom(room string) bool {
+	return strings.HasPrefix(room, dmRoomPrefix)
+}
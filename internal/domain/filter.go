@@ -0,0 +1,139 @@
+package domain
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Word filter modes accepted by WordFilterStage.
+const (
+	FilterMask   = "mask"   // replace each blocked word with asterisks
+	FilterReject = "reject" // refuse the whole message
+)
+
+// ParseFilterMode validates a word filter mode, case-insensitively.
+func ParseFilterMode(s string) (string, error) {
+	switch m := strings.ToLower(s); m {
+	case FilterMask, FilterReject:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid filter mode %q: want mask or reject", s)
+}
+
+// ParseWordList reads a word list with one word or phrase per line. Blank
+// lines and lines starting with # are skipped.
+func ParseWordList(r io.Reader) ([]string, error) {
+	var words []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, sc.Err()
+}
+
+// WordFilter finds listed words in text, ignoring case and matching whole
+// words only, so "ass" does not match "class".
+type WordFilter struct {
+	// re matches any listed word followed by a non-word character or the
+	// end of the text; the word itself is submatch 1.
+	re *regexp.Regexp
+}
+
+// NewWordFilter compiles words into a single matcher. With no words it
+// matches nothing.
+func NewWordFilter(words []string) *WordFilter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return &WordFilter{}
+	}
+	// Longest first, so "bad word" wins over "bad" where both fit.
+	slices.SortFunc(quoted, func(a, b string) int { return len(b) - len(a) })
+	return &WordFilter{
+		re: regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)(?:[^\p{L}\p{M}\p{N}_]|$)`),
+	}
+}
+
+// Contains reports whether text contains a listed word.
+func (f *WordFilter) Contains(text string) bool {
+	return len(f.find(text)) > 0
+}
+
+// Mask replaces every rune of each listed word in text with '*'.
+func (f *WordFilter) Mask(text string) string {
+	matches := f.find(text)
+	if len(matches) == 0 {
+		return text
+	}
+	var b strings.Builder
+	b.Grow(len(text))
+	last := 0
+	for _, m := range matches {
+		b.WriteString(text[last:m[0]])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[m[0]:m[1]])))
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// find returns the byte ranges of the listed words in text.
+func (f *WordFilter) find(text string) [][2]int {
+	if f.re == nil {
+		return nil
+	}
+	var out [][2]int
+	for pos := 0; pos < len(text); {
+		loc := f.re.FindStringSubmatchIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[2], pos+loc[3]
+		// The pattern checks the end of a word; check its start here.
+		if prev, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWordRune(prev) {
+			_, size := utf8.DecodeRuneInString(text[start:])
+			pos = start + size
+			continue
+		}
+		out = append(out, [2]int{start, end})
+		pos = end
+	}
+	return out
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r)
+}
+
+// WordFilterStage checks chat messages, direct messages and edits against
+// f, masking listed words or rejecting the message with
+// ErrCodeMessageFiltered depending on mode.
+func WordFilterStage(f *WordFilter, mode string) MessageStage {
+	return StageFunc(func(msg *Message) error {
+		if !carriesText(msg.Type) {
+			return nil
+		}
+		if mode == FilterReject {
+			if f.Contains(msg.Text) {
+				return &StageError{Code: ErrCodeMessageFiltered, Message: "message contains a blocked word"}
+			}
+			return nil
+		}
+		msg.Text = f.Mask(msg.Text)
+		return nil
+	})
+}
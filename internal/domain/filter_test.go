@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWordFilterMask(t *testing.T) {
+	t.Parallel()
+	f := NewWordFilter([]string{"darn", "heck", "bad word", "café"})
+	tests := []struct {
+		in, want string
+	}{
+		{"darn it", "**** it"},
+		{"DARN, Heck!", "****, ****!"},
+		{"darned darnit undarn", "darned darnit undarn"},
+		{"heck_ heck2 heck", "heck_ heck2 ****"},
+		{"a bad word here", "a ******** here"},
+		{"bad words", "bad words"},
+		{"Café cafés", "**** cafés"},
+		{"heckheck heck heck", "heckheck **** ****"},
+		{"clean", "clean"},
+	}
+	for _, tt := range tests {
+		if got := f.Mask(tt.in); got != tt.want {
+			t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWordFilterEmpty(t *testing.T) {
+	t.Parallel()
+	f := NewWordFilter([]string{"", "  "})
+	if f.Contains("anything") || f.Mask("anything") != "anything" {
+		t.Error("expected an empty filter to match nothing")
+	}
+}
+
+func TestWordFilterStage(t *testing.T) {
+	t.Parallel()
+	f := NewWordFilter([]string{"darn"})
+
+	msg := Message{Type: MsgChat, Text: "darn it"}
+	if err := WordFilterStage(f, FilterMask).Process(&msg); err != nil || msg.Text != "**** it" {
+		t.Errorf("expected masked text, got %q, %v", msg.Text, err)
+	}
+
+	msg = Message{Type: MsgEdit, Text: "darn it"}
+	err := WordFilterStage(f, FilterReject).Process(&msg)
+	var se *StageError
+	if !errors.As(err, &se) || se.Code != ErrCodeMessageFiltered {
+		t.Errorf("expected message_filtered rejection, got %v", err)
+	}
+	if msg.Text != "darn it" {
+		t.Errorf("expected rejected text untouched, got %q", msg.Text)
+	}
+
+	msg = Message{Type: MsgChat, Text: "fine"}
+	if err := WordFilterStage(f, FilterReject).Process(&msg); err != nil {
+		t.Errorf("expected clean message to pass, got %v", err)
+	}
+
+	msg = Message{Type: MsgStatus, Text: "darn"}
+	if err := WordFilterStage(f, FilterReject).Process(&msg); err != nil || msg.Text != "darn" {
+		t.Errorf("expected non-text types skipped, got %q, %v", msg.Text, err)
+	}
+}
+
+func TestParseWordList(t *testing.T) {
+	t.Parallel()
+	words, err := ParseWordList(strings.NewReader("# blocked\ndarn\n\n  heck  \nbad word\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if want := []string{"darn", "heck", "bad word"}; !slices.Equal(words, want) {
+		t.Errorf("expected %v, got %v", want, words)
+	}
+}
+
+func TestParseFilterMode(t *testing.T) {
+	t.Parallel()
+	if m, err := ParseFilterMode("Reject"); err != nil || m != FilterReject {
+		t.Errorf("expected reject, got %q, %v", m, err)
+	}
+	if _, err := ParseFilterMode("drop"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
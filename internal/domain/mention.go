@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MentionMessage tells a user they were @-mentioned in a room message. It
+// is sent only to the mentioned user's connections.
+type MentionMessage struct {
+	Type      string `json:"type"`
+	Room      string `json:"room"`
+	From      string `json:"from"`
+	MessageID string `json:"message_id"`
+}
+
+// ParseMentions returns the usernames @-mentioned in text, in order of first
+// appearance and without duplicates. A mention is an @ at the start of the
+// text or after a character that is not part of a name, followed by letters,
+// digits, '_', '-' or '.'. Trailing dots are sentence punctuation, not part
+// of the name, so "@bob." and "@bob," both mention bob, and an address such
+// as "alice@example.com" mentions nobody.
+func ParseMentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	prev := ' '
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		if r != '@' || isMentionRune(prev) {
+			prev = r
+			continue
+		}
+		end := i + strings.IndexFunc(text[i:], func(r rune) bool { return !isMentionRune(r) })
+		if end < i {
+			end = len(text)
+		}
+		name := strings.TrimRight(text[i:end], ".")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		prev = '@'
+		if end > i {
+			prev, _ = utf8.DecodeLastRuneInString(text[i:end])
+		}
+		i = end
+	}
+	return names
+}
+
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hi @bob", []string{"bob"}},
+		{"@bob, are you there?", []string{"bob"}},
+		{"thanks @bob.", []string{"bob"}},
+		{"ask @bob... or @carol!", []string{"bob", "carol"}},
+		{"(@bob) @bob @alice", []string{"bob", "alice"}},
+		{"@first.last and @under_score-dash", []string{"first.last", "under_score-dash"}},
+		{"@josé: ¿qué tal?", []string{"josé"}},
+		{"mail alice@example.com", nil},
+		{"@ alone and @@", nil},
+		{"@@bob", []string{"bob"}},
+		{"no mentions here", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseMentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMentions(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -2,27 +2,147 @@ package domain
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 )
 
+// ErrMessageNotFound is returned when a query references an unknown message id.
+var ErrMessageNotFound = errors.New("message not found")
+
 // Message types.
 const (
-	MsgChat    = "chat"
-	MsgJoin    = "join"
-	MsgLeave   = "leave"
-	MsgSystem  = "system"
-	MsgHistory = "history"
-	MsgPresence = "presence"
-	MsgError   = "error"
+	MsgChat      = "chat"
+	MsgJoin      = "join"
+	MsgLeave     = "leave"
+	MsgSystem    = "system"
+	MsgHistory   = "history"
+	MsgPresence  = "presence"
+	MsgError     = "error"
+	MsgHello     = "hello"
+	MsgWelcome   = "welcome"
+	MsgDelivered = "delivered"
+	MsgReact     = "react"
+	MsgAck       = "ack"
+	MsgRename    = "rename"
+	MsgNick      = "nick" // alias of rename accepted from clients
+	MsgLock      = "lock"
+	MsgUnlock    = "unlock"
+	MsgDM        = "dm"
+	MsgEdit      = "edit"
+	MsgDelete    = "delete"
+	MsgKick      = "kick"
+	MsgPing      = "ping"
+	MsgPong      = "pong"
+	MsgStatus    = "status"
+	MsgNack      = "nack"
+	MsgMention   = "mention"
+	MsgTopic     = "topic"
+	MsgWhoami    = "whoami"
+)
+
+// MsgDeleted is the type a soft-deleted message has in history: a tombstone
+// that keeps its place, with the text removed.
+const MsgDeleted = "deleted"
+
+// Incremental presence updates, sent to a room's existing members as users
+// arrive and go; joiners get a full MsgPresence snapshot instead.
+const (
+	MsgPresenceAdd    = "presence_add"
+	MsgPresenceRemove = "presence_remove"
+)
+
+// Error codes carried in ErrorMessage.Code so clients can react to specific
+// failures without matching on message text.
+const (
+	ErrCodeReactionEmojiLimit = "reaction_emoji_limit"
+	ErrCodeReactionUserLimit  = "reaction_user_limit"
+	ErrCodeServerBusy         = "server_busy"
+	ErrCodeTooManyErrors      = "too_many_errors"
+	ErrCodeNameTaken          = "name_taken"
+	ErrCodeRoomLocked         = "room_locked"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeUserOffline        = "user_offline"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeRoomFull           = "room_full"
+	ErrCodeBadPassword        = "bad_password"
+	ErrCodeBanned             = "banned"
+	ErrCodeKicked             = "kicked"
+	ErrCodeRoomClosed         = "room_closed"
+	ErrCodeMessageTooLarge    = "message_too_large"
+	ErrCodeJoinFailed         = "join_failed"
+	ErrCodeMessageFiltered    = "message_filtered"
+	ErrCodeInternal           = "internal_error"
+)
+
+// WebSocket close codes, from the 4000-4999 application range, sent with a
+// reason in the close frame when the server ends a connection.
+const (
+	CloseTooManyErrors = 4001 // protocol error limit reached
+	CloseBadHandshake  = 4002 // first message was not a valid hello
+	CloseIdle          = 4003 // no messages within the idle timeout
+	CloseRoomClosed    = 4004 // an admin closed a room the client was in
+	CloseSlowConsumer  = 4005 // still blocked on an earlier room broadcast
 )
 
+// ProtocolVersion is the current WebSocket protocol version announced in welcome.
+const ProtocolVersion = 1
+
 // Message represents a chat protocol message.
 type Message struct {
+	ID        string    `json:"id,omitempty"`
 	Type      string    `json:"type"`
 	Room      string    `json:"room,omitempty"`
 	User      string    `json:"user,omitempty"`
 	Text      string    `json:"text,omitempty"`
 	Timestamp time.Time `json:"timestamp,omitempty"`
+	Origin    string    `json:"origin,omitempty"`
+	Receipt   bool      `json:"receipt,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Emoji     string    `json:"emoji,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	RoomMode  string    `json:"room_mode,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`      // per-connection frame number under ack flow control
+	Name      string    `json:"name,omitempty"`     // sender's display name, if it differs from User
+	To        string    `json:"to,omitempty"`       // recipient of a direct message
+	Password  string    `json:"password,omitempty"` // room password, on join only
+	State     string    `json:"state,omitempty"`    // requested presence status, on status only
+
+	ClientMsgID string `json:"client_msg_id,omitempty"` // sender's id for the chat, answered with ack or nack
+	SinceID     string `json:"since_id,omitempty"`      // last message id the client has, on join only
+	ReplyTo     string `json:"reply_to,omitempty"`      // id of the message a chat replies to
+
+	Rooms []string `json:"rooms,omitempty"` // rooms to join at once, on join only
+}
+
+// Thread is a message and its direct replies, oldest first.
+type Thread struct {
+	Parent  Message   `json:"parent"`
+	Replies []Message `json:"replies"`
+}
+
+// MessageEdit is a prior version of an edited message: the text it had
+// until it was replaced at EditedAt.
+type MessageEdit struct {
+	MessageID string    `json:"message_id"`
+	Text      string    `json:"text"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// Room modes, chosen by the join request that creates a room. The empty
+// mode persists messages and removes the room once it is empty.
+const (
+	RoomModeDefault    = ""
+	RoomModeEphemeral  = "ephemeral"  // never persisted, no history, removed when empty
+	RoomModePersistent = "persistent" // persisted, kept when empty
+)
+
+// ValidRoomMode reports whether mode is a known room mode.
+func ValidRoomMode(mode string) bool {
+	switch mode {
+	case RoomModeDefault, RoomModeEphemeral, RoomModePersistent:
+		return true
+	}
+	return false
 }
 
 // HistoryMessage is sent to a client upon joining a room.
@@ -36,12 +156,101 @@ type HistoryMessage struct {
 type PresenceMessage struct {
 	Type  string   `json:"type"`
 	Room  string   `json:"room"`
-	Users []string `json:"users"`
+	Topic string   `json:"topic,omitempty"`
+	Users []string `json:"users"` // sorted, each user listed once
+	// Members carries per-user connection counts when the server is
+	// configured to include them.
+	Members []PresenceMember `json:"members,omitempty"`
+	// Names maps usernames to display names for users who have set one.
+	Names map[string]string `json:"names,omitempty"`
+	// Statuses maps usernames to their presence status for users who are
+	// not online; users missing from it are online.
+	Statuses map[string]string `json:"statuses,omitempty"`
+}
+
+// PresenceDiff adds a user to, or removes one from, the roster a member got
+// in its presence snapshot. A presence_add for a user already listed
+// replaces that entry, for example with a new connection count.
+type PresenceDiff struct {
+	Type   string `json:"type"` // MsgPresenceAdd or MsgPresenceRemove
+	Room   string `json:"room"`
+	User   string `json:"user"`
+	Name   string `json:"name,omitempty"`   // display name, if set
+	Status string `json:"status,omitempty"` // omitted when online
+	// Connections is the user's connection count, sent when the server is
+	// configured to include them.
+	Connections int `json:"connections,omitempty"`
+}
+
+// PresenceMember is one user's entry in a presence snapshot.
+type PresenceMember struct {
+	User        string `json:"user"`
+	Connections int    `json:"connections"`
+}
+
+// HelloMessage is the first message a client sends when the server requires a handshake.
+type HelloMessage struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// WelcomeMessage acknowledges a hello with the negotiated protocol version and capabilities.
+type WelcomeMessage struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// DeliveredMessage answers a chat sent with "receipt": true, telling the
+// sender how many other room members the message was enqueued to. The
+// sender's own connection is not counted.
+type DeliveredMessage struct {
+	Type  string `json:"type"`
+	Room  string `json:"room"`
+	ID    string `json:"id"`
+	Count int    `json:"count"`
+}
+
+// AckMessage answers a chat sent with a client_msg_id, to the sender only:
+// an ack with the server-assigned id once the message is stored, or a nack
+// with the reason it was not.
+type AckMessage struct {
+	Type        string `json:"type"`
+	ClientMsgID string `json:"client_msg_id"`
+	ID          string `json:"id,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// PongMessage answers an application-level ping, echoing its opaque id so
+// the client can measure round-trip latency.
+type PongMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// WhoamiMessage answers a whoami request with the connection's user and the
+// rooms it is in, sorted by name.
+type WhoamiMessage struct {
+	Type  string   `json:"type"`
+	User  string   `json:"user"`
+	Rooms []string `json:"rooms"`
 }
 
 // ErrorMessage reports an error to the client.
 type ErrorMessage struct {
 	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	// Rooms lists the rooms of a multi-room join that could not be joined,
+	// with code ErrCodeJoinFailed.
+	Rooms []RoomError `json:"rooms,omitempty"`
+}
+
+// RoomError is why one room of a multi-room join was refused.
+type RoomError struct {
+	Room    string `json:"room"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
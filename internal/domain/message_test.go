@@ -81,6 +81,35 @@ func TestPresenceMessageEncode(t *testing.T) {
 	if _, ok := raw["users"]; !ok {
 		t.Error("expected users field in presence message")
 	}
+	if _, ok := raw["statuses"]; ok {
+		t.Error("expected statuses omitted when everyone is online")
+	}
+}
+
+func TestPresenceMessageEncodeStatuses(t *testing.T) {
+	t.Parallel()
+	pm := PresenceMessage{
+		Type:     MsgPresence,
+		Room:     "general",
+		Users:    []string{"alice", "bob"},
+		Statuses: map[string]string{"bob": StatusAway},
+	}
+	data, err := Encode(pm)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	want := `{"type":"presence","room":"general","users":["alice","bob"],"statuses":{"bob":"away"}}`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	var decoded PresenceMessage
+	if err := json.Unmarshal([]byte(`{"type":"presence","room":"general","users":["alice"]}`), &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if decoded.Statuses != nil || len(decoded.Users) != 1 {
+		t.Errorf("expected an old-style frame to decode with no statuses, got %+v", decoded)
+	}
 }
 
 func TestErrorMessageEncode(t *testing.T) {
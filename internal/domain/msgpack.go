@@ -0,0 +1,249 @@
+package domain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// errMsgpackTruncated is returned when a msgpack value ends early.
+var errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+
+// appendMsgpackNumber appends a JSON number as an integer when it is one,
+// and as a float64 otherwise.
+func appendMsgpackNumber(b []byte, num string) ([]byte, error) {
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return appendMsgpackInt(b, n), nil
+	}
+	if n, err := strconv.ParseUint(num, 10, 64); err == nil {
+		return appendMsgpackUint(b, n), nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, 0xcb)
+	return binary.BigEndian.AppendUint64(b, math.Float64bits(f)), nil
+}
+
+func appendMsgpackUint(b []byte, n uint64) []byte {
+	if n <= math.MaxInt64 {
+		return appendMsgpackInt(b, int64(n))
+	}
+	b = append(b, 0xcf)
+	return binary.BigEndian.AppendUint64(b, n)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	b = append(b, 0xd3)
+	return binary.BigEndian.AppendUint64(b, uint64(n))
+}
+
+func appendMsgpackString[S ~string | ~[]byte](b []byte, s S) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackHeader writes an array or map length using the fix, 16-bit
+// or 32-bit form.
+func appendMsgpackHeader(b []byte, n int, fix, b16, b32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, b16)
+		return binary.BigEndian.AppendUint16(b, uint16(n))
+	}
+	b = append(b, b32)
+	return binary.BigEndian.AppendUint32(b, uint32(n))
+}
+
+// decodeMsgpack decodes a single msgpack value into nil, bool, int64,
+// uint64, float64, string, []any or map[string]any. Binary values decode
+// as strings; extension types and non-string map keys are rejected.
+func decodeMsgpack(data []byte) (any, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return v, nil
+}
+
+// maxMsgpackDepth bounds nesting so hostile input cannot exhaust the stack.
+const maxMsgpackDepth = 64
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads an n-byte big-endian unsigned integer.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	tb, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := tb[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t&0x0f), depth)
+	case t&0xf0 == 0x80:
+		return d.object(int(t&0x0f), depth)
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (t - 0xcc))
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := 1
+		switch t {
+		case 0xda, 0xc5:
+			size = 2
+		case 0xdb, 0xc6:
+			size = 4
+		}
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", t)
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n, depth int) (any, error) {
+	// Every element takes at least one byte, which bounds n by the input.
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	items := make([]any, n)
+	for i := range items {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = v
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) object(n, depth int) (any, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackTruncated
+	}
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map key is not a string")
+		}
+		if m[key], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,432 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The msgpack codec's fast paths. Chat traffic is Messages coming in and
+// frames already encoded as JSON going out, so those are converted
+// directly rather than through a decoded JSON tree. The output matches the
+// general path: the same keys, omitted when JSON omits them, in sorted
+// order.
+
+// appendMessage appends m as a msgpack map with Message's JSON keys.
+func appendMessage(b []byte, m *Message) []byte {
+	n := 2 // timestamp and type are never omitted
+	for _, v := range [...]string{
+		m.ClientID, m.ClientMsgID, m.Emoji, m.ID, m.MessageID, m.Name, m.Origin,
+		m.Password, m.ReplyTo, m.Room, m.RoomMode, m.SinceID, m.State, m.Text,
+		m.To, m.User,
+	} {
+		if v != "" {
+			n++
+		}
+	}
+	if m.Receipt {
+		n++
+	}
+	if len(m.Rooms) > 0 {
+		n++
+	}
+	if m.Seq != 0 {
+		n++
+	}
+
+	str := func(k, v string) {
+		if v != "" {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpackString(b, v)
+		}
+	}
+	b = appendMsgpackHeader(b, n, 0x80, 0xde, 0xdf)
+	str("client_id", m.ClientID)
+	str("client_msg_id", m.ClientMsgID)
+	str("emoji", m.Emoji)
+	str("id", m.ID)
+	str("message_id", m.MessageID)
+	str("name", m.Name)
+	str("origin", m.Origin)
+	str("password", m.Password)
+	if m.Receipt {
+		b = appendMsgpackString(b, "receipt")
+		b = append(b, 0xc3)
+	}
+	str("reply_to", m.ReplyTo)
+	str("room", m.Room)
+	str("room_mode", m.RoomMode)
+	if len(m.Rooms) > 0 {
+		b = appendMsgpackString(b, "rooms")
+		b = appendMsgpackHeader(b, len(m.Rooms), 0x90, 0xdc, 0xdd)
+		for _, room := range m.Rooms {
+			b = appendMsgpackString(b, room)
+		}
+	}
+	if m.Seq != 0 {
+		b = appendMsgpackString(b, "seq")
+		b = appendMsgpackUint(b, m.Seq)
+	}
+	str("since_id", m.SinceID)
+	str("state", m.State)
+	str("text", m.Text)
+	b = appendMsgpackString(b, "timestamp")
+	var ts [len(time.RFC3339Nano) + 8]byte
+	b = appendMsgpackString(b, m.Timestamp.AppendFormat(ts[:0], time.RFC3339Nano))
+	str("to", m.To)
+	b = appendMsgpackString(b, "type")
+	b = appendMsgpackString(b, m.Type)
+	str("user", m.User)
+	return b
+}
+
+// decodeMessage decodes a msgpack map into m, setting the fields whose JSON
+// keys it holds. Like encoding/json, it matches keys case-insensitively,
+// ignores unknown ones and leaves fields alone for nil values.
+func decodeMessage(data []byte, m *Message) error {
+	d := msgpackDecoder{data: data}
+	n, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+	for range n {
+		k, err := d.value(1)
+		if err != nil {
+			return err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return errors.New("msgpack: map key is not a string")
+		}
+		v, err := d.value(1)
+		if err != nil {
+			return err
+		}
+		if err := m.setMsgpackField(key, v); err != nil {
+			return err
+		}
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
+
+// mapLen reads a map header, returning 0 for nil.
+func (d *msgpackDecoder) mapLen() (int, error) {
+	tb, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch t := tb[0]; {
+	case t == 0xc0:
+		return 0, nil
+	case t&0xf0 == 0x80:
+		n = uint64(t & 0x0f)
+	case t == 0xde || t == 0xdf:
+		if n, err = d.uint(2 << (t - 0xde)); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("msgpack: cannot decode type 0x%02x into a message", t)
+	}
+	if n > uint64(len(d.data)-d.pos)/2 {
+		return 0, errMsgpackTruncated
+	}
+	return int(n), nil
+}
+
+func (m *Message) setMsgpackField(key string, v any) error {
+	if v == nil {
+		return nil
+	}
+	var dst *string
+	switch key {
+	case "id":
+		dst = &m.ID
+	case "type":
+		dst = &m.Type
+	case "room":
+		dst = &m.Room
+	case "user":
+		dst = &m.User
+	case "text":
+		dst = &m.Text
+	case "origin":
+		dst = &m.Origin
+	case "message_id":
+		dst = &m.MessageID
+	case "emoji":
+		dst = &m.Emoji
+	case "client_id":
+		dst = &m.ClientID
+	case "room_mode":
+		dst = &m.RoomMode
+	case "name":
+		dst = &m.Name
+	case "to":
+		dst = &m.To
+	case "password":
+		dst = &m.Password
+	case "state":
+		dst = &m.State
+	case "client_msg_id":
+		dst = &m.ClientMsgID
+	case "since_id":
+		dst = &m.SinceID
+	case "reply_to":
+		dst = &m.ReplyTo
+	case "timestamp":
+		s, ok := v.(string)
+		if !ok {
+			return msgpackFieldError(key, v)
+		}
+		return m.Timestamp.UnmarshalText([]byte(s))
+	case "receipt":
+		b, ok := v.(bool)
+		if !ok {
+			return msgpackFieldError(key, v)
+		}
+		m.Receipt = b
+		return nil
+	case "seq":
+		switch n := v.(type) {
+		case uint64:
+			m.Seq = n
+		case int64:
+			if n < 0 {
+				return msgpackFieldError(key, v)
+			}
+			m.Seq = uint64(n)
+		default:
+			return msgpackFieldError(key, v)
+		}
+		return nil
+	case "rooms":
+		items, ok := v.([]any)
+		if !ok {
+			return msgpackFieldError(key, v)
+		}
+		m.Rooms = make([]string, len(items))
+		for i, item := range items {
+			if m.Rooms[i], ok = item.(string); !ok {
+				return msgpackFieldError(key, v)
+			}
+		}
+		return nil
+	default:
+		if lower := strings.ToLower(key); lower != key {
+			return m.setMsgpackField(lower, v)
+		}
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return msgpackFieldError(key, v)
+	}
+	*dst = s
+	return nil
+}
+
+func msgpackFieldError(key string, v any) error {
+	return fmt.Errorf("msgpack: cannot decode %T into message field %q", v, key)
+}
+
+// transcodeJSON appends the msgpack form of a single JSON value to b.
+func transcodeJSON(b, data []byte) ([]byte, error) {
+	t := jsonTranscoder{data: data}
+	b, err := t.value(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.skipSpace()
+	if t.pos != len(t.data) {
+		return nil, errors.New("json: trailing data")
+	}
+	return b, nil
+}
+
+var errJSONTruncated = errors.New("json: unexpected end of data")
+
+type jsonTranscoder struct {
+	data []byte
+	pos  int
+}
+
+func (t *jsonTranscoder) skipSpace() {
+	for t.pos < len(t.data) {
+		switch t.data[t.pos] {
+		case ' ', '\t', '\n', '\r':
+			t.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (t *jsonTranscoder) value(b []byte, depth int) ([]byte, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("json: nesting too deep")
+	}
+	t.skipSpace()
+	if t.pos >= len(t.data) {
+		return nil, errJSONTruncated
+	}
+	switch c := t.data[t.pos]; c {
+	case '{':
+		return t.object(b, depth)
+	case '[':
+		return t.array(b, depth)
+	case '"':
+		s, err := t.str()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpackString(b, s), nil
+	case 't':
+		return b, t.literal(&b, "true", 0xc3)
+	case 'f':
+		return b, t.literal(&b, "false", 0xc2)
+	case 'n':
+		return b, t.literal(&b, "null", 0xc0)
+	}
+	start := t.pos
+	for t.pos < len(t.data) && strings.IndexByte("+-.0123456789eE", t.data[t.pos]) >= 0 {
+		t.pos++
+	}
+	if t.pos == start {
+		return nil, fmt.Errorf("json: unexpected %q", t.data[start])
+	}
+	return appendMsgpackNumber(b, string(t.data[start:t.pos]))
+}
+
+func (t *jsonTranscoder) literal(b *[]byte, word string, tag byte) error {
+	if !bytes.HasPrefix(t.data[t.pos:], []byte(word)) {
+		return fmt.Errorf("json: invalid literal at offset %d", t.pos)
+	}
+	t.pos += len(word)
+	*b = append(*b, tag)
+	return nil
+}
+
+// str reads a string, returning the raw bytes when it has no escapes.
+func (t *jsonTranscoder) str() ([]byte, error) {
+	start := t.pos
+	t.pos++
+	escaped := false
+	for t.pos < len(t.data) {
+		switch t.data[t.pos] {
+		case '\\':
+			escaped = true
+			t.pos += 2
+			continue
+		case '"':
+			t.pos++
+			if !escaped {
+				return t.data[start+1 : t.pos-1], nil
+			}
+			var s string
+			if err := json.Unmarshal(t.data[start:t.pos], &s); err != nil {
+				return nil, err
+			}
+			return []byte(s), nil
+		}
+		t.pos++
+	}
+	return nil, errJSONTruncated
+}
+
+// expect skips space and reports whether the next byte is c, consuming it.
+func (t *jsonTranscoder) expect(c byte) bool {
+	t.skipSpace()
+	if t.pos < len(t.data) && t.data[t.pos] == c {
+		t.pos++
+		return true
+	}
+	return false
+}
+
+// seq reads the members of an array or object up to end, calling member
+// for each, and returns how many there were.
+func (t *jsonTranscoder) seq(end byte, member func() error) (int, error) {
+	t.pos++ // the opening bracket
+	if t.expect(end) {
+		return 0, nil
+	}
+	for n := 1; ; n++ {
+		if err := member(); err != nil {
+			return 0, err
+		}
+		if t.expect(end) {
+			return n, nil
+		}
+		if !t.expect(',') {
+			return 0, fmt.Errorf("json: expected ',' or %q at offset %d", end, t.pos)
+		}
+	}
+}
+
+func (t *jsonTranscoder) array(b []byte, depth int) ([]byte, error) {
+	start := len(b)
+	n, err := t.seq(']', func() (err error) {
+		b, err = t.value(b, depth+1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	header := appendMsgpackHeader(nil, n, 0x90, 0xdc, 0xdd)
+	return slices.Insert(b, start, header...), nil
+}
+
+// objectMember is where an encoded key and value sit in the output.
+type objectMember struct {
+	key        []byte
+	start, end int
+}
+
+func (t *jsonTranscoder) object(b []byte, depth int) ([]byte, error) {
+	start := len(b)
+	var members []objectMember
+	_, err := t.seq('}', func() error {
+		t.skipSpace()
+		if t.pos >= len(t.data) || t.data[t.pos] != '"' {
+			return fmt.Errorf("json: expected key at offset %d", t.pos)
+		}
+		key, err := t.str()
+		if err != nil {
+			return err
+		}
+		if !t.expect(':') {
+			return fmt.Errorf("json: expected ':' at offset %d", t.pos)
+		}
+		m := objectMember{key: key, start: len(b)}
+		b = appendMsgpackString(b, key)
+		if b, err = t.value(b, depth+1); err != nil {
+			return err
+		}
+		m.end = len(b)
+		members = append(members, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := func(x, y objectMember) int { return bytes.Compare(x.key, y.key) }
+	if !slices.IsSortedFunc(members, byKey) {
+		encoded := slices.Clone(b[start:])
+		slices.SortStableFunc(members, byKey)
+		b = b[:start]
+		for _, m := range members {
+			b = append(b, encoded[m.start-start:m.end-start]...)
+		}
+	}
+	header := appendMsgpackHeader(nil, len(members), 0x80, 0xde, 0xdf)
+	return slices.Insert(b, start, header...), nil
+}
@@ -0,0 +1,23 @@
+package domain
+
+import "testing"
+
+func TestHashPassword(t *testing.T) {
+	t.Parallel()
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if !CheckPassword(hash, "hunter2") {
+		t.Error("expected the password to match its hash")
+	}
+	if CheckPassword(hash, "hunter3") {
+		t.Error("expected a different password not to match")
+	}
+	if CheckPassword("not-a-hash", "hunter2") {
+		t.Error("expected a malformed hash never to match")
+	}
+	if again, _ := HashPassword("hunter2"); again == hash {
+		t.Error("expected hashes of the same password to differ by salt")
+	}
+}
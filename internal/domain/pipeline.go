@@ -0,0 +1,77 @@
+package domain
+
+import "errors"
+
+// ErrTextRequired rejects a chat message whose text is empty after
+// normalization.
+var ErrTextRequired = errors.New("text required")
+
+// MessageStage is one step of an inbound message pipeline. Process may
+// mutate msg in place; returning an error rejects the message and stops the
+// pipeline. Return a *StageError to give the sender a machine-readable code.
+type MessageStage interface {
+	Process(msg *Message) error
+}
+
+// StageFunc adapts a function to a MessageStage.
+type StageFunc func(msg *Message) error
+
+// Process calls f(msg).
+func (f StageFunc) Process(msg *Message) error {
+	return f(msg)
+}
+
+// StageError rejects a message with an error code for ErrorMessage.Code.
+type StageError struct {
+	Code    string
+	Message string
+}
+
+func (e *StageError) Error() string {
+	return e.Message
+}
+
+// Pipeline runs stages in order until one rejects the message.
+type Pipeline []MessageStage
+
+// Process runs every stage against msg, returning the first rejection.
+func (p Pipeline) Process(msg *Message) error {
+	for _, s := range p {
+		if err := s.Process(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carriesText reports whether messages of type t carry user-written text
+// that the built-in stages check.
+func carriesText(t string) bool {
+	return t == MsgChat || t == MsgDM || t == MsgEdit
+}
+
+// NormalizeStage applies NormalizeText to chat messages, direct messages and
+// edits, and rejects those left empty.
+func NormalizeStage() MessageStage {
+	return StageFunc(func(msg *Message) error {
+		if !carriesText(msg.Type) {
+			return nil
+		}
+		msg.Text = NormalizeText(msg.Text)
+		if msg.Text == "" {
+			return ErrTextRequired
+		}
+		return nil
+	})
+}
+
+// ValidateStage applies ValidateMessage to chat messages, direct messages
+// and edits.
+func ValidateStage(maxTextLen int) MessageStage {
+	return StageFunc(func(msg *Message) error {
+		if !carriesText(msg.Type) {
+			return nil
+		}
+		return ValidateMessage(*msg, maxTextLen)
+	})
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPipelineOrderAndMutation(t *testing.T) {
+	t.Parallel()
+	var order []string
+	stage := func(name string) MessageStage {
+		return StageFunc(func(msg *Message) error {
+			order = append(order, name)
+			msg.Text += name
+			return nil
+		})
+	}
+	p := Pipeline{stage("a"), stage("b"), stage("c")}
+
+	msg := Message{Type: MsgChat, Text: ">"}
+	if err := p.Process(&msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(order, "") != "abc" {
+		t.Errorf("expected stages in order abc, got %v", order)
+	}
+	if msg.Text != ">abc" {
+		t.Errorf("expected each stage to see the previous mutation, got %q", msg.Text)
+	}
+}
+
+func TestPipelineRejectionStops(t *testing.T) {
+	t.Parallel()
+	reached := false
+	p := Pipeline{
+		StageFunc(func(msg *Message) error {
+			return &StageError{Code: "blocked", Message: "blocked word"}
+		}),
+		StageFunc(func(msg *Message) error {
+			reached = true
+			return nil
+		}),
+	}
+
+	err := p.Process(&Message{Type: MsgChat, Text: "hi"})
+	var se *StageError
+	if !errors.As(err, &se) || se.Code != "blocked" {
+		t.Fatalf("expected StageError with code blocked, got %v", err)
+	}
+	if reached {
+		t.Error("expected stages after a rejection not to run")
+	}
+}
+
+func TestBuiltinStages(t *testing.T) {
+	t.Parallel()
+	msg := Message{Type: MsgChat, Text: "  hi  "}
+	if err := NormalizeStage().Process(&msg); err != nil || msg.Text != "hi" {
+		t.Errorf("expected normalized text, got %q, %v", msg.Text, err)
+	}
+	blank := Message{Type: MsgChat, Text: " \n "}
+	if err := NormalizeStage().Process(&blank); err != ErrTextRequired {
+		t.Errorf("expected ErrTextRequired, got %v", err)
+	}
+	long := Message{Type: MsgChat, Text: "hello"}
+	if err := ValidateStage(3).Process(&long); err != ErrTextTooLong {
+		t.Errorf("expected ErrTextTooLong, got %v", err)
+	}
+	system := Message{Type: MsgSystem, Text: "hello"}
+	if err := ValidateStage(3).Process(&system); err != nil {
+		t.Errorf("expected non-chat messages to pass, got %v", err)
+	}
+}
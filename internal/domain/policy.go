@@ -0,0 +1,44 @@
+package domain
+
+import "strings"
+
+// TypePolicy decides, per message type, whether routed messages are
+// persisted and whether stored messages are replayed in join history.
+// A nil History set includes every stored type.
+type TypePolicy struct {
+	Persist map[string]bool
+	History map[string]bool
+}
+
+// DefaultTypePolicy persists chat and direct messages and replays
+// everything stored.
+func DefaultTypePolicy() TypePolicy {
+	return TypePolicy{Persist: map[string]bool{MsgChat: true, MsgDM: true}}
+}
+
+// ShouldPersist reports whether messages of type t are saved to the store.
+func (p TypePolicy) ShouldPersist(t string) bool {
+	return p.Persist[t]
+}
+
+// IncludeInHistory reports whether stored messages of type t are sent to joiners.
+func (p TypePolicy) IncludeInHistory(t string) bool {
+	return p.History == nil || p.History[t]
+}
+
+// ParseTypeSet parses a comma-separated list of message types. An empty
+// string yields nil.
+func ParseTypeSet(s string) map[string]bool {
+	var set map[string]bool
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[t] = true
+	}
+	return set
+}
@@ -0,0 +1,28 @@
+package domain
+
+import "testing"
+
+func TestDefaultTypePolicy(t *testing.T) {
+	t.Parallel()
+	p := DefaultTypePolicy()
+	if !p.ShouldPersist(MsgChat) || !p.ShouldPersist(MsgDM) {
+		t.Error("expected chat and dm to be persisted by default")
+	}
+	if p.ShouldPersist(MsgSystem) {
+		t.Error("expected system not to be persisted by default")
+	}
+	if !p.IncludeInHistory(MsgChat) || !p.IncludeInHistory(MsgSystem) {
+		t.Error("expected all stored types in history by default")
+	}
+}
+
+func TestParseTypeSet(t *testing.T) {
+	t.Parallel()
+	set := ParseTypeSet(" chat, system ,,")
+	if len(set) != 2 || !set[MsgChat] || !set[MsgSystem] {
+		t.Errorf("unexpected set: %v", set)
+	}
+	if ParseTypeSet("") != nil {
+		t.Error("expected nil for empty string")
+	}
+}
@@ -1,8 +1,74 @@
 package domain
 
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Room lookup errors.
+var (
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound = errors.New("room not found")
+)
+
+// MaxRoomNameLen is the longest room name accepted, in characters.
+const MaxRoomNameLen = 64
+
+// Room name validation errors returned by ValidateRoomName.
+var (
+	ErrRoomNameEmpty   = errors.New("room name required")
+	ErrRoomNameTooLong = errors.New("room name too long (max 64 characters)")
+	ErrRoomNameInvalid = errors.New("room name may only contain letters, digits, '-' and '_'")
+)
+
+// ValidateRoomName checks a client-supplied room name and returns it in
+// canonical lowercase form, so "General" and "general" are the same room.
+// Names are 1 to MaxRoomNameLen ASCII letters, digits, dashes, and
+// underscores.
+func ValidateRoomName(name string) (string, error) {
+	if name == "" {
+		return "", ErrRoomNameEmpty
+	}
+	name = NormalizeRoomName(name)
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return "", ErrRoomNameInvalid
+		}
+	}
+	if len(name) > MaxRoomNameLen {
+		return "", ErrRoomNameTooLong
+	}
+	return name, nil
+}
+
+// NormalizeRoomName returns the canonical form of a room name for lookups,
+// matching what ValidateRoomName stores, without rejecting invalid names.
+// Direct-message room names embed user names and are returned unchanged.
+func NormalizeRoomName(name string) string {
+	if IsDMRoom(name) {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
 // Room represents a chat room.
 type Room struct {
-	Name       string `json:"name"`
-	UserCount  int    `json:"user_count"`
-	MessageCount int  `json:"message_count,omitempty"`
+	Name         string `json:"name"`
+	Topic        string `json:"topic,omitempty"`
+	UserCount    int    `json:"user_count"`
+	MessageCount int    `json:"message_count,omitempty"`
+	// Private is set for rooms that need a password to join.
+	Private bool `json:"private"`
+	// CreatedAt is when the room was created; it is left out for rooms
+	// known only from stored history.
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// PollResult answers a long-poll for a room's messages. Seq is the room's
+// latest message sequence number; pass it as after_seq on the next poll.
+type PollResult struct {
+	Room     string    `json:"room"`
+	Messages []Message `json:"messages"`
+	Seq      uint64    `json:"seq"`
 }
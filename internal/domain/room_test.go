@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRoomName(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr error
+	}{
+		{"lowercase", "general", "general", nil},
+		{"mixed case folded", "General", "general", nil},
+		{"dash and underscore", "team-a_ops", "team-a_ops", nil},
+		{"digits", "room2", "room2", nil},
+		{"at max length", strings.Repeat("a", MaxRoomNameLen), strings.Repeat("a", MaxRoomNameLen), nil},
+		{"empty", "", "", ErrRoomNameEmpty},
+		{"over max length", strings.Repeat("a", MaxRoomNameLen+1), "", ErrRoomNameTooLong},
+		{"whitespace", "  ", "", ErrRoomNameInvalid},
+		{"space inside", "my room", "", ErrRoomNameInvalid},
+		{"control character", "gen\neral", "", ErrRoomNameInvalid},
+		{"dm room", "dm:alice:bob", "", ErrRoomNameInvalid},
+		{"non-ascii letter", "café", "", ErrRoomNameInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ValidateRoomName(tt.in)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("ValidateRoomName(%q) = %q, %v, want %q, %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
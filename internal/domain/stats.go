@@ -0,0 +1,41 @@
+package domain
+
+import "time"
+
+// Server load modes reported in Stats.
+const (
+	ModeNormal = "normal"
+	ModeBusy   = "busy"
+)
+
+// Stats is a snapshot of server load.
+type Stats struct {
+	Mode                 string `json:"mode"`
+	Connections          int    `json:"connections"`
+	MaxConnections       int    `json:"max_connections"` // MAX_CONNECTIONS; 0 is unlimited
+	QueueDepth           int    `json:"queue_depth"`
+	PendingRegistrations int    `json:"pending_registrations"` // joins within QueueDepth
+	Rooms                int    `json:"rooms"`
+	ControlFrameErrors   int64  `json:"control_frame_errors"` // connections dropped for malformed control frames
+
+	Clients        int   `json:"clients"`         // connected clients, whatever rooms they are in
+	Memberships    int64 `json:"memberships"`     // room memberships; a client in two rooms counts twice
+	MessagesRouted int64 `json:"messages_routed"` // room and direct messages delivered since start
+	UptimeSeconds  int64 `json:"uptime_seconds"`
+	Goroutines     int   `json:"goroutines"`
+
+	DroppedMessages int64 `json:"dropped_messages"` // chat frames dropped because the hub queue was full
+}
+
+// UserList is a page of usernames. Next, when set, is the cursor for the
+// following page.
+type UserList struct {
+	Users []string `json:"users"`
+	Next  string   `json:"next,omitempty"`
+}
+
+// LastSeen reports when a user was last active.
+type LastSeen struct {
+	User     string    `json:"user"`
+	LastSeen time.Time `json:"last_seen"`
+}
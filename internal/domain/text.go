@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxBlankLines is the number of consecutive blank lines kept by NormalizeText.
+const maxBlankLines = 1
+
+// NormalizeText cleans up chat text before it is persisted or broadcast.
+// It converts CRLF line endings to LF, trims surrounding whitespace,
+// collapses runs of blank lines down to a single blank line, and normalizes
+// the result to Unicode NFC. Internal spacing and indentation are preserved.
+func NormalizeText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimSpace(text)
+
+	lines := strings.Split(text, "\n")
+	out := make([]string, 0, len(lines))
+	blank := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			blank++
+			if blank > maxBlankLines {
+				continue
+			}
+			line = ""
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+
+	return norm.NFC.String(strings.Join(out, "\n"))
+}
+
+// Validation errors returned by ValidateMessage.
+var (
+	ErrTextTooLong = errors.New("text too long")
+	ErrInvalidText = errors.New("text is not valid UTF-8")
+)
+
+// ValidateMessage checks a client-supplied message's text. Length is counted
+// in runes rather than bytes, so emoji and CJK text get the same allowance as
+// ASCII. A maxTextLen of zero or less disables the length check.
+func ValidateMessage(msg Message, maxTextLen int) error {
+	if !utf8.ValidString(msg.Text) {
+		return ErrInvalidText
+	}
+	if maxTextLen > 0 && utf8.RuneCountInString(msg.Text) > maxTextLen {
+		return ErrTextTooLong
+	}
+	return nil
+}
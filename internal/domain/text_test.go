@@ -0,0 +1,73 @@
+package domain
+
+import "testing"
+
+func TestNormalizeText(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"surrounding whitespace", "\n\t  hello  \t\n", "hello"},
+		{"crlf", "a\r\nb", "a\nb"},
+		{"collapse blank lines", "a\n\n\n\n\nb", "a\n\nb"},
+		{"whitespace-only lines", "a\n \n\t\n  \nb", "a\n\nb"},
+		{"keeps indentation", "code:\n    x := 1", "code:\n    x := 1"},
+		{"nfc", "café", "café"},
+		{"empty", "   \n\n ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := NormalizeText(tt.in); got != tt.want {
+				t.Errorf("NormalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMessageCountsRunes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		text string
+		max  int
+		want error
+	}{
+		{"ascii at limit", "hello", 5, nil},
+		{"ascii over limit", "hello!", 5, ErrTextTooLong},
+		{"emoji at limit", "😀😀😀😀😀", 5, nil},
+		{"emoji over limit", "😀😀😀😀😀😀", 5, ErrTextTooLong},
+		{"cjk at limit", "你好世界吗", 5, nil},
+		{"cjk over limit", "你好世界吗啊", 5, ErrTextTooLong},
+		{"unlimited", "😀😀😀😀😀😀", 0, nil},
+		{"invalid utf8", "bad\xffbyte", 100, ErrInvalidText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := ValidateMessage(Message{Type: MsgChat, Text: tt.text}, tt.max)
+			if err != tt.want {
+				t.Errorf("ValidateMessage(%q, %d) = %v, want %v", tt.text, tt.max, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultibyteRoundTrip(t *testing.T) {
+	t.Parallel()
+	text := "héllo 👋🏽 世界 — 🇯🇵"
+	data, err := Encode(Message{Type: MsgChat, Text: text})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if decoded.Text != text {
+		t.Errorf("round trip: got %q, want %q", decoded.Text, text)
+	}
+}
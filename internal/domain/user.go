@@ -1,6 +1,60 @@
 package domain
 
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
 // User represents a connected chat user.
 type User struct {
 	Name string `json:"name"`
 }
+
+// Presence statuses a client can set. Every connection starts online.
+const (
+	StatusOnline = "online"
+	StatusAway   = "away"
+	StatusBusy   = "busy"
+)
+
+// ErrInvalidStatus rejects a status other than online, away, or busy.
+var ErrInvalidStatus = errors.New("status must be online, away, or busy")
+
+// ValidStatus reports whether s is a known presence status.
+func ValidStatus(s string) bool {
+	switch s {
+	case StatusOnline, StatusAway, StatusBusy:
+		return true
+	}
+	return false
+}
+
+// MaxDisplayNameLen is the longest display name, in runes, a client may set.
+const MaxDisplayNameLen = 32
+
+// Display name errors returned by CleanDisplayName and renames.
+var (
+	ErrInvalidName = errors.New("display name must be 1-32 printable characters")
+	ErrNameTaken   = errors.New("display name already in use")
+)
+
+// CleanDisplayName trims and NFC-normalizes a requested display name and
+// checks that it is non-empty, at most MaxDisplayNameLen runes, and free of
+// control characters.
+func CleanDisplayName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidName
+	}
+	name = norm.NFC.String(strings.TrimSpace(name))
+	if name == "" || utf8.RuneCountInString(name) > MaxDisplayNameLen {
+		return "", ErrInvalidName
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
@@ -1,11 +1,36 @@
 package handler
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/metrics"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// Page sizes for the REST history, search, and user list endpoints.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 100
+	defaultUsersLimit   = 100
+	maxUsersLimit       = 1000
+
+	defaultMultiHistoryLimit = 10
+	maxMultiHistoryLimit     = 50
+	maxMultiHistoryRooms     = 20
 )
 
 // Health returns a simple health check handler.
@@ -25,11 +50,360 @@ func ListRooms(h *hub.Hub) http.HandlerFunc {
 	}
 }
 
+// AllRooms returns live rooms merged with rooms that only have stored
+// history, ordered by name. History-only rooms have a user_count of 0.
+func AllRooms(h *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := h.AllRooms()
+		if err != nil {
+			slog.Error("list rooms", "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+	}
+}
+
+// Stats returns server load and the current load-shedding mode.
+func Stats(h *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Stats())
+	}
+}
+
+// authorized reports whether r carries the admin token as a bearer token,
+// answering 401 when it does not. Admin endpoints fail closed: with no
+// token configured they answer 503 to everyone.
+func authorized(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		http.Error(w, `{"error":"admin endpoints disabled: ADMIN_TOKEN not set"}`, http.StatusServiceUnavailable)
+		return false
+	}
+	if !hasBearer(r, adminToken) {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// hasBearer reports whether r carries token as "Authorization: Bearer
+// <token>", comparing in constant time.
+func hasBearer(r *http.Request, token string) bool {
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) == 1
+}
+
+// denyPrivate answers 403 and returns true when name is a password-protected
+// room. Only members who joined with the password may read it, over the
+// WebSocket, and REST readers are anonymous.
+func denyPrivate(w http.ResponseWriter, h *hub.Hub, name string) bool {
+	private, err := h.RoomPrivate(name)
+	if err != nil {
+		slog.Error("room private", "room", name, "err", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return true
+	}
+	if private {
+		http.Error(w, `{"error":"room is private"}`, http.StatusForbidden)
+	}
+	return private
+}
+
+// createRoomRequest is the body of POST /api/rooms.
+type createRoomRequest struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+}
+
+// CreateRoom creates an empty room ahead of use. Requests must carry
+// adminToken as "Authorization: Bearer <token>".
+func CreateRoom(h *hub.Hub, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, adminToken) {
+			return
+		}
+
+		var req createRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		name, err := domain.ValidateRoomName(req.Name)
+		if err != nil {
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+
+		room, err := h.CreateRoom(name, req.Topic)
+		switch {
+		case errors.Is(err, domain.ErrRoomExists):
+			http.Error(w, `{"error":"room already exists"}`, http.StatusConflict)
+			return
+		case errors.Is(err, hub.ErrMaxRooms):
+			http.Error(w, `{"error":"max rooms reached"}`, http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			slog.Error("create room", "room", req.Name, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// DeleteRoom force-closes a live room, disconnecting everyone in it. With
+// ?purge=true it also deletes everything the store keeps for the room, and
+// succeeds even if the room is not live. Like CreateRoom it requires
+// adminToken.
+func DeleteRoom(h *hub.Hub, s store.Store, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, adminToken) {
+			return
+		}
+		name, err := domain.ValidateRoomName(r.PathValue("name"))
+		if err != nil {
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+		purge := r.URL.Query().Get("purge") == "true"
+		rd, canPurge := s.(store.RoomDeleteStore)
+		if purge && !canPurge {
+			http.Error(w, `{"error":"purge not supported"}`, http.StatusNotImplemented)
+			return
+		}
+
+		err = h.CloseRoom(name)
+		if errors.Is(err, domain.ErrRoomNotFound) && !purge {
+			http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+			return
+		}
+		if purge {
+			err := rd.DeleteRoom(name)
+			switch {
+			case errors.Is(err, errors.ErrUnsupported):
+				http.Error(w, `{"error":"purge not supported"}`, http.StatusNotImplemented)
+				return
+			case err != nil:
+				slog.Error("purge room", "room", name, "err", err)
+				http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// announceRequest is the body of POST /api/announce.
+type announceRequest struct {
+	Text  string   `json:"text"`
+	Rooms []string `json:"rooms"` // "*" selects every room
+}
+
+// announceResponse lists the rooms an announcement reached.
+type announceResponse struct {
+	Rooms []string `json:"rooms"`
+}
+
+// Announce broadcasts a system message to the named live rooms, or to all
+// of them when the list includes "*", and persists it so later joiners see
+// it. It is guarded by adminToken like CreateRoom. Text longer than
+// maxTextLen runes is rejected; zero means unlimited.
+func Announce(h *hub.Hub, adminToken string, maxTextLen int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, adminToken) {
+			return
+		}
+
+		var req announceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Text) == "" {
+			http.Error(w, `{"error":"text required"}`, http.StatusBadRequest)
+			return
+		}
+		if len(req.Rooms) == 0 {
+			http.Error(w, `{"error":"rooms required"}`, http.StatusBadRequest)
+			return
+		}
+		msg := domain.Message{Type: domain.MsgSystem, Text: req.Text, Timestamp: time.Now().UTC()}
+		if err := domain.ValidateMessage(msg, maxTextLen); err != nil {
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+
+		var reached []string
+		if slices.Contains(req.Rooms, "*") {
+			reached = h.BroadcastAll(msg)
+		} else {
+			reached = h.BroadcastTo(slices.DeleteFunc(req.Rooms, domain.IsDMRoom), msg)
+		}
+		slog.Info("announcement", "rooms", len(reached))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(announceResponse{Rooms: reached})
+	}
+}
+
+// maxPostBody caps the size, in bytes, of a POST /api/rooms/{name}/messages body.
+const maxPostBody = 64 << 10
+
+// postMessageRequest is the body of POST /api/rooms/{name}/messages.
+type postMessageRequest struct {
+	User string `json:"user"`
+	Text string `json:"text"`
+}
+
+// PostMessage lets bots and webhooks post a chat message over HTTP. The
+// message is persisted and broadcast like one sent over WebSocket, into a
+// room opened for it alone if none is live (see hub.Post), and returned with
+// its id and server timestamp. Text
+// longer than maxTextLen runes is rejected; zero means unlimited.
+func PostMessage(h *hub.Hub, maxTextLen int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req postMessageRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBody)).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if req.User == "" {
+			http.Error(w, `{"error":"user required"}`, http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Text) == "" {
+			http.Error(w, `{"error":"text required"}`, http.StatusBadRequest)
+			return
+		}
+		room, err := domain.ValidateRoomName(r.PathValue("name"))
+		if err != nil {
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+		msg := domain.Message{
+			ID:        uuid.NewString(),
+			Type:      domain.MsgChat,
+			Room:      room,
+			User:      req.User,
+			Text:      req.Text,
+			Timestamp: time.Now().UTC(),
+		}
+		if err := domain.ValidateMessage(msg, maxTextLen); err != nil {
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+
+		posted, err := h.Post(msg)
+		var pe *hub.PostError
+		switch {
+		case errors.Is(err, domain.ErrRoomNotFound):
+			http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+			return
+		case errors.Is(err, hub.ErrPrivateRoom):
+			http.Error(w, `{"error":"room is private"}`, http.StatusForbidden)
+			return
+		case errors.Is(err, hub.ErrMaxRooms), errors.Is(err, hub.ErrStopped):
+			http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusServiceUnavailable)
+			return
+		case errors.As(err, &pe):
+			code := http.StatusBadRequest
+			switch pe.Code {
+			case domain.ErrCodeRoomLocked:
+				code = http.StatusConflict
+			case domain.ErrCodeRateLimited:
+				code = http.StatusTooManyRequests
+			}
+			body, _ := json.Marshal(map[string]string{"error": pe.Message, "code": pe.Code})
+			http.Error(w, string(body), code)
+			return
+		case err != nil:
+			slog.Error("post message", "room", msg.Room, "user", req.User, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(posted)
+	}
+}
+
+// ListUsers returns connected usernames in sorted order, optionally limited
+// to one room with ?room=. Results are paged with ?limit=N; pass the returned
+// next value as ?after= to fetch the following page.
+func ListUsers(h *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := defaultUsersLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, `{"error":"invalid limit"}`, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxUsersLimit)
+		}
+
+		var users []string
+		if room := q.Get("room"); room != "" {
+			var ok bool
+			if users, ok = h.RoomUsers(domain.NormalizeRoomName(room)); !ok {
+				http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+				return
+			}
+		} else {
+			users = h.ConnectedUsers()
+		}
+
+		if after := q.Get("after"); after != "" {
+			i, _ := slices.BinarySearch(users, after)
+			if i < len(users) && users[i] == after {
+				i++
+			}
+			users = users[i:]
+		}
+		page := domain.UserList{Users: users}
+		if len(users) > limit {
+			page.Users = users[:limit]
+			page.Next = users[limit-1]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// UserLastSeen returns when a user last sent a message or left a room, or
+// 404 if the user has never been seen.
+func UserLastSeen(h *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("name")
+		t, ok, err := h.LastSeen(user)
+		if err != nil {
+			slog.Error("last seen", "user", user, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, `{"error":"user not found"}`, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(domain.LastSeen{User: user, LastSeen: t})
+	}
+}
+
 // RoomInfo returns details about a specific room.
 func RoomInfo(h *hub.Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract room name from path: /api/rooms/{name}
-		name := strings.TrimPrefix(r.URL.Path, "/api/rooms/")
+		name := domain.NormalizeRoomName(strings.TrimPrefix(r.URL.Path, "/api/rooms/"))
 		if name == "" {
 			http.Error(w, `{"error":"room name required"}`, http.StatusBadRequest)
 			return
@@ -45,3 +419,312 @@ func RoomInfo(h *hub.Hub) http.HandlerFunc {
 		json.NewEncoder(w).Encode(info)
 	}
 }
+
+// RoomHistory pages forward through a room's stored messages.
+// GET /api/rooms/{name}/history?after_id=X&limit=N returns up to N messages
+// saved after message X, oldest first. Private rooms are refused with 403.
+func RoomHistory(h *hub.Hub, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := domain.NormalizeRoomName(r.PathValue("name"))
+		afterID := r.URL.Query().Get("after_id")
+		if name == "" || afterID == "" {
+			http.Error(w, `{"error":"room name and after_id required"}`, http.StatusBadRequest)
+			return
+		}
+		// Direct messages are only readable by their participants over the
+		// WebSocket, and this endpoint does not know who is asking.
+		if domain.IsDMRoom(name) {
+			http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+			return
+		}
+		if denyPrivate(w, h, name) {
+			return
+		}
+
+		limit := defaultHistoryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, `{"error":"invalid limit"}`, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxHistoryLimit)
+		}
+
+		msgs, err := s.HistoryAfterID(name, afterID, limit)
+		if errors.Is(err, domain.ErrMessageNotFound) {
+			http.Error(w, `{"error":"message not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("history after id", "room", name, "after_id", afterID, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if msgs == nil {
+			msgs = []domain.Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msgs)
+	}
+}
+
+// RoomThread handles GET /api/rooms/{name}/thread/{id}?limit=N, returning
+// message id and up to N of its direct replies, oldest first. The message
+// must belong to the named room, which must not be private.
+func RoomThread(h *hub.Hub, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, id := domain.NormalizeRoomName(r.PathValue("name")), r.PathValue("id")
+		ts, ok := s.(store.ThreadStore)
+		if !ok || domain.IsDMRoom(name) {
+			http.Error(w, `{"error":"message not found"}`, http.StatusNotFound)
+			return
+		}
+		if denyPrivate(w, h, name) {
+			return
+		}
+
+		limit := defaultHistoryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, `{"error":"invalid limit"}`, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxHistoryLimit)
+		}
+
+		msgs, err := ts.Thread(id, limit)
+		if err == nil && msgs[0].Room != name {
+			err = domain.ErrMessageNotFound
+		}
+		if errors.Is(err, domain.ErrMessageNotFound) {
+			http.Error(w, `{"error":"message not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("thread", "room", name, "id", id, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(domain.Thread{Parent: msgs[0], Replies: append([]domain.Message{}, msgs[1:]...)})
+	}
+}
+
+// MultiHistory handles GET /api/history?rooms=a,b,c&limit=N, returning the
+// last N messages of each room, oldest first, keyed by room name. Rooms with
+// no history, direct-message rooms and private rooms map to an empty array.
+func MultiHistory(h *hub.Hub, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rooms []string
+		for name := range strings.SplitSeq(r.URL.Query().Get("rooms"), ",") {
+			if name = domain.NormalizeRoomName(strings.TrimSpace(name)); name != "" && !slices.Contains(rooms, name) {
+				rooms = append(rooms, name)
+			}
+		}
+		if len(rooms) == 0 {
+			http.Error(w, `{"error":"rooms required"}`, http.StatusBadRequest)
+			return
+		}
+		if len(rooms) > maxMultiHistoryRooms {
+			http.Error(w, `{"error":"too many rooms"}`, http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultMultiHistoryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, `{"error":"invalid limit"}`, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxMultiHistoryLimit)
+		}
+
+		// Direct messages are only readable by their participants, and
+		// private rooms by their members.
+		public := make([]string, 0, len(rooms))
+		for _, name := range rooms {
+			if domain.IsDMRoom(name) {
+				continue
+			}
+			private, err := h.RoomPrivate(name)
+			if err != nil {
+				slog.Error("room private", "room", name, "err", err)
+				http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+				return
+			}
+			if !private {
+				public = append(public, name)
+			}
+		}
+		history, err := multiHistory(s, public, limit)
+		if err != nil {
+			slog.Error("multi-room history", "rooms", len(public), "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, name := range rooms {
+			if history[name] == nil {
+				history[name] = []domain.Message{}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	}
+}
+
+// multiHistory fetches several rooms' history in one call when the store
+// supports it, and one room at a time otherwise.
+func multiHistory(s store.Store, rooms []string, limit int) (map[string][]domain.Message, error) {
+	if ms, ok := s.(store.MultiHistoryStore); ok {
+		return ms.HistoryMulti(rooms, limit)
+	}
+	out := make(map[string][]domain.Message, len(rooms))
+	for _, room := range rooms {
+		msgs, err := s.History(room, limit)
+		if err != nil {
+			return nil, err
+		}
+		out[room] = msgs
+	}
+	return out, nil
+}
+
+// maxSearchQueryLen caps the length, in bytes, of a search query.
+const maxSearchQueryLen = 200
+
+// SearchRoom handles GET /api/rooms/{name}/search?q=<term>&limit=<n>,
+// returning up to n of the newest messages matching every word of the term,
+// oldest first. Like RoomHistory it refuses private rooms.
+func SearchRoom(h *hub.Hub, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := domain.NormalizeRoomName(r.PathValue("name"))
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if name == "" || q == "" {
+			http.Error(w, `{"error":"room name and q required"}`, http.StatusBadRequest)
+			return
+		}
+		if len(q) > maxSearchQueryLen {
+			http.Error(w, `{"error":"query too long"}`, http.StatusBadRequest)
+			return
+		}
+		// Same as RoomHistory: DMs are not readable over REST.
+		if domain.IsDMRoom(name) {
+			http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+			return
+		}
+		if denyPrivate(w, h, name) {
+			return
+		}
+		ss, ok := s.(store.SearchStore)
+		if !ok {
+			http.Error(w, `{"error":"search not supported"}`, http.StatusNotImplemented)
+			return
+		}
+
+		limit := defaultSearchLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, `{"error":"invalid limit"}`, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxSearchLimit)
+		}
+
+		msgs, err := ss.Search(name, q, limit)
+		if err != nil {
+			slog.Error("search", "room", name, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if msgs == nil {
+			msgs = []domain.Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msgs)
+	}
+}
+
+// MessageEdits returns the prior versions of an edited message, oldest
+// first. Like CreateRoom it requires adminToken.
+func MessageEdits(s store.Store, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, adminToken) {
+			return
+		}
+
+		es, ok := s.(store.EditStore)
+		if !ok {
+			http.Error(w, `{"error":"message not found"}`, http.StatusNotFound)
+			return
+		}
+		id := r.PathValue("id")
+		edits, err := es.EditHistory(id)
+		if errors.Is(err, domain.ErrMessageNotFound) {
+			http.Error(w, `{"error":"message not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("edit history", "message_id", id, "err", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		if edits == nil {
+			edits = []domain.MessageEdit{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(edits)
+	}
+}
+
+// PollRoom is a long-poll fallback for clients that cannot use WebSockets.
+// It returns the room's messages after ?after_seq=, waiting up to timeout for
+// one to arrive, along with the latest seq to pass on the next poll.
+func PollRoom(h *hub.Hub, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := domain.NormalizeRoomName(r.PathValue("name"))
+		var after uint64
+		if v := r.URL.Query().Get("after_seq"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, `{"error":"invalid after_seq"}`, http.StatusBadRequest)
+				return
+			}
+			after = n
+		}
+
+		res, err := h.Poll(r.Context(), name, after, timeout)
+		if errors.Is(err, domain.ErrRoomNotFound) {
+			http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, hub.ErrPrivateRoom) {
+			http.Error(w, `{"error":"room is private"}`, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			// The client went away while waiting.
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// Metrics serves per-room message counters in the Prometheus text format.
+func Metrics(m *metrics.RoomLabels) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	}
+}
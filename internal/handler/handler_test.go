@@ -1,16 +1,23 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/store"
 	"github.com/devaloi/chatterbox/internal/testutil"
 )
 
@@ -78,6 +85,366 @@ func TestWSUpgradeNoUser(t *testing.T) {
 	}
 }
 
+func TestRoomThread(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for i, m := range []domain.Message{
+		{ID: "p", Room: "general", Text: "parent"},
+		{ID: "r1", Room: "general", Text: "reply", ReplyTo: "p"},
+		{ID: "s", Room: "secret", Text: "private parent"},
+	} {
+		m.Type, m.User, m.Timestamp = domain.MsgChat, "alice", now.Add(time.Duration(i)*time.Second)
+		s.Save(m)
+	}
+	s.SetRoomPassword("secret", "hash")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/rooms/{name}/thread/{id}", RoomThread(hub.New(s, 100, 50), s))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/api/rooms/general/thread/p")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var thread domain.Thread
+	json.NewDecoder(w.Body).Decode(&thread)
+	if thread.Parent.ID != "p" || len(thread.Replies) != 1 || thread.Replies[0].ReplyTo != "p" {
+		t.Errorf("expected parent p with reply r1, got %+v", thread)
+	}
+
+	if w := get("/api/rooms/random/thread/p"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a message in another room, got %d", w.Code)
+	}
+	if w := get("/api/rooms/general/thread/nope"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown message, got %d", w.Code)
+	}
+	if w := get("/api/rooms/secret/thread/s"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a thread in a private room, got %d", w.Code)
+	}
+}
+
+func TestMultiHistory(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	now := time.Now().UTC()
+	for i, room := range []string{"general", "general", "random", "dm:alice:bob"} {
+		s.Save(domain.Message{ID: fmt.Sprint("m", i), Type: domain.MsgChat, Room: room, User: "alice",
+			Text: "hi", Timestamp: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	get := func(query string) (int, map[string][]domain.Message) {
+		req := httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil)
+		w := httptest.NewRecorder()
+		MultiHistory(hub.New(s, 100, 50), s)(w, req)
+		var history map[string][]domain.Message
+		json.NewDecoder(w.Body).Decode(&history)
+		return w.Code, history
+	}
+
+	code, history := get("rooms=general,random,empty,dm:alice:bob&limit=1")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if msgs := history["general"]; len(msgs) != 1 || msgs[0].ID != "m1" {
+		t.Errorf("expected the newest general message, got %+v", msgs)
+	}
+	if msgs := history["random"]; len(msgs) != 1 {
+		t.Errorf("expected one random message, got %+v", msgs)
+	}
+	for _, room := range []string{"empty", "dm:alice:bob"} {
+		if msgs, ok := history[room]; !ok || len(msgs) != 0 {
+			t.Errorf("%s: expected an empty array, got %+v", room, msgs)
+		}
+	}
+
+	if code, _ := get(""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without rooms, got %d", code)
+	}
+	many := make([]string, maxMultiHistoryRooms+1)
+	for i := range many {
+		many[i] = fmt.Sprint("room", i)
+	}
+	if code, _ := get("rooms=" + strings.Join(many, ",")); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for too many rooms, got %d", code)
+	}
+}
+
+func TestMultiHistorySkipsPrivateRooms(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	now := time.Now().UTC()
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi", Timestamp: now})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "psst", Timestamp: now})
+	s.SetRoomPassword("secret", "hash")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/history?rooms=general,secret", nil)
+	w := httptest.NewRecorder()
+	MultiHistory(hub.New(s, 100, 50), s)(w, req)
+	var history map[string][]domain.Message
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history["general"]) != 1 {
+		t.Errorf("expected general's message, got %+v", history["general"])
+	}
+	if msgs, ok := history["secret"]; !ok || len(msgs) != 0 {
+		t.Errorf("expected an empty array for the private room, got %+v", msgs)
+	}
+}
+
+func TestWSGuests(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+	if _, err := h.CreateRoom("general", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(ServeWSGuests(h))
+	defer server.Close()
+
+	// A named user is still accepted.
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user=alice", nil)
+	if err != nil {
+		t.Fatalf("dial alice: %v", err)
+	}
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial guest: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	next := func(want string) map[string]any {
+		t.Helper()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read %s: %v", want, err)
+			}
+			var msg map[string]any
+			json.Unmarshal(data, &msg)
+			if msg["type"] == want {
+				return msg
+			}
+		}
+	}
+
+	// Guests cannot create rooms by default.
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"new-room"}`))
+	if msg := next("error"); msg["code"] != domain.ErrCodeForbidden {
+		t.Errorf("expected forbidden joining a new room, got %v", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	users, _ := next("presence")["users"].([]any)
+	if len(users) != 1 {
+		t.Fatalf("expected one user in presence, got %v", users)
+	}
+	if name, _ := users[0].(string); !strings.HasPrefix(name, "guest-") || len(name) != len("guest-7f3a91c2") {
+		t.Errorf("expected a generated guest name, got %q", name)
+	}
+}
+
+func TestWSAdminTokenGrantsModerator(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50, hub.WithKickBan(0))
+	go h.Run()
+	defer h.Stop()
+
+	server := httptest.NewServer(ServeWSConfig(h, WSConfig{AdminToken: "secret"}))
+	defer server.Close()
+	dial := func(user, token string) *websocket.Conn {
+		t.Helper()
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user="+user, header)
+		if err != nil {
+			t.Fatalf("dial %s: %v", user, err)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+		return conn
+	}
+	next := func(conn *websocket.Conn, want string) map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read %s: %v", want, err)
+			}
+			var msg map[string]any
+			json.Unmarshal(data, &msg)
+			if msg["type"] == want {
+				return msg
+			}
+		}
+	}
+
+	bob := dial("bob", "")
+	defer bob.Close()
+	next(bob, "presence")
+	// A wrong token, or a moderator's name, is an ordinary user.
+	for _, token := range []string{"", "guess"} {
+		mod := dial("mod", token)
+		next(mod, "presence")
+		mod.WriteMessage(websocket.TextMessage, []byte(`{"type":"kick","room":"general","user":"bob"}`))
+		if msg := next(mod, "error"); msg["code"] != domain.ErrCodeForbidden {
+			t.Errorf("token %q: expected forbidden, got %v", token, msg)
+		}
+		mod.Close()
+	}
+
+	mod := dial("mod", "secret")
+	defer mod.Close()
+	next(mod, "presence")
+	mod.WriteMessage(websocket.TextMessage, []byte(`{"type":"kick","room":"general","user":"bob"}`))
+	if msg := next(bob, "error"); msg["code"] != domain.ErrCodeKicked {
+		t.Errorf("expected bob kicked by the authenticated moderator, got %v", msg)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		trust      bool
+		want       string
+	}{
+		{"untrusted ignores header", "10.0.0.1:5000", []string{"1.2.3.4"}, false, "10.0.0.1"},
+		{"no header", "10.0.0.1:5000", nil, true, "10.0.0.1"},
+		{"single hop", "10.0.0.1:5000", []string{"1.2.3.4"}, true, "1.2.3.4"},
+		{"chain uses last hop", "10.0.0.1:5000", []string{"6.6.6.6, 1.2.3.4"}, true, "1.2.3.4"},
+		{"spaces trimmed", "10.0.0.1:5000", []string{"  1.2.3.4  "}, true, "1.2.3.4"},
+		{"trailing empty entry", "10.0.0.1:5000", []string{"1.2.3.4, "}, true, "1.2.3.4"},
+		{"repeated headers", "10.0.0.1:5000", []string{"6.6.6.6", "5.5.5.5, 1.2.3.4"}, true, "1.2.3.4"},
+		{"invalid last hop", "10.0.0.1:5000", []string{"1.2.3.4, unknown"}, true, "10.0.0.1"},
+		{"ipv6 hop", "10.0.0.1:5000", []string{"2001:db8::1"}, true, "2001:db8::1"},
+		{"ipv6 remote", "[2001:db8::2]:5000", nil, false, "2001:db8::2"},
+		{"remote without port", "10.0.0.1", nil, false, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := realIP(r, tt.trust); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWSMaxConnsPerIP(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	server := httptest.NewServer(ServeWSConfig(h, WSConfig{MaxConnsPerIP: 2}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?user=alice"
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected the connection over the limit to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v", resp)
+	}
+
+	// Closing a connection frees its slot once the server notices.
+	conns[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a slot after closing a connection: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWSMaxConnections(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50, hub.WithMaxConnections(2))
+	go h.Run()
+	defer h.Stop()
+
+	server := httptest.NewServer(ServeWS(h))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?user="
+
+	var conns []*websocket.Conn
+	for _, user := range []string{"alice", "bob"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+user, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", user, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"carol", nil)
+	if err == nil {
+		t.Fatal("expected the connection over the limit to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", resp)
+	}
+	if got := h.Stats().MaxConnections; got != 2 {
+		t.Errorf("expected max_connections 2, got %d", got)
+	}
+
+	// Closing a connection frees its slot once the server notices.
+	conns[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"carol", nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a slot after closing a connection: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func TestWSUpgradeSuccess(t *testing.T) {
 	t.Parallel()
 	s := testutil.NewMockStore()
@@ -111,3 +478,801 @@ func TestWSUpgradeSuccess(t *testing.T) {
 		t.Errorf("unexpected first message type: %v", msg["type"])
 	}
 }
+
+func TestWSUpgradeRefusedWhenBusy(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50, hub.WithLoadShedding(10, 0, 0, 0))
+	// The event loop is not running, so routed messages pile up in the queue.
+	sender := testutil.NewMockClient("flood")
+	for i := 0; i < 10; i++ {
+		h.RouteMessage(domain.Message{Type: domain.MsgChat, Room: "general", Text: "x"}, sender)
+	}
+
+	srv := httptest.NewServer(ServeWS(h))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "?user=alice"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected upgrade to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	w := httptest.NewRecorder()
+	Stats(h)(w, req)
+	var stats domain.Stats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if stats.Mode != domain.ModeBusy || stats.QueueDepth != 10 {
+		t.Errorf("expected busy mode with queue depth 10, got %+v", stats)
+	}
+}
+
+func TestRoomHistoryAfterID(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for i, id := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		s.Save(domain.Message{ID: id, Type: domain.MsgChat, Room: "general", User: "alice",
+			Text: id, Timestamp: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms/{name}/history", RoomHistory(hub.New(s, 100, 50), s))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/general/history?after_id=m2&limit=2", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var msgs []domain.Message
+	json.NewDecoder(w.Body).Decode(&msgs)
+	if len(msgs) != 2 || msgs[0].ID != "m3" || msgs[1].ID != "m4" {
+		t.Errorf("expected [m3 m4], got %+v", msgs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/rooms/general/history?after_id=m3", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	msgs = nil
+	json.NewDecoder(w.Body).Decode(&msgs)
+	if len(msgs) != 2 || msgs[0].ID != "m4" || msgs[1].ID != "m5" {
+		t.Errorf("expected [m4 m5], got %+v", msgs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/rooms/general/history?after_id=nope", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", w.Code)
+	}
+}
+
+func TestSearchRoom(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for i, text := range []string{"deploy at noon", "lunch", "deploy done"} {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice",
+			Text: text, Timestamp: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/rooms/{name}/search", SearchRoom(hub.New(s, 100, 50), s))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/general/search?q=deploy", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var msgs []domain.Message
+	json.NewDecoder(w.Body).Decode(&msgs)
+	if len(msgs) != 2 || msgs[0].Text != "deploy at noon" || msgs[1].Text != "deploy done" {
+		t.Errorf("expected both deploy messages oldest-first, got %+v", msgs)
+	}
+
+	for _, target := range []string{
+		"/api/rooms/general/search",
+		"/api/rooms/general/search?q=deploy&limit=0",
+		"/api/rooms/general/search?q=" + strings.Repeat("x", maxSearchQueryLen+1),
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestRoomPathsIgnoreCase(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	if _, err := h.CreateRoom("general", ""); err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	now := time.Now().UTC()
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "deploy at noon", Timestamp: now})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "general", User: "alice", Text: "deploy done", Timestamp: now.Add(time.Second)})
+	s.Save(domain.Message{ID: "m3", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "deploy keys", Timestamp: now})
+	s.Save(domain.Message{ID: "m4", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "deploy more", Timestamp: now.Add(time.Second)})
+	s.SetRoomPassword("secret", "hash")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms/", RoomInfo(h))
+	mux.HandleFunc("/api/rooms/{name}/history", RoomHistory(h, s))
+	mux.HandleFunc("GET /api/rooms/{name}/search", SearchRoom(h, s))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/api/rooms/General"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for room info, got %d", w.Code)
+	}
+	for _, path := range []string{
+		"/api/rooms/GENERAL/history?after_id=m1",
+		"/api/rooms/General/search?q=done",
+	} {
+		w := get(path)
+		var msgs []domain.Message
+		json.NewDecoder(w.Body).Decode(&msgs)
+		if w.Code != http.StatusOK || len(msgs) != 1 || msgs[0].ID != "m2" {
+			t.Errorf("%s: expected [m2], got %d %+v", path, w.Code, msgs)
+		}
+	}
+	if w := get("/api/rooms/Secret/history?after_id=m3"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a private room spelled in mixed case, got %d", w.Code)
+	}
+}
+
+func TestPrivateRoomNotReadable(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "deploy keys", Timestamp: time.Now().UTC()})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "deploy more", Timestamp: time.Now().UTC()})
+	s.SetRoomPassword("secret", "hash")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms/{name}/history", RoomHistory(h, s))
+	mux.HandleFunc("GET /api/rooms/{name}/search", SearchRoom(h, s))
+	mux.HandleFunc("/api/rooms/{name}/poll", PollRoom(h, time.Second))
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	// With only its stored password left, the room is still private.
+	if code := get("/api/rooms/secret/history?after_id=m1"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for history, got %d", code)
+	}
+	if code := get("/api/rooms/secret/search?q=deploy"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for search, got %d", code)
+	}
+
+	if _, err := h.CreateRoom("secret", ""); err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	if code := get("/api/rooms/secret/poll?after_seq=0"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for poll, got %d", code)
+	}
+	if code := get("/api/rooms/secret/history?after_id=m1"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for history of the live room, got %d", code)
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms", ListRooms(h))
+	mux.HandleFunc("POST /api/rooms", CreateRoom(h, "secret"))
+
+	post := func(body, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(`{"name":"eng","topic":"Engineering"}`, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", code)
+	}
+	if code := post(`{"name":"eng","topic":"Engineering"}`, "secret"); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(`{"name":"eng"}`, "secret"); code != http.StatusConflict {
+		t.Errorf("expected 409 for duplicate, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/rooms", nil))
+	var rooms []domain.Room
+	json.NewDecoder(w.Body).Decode(&rooms)
+	if len(rooms) != 1 || rooms[0].Name != "eng" || rooms[0].Topic != "Engineering" || rooms[0].UserCount != 0 {
+		t.Errorf("expected eng with topic and zero users, got %+v", rooms)
+	}
+
+	// Without a configured token the endpoint is disabled, not open.
+	w = httptest.NewRecorder()
+	CreateRoom(h, "")(w, httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(`{"name":"ops"}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without ADMIN_TOKEN, got %d", w.Code)
+	}
+
+	// The record survives a restart of the hub.
+	h2 := hub.New(s, 100, 50)
+	if err := h2.RestoreRooms(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer h2.Stop()
+	if info := h2.RoomInfo("eng"); info == nil || info.Topic != "Engineering" {
+		t.Errorf("expected restored room with topic, got %+v", info)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", ServeWS(h))
+	mux.HandleFunc("/api/rooms", ListRooms(h))
+	mux.HandleFunc("DELETE /api/rooms/{name}", DeleteRoom(h, s, "secret"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	del := func(target, token string) int {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("delete %s: %v", target, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?user=alice", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if info := h.RoomInfo("general"); info != nil && info.UserCount == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice never joined general")
+		}
+	}
+
+	if code := del("/api/rooms/general", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", code)
+	}
+	// With no token configured the endpoint fails closed.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/rooms/general", nil)
+	req.SetPathValue("name", "general")
+	DeleteRoom(h, s, "")(w, req)
+	if w.Code != http.StatusServiceUnavailable || h.RoomInfo("general") == nil {
+		t.Errorf("expected 503 and the room kept without ADMIN_TOKEN, got %d", w.Code)
+	}
+	if code := del("/api/rooms/general", "secret"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	// Alice is told why, then disconnected with the room-closed close code.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	gotError := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, domain.CloseRoomClosed) {
+				t.Errorf("expected close code %d, got %v", domain.CloseRoomClosed, err)
+			}
+			break
+		}
+		var em domain.ErrorMessage
+		if json.Unmarshal(data, &em) == nil && em.Code == domain.ErrCodeRoomClosed {
+			gotError = true
+		}
+	}
+	if !gotError {
+		t.Error("expected a room_closed error before the close frame")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/rooms", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("expected no rooms listed, got %s", body)
+	}
+	if code := del("/api/rooms/general", "secret"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a room that is gone, got %d", code)
+	}
+
+	// Purging works on rooms that only have stored history.
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "archive", User: "alice", Text: "old"})
+	if code := del("/api/rooms/archive?purge=true", "secret"); code != http.StatusNoContent {
+		t.Fatalf("expected 204 for purge, got %d", code)
+	}
+	if n, err := s.CountMessages("archive"); err != nil || n != 0 {
+		t.Errorf("expected archive purged, got %d messages, %v", n, err)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(testutil.NewMockClient("bob"), "random")
+
+	handle := Announce(h, "secret", 100)
+	post := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/announce", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handle(w, req)
+		return w
+	}
+
+	if w := post(`{"text":"maintenance in 5m","rooms":["*"]}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	if w := post(`{"text":"  ","rooms":["*"]}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty text, got %d", w.Code)
+	}
+	if w := post(`{"text":"hi"}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without rooms, got %d", w.Code)
+	}
+
+	w := post(`{"text":"maintenance in 5m","rooms":["general","missing"]}`, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Rooms []string `json:"rooms"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Rooms) != 1 || resp.Rooms[0] != "general" {
+		t.Errorf("expected only general reached, got %v", resp.Rooms)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var got domain.Message
+	for _, m := range alice.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem && msg.Text == "maintenance in 5m" {
+			got = msg
+		}
+	}
+	if got.Room != "general" {
+		t.Errorf("expected alice to get the announcement, got %+v", got)
+	}
+
+	w = post(`{"text":"back soon","rooms":["*"]}`, "secret")
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Rooms) != 2 {
+		t.Errorf("expected both rooms for *, got %v", resp.Rooms)
+	}
+}
+
+func TestPostMessageReachesWebSocketClient(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/rooms/{name}/messages", PostMessage(h, 10))
+	mux.HandleFunc("/ws", ServeWS(h))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?user=alice", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"general"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(server.URL+"/api/rooms/general/messages", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		return resp
+	}
+	for _, body := range []string{`{"user":"bot","text":"  "}`, `{"user":"bot","text":"far too long"}`, `{"text":"hi"}`} {
+		if resp := post(body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	resp := post(`{"user":"bot","text":"deployed"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var created domain.Message
+	json.NewDecoder(resp.Body).Decode(&created)
+	if created.ID == "" || created.Timestamp.IsZero() || created.User != "bot" {
+		t.Errorf("expected stored message with id and timestamp, got %+v", created)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("posted message never reached the WebSocket client: %v", err)
+		}
+		var msg domain.Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == domain.MsgChat {
+			if msg.ID != created.ID || msg.Text != "deployed" {
+				t.Errorf("expected the posted message, got %+v", msg)
+			}
+			break
+		}
+	}
+	if stored, _ := s.History("general", 10); len(stored) != 1 {
+		t.Errorf("expected the message persisted, got %d", len(stored))
+	}
+}
+
+func TestMessageEdits(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "v1"})
+	s.EditMessage("general", "m1", "v2")
+	s.EditMessage("general", "m1", "v3")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/messages/{id}/edits", MessageEdits(s, "secret"))
+	get := func(id, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/messages/"+id+"/edits", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("m1", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	w := get("m1", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var edits []domain.MessageEdit
+	json.NewDecoder(w.Body).Decode(&edits)
+	if len(edits) != 2 || edits[0].Text != "v1" || edits[1].Text != "v2" {
+		t.Errorf("expected prior versions [v1 v2], got %+v", edits)
+	}
+	if w := get("nope", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", w.Code)
+	}
+}
+
+func TestPollRoomReturnsNewMessage(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms/{name}/poll", PollRoom(h, 5*time.Second))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	type result struct {
+		res domain.PollResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/api/rooms/general/poll?after_seq=0")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var res domain.PollResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		done <- result{res, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("poll returned before any message was posted")
+	default:
+	}
+	h.RouteMessageSync(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "bob", Text: "hi"}, bob)
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("poll: %v", r.err)
+		}
+		if len(r.res.Messages) != 1 || r.res.Messages[0].ID != "m1" || r.res.Seq != 1 {
+			t.Fatalf("expected m1 at seq 1, got %+v", r.res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("poll did not return promptly after a message was posted")
+	}
+
+	// Nothing new after seq 1, so a short poll times out empty.
+	res, err := h.Poll(context.Background(), "general", 1, 20*time.Millisecond)
+	if err != nil || len(res.Messages) != 0 || res.Seq != 1 {
+		t.Errorf("expected empty result at seq 1, got %+v, %v", res, err)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/rooms/nope/poll")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown room, got %d", resp.StatusCode)
+	}
+}
+
+func TestUserLastSeen(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}, alice)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/users/{name}/lastseen", UserLastSeen(h))
+	get := func(user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users/"+user+"/lastseen", nil))
+		return w
+	}
+
+	w := get("alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var ls domain.LastSeen
+	json.NewDecoder(w.Body).Decode(&ls)
+	if ls.User != "alice" || ls.LastSeen.IsZero() {
+		t.Errorf("expected alice's last seen time, got %+v", ls)
+	}
+	if w := get("bob"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a user never seen, got %d", w.Code)
+	}
+}
+
+func TestWSMsgpackCodec(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+	server := httptest.NewServer(ServeWS(h))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"?user=alice&codec=xml", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown codec, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?user=alice&codec=msgpack", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	join, _ := domain.Msgpack.Marshal(domain.Message{Type: domain.MsgJoin, Room: "general"})
+	conn.WriteMessage(websocket.BinaryMessage, join)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("expected a binary frame, got type %d", frameType)
+	}
+	var pm domain.PresenceMessage
+	if err := domain.Msgpack.Unmarshal(data, &pm); err != nil {
+		t.Fatalf("decode msgpack: %v", err)
+	}
+	if pm.Type != domain.MsgPresence || pm.Room != "general" || len(pm.Users) != 1 || pm.Users[0] != "alice" {
+		t.Errorf("expected presence for alice in general, got %+v", pm)
+	}
+}
+
+func TestAllRoomsMergesHistoricalRooms(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "archive", User: "alice", Text: "old"})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"})
+	s.Save(domain.Message{ID: "m3", Type: domain.MsgDM, Room: domain.DMRoom("alice", "bob"), User: "alice", Text: "psst"})
+
+	h := hub.New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+	h.RegisterSync(testutil.NewMockClient("alice"), "general")
+	h.RegisterSync(testutil.NewMockClient("bob"), "lobby")
+
+	w := httptest.NewRecorder()
+	AllRooms(h)(w, httptest.NewRequest(http.MethodGet, "/api/rooms/all", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"user_count":0`) {
+		t.Errorf("expected history-only rooms to report user_count 0, got %s", w.Body)
+	}
+	var rooms []domain.Room
+	json.NewDecoder(w.Body).Decode(&rooms)
+	want := []domain.Room{{Name: "archive"}, {Name: "general", UserCount: 1}, {Name: "lobby", UserCount: 1}}
+	if len(rooms) != len(want) {
+		t.Fatalf("got %+v, want %+v", rooms, want)
+	}
+	for i := range want {
+		// Only live rooms know when they were created.
+		if live := rooms[i].UserCount > 0; live == rooms[i].CreatedAt.IsZero() {
+			t.Errorf("room %d: unexpected created_at %v for %s", i, rooms[i].CreatedAt, rooms[i].Name)
+		}
+		rooms[i].CreatedAt = time.Time{}
+		if rooms[i] != want[i] {
+			t.Errorf("room %d: got %+v, want %+v", i, rooms[i], want[i])
+		}
+	}
+}
+
+func TestStaticServesIndexForClientRoutes(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<!doctype html><title>app</title>"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0o644)
+	h := Static(dir)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/", "/rooms/general", "/settings"} {
+		w := get(path)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>app</title>") {
+			t.Errorf("%s: expected index.html, got %d %q", path, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: expected text/html, got %q", path, ct)
+		}
+	}
+
+	w := get("/app.js")
+	if w.Code != http.StatusOK || w.Body.String() != "console.log(1)" {
+		t.Errorf("expected the real asset, got %d %q", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+		t.Errorf("expected a javascript content type, got %q", ct)
+	}
+
+	for _, path := range []string{"/missing.js", "/api", "/api/nope"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestStatsCountsClientsAndMessages(t *testing.T) {
+	t.Parallel()
+	h := hub.New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	for range 2 {
+		defer h.TrackConn(io.NopCloser(strings.NewReader("")))()
+	}
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	h.RegisterSync(bob, "random")
+	h.RegisterSync(bob, "help")
+	h.UnregisterSync(bob, "help")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}, alice)
+
+	w := httptest.NewRecorder()
+	Stats(h)(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	var fields map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&fields); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	for _, key := range []string{"clients", "memberships", "rooms", "messages_routed", "uptime_seconds", "goroutines"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("expected %q in stats, got %v", key, fields)
+		}
+	}
+	if fields["clients"] != 2.0 || fields["memberships"] != 3.0 || fields["rooms"] != 2.0 || fields["messages_routed"] != 1.0 {
+		t.Errorf("expected 2 clients with 3 memberships in 2 rooms and 1 message routed, got %v", fields)
+	}
+	if g, _ := fields["goroutines"].(float64); g < 1 {
+		t.Errorf("expected a goroutine count, got %v", fields["goroutines"])
+	}
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Static serves the browser client from dir. Requests for files that exist
+// are served as usual, with content types from their extensions. Other
+// extensionless paths get dir/index.html, so deep links into a single-page
+// app load the app and its client-side router takes over. Missing assets
+// (paths with an extension) and unknown /api paths still 404.
+func Static(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	index := filepath.Join(dir, "index.html")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if p == "/api" || strings.HasPrefix(p, "/api/") {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p)))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) || path.Ext(p) != "" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		http.ServeFile(w, r, index)
+	})
+}
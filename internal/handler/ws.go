@@ -1,15 +1,24 @@
 package handler
 
 import (
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/devaloi/chatterbox/internal/client"
+	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/hub"
 )
 
+// busyRetryAfter is the Retry-After value, in seconds, sent with 503
+// responses while the hub is shedding load.
+const busyRetryAfter = "5"
+
 // WebSocket read/write buffer sizes (bytes).
 const (
 	wsReadBufferSize  = 1024
@@ -22,23 +31,175 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-// ServeWS handles WebSocket upgrade requests.
-func ServeWS(h *hub.Hub) http.HandlerFunc {
+// ServeWS handles WebSocket upgrade requests. The options are applied to
+// every client created by the handler. Clients pick their wire format with
+// ?codec=json (the default) or ?codec=msgpack.
+func ServeWS(h *hub.Hub, opts ...client.Option) http.HandlerFunc {
+	return ServeWSConfig(h, WSConfig{}, opts...)
+}
+
+// ServeWSGuests is ServeWS for servers that admit guests: a request without
+// a user param connects as a guest (see client.WithGuest) with a generated
+// name like guest-7f3a91c2.
+func ServeWSGuests(h *hub.Hub, opts ...client.Option) http.HandlerFunc {
+	return ServeWSConfig(h, WSConfig{AllowGuests: true}, opts...)
+}
+
+// WSConfig holds connection-level settings for ServeWSConfig.
+type WSConfig struct {
+	// AllowGuests connects a request without a user param as a guest (see
+	// client.WithGuest) with a generated name like guest-7f3a91c2.
+	AllowGuests bool
+	// TrustProxy takes the client address from X-Forwarded-For (see realIP).
+	TrustProxy bool
+	// MaxConnsPerIP refuses upgrades with 429 while that many connections
+	// from the same client IP are open. Zero is unlimited.
+	MaxConnsPerIP int
+	// AdminToken, if set, gives an upgrade request that carries it as
+	// "Authorization: Bearer <token>" moderator rights (see
+	// client.WithModerator). Without it nobody is a moderator.
+	AdminToken string
+	// RelayToken, if set, marks an upgrade request that carries it as a
+	// bearer token as a federated peer's relay (see client.WithRelay).
+	RelayToken string
+}
+
+// connLimit counts open connections per client IP.
+type connLimit struct {
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// acquire counts a new connection from ip, or reports false if ip is at
+// the limit.
+func (l *connLimit) acquire(ip string) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release uncounts a connection counted by acquire.
+func (l *connLimit) release(ip string) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// ServeWSConfig is ServeWS with connection-level settings.
+func ServeWSConfig(h *hub.Hub, cfg WSConfig, opts ...client.Option) http.HandlerFunc {
+	limit := &connLimit{max: cfg.MaxConnsPerIP, conns: make(map[string]int)}
 	return func(w http.ResponseWriter, r *http.Request) {
+		opts := opts[:len(opts):len(opts)]
 		user := r.URL.Query().Get("user")
 		if user == "" {
-			http.Error(w, `{"error":"user query param required"}`, http.StatusBadRequest)
+			if !cfg.AllowGuests {
+				http.Error(w, `{"error":"user query param required"}`, http.StatusBadRequest)
+				return
+			}
+			user = guestName(h)
+			opts = append(opts, client.WithGuest())
+		}
+		if cfg.AdminToken != "" && hasBearer(r, cfg.AdminToken) {
+			opts = append(opts, client.WithModerator())
+		}
+		if cfg.RelayToken != "" && hasBearer(r, cfg.RelayToken) {
+			opts = append(opts, client.WithRelay())
+		}
+
+		codec, ok := domain.CodecByName(r.URL.Query().Get("codec"))
+		if !ok {
+			http.Error(w, `{"error":"unknown codec"}`, http.StatusBadRequest)
+			return
+		}
+
+		if h.Busy() {
+			w.Header().Set("Retry-After", busyRetryAfter)
+			http.Error(w, `{"error":"server busy"}`, http.StatusServiceUnavailable)
 			return
 		}
 
+		if !h.AcquireConn() {
+			slog.Warn("connection limit reached", "user", user)
+			w.Header().Set("Retry-After", busyRetryAfter)
+			http.Error(w, `{"error":"server full"}`, http.StatusServiceUnavailable)
+			return
+		}
+		ip := realIP(r, cfg.TrustProxy)
+		if !limit.acquire(ip) {
+			h.ReleaseConn()
+			slog.Warn("too many connections from ip", "user", user, "ip", ip)
+			http.Error(w, `{"error":"too many connections"}`, http.StatusTooManyRequests)
+			return
+		}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Printf("ws upgrade error: %v", err)
+			h.ReleaseConn()
+			limit.release(ip)
+			slog.Warn("ws upgrade", "user", user, "ip", ip, "err", err)
 			return
 		}
 
-		c := client.New(h, conn, user)
-		go c.ReadPump()
-		go c.WritePump()
+		opts = append(opts,
+			client.WithCodec(codec),
+			client.WithRemote(ip, r.Header.Get("Origin")),
+			client.WithOnClose(func() {
+				limit.release(ip)
+				h.ReleaseConn()
+			}),
+		)
+		c := client.New(h, conn, user, opts...)
+		c.Start()
+	}
+}
+
+// guestName returns a generated username for a guest: "guest-" and eight
+// random hex digits, drawn again while a connected user has the name.
+func guestName(h *hub.Hub) string {
+	for {
+		if name := "guest-" + uuid.NewString()[:8]; !h.UserConnected(name) {
+			return name
+		}
+	}
+}
+
+// realIP returns the client's IP address. Behind a trusted proxy it is the
+// last entry in X-Forwarded-For, the one the nearest proxy appended; entries
+// to its left are supplied by the client and could be forged, so they are
+// never used. Otherwise, or when that entry is not an IP address, it is the
+// host part of r.RemoteAddr.
+func realIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if ip := net.ParseIP(hop); ip != nil {
+				return ip.String()
+			}
+			break
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
 }
@@ -0,0 +1,65 @@
+package hub
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// BroadcastAll sends msg to every live room and returns the rooms reached,
+// sorted. See BroadcastTo.
+func (h *Hub) BroadcastAll(msg domain.Message) []string {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+	return announce(rooms, msg)
+}
+
+// BroadcastTo sends msg to the named rooms that are live and returns the
+// rooms reached, sorted. Each copy is stamped with its room and persisted,
+// whatever the type policy, unless the room is ephemeral, so members who
+// join later see it in their history.
+func (h *Hub) BroadcastTo(names []string, msg domain.Message) []string {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(names))
+	for _, name := range names {
+		if r, ok := h.rooms[name]; ok && !slices.Contains(rooms, r) {
+			rooms = append(rooms, r)
+		}
+	}
+	h.mu.RUnlock()
+	return announce(rooms, msg)
+}
+
+// announce persists and broadcasts msg in each room. Rooms are collected
+// under the hub lock but broadcast to after it is released, so a slow room
+// cannot stall the event loop.
+func announce(rooms []*Room, msg domain.Message) []string {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	reached := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		m := msg
+		m.Room = r.name
+		if r.store != nil && r.mode != domain.RoomModeEphemeral {
+			if err := r.store.Save(m); err != nil {
+				slog.Error("store save", "room", r.name, "type", m.Type, "err", err)
+			}
+		}
+		data, err := domain.Encode(m)
+		if err != nil {
+			slog.Error("encode announcement", "room", r.name, "err", err)
+			continue
+		}
+		r.Broadcast(data)
+		reached = append(reached, r.name)
+	}
+	slices.Sort(reached)
+	return reached
+}
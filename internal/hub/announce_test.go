@@ -0,0 +1,83 @@
+package hub
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubBroadcastTo(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	carol := testutil.NewMockClient("carol")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "random")
+	h.RegisterSync(carol, "eng")
+
+	reached := h.BroadcastTo([]string{"random", "general", "nope"}, domain.Message{Type: domain.MsgSystem, Text: "maintenance in 5m"})
+	if !slices.Equal(reached, []string{"general", "random"}) {
+		t.Fatalf("expected general and random, got %v", reached)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	announced := func(c *testutil.MockClient) *domain.Message {
+		for _, m := range c.GetMessages() {
+			var msg domain.Message
+			if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem && msg.Text == "maintenance in 5m" {
+				return &msg
+			}
+		}
+		return nil
+	}
+	if m := announced(alice); m == nil || m.Room != "general" {
+		t.Errorf("expected alice to get the announcement in general, got %+v", m)
+	}
+	if announced(bob) == nil {
+		t.Error("expected bob to get the announcement")
+	}
+	if announced(carol) != nil {
+		t.Error("expected carol's room to be skipped")
+	}
+
+	// Late joiners see it in history.
+	dave := testutil.NewMockClient("dave")
+	h.RegisterSync(dave, "general")
+	found := false
+	for _, m := range dave.GetMessages() {
+		var hm domain.HistoryMessage
+		if json.Unmarshal(m, &hm) != nil || hm.Type != domain.MsgHistory {
+			continue
+		}
+		for _, msg := range hm.Messages {
+			found = found || (msg.Type == domain.MsgSystem && msg.Text == "maintenance in 5m")
+		}
+	}
+	if !found {
+		t.Error("expected the announcement in a late joiner's history")
+	}
+}
+
+func TestHubBroadcastAll(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	h.RegisterSync(testutil.NewMockClient("alice"), "general")
+	h.RegisterSync(testutil.NewMockClient("bob"), "random")
+
+	reached := h.BroadcastAll(domain.Message{Type: domain.MsgSystem, Text: "hello everyone"})
+	if !slices.Equal(reached, []string{"general", "random"}) {
+		t.Errorf("expected every room, got %v", reached)
+	}
+}
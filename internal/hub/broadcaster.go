@@ -0,0 +1,25 @@
+package hub
+
+import "github.com/devaloi/chatterbox/internal/broadcast"
+
+// WithBroadcaster sets how room broadcasts reach members. The default,
+// broadcast.Local, only reaches clients of this hub; a broadcaster shared by
+// several instances should deliver what the others publish with
+// DeliverRemote.
+func WithBroadcaster(b broadcast.Broadcaster) Option {
+	return func(h *Hub) {
+		h.broadcaster = b
+	}
+}
+
+// DeliverRemote queues a frame broadcast to room by another instance on this
+// hub's members of the room. It does nothing if the room has no members
+// here.
+func (h *Hub) DeliverRemote(room string, data []byte) {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if ok {
+		r.deliver(data)
+	}
+}
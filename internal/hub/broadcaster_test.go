@@ -0,0 +1,193 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/broadcast"
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+// respServer is just enough of a Redis server for broadcast.Redis: PUBLISH
+// and PSUBSCRIBE, with every pattern treated as matching every channel.
+type respServer struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	subs map[net.Conn]string // subscriber connections and their pattern
+}
+
+func newRESPServer(t *testing.T) *respServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &respServer{ln: ln, subs: make(map[net.Conn]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *respServer) url() string {
+	return "redis://" + s.ln.Addr().String()
+}
+
+func (s *respServer) subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs)
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PSUBSCRIBE":
+			s.mu.Lock()
+			s.subs[conn] = args[1]
+			writeArray(conn, "psubscribe", args[1])
+			s.mu.Unlock()
+		case "PUBLISH":
+			s.mu.Lock()
+			for sub, pattern := range s.subs {
+				writeArray(sub, "pmessage", pattern, args[1], args[2])
+			}
+			n := len(s.subs)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		default:
+			io.WriteString(conn, "+OK\r\n")
+		}
+	}
+}
+
+// readCommand reads a RESP array of bulk strings.
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// writeArray writes items as a RESP array of bulk strings. The caller holds
+// respServer.mu, so pushes to one subscriber don't interleave.
+func writeArray(conn net.Conn, items ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, item := range items {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(item), item)
+	}
+	io.WriteString(conn, b.String())
+}
+
+// chatTexts returns the text of each chat frame c received.
+func chatTexts(c *testutil.MockClient) []string {
+	var texts []string
+	for _, m := range c.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgChat {
+			texts = append(texts, msg.Text)
+		}
+	}
+	return texts
+}
+
+func TestHubsShareRoomThroughRedisBroadcaster(t *testing.T) {
+	t.Parallel()
+	srv := newRESPServer(t)
+
+	newHub := func(id string) *Hub {
+		b, err := broadcast.NewRedis(srv.url(), id)
+		if err != nil {
+			t.Fatalf("new redis: %v", err)
+		}
+		h := New(testutil.NewMockStore(), 100, 50, WithServerID(id), WithBroadcaster(b))
+		b.Start(h.DeliverRemote)
+		go h.Run()
+		t.Cleanup(func() {
+			h.Stop()
+			b.Stop()
+		})
+		return h
+	}
+	hubA, hubB := newHub("a"), newHub("b")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.subscribers() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcasters never subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	hubA.RegisterSync(alice, "general")
+	hubB.RegisterSync(bob, "general")
+
+	hubA.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hello from a"}, alice)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for len(chatTexts(bob)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected bob on hub b to get alice's message")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := chatTexts(bob); len(got) != 1 || got[0] != "hello from a" {
+		t.Errorf("expected bob to get the message once, got %v", got)
+	}
+	// Give the echo from Redis time to arrive, then check hub a ignored it.
+	time.Sleep(100 * time.Millisecond)
+	if got := chatTexts(alice); len(got) != 1 {
+		t.Errorf("expected alice's own hub to deliver her message once, got %v", got)
+	}
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// handleDM delivers a direct message to every tracked connection of its
+// recipient and echoes it to the sender. It is stored under the pair's
+// synthetic room (domain.DMRoom) so DMHistory can replay it.
+func (h *Hub) handleDM(req MessageRequest) {
+	msg := req.Message
+	if !h.process(&msg, req.Sender) {
+		return
+	}
+
+	h.connsMu.Lock()
+	targets := make([]Client, 0, len(h.users[msg.To]))
+	for cl := range h.users[msg.To] {
+		targets = append(targets, cl)
+	}
+	h.connsMu.Unlock()
+	if len(targets) == 0 {
+		sendErrorCode(req.Sender, domain.ErrCodeUserOffline, "user offline: "+msg.To)
+		return
+	}
+
+	if msg.Origin == "" {
+		msg.Origin = h.serverID
+	}
+	msg.Room = domain.DMRoom(msg.User, msg.To)
+	if h.store != nil && h.policy.ShouldPersist(msg.Type) {
+		if err := h.store.Save(msg); err != nil {
+			slog.Error("store save", "room", msg.Room, "user", msg.User, "err", err)
+		}
+	}
+
+	data, err := domain.Encode(msg)
+	if err != nil {
+		slog.Error("encode dm", "room", msg.Room, "user", msg.User, "err", err)
+		return
+	}
+	for _, cl := range targets {
+		cl.Send(data)
+	}
+	req.Sender.Send(data)
+	h.routed.Add(1)
+}
+
+// DMHistory returns up to the hub's history limit of direct messages
+// exchanged between two users, oldest first.
+func (h *Hub) DMHistory(user, peer string) ([]domain.Message, error) {
+	if h.store == nil || h.maxHistory <= 0 {
+		return nil, nil
+	}
+	msgs, err := h.store.History(domain.DMRoom(user, peer), h.maxHistory)
+	if err != nil {
+		return nil, err
+	}
+	return store.ClampHistory(msgs, h.maxHistory), nil
+}
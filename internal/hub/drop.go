@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/deadletter"
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// WithDeadLetters records messages the hub drops, because its message queue
+// is full or a room's rate limit was hit, to sink.
+func WithDeadLetters(sink deadletter.Sink) Option {
+	return func(h *Hub) {
+		h.deadLetters = sink
+	}
+}
+
+// dropMessage accounts for a message that could not be queued, and tells
+// its sender: a nack if the message asked for an ack, a server_busy error
+// otherwise.
+func (h *Hub) dropMessage(msg domain.Message, sender Client) {
+	h.dropped.Add(1)
+	user := msg.User
+	if sender != nil {
+		user = sender.Username()
+		if msg.ClientMsgID != "" {
+			sendNack(sender, msg.ClientMsgID, "server busy")
+		} else {
+			sendErrorCode(sender, domain.ErrCodeServerBusy, "server busy, "+msg.Type+" dropped")
+		}
+	}
+	slog.Warn("hub message queue full, dropping message",
+		"room", msg.Room, "user", user, "type", msg.Type)
+	h.deadLetter(deadletter.ReasonHubQueueFull, msg, sender)
+}
+
+// deadLetter records a dropped msg with the dead-letter sink, if any.
+func (h *Hub) deadLetter(reason string, msg domain.Message, sender Client) {
+	if h.deadLetters == nil {
+		return
+	}
+	user := msg.User
+	if sender != nil {
+		user = sender.Username()
+	}
+	h.deadLetters.Record(deadletter.Record{
+		Reason:    reason,
+		Room:      msg.Room,
+		User:      user,
+		Size:      len(msg.Text),
+		Timestamp: time.Now().UTC(),
+	})
+}
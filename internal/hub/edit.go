@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// DeleteMode selects what deleting a message does to its stored copy.
+type DeleteMode int
+
+const (
+	// DeleteSoft marks the message deleted and keeps it for audit; history
+	// replays it as a domain.MsgDeleted tombstone. This is the default. Stores
+	// without soft delete fall back to DeleteHard.
+	DeleteSoft DeleteMode = iota
+	// DeleteHard removes the message and its edit history.
+	DeleteHard
+)
+
+// ParseDeleteMode parses "soft" or "hard".
+func ParseDeleteMode(s string) (DeleteMode, error) {
+	switch s {
+	case "", "soft":
+		return DeleteSoft, nil
+	case "hard":
+		return DeleteHard, nil
+	}
+	return 0, fmt.Errorf("invalid delete mode %q: want soft or hard", s)
+}
+
+// WithDeleteMode sets how deleted messages are removed from the store.
+func WithDeleteMode(m DeleteMode) Option {
+	return func(h *Hub) {
+		h.deleteMode = m
+	}
+}
+
+// deleteMessage deletes a stored message according to the delete mode.
+func (h *Hub) deleteMessage(es store.EditStore, room, id string) error {
+	if sd, ok := h.store.(store.SoftDeleteStore); ok && h.deleteMode == DeleteSoft {
+		return sd.SoftDelete(room, id)
+	}
+	return es.DeleteMessage(room, id)
+}
+
+// handleEdit applies an edit or delete to a stored message and broadcasts
+// the change to the room. Only the message's author may change it.
+func (h *Hub) handleEdit(r *Room, req MessageRequest) {
+	es, ok := h.store.(store.EditStore)
+	if !ok || r.mode == domain.RoomModeEphemeral {
+		sendError(req.Sender, "message not found")
+		return
+	}
+	msg := req.Message
+	orig, err := es.Message(r.name, msg.MessageID)
+	if errors.Is(err, domain.ErrMessageNotFound) {
+		sendError(req.Sender, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("store lookup", "room", r.name, "user", req.Sender.Username(), "err", err)
+		sendError(req.Sender, "edit failed")
+		return
+	}
+	if orig.User != req.Sender.Username() {
+		sendErrorCode(req.Sender, domain.ErrCodeForbidden, "only the author can edit or delete a message")
+		return
+	}
+
+	if msg.Type == domain.MsgEdit {
+		if r.Locked() {
+			sendErrorCode(req.Sender, domain.ErrCodeRoomLocked, "room is locked")
+			return
+		}
+		if !h.process(&msg, req.Sender) {
+			return
+		}
+		err = es.EditMessage(r.name, msg.MessageID, msg.Text)
+	} else {
+		msg.Text = ""
+		err = h.deleteMessage(es, r.name, msg.MessageID)
+	}
+	if err != nil {
+		slog.Error("store "+msg.Type, "room", r.name, "user", req.Sender.Username(), "err", err)
+		sendError(req.Sender, msg.Type+" failed")
+		return
+	}
+
+	data, err := domain.Encode(msg)
+	if err != nil {
+		slog.Error("encode "+msg.Type, "room", r.name, "err", err)
+		return
+	}
+	r.poll.add(msg)
+	r.Broadcast(data)
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubEditAndDelete(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	h.RouteMessageSync(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "helo"}, alice)
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgEdit, Room: "general", User: "bob", MessageID: "m1", Text: "hijacked"}, bob)
+	if em := lastError(bob); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a non-author, got %+v", em)
+	}
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgEdit, Room: "general", User: "alice", MessageID: "m1", Text: "hello"}, alice)
+	if msgs, _ := s.History("general", 10); len(msgs) != 1 || msgs[0].Text != "hello" {
+		t.Fatalf("expected edited text stored, got %+v", msgs)
+	}
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgDelete, Room: "general", User: "alice", MessageID: "m1"}, alice)
+	if msgs, _ := s.History("general", 10); len(msgs) != 1 || msgs[0].Type != domain.MsgDeleted || msgs[0].Text != "" {
+		t.Fatalf("expected message soft-deleted to a tombstone, got %+v", msgs)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var events []domain.Message
+	for _, m := range bob.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && (msg.Type == domain.MsgEdit || msg.Type == domain.MsgDelete) {
+			events = append(events, msg)
+		}
+	}
+	if len(events) != 2 || events[0].Text != "hello" || events[1].Type != domain.MsgDelete || events[1].MessageID != "m1" {
+		t.Errorf("expected edit then delete events, got %+v", events)
+	}
+}
+
+func TestHubHardDelete(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50, WithDeleteMode(DeleteHard))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RouteMessageSync(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "oops"}, alice)
+	h.RouteMessageSync(domain.Message{Type: domain.MsgDelete, Room: "general", User: "alice", MessageID: "m1"}, alice)
+
+	if msgs, _ := s.History("general", 10); len(msgs) != 0 {
+		t.Fatalf("expected message removed, got %+v", msgs)
+	}
+	if n, _ := s.CountMessages("general"); n != 0 {
+		t.Errorf("expected no stored rows, got %d", n)
+	}
+}
+
+func TestParseDeleteMode(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]DeleteMode{"": DeleteSoft, "soft": DeleteSoft, "hard": DeleteHard} {
+		if got, err := ParseDeleteMode(in); err != nil || got != want {
+			t.Errorf("ParseDeleteMode(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseDeleteMode("purge"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// RoomEviction selects what happens when a new room is needed but the hub
+// already has maxRooms rooms.
+type RoomEviction int
+
+const (
+	// EvictionNone refuses the new room. This is the default.
+	EvictionNone RoomEviction = iota
+	// EvictionLRU unloads the empty room that has been idle longest to make
+	// space, and refuses only when every room has members. Messages,
+	// passwords and room records in the store are kept; only the in-memory
+	// room is dropped.
+	EvictionLRU
+)
+
+// ParseRoomEviction parses "none" or "lru".
+func ParseRoomEviction(s string) (RoomEviction, error) {
+	switch s {
+	case "", "none":
+		return EvictionNone, nil
+	case "lru":
+		return EvictionLRU, nil
+	}
+	return 0, fmt.Errorf("invalid room eviction %q: want none or lru", s)
+}
+
+// WithRoomEviction sets how the hub makes space for a new room once it has
+// maxRooms rooms.
+func WithRoomEviction(e RoomEviction) Option {
+	return func(h *Hub) {
+		h.eviction = e
+	}
+}
+
+// hasRoomSpaceLocked reports whether another room may be started, evicting
+// an idle room first if the eviction mode allows it. The caller must hold
+// h.mu.
+func (h *Hub) hasRoomSpaceLocked() bool {
+	if len(h.rooms) < h.maxRooms {
+		return true
+	}
+	if h.eviction != EvictionLRU {
+		return false
+	}
+	var victim *Room
+	var oldest time.Time
+	for _, r := range h.rooms {
+		if !r.empty() {
+			continue
+		}
+		if last := r.LastActive(); victim == nil || last.Before(oldest) {
+			victim, oldest = r, last
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	victim.Stop()
+	delete(h.rooms, victim.name)
+	slog.Info("room evicted", "room", victim.name, "idle", time.Since(oldest).Round(time.Second))
+	return true
+}
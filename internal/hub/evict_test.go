@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubEvictsIdleRoomOnlyInLRUMode(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 3, 50, WithRoomEviction(EvictionLRU))
+	go h.Run()
+	defer h.Stop()
+
+	// Two empty persistent rooms; "older" has been idle longest.
+	if _, err := h.CreateRoom("older", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := h.CreateRoom("newer", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "active")
+
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "fresh")
+	if _, ok := h.RoomUsers("older"); ok {
+		t.Error("expected the longest-idle room to be evicted")
+	}
+	for _, name := range []string{"newer", "active", "fresh"} {
+		if _, ok := h.RoomUsers(name); !ok {
+			t.Errorf("expected room %q kept", name)
+		}
+	}
+
+	carol := testutil.NewMockClient("carol")
+	h.RegisterSync(carol, "another")
+	if _, ok := h.RoomUsers("newer"); ok {
+		t.Error("expected the remaining idle room to be evicted")
+	}
+
+	// Every room now has members, so nothing can be evicted.
+	dave := testutil.NewMockClient("dave")
+	h.RegisterSync(dave, "overflow")
+	if _, ok := h.RoomUsers("overflow"); ok {
+		t.Error("expected the join refused when every room is active")
+	}
+	if em := lastError(dave); em.Message != "max rooms reached" {
+		t.Errorf("expected max rooms error, got %+v", em)
+	}
+	if _, ok := h.RoomUsers("active"); !ok {
+		t.Error("expected the active room kept")
+	}
+}
+
+func TestHubRejectsNewRoomsByDefault(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 1, 50)
+	go h.Run()
+	defer h.Stop()
+
+	if _, err := h.CreateRoom("idle", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	if _, ok := h.RoomUsers("general"); ok {
+		t.Error("expected the join refused at max rooms")
+	}
+	if _, ok := h.RoomUsers("idle"); !ok {
+		t.Error("expected the idle room kept without eviction")
+	}
+}
+
+func TestParseRoomEviction(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]RoomEviction{"": EvictionNone, "none": EvictionNone, "lru": EvictionLRU} {
+		if got, err := ParseRoomEviction(in); err != nil || got != want {
+			t.Errorf("ParseRoomEviction(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseRoomEviction("fifo"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
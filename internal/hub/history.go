@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// ParseRoomHistory parses per-room history limits written as comma-separated
+// room=limit pairs, such as "general=200,eng=500". Room names are
+// canonicalized; limits must be positive. An empty string sets none.
+func ParseRoomHistory(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid room history %q: want room=limit", pair)
+		}
+		room, err := domain.ValidateRoomName(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid room history %q: %w", pair, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid room history %q: limit must be a positive integer", pair)
+		}
+		limits[room] = n
+	}
+	return limits, nil
+}
+
+// WithRoomHistory overrides the history limit for the named rooms, so busy
+// rooms can keep more scrollback than the default. Limits above max are
+// lowered to it; a max of zero leaves them uncapped.
+func WithRoomHistory(limits map[string]int, max int) Option {
+	return func(h *Hub) {
+		h.roomHistory = make(map[string]int, len(limits))
+		for room, n := range limits {
+			if max > 0 && n > max {
+				n = max
+			}
+			h.roomHistory[room] = n
+		}
+	}
+}
+
+// historyLimit returns the number of messages replayed to joiners of room.
+func (h *Hub) historyLimit(room string) int {
+	if n, ok := h.roomHistory[room]; ok {
+		return n
+	}
+	return h.maxHistory
+}
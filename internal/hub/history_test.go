@@ -0,0 +1,72 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"testing"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubRoomHistoryOverride(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	for _, room := range []string{"general", "busy", "huge"} {
+		for i := 0; i < 30; i++ {
+			s.Save(domain.Message{Type: domain.MsgChat, Room: room, User: "alice", Text: fmt.Sprint(i)})
+		}
+	}
+	h := New(s, 100, 5, WithRoomHistory(map[string]int{"busy": 20, "huge": 500}, 25))
+	go h.Run()
+	defer h.Stop()
+
+	historyLen := func(room string) int {
+		c := testutil.NewMockClient("bob")
+		h.RegisterSync(c, room)
+		for _, m := range c.GetMessages() {
+			var hm domain.HistoryMessage
+			if json.Unmarshal(m, &hm) == nil && hm.Type == domain.MsgHistory {
+				return len(hm.Messages)
+			}
+		}
+		return -1
+	}
+	if n := historyLen("general"); n != 5 {
+		t.Errorf("expected the default 5 messages, got %d", n)
+	}
+	if n := historyLen("busy"); n != 20 {
+		t.Errorf("expected the room's own limit of 20, got %d", n)
+	}
+	if n := historyLen("huge"); n != 25 {
+		t.Errorf("expected the limit capped at 25, got %d", n)
+	}
+}
+
+func TestParseRoomHistory(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in      string
+		want    map[string]int
+		wantErr bool
+	}{
+		{"", map[string]int{}, false},
+		{"general=200", map[string]int{"general": 200}, false},
+		{" General = 200 , eng=5,", map[string]int{"general": 200, "eng": 5}, false},
+		{"general", nil, true},
+		{"general=0", nil, true},
+		{"general=lots", nil, true},
+		{"bad room=10", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoomHistory(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRoomHistory(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("ParseRoomHistory(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
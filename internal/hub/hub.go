@@ -1,10 +1,23 @@
 package hub
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/devaloi/chatterbox/internal/broadcast"
+	"github.com/devaloi/chatterbox/internal/deadletter"
 	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/metrics"
+	"github.com/devaloi/chatterbox/internal/ratelimit"
 	"github.com/devaloi/chatterbox/internal/store"
 )
 
@@ -15,18 +28,48 @@ const hubChannelBuffer = 256
 type RegisterRequest struct {
 	Client Client
 	Room   string
+	// Mode is the room mode (domain.RoomMode*) used if this request creates
+	// the room. It is ignored when the room already exists.
+	Mode string
+	// Password is required to join a private room, and makes a room this
+	// request creates private.
+	Password string
+	// SinceID, if set, is the last message the client has; its history then
+	// holds only newer messages (see Room.JoinSince).
+	SinceID string
+	// JoinOnly refuses the join if the room does not exist yet, rather than
+	// creating it.
+	JoinOnly bool
+	// OnReject, if set, is told why the join was refused instead of the
+	// client getting an error frame, so callers can report several joins
+	// together. It runs on the event loop or the room's goroutine and must
+	// not block.
+	OnReject func(code, message string)
+	// Done, if set, is closed once the event loop has handled the request.
+	Done chan struct{}
+
+	// Set by preparePassword before the request is queued.
+	checkedHash string // room hash Password was checked against
+	passwordOK  bool   // Password matches checkedHash
+	newHash     string // Password hashed, for a room the request creates
+	passwordErr error  // the room's password could not be checked
 }
 
 // UnregisterRequest asks the hub to unregister a client from a room.
 type UnregisterRequest struct {
 	Client Client
 	Room   string
+	// Done, if set, is closed once the event loop has handled the request.
+	Done chan struct{}
 }
 
 // MessageRequest routes a message through the hub.
 type MessageRequest struct {
 	Message domain.Message
 	Sender  Client
+	// Done, if set, is closed once the event loop has handled the request.
+	// Fan-out to room members is still asynchronous.
+	Done chan struct{}
 }
 
 // Hub manages all rooms and routes messages between clients.
@@ -45,11 +88,175 @@ type Hub struct {
 	maxHistory int
 	quit       chan struct{}
 	stopOnce   sync.Once
+
+	roomHistory map[string]int // per-room overrides of maxHistory
+
+	pipeline    domain.Pipeline
+	serverID    string
+	broadcaster broadcast.Broadcaster
+
+	maxReactionEmoji int
+	maxUserReactions int
+	policy           domain.TypePolicy
+	joinOrder        JoinOrder
+	eviction         RoomEviction
+	deleteMode       DeleteMode
+
+	presenceConnections bool
+	uniqueNames         bool
+	maxRoomUsers        int
+	roomMsgsPerSec      int
+	kickBan             time.Duration
+	bans                *banList // shared by every room, so bans outlive them
+
+	roomMetrics *metrics.RoomLabels
+
+	load           loadShedder
+	loadMu         sync.Mutex
+	maxPendingRegs int
+	connSlots      chan struct{} // semaphore for WithMaxConnections; nil is unlimited
+
+	controlFrameErrors atomic.Int64
+
+	// Counters for Stats.
+	started time.Time
+	members atomic.Int64 // room memberships across all rooms
+	routed  atomic.Int64 // room and direct messages delivered
+	dropped atomic.Int64 // messages dropped because the queue was full
+
+	deadLetters deadletter.Sink
+
+	lastSeen map[string]time.Time // username -> last activity
+	seenMu   sync.Mutex
+
+	// Live connections, tracked so Shutdown can close them and wait for
+	// their goroutines to exit.
+	conns    map[io.Closer]struct{}
+	users    map[string]map[Client]struct{} // username -> tracked clients
+	connsMu  sync.Mutex
+	connsWG  sync.WaitGroup
+	shutdown bool
+}
+
+// Option configures optional Hub behavior.
+type Option func(*Hub)
+
+// WithTextNormalization enables server-side cleanup of chat text
+// (see domain.NormalizeText) before messages are persisted and broadcast.
+// It appends domain.NormalizeStage to the pipeline at this option's position.
+func WithTextNormalization(enabled bool) Option {
+	return func(h *Hub) {
+		if enabled {
+			h.pipeline = append(h.pipeline, domain.NormalizeStage())
+		}
+	}
+}
+
+// WithPipeline appends stages to the inbound message pipeline. Stages run in
+// the order given, across all WithPipeline and WithTextNormalization options,
+// after room lookup and before the message is persisted and broadcast.
+func WithPipeline(stages ...domain.MessageStage) Option {
+	return func(h *Hub) {
+		h.pipeline = append(h.pipeline, stages...)
+	}
+}
+
+// WithServerID stamps messages routed by this hub with id as their origin,
+// so relayed copies can be recognized and not echoed back.
+func WithServerID(id string) Option {
+	return func(h *Hub) {
+		h.serverID = id
+	}
+}
+
+// WithReactionLimits caps the distinct emoji on a single message and the
+// total reactions a user may add in a room. Zero means unlimited.
+func WithReactionLimits(maxEmojiPerMessage, maxPerUser int) Option {
+	return func(h *Hub) {
+		h.maxReactionEmoji = maxEmojiPerMessage
+		h.maxUserReactions = maxPerUser
+	}
+}
+
+// WithTypePolicy sets which message types are persisted and replayed in
+// join history.
+func WithTypePolicy(p domain.TypePolicy) Option {
+	return func(h *Hub) {
+		h.policy = p
+	}
+}
+
+// WithJoinOrder sets the order of the presence and history frames sent to
+// a joining client.
+func WithJoinOrder(o JoinOrder) Option {
+	return func(h *Hub) {
+		h.joinOrder = o
+	}
+}
+
+// WithPresenceConnections adds each user's connection count to presence
+// snapshots, for users connected to a room more than once.
+func WithPresenceConnections(enabled bool) Option {
+	return func(h *Hub) {
+		h.presenceConnections = enabled
+	}
+}
+
+// WithMaxRoomUsers caps how many connections a room accepts; joins beyond
+// it are refused with a room_full error. Zero means unlimited.
+func WithMaxRoomUsers(n int) Option {
+	return func(h *Hub) {
+		h.maxRoomUsers = n
+	}
+}
+
+// WithRoomRateLimit caps the chat messages each room accepts to perSec a
+// second across all senders, allowing bursts of up to perSec. Messages over
+// the cap are refused with a rate_limited error to their sender, so one busy
+// room cannot flood its members. Zero means unlimited.
+func WithRoomRateLimit(perSec int) Option {
+	return func(h *Hub) {
+		h.roomMsgsPerSec = perSec
+	}
+}
+
+// JoinRejecter is a Client that tracks its own room memberships and must
+// forget a room when the hub refuses to let it in or kicks it out.
+type JoinRejecter interface {
+	Client
+	JoinRejected(room string)
+}
+
+// rejectJoin tells a client its join was refused.
+func rejectJoin(c Client, room, code, text string) {
+	if jr, ok := c.(JoinRejecter); ok {
+		jr.JoinRejected(room)
+	}
+	sendErrorCode(c, code, text)
+}
+
+// rejectRegister refuses req, through its OnReject hook if it has one.
+func rejectRegister(req RegisterRequest, code, text string) {
+	if req.OnReject == nil {
+		rejectJoin(req.Client, req.Room, code, text)
+		return
+	}
+	if jr, ok := req.Client.(JoinRejecter); ok {
+		jr.JoinRejected(req.Room)
+	}
+	req.OnReject(code, text)
+}
+
+// WithRoomMetrics counts messages routed to each room in m.
+func WithRoomMetrics(m *metrics.RoomLabels) Option {
+	return func(h *Hub) {
+		h.roomMetrics = m
+	}
 }
 
 // New creates a new Hub.
-func New(s store.Store, maxRooms, maxHistory int) *Hub {
-	return &Hub{
+func New(s store.Store, maxRooms, maxHistory int, opts ...Option) *Hub {
+	h := &Hub{
 		rooms:      make(map[string]*Room),
 		register:   make(chan RegisterRequest, hubChannelBuffer),
 		unregister: make(chan UnregisterRequest, hubChannelBuffer),
@@ -58,7 +265,20 @@ func New(s store.Store, maxRooms, maxHistory int) *Hub {
 		maxRooms:   maxRooms,
 		maxHistory: maxHistory,
 		quit:       make(chan struct{}),
+		conns:      make(map[io.Closer]struct{}),
+		users:      make(map[string]map[Client]struct{}),
+		lastSeen:   make(map[string]time.Time),
+		policy:     domain.DefaultTypePolicy(),
+		kickBan:    DefaultKickBan,
+		bans:       newBanList(),
+		started:    time.Now(),
+
+		broadcaster: broadcast.Local{},
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
 
 // Run starts the hub's main event loop. Should be called as a goroutine.
@@ -66,11 +286,15 @@ func (h *Hub) Run() {
 	for {
 		select {
 		case req := <-h.register:
-			h.handleRegister(req)
+			if h.handleRegister(req) {
+				signal(req.Done)
+			}
 		case req := <-h.unregister:
 			h.handleUnregister(req)
+			signal(req.Done)
 		case req := <-h.message:
 			h.handleMessage(req)
+			signal(req.Done)
 		case <-h.quit:
 			return
 		}
@@ -90,9 +314,162 @@ func (h *Hub) Stop() {
 	})
 }
 
+// TrackConn registers a live connection with the hub. The returned function
+// must be called exactly once, after all of the connection's goroutines have
+// exited. Connections tracked after Shutdown has begun are closed immediately.
+// Connections that are also a Client are indexed by username for
+// ConnectedUsers.
+func (h *Hub) TrackConn(c io.Closer) (done func()) {
+	cl, isClient := c.(Client)
+	h.connsMu.Lock()
+	h.connsWG.Add(1)
+	h.conns[c] = struct{}{}
+	// Relays are connections, not users.
+	isClient = isClient && !isRelay(cl)
+	if isClient {
+		name := cl.Username()
+		if h.users[name] == nil {
+			h.users[name] = make(map[Client]struct{})
+		}
+		h.users[name][cl] = struct{}{}
+	}
+	closing := h.shutdown
+	h.connsMu.Unlock()
+	if closing {
+		c.Close()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.connsMu.Lock()
+			delete(h.conns, c)
+			if isClient {
+				name := cl.Username()
+				delete(h.users[name], cl)
+				if len(h.users[name]) == 0 {
+					delete(h.users, name)
+				}
+			}
+			h.connsMu.Unlock()
+			h.connsWG.Done()
+		})
+	}
+}
+
+// Drainer is implemented by connections that can close gracefully: stop
+// taking new messages, write whatever is already queued, and then close.
+type Drainer interface {
+	Drain()
+}
+
+// Disconnecter is implemented by connections that can close gracefully, like
+// a Drainer, with a given WebSocket close code and reason.
+type Disconnecter interface {
+	Disconnect(code int, reason string)
+}
+
+// FrameEncoder is implemented by connections that write frames in a codec
+// other than JSON. A room fan-out encodes each frame once per codec and
+// hands members the JSON and its encoding together, rather than every
+// member transcoding the same frame.
+type FrameEncoder interface {
+	Codec() domain.Codec
+	SendEncoded(data, encoded []byte)
+}
+
+// Announce sends a system message with the given text to every room. The
+// message is queued on each member's connection before Announce returns, so
+// a Shutdown that follows delivers it ahead of the close frame.
+func (h *Hub) Announce(text string) {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+
+	now := time.Now().UTC()
+	for _, r := range rooms {
+		msg := domain.Message{ID: uuid.NewString(), Type: domain.MsgSystem, Room: r.name, Text: text, Timestamp: now}
+		r.saveEvent(msg)
+		data, err := domain.Encode(msg)
+		if err != nil {
+			slog.Error("encode announcement", "room", r.name, "err", err)
+			continue
+		}
+		r.sendAll(data)
+	}
+}
+
+// Shutdown closes every tracked connection and waits for their goroutines to
+// exit before stopping the hub. Connections implementing Drainer are asked to
+// close gracefully; the rest are closed outright. The event loop keeps
+// running while clients unregister. If ctx expires first, connections that
+// are still open are force-closed, the hub is stopped anyway, and ctx's error
+// is returned.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.connsMu.Lock()
+	h.shutdown = true
+	conns := make([]io.Closer, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.connsMu.Unlock()
+
+	for _, c := range conns {
+		if d, ok := c.(Drainer); ok {
+			d.Drain()
+		} else {
+			c.Close()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.connsWG.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		h.connsMu.Lock()
+		for c := range h.conns {
+			c.Close()
+		}
+		h.connsMu.Unlock()
+	}
+	h.Stop()
+	return err
+}
+
+// signal closes a request's completion channel, if it has one.
+func signal(done chan struct{}) {
+	if done != nil {
+		close(done)
+	}
+}
+
+// wait blocks until done is closed or the hub stops.
+func (h *Hub) wait(done chan struct{}) {
+	select {
+	case <-done:
+	case <-h.quit:
+	}
+}
+
 // Register queues a client registration request.
 func (h *Hub) Register(client Client, room string) {
-	h.register <- RegisterRequest{Client: client, Room: room}
+	h.RegisterMode(client, room, domain.RoomModeDefault)
+}
+
+// RegisterMode queues a client registration that creates the room with the
+// given mode (domain.RoomMode*) if it does not exist yet.
+func (h *Hub) RegisterMode(client Client, room, mode string) {
+	h.register <- RegisterRequest{Client: client, Room: room, Mode: mode}
 }
 
 // Unregister queues a client unregistration request.
@@ -100,9 +477,46 @@ func (h *Hub) Unregister(client Client, room string) {
 	h.unregister <- UnregisterRequest{Client: client, Room: room}
 }
 
-// RouteMessage queues a message for routing.
+// RouteMessage queues a message for routing. It never blocks: if the
+// message queue is full the message is dropped, counted in Stats, recorded
+// as a dead letter, and the sender is told it was not handled.
 func (h *Hub) RouteMessage(msg domain.Message, sender Client) {
-	h.message <- MessageRequest{Message: msg, Sender: sender}
+	select {
+	case h.message <- MessageRequest{Message: msg, Sender: sender}:
+	default:
+		h.dropMessage(msg, sender)
+	}
+}
+
+// RegisterSync registers a client and blocks until the hub has handled the
+// request, including sending the joiner its presence and history snapshot.
+// It is intended for tests that would otherwise sleep.
+func (h *Hub) RegisterSync(client Client, room string) {
+	h.registerSync(RegisterRequest{Client: client, Room: room})
+}
+
+func (h *Hub) registerSync(req RegisterRequest) {
+	h.preparePassword(&req)
+	req.Done = make(chan struct{})
+	h.register <- req
+	h.wait(req.Done)
+}
+
+// UnregisterSync unregisters a client and blocks until the hub has handled
+// the request.
+func (h *Hub) UnregisterSync(client Client, room string) {
+	done := make(chan struct{})
+	h.unregister <- UnregisterRequest{Client: client, Room: room, Done: done}
+	h.wait(done)
+}
+
+// RouteMessageSync routes a message and blocks until the hub has handled it.
+// The message is persisted by then, but delivery to room members happens on
+// the room's goroutine and may still be in flight.
+func (h *Hub) RouteMessageSync(msg domain.Message, sender Client) {
+	done := make(chan struct{})
+	h.message <- MessageRequest{Message: msg, Sender: sender, Done: done}
+	h.wait(done)
 }
 
 // ListRooms returns info about all active rooms.
@@ -113,48 +527,208 @@ func (h *Hub) ListRooms() []domain.Room {
 	for _, r := range h.rooms {
 		rooms = append(rooms, domain.Room{
 			Name:      r.Name(),
+			Topic:     r.Topic(),
 			UserCount: r.ClientCount(),
+			Private:   r.Private(),
+			CreatedAt: r.CreatedAt(),
 		})
 	}
 	return rooms
 }
 
-// RoomInfo returns details about a specific room, or nil if not found.
+// AllRooms returns the live rooms, with user counts, merged with the rooms
+// the store holds messages for, ordered by name. Rooms with history but no
+// live room have a user count of zero, and are marked private when the
+// store holds a password for them. Direct-message rooms are left out.
+func (h *Hub) AllRooms() ([]domain.Room, error) {
+	rooms := h.ListRooms()
+	ps, _ := h.store.(store.RoomPasswordStore)
+	if ms, ok := h.store.(store.MessageRoomStore); ok {
+		names, err := ms.MessageRooms()
+		if err != nil {
+			return nil, err
+		}
+		live := make(map[string]bool, len(rooms))
+		for _, r := range rooms {
+			live[r.Name] = true
+		}
+		for _, name := range names {
+			if live[name] || domain.IsDMRoom(name) {
+				continue
+			}
+			room := domain.Room{Name: name}
+			if ps != nil {
+				hash, err := ps.RoomPassword(name)
+				if err != nil {
+					return nil, err
+				}
+				room.Private = hash != ""
+			}
+			rooms = append(rooms, room)
+		}
+	}
+	slices.SortFunc(rooms, func(a, b domain.Room) int { return strings.Compare(a.Name, b.Name) })
+	return rooms, nil
+}
+
+// RoomInfo returns details about a specific room, or nil if not found. The
+// message count is filled in when the store can count messages.
 func (h *Hub) RoomInfo(name string) *domain.Room {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
 	r, ok := h.rooms[name]
 	if !ok {
+		h.mu.RUnlock()
 		return nil
 	}
-	return &domain.Room{
+	info := &domain.Room{
 		Name:      r.Name(),
+		Topic:     r.Topic(),
 		UserCount: r.ClientCount(),
+		Private:   r.Private(),
+		CreatedAt: r.CreatedAt(),
 	}
+	h.mu.RUnlock()
+
+	if cs, ok := h.store.(store.CountStore); ok {
+		n, err := cs.CountMessages(name)
+		if err != nil {
+			slog.Error("count messages", "room", name, "err", err)
+		}
+		info.MessageCount = n
+	}
+	return info
 }
 
-func (h *Hub) handleRegister(req RegisterRequest) {
+// handleRegister adds req's client to its room, starting the room if
+// needed. It reports false if the request is not done yet: handed back to
+// have its password checked again, or queued on the room, which signals
+// Done once the join is applied.
+func (h *Hub) handleRegister(req RegisterRequest) bool {
+	if req.passwordErr != nil {
+		rejectRegister(req, domain.ErrCodeInternal, "could not check the room password")
+		return true
+	}
+	h.mu.RLock()
+	_, live := h.rooms[req.Room]
+	h.mu.RUnlock()
+	stored := ""
+	if !live && !req.JoinOnly {
+		var err error
+		if stored, err = h.storedPassword(req.Room, req.Mode); err != nil {
+			rejectRegister(req, domain.ErrCodeInternal, "could not check the room password")
+			return true
+		}
+	}
+
 	h.mu.Lock()
 	r, ok := h.rooms[req.Room]
+	adopted := false
 	if !ok {
-		if len(h.rooms) >= h.maxRooms {
+		if req.JoinOnly {
 			h.mu.Unlock()
-			errMsg := domain.ErrorMessage{Type: domain.MsgError, Message: "max rooms reached"}
-			data, err := domain.Encode(errMsg)
-			if err != nil {
-				log.Printf("encode error: %v", err)
-				return
-			}
-			req.Client.Send(data)
-			return
+			rejectRegister(req, domain.ErrCodeForbidden, "room does not exist")
+			return true
+		}
+		if live {
+			// Closed since the lookup above, so its stored password
+			// was not read.
+			h.mu.Unlock()
+			rejectRegister(req, domain.ErrCodeRoomClosed, ErrRoomClosed.Error())
+			return true
+		}
+		if !h.hasRoomSpaceLocked() {
+			h.mu.Unlock()
+			rejectRegister(req, "", "max rooms reached")
+			return true
+		}
+		r = h.startRoom(req.Room, req.Mode)
+		r.passwordHash = stored
+		if stored == "" && req.newHash != "" {
+			r.passwordHash = req.newHash
+			adopted = true
 		}
-		r = NewRoom(req.Room, h.store, h.maxHistory)
-		h.rooms[req.Room] = r
-		go r.Run()
-		log.Printf("room created: %s", req.Room)
 	}
 	h.mu.Unlock()
-	r.Join(req.Client)
+	if adopted {
+		h.savePassword(r)
+	}
+	if !adopted && r.passwordHash != "" {
+		switch {
+		case req.Password != "" && req.checkedHash != r.passwordHash:
+			// The password was checked against an older hash, or none.
+			// Check it again off the event loop rather than hash here.
+			h.dropIfEmpty(r)
+			go h.recheckPassword(req)
+			return false
+		case !req.passwordOK:
+			rejectRegister(req, domain.ErrCodeBadPassword, "incorrect room password")
+			h.dropIfEmpty(r)
+			return true
+		}
+	}
+	add := func() error { return r.join(req.Client, req.SinceID) }
+	if isRelay(req.Client) {
+		add = func() error { return r.watch(req.Client) }
+	}
+	// Queued behind the room's pending fan-outs; the event loop moves on
+	// rather than wait for them.
+	r.admit(add, func(err error) {
+		h.joined(req, r, err)
+		signal(req.Done)
+	})
+	return false
+}
+
+// joined reports the outcome of a registration's join, once the room has
+// applied it.
+func (h *Hub) joined(req RegisterRequest, r *Room, err error) {
+	switch {
+	case errors.Is(err, ErrRoomFull):
+		rejectRegister(req, domain.ErrCodeRoomFull, err.Error())
+	case errors.Is(err, ErrBanned):
+		rejectRegister(req, domain.ErrCodeBanned, err.Error())
+		h.dropIfEmpty(r)
+	case errors.Is(err, ErrRoomClosed):
+		rejectRegister(req, domain.ErrCodeRoomClosed, err.Error())
+	}
+}
+
+// startRoom creates a room configured from the hub's settings, adds it to
+// h.rooms and starts its goroutine. The caller must hold h.mu.
+func (h *Hub) startRoom(name, mode string) *Room {
+	r := NewRoom(name, h.store, h.historyLimit(name))
+	r.reactions = newReactions(h.maxReactionEmoji, h.maxUserReactions)
+	r.policy = h.policy
+	r.joinOrder = h.joinOrder
+	r.busy = h.Busy
+	r.mode = mode
+	r.presenceConnections = h.presenceConnections
+	r.maxClients = h.maxRoomUsers
+	r.bans = h.bans
+	if h.roomMsgsPerSec > 0 {
+		r.limiter = ratelimit.New(h.roomMsgsPerSec)
+	}
+	r.broadcaster = h.broadcaster
+	r.members = &h.members
+	r.onCrash = func() { h.closeCrashedRoom(r) }
+	h.rooms[name] = r
+	go r.Run()
+	slog.Info("room created", "room", name)
+	return r
+}
+
+// closeCrashedRoom removes a room whose broadcast loop gave up after
+// repeated panics, and tells its members they are no longer in it.
+func (h *Hub) closeCrashedRoom(r *Room) {
+	h.mu.Lock()
+	if h.rooms[r.name] == r {
+		delete(h.rooms, r.name)
+	}
+	h.mu.Unlock()
+	r.Stop()
+	for _, c := range r.removeAll() {
+		rejectJoin(c, r.name, domain.ErrCodeRoomClosed, "room closed after an internal error")
+	}
 }
 
 func (h *Hub) handleUnregister(req UnregisterRequest) {
@@ -167,45 +741,237 @@ func (h *Hub) handleUnregister(req UnregisterRequest) {
 	h.mu.Unlock()
 
 	r.Leave(req.Client)
+	h.dropIfEmpty(r)
 
-	// Auto-cleanup empty rooms. Hold the lock for the entire check-and-delete
-	// to prevent a TOCTOU race where a client could join between the count
-	// check and the delete.
+	if isRelay(req.Client) {
+		return
+	}
+	user := req.Client.Username()
+	h.touch(user, time.Now().UTC())
+	h.persistLastSeen(user)
+}
+
+// dropIfEmpty stops and removes a room nobody is in or watches, unless it
+// is persistent. It holds the lock for the entire check-and-delete to prevent a
+// TOCTOU race where a client could join between the count check and the
+// delete.
+func (h *Hub) dropIfEmpty(r *Room) {
 	h.mu.Lock()
-	if r.ClientCount() == 0 {
+	if r.empty() && r.mode != domain.RoomModePersistent && h.rooms[r.name] == r {
 		r.Stop()
-		delete(h.rooms, req.Room)
-		log.Printf("room deleted: %s", req.Room)
+		delete(h.rooms, r.name)
+		slog.Info("room deleted", "room", r.name)
 	}
 	h.mu.Unlock()
 }
 
 func (h *Hub) handleMessage(req MessageRequest) {
+	relayed := req.Sender != nil && isRelay(req.Sender)
+	if req.Sender != nil && !relayed {
+		h.touch(req.Sender.Username(), time.Now().UTC())
+	}
+	if req.Message.Type == domain.MsgDM {
+		h.handleDM(req)
+		return
+	}
+
 	h.mu.RLock()
 	r, ok := h.rooms[req.Message.Room]
 	h.mu.RUnlock()
 	if !ok {
-		errMsg := domain.ErrorMessage{Type: domain.MsgError, Message: "room not found"}
-		data, err := domain.Encode(errMsg)
-		if err != nil {
-			log.Printf("encode error: %v", err)
+		sendError(req.Sender, "room not found")
+		return
+	}
+
+	switch req.Message.Type {
+	case domain.MsgReact:
+		h.handleReaction(r, req)
+		return
+	case domain.MsgLock, domain.MsgUnlock:
+		h.handleLock(r, req)
+		return
+	case domain.MsgKick:
+		h.handleKick(r, req)
+		return
+	case domain.MsgTopic:
+		h.handleTopic(r, req)
+		return
+	case domain.MsgEdit, domain.MsgDelete:
+		h.handleEdit(r, req)
+		return
+	case domain.MsgChat:
+		if r.Locked() {
+			sendErrorCode(req.Sender, domain.ErrCodeRoomLocked, "room is locked")
+			return
+		}
+		if req.Message.ReplyTo != "" && !h.replyParentExists(r, req.Message.ReplyTo) {
+			sendError(req.Sender, "reply parent not found")
+			return
+		}
+		if r.limiter != nil && !r.limiter.Allow(time.Now()) {
+			h.deadLetter(deadletter.ReasonRoomRateLimited, req.Message, req.Sender)
+			sendErrorCode(req.Sender, domain.ErrCodeRateLimited, "room rate limit exceeded")
 			return
 		}
-		req.Sender.Send(data)
+	}
+
+	if !h.process(&req.Message, req.Sender) {
 		return
 	}
 
-	// Persist the message.
-	if h.store != nil {
-		if err := h.store.Save(req.Message); err != nil {
-			log.Printf("store save error: %v", err)
+	// Only a relay may say which server a message came from; anything
+	// else is stamped as routed here, whatever origin its sender claimed,
+	// so clients cannot defeat loop prevention.
+	if !relayed || req.Message.Origin == "" {
+		req.Message.Origin = h.serverID
+	}
+
+	// Persist the message. A resubmission with an already-used client id is
+	// not broadcast again; the sender gets the original message id back.
+	// The sender is acked (or nacked) ahead of the broadcast, so the ack
+	// reaches it before its own copy of the message.
+	clientID := req.Message.ClientID
+	req.Message.ClientID = ""
+	clientMsgID := req.Message.ClientMsgID
+	req.Message.ClientMsgID = ""
+	var saveErr error
+	if h.store != nil && h.policy.ShouldPersist(req.Message.Type) && r.mode != domain.RoomModeEphemeral {
+		if is, ok := h.store.(store.IdempotentStore); ok && clientID != "" {
+			id, err := is.SaveIdempotent(req.Message, clientID)
+			if err != nil {
+				slog.Error("store save", "room", req.Message.Room, "user", req.Message.User, "err", err)
+				saveErr = err
+			} else if id != req.Message.ID {
+				sendAck(req.Sender, clientMsgID, id, nil)
+				h.sendDuplicate(req, id, clientID)
+				return
+			}
+		} else if err := h.store.Save(req.Message); err != nil {
+			slog.Error("store save", "room", req.Message.Room, "user", req.Message.User, "err", err)
+			saveErr = err
 		}
 	}
+	sendAck(req.Sender, clientMsgID, req.Message.ID, saveErr)
 
+	receipt := req.Message.Receipt
+	req.Message.Receipt = false
+	if p, ok := req.Sender.(*poster); ok {
+		p.msg = req.Message
+	}
 	data, err := domain.Encode(req.Message)
 	if err != nil {
-		log.Printf("encode error: %v", err)
+		slog.Error("encode message", "room", req.Message.Room, "user", req.Message.User, "err", err)
+		return
+	}
+	r.poll.add(req.Message)
+	if h.roomMetrics != nil {
+		h.roomMetrics.Observe(r.name)
+	}
+	h.routed.Add(1)
+	if req.Message.Type == domain.MsgChat {
+		h.notifyMentions(r, req.Message)
+	}
+	if !receipt {
+		r.Broadcast(data)
+		return
+	}
+
+	sender, room, id := req.Sender, req.Message.Room, req.Message.ID
+	r.BroadcastWithReceipt(data, sender, func(count int) {
+		dm := domain.DeliveredMessage{Type: domain.MsgDelivered, Room: room, ID: id, Count: count}
+		data, err := domain.Encode(dm)
+		if err != nil {
+			slog.Error("encode receipt", "room", room, "err", err)
+			return
+		}
+		sender.Send(data)
+	})
+}
+
+// process runs the pipeline over msg and reports whether it passed. A
+// rejected message is answered with an error to sender.
+func (h *Hub) process(msg *domain.Message, sender Client) bool {
+	err := h.pipeline.Process(msg)
+	if err == nil {
+		return true
+	}
+	var se *domain.StageError
+	if errors.As(err, &se) {
+		sendErrorCode(sender, se.Code, se.Message)
+	} else {
+		sendError(sender, err.Error())
+	}
+	return false
+}
+
+func (h *Hub) handleReaction(r *Room, req MessageRequest) {
+	switch err := r.React(req.Message); err {
+	case nil:
+	case errReactionEmojiLimit:
+		sendErrorCode(req.Sender, domain.ErrCodeReactionEmojiLimit, err.Error())
+	case errReactionUserLimit:
+		sendErrorCode(req.Sender, domain.ErrCodeReactionUserLimit, err.Error())
+	default:
+		sendError(req.Sender, err.Error())
+	}
+}
+
+// sendDuplicate echoes a deduplicated message back to its sender only,
+// carrying the id it was originally stored under.
+func (h *Hub) sendDuplicate(req MessageRequest, id, clientID string) {
+	msg := req.Message
+	msg.ID = id
+	msg.ClientID = clientID
+	msg.Receipt = false
+	data, err := domain.Encode(msg)
+	if err != nil {
+		slog.Error("encode duplicate", "room", msg.Room, "user", msg.User, "err", err)
+		return
+	}
+	req.Sender.Send(data)
+}
+
+// sendAck tells the sender of a message carrying a client_msg_id whether it
+// was stored under id. Messages without one get no answer. Store errors are
+// logged by the caller and reported to the client only generically.
+func sendAck(c Client, clientMsgID, id string, saveErr error) {
+	if clientMsgID == "" {
+		return
+	}
+	if saveErr != nil {
+		sendNack(c, clientMsgID, "message not saved")
+		return
+	}
+	sendAckMessage(c, domain.AckMessage{Type: domain.MsgAck, ClientMsgID: clientMsgID, ID: id})
+}
+
+// sendNack tells the sender of a message carrying clientMsgID that it was
+// not handled, and why.
+func sendNack(c Client, clientMsgID, reason string) {
+	sendAckMessage(c, domain.AckMessage{Type: domain.MsgNack, ClientMsgID: clientMsgID, Error: reason})
+}
+
+func sendAckMessage(c Client, ack domain.AckMessage) {
+	data, err := domain.Encode(ack)
+	if err != nil {
+		slog.Error("encode ack", "user", c.Username(), "err", err)
+		return
+	}
+	c.Send(data)
+}
+
+// sendError encodes an ErrorMessage and sends it to a single client.
+func sendError(c Client, message string) {
+	sendErrorCode(c, "", message)
+}
+
+// sendErrorCode sends an ErrorMessage carrying a machine-readable code.
+func sendErrorCode(c Client, code, message string) {
+	errMsg := domain.ErrorMessage{Type: domain.MsgError, Code: code, Message: message}
+	data, err := domain.Encode(errMsg)
+	if err != nil {
+		slog.Error("encode error message", "user", c.Username(), "err", err)
 		return
 	}
-	r.Broadcast(data)
+	c.Send(data)
 }
@@ -1,11 +1,18 @@
 package hub
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/devaloi/chatterbox/internal/deadletter"
 	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
 	"github.com/devaloi/chatterbox/internal/testutil"
 )
 
@@ -17,8 +24,7 @@ func TestHubCreateRoom(t *testing.T) {
 	defer h.Stop()
 
 	c := testutil.NewMockClient("alice")
-	h.Register(c, "general")
-	time.Sleep(100 * time.Millisecond)
+	h.RegisterSync(c, "general")
 
 	rooms := h.ListRooms()
 	if len(rooms) != 1 {
@@ -37,8 +43,7 @@ func TestHubRoomInfo(t *testing.T) {
 	defer h.Stop()
 
 	c := testutil.NewMockClient("alice")
-	h.Register(c, "general")
-	time.Sleep(100 * time.Millisecond)
+	h.RegisterSync(c, "general")
 
 	info := h.RoomInfo("general")
 	if info == nil {
@@ -53,6 +58,104 @@ func TestHubRoomInfo(t *testing.T) {
 	}
 }
 
+func TestHubRoomCreatedAt(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	before := time.Now()
+	h := New(s, 100, 50)
+	go h.Run()
+	h.RegisterSync(testutil.NewMockClient("alice"), "general")
+	created, err := h.CreateRoom("eng", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	rooms := h.ListRooms()
+	if len(rooms) != 2 {
+		t.Fatalf("expected 2 rooms, got %+v", rooms)
+	}
+	for _, r := range rooms {
+		if r.CreatedAt.Before(before) || r.CreatedAt.After(after) {
+			t.Errorf("expected %s created between %v and %v, got %v", r.Name, before, after, r.CreatedAt)
+		}
+	}
+	if info := h.RoomInfo("general"); info == nil || info.CreatedAt.IsZero() {
+		t.Errorf("expected room info with a creation time, got %+v", info)
+	}
+	h.Stop()
+
+	// A created room keeps its creation time across a restart.
+	h2 := New(s, 100, 50)
+	if err := h2.RestoreRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if info := h2.RoomInfo("eng"); info == nil || !info.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("expected restored room created at %v, got %+v", created.CreatedAt, info)
+	}
+}
+
+func TestHubCloseRoomRefusesRacingJoin(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	if _, err := h.CreateRoom("general", ""); err != nil {
+		t.Fatal(err)
+	}
+	// A register that looked the room up just before the close holds the
+	// old room, and joins it only after the close.
+	h.mu.RLock()
+	r := h.rooms["general"]
+	h.mu.RUnlock()
+	if err := h.CloseRoom("general"); err != nil {
+		t.Fatal(err)
+	}
+	alice := testutil.NewMockClient("alice")
+	if err := r.Join(alice); !errors.Is(err, ErrRoomClosed) {
+		t.Errorf("expected ErrRoomClosed joining a closed room, got %v", err)
+	}
+	if n := r.ClientCount(); n != 0 {
+		t.Errorf("expected the closed room to stay empty, got %d members", n)
+	}
+
+	// Concurrent joins and closes leave no one stranded in a dead room.
+	for range 50 {
+		bob := testutil.NewMockClient("bob")
+		h.CreateRoom("general", "")
+		joined := make(chan struct{})
+		go func() {
+			h.RegisterSync(bob, "general")
+			close(joined)
+		}()
+		h.CloseRoom("general")
+		<-joined
+		info := h.RoomInfo("general")
+		if (info == nil || info.UserCount != 1) && lastError(bob).Code != domain.ErrCodeRoomClosed {
+			t.Fatalf("expected bob in a live room or told it closed, got %+v", info)
+		}
+		h.CloseRoom("general")
+	}
+}
+
+func TestHubUserConnected(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	track(h, "guest-7f3a91c2")
+	if !h.UserConnected("guest-7f3a91c2") {
+		t.Error("expected a tracked user to be connected")
+	}
+	if h.UserConnected("guest-00000000") {
+		t.Error("expected an unknown user not to be connected")
+	}
+}
+
 func TestHubRouteMessage(t *testing.T) {
 	t.Parallel()
 	s := testutil.NewMockStore()
@@ -106,15 +209,13 @@ func TestHubAutoCleanup(t *testing.T) {
 	defer h.Stop()
 
 	c := testutil.NewMockClient("alice")
-	h.Register(c, "temp")
-	time.Sleep(100 * time.Millisecond)
+	h.RegisterSync(c, "temp")
 
 	if len(h.ListRooms()) != 1 {
 		t.Fatal("expected 1 room")
 	}
 
-	h.Unregister(c, "temp")
-	time.Sleep(100 * time.Millisecond)
+	h.UnregisterSync(c, "temp")
 
 	if len(h.ListRooms()) != 0 {
 		t.Error("expected room to be auto-deleted")
@@ -132,12 +233,9 @@ func TestHubMaxRooms(t *testing.T) {
 	c2 := testutil.NewMockClient("bob")
 	c3 := testutil.NewMockClient("charlie")
 
-	h.Register(c1, "room1")
-	h.Register(c2, "room2")
-	time.Sleep(100 * time.Millisecond)
-
-	h.Register(c3, "room3")
-	time.Sleep(100 * time.Millisecond)
+	h.RegisterSync(c1, "room1")
+	h.RegisterSync(c2, "room2")
+	h.RegisterSync(c3, "room3")
 
 	if len(h.ListRooms()) != 2 {
 		t.Errorf("expected 2 rooms (max), got %d", len(h.ListRooms()))
@@ -156,3 +254,570 @@ func TestHubMaxRooms(t *testing.T) {
 		t.Error("expected error message for max rooms")
 	}
 }
+
+func TestHubTextNormalization(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50, WithTextNormalization(true))
+	go h.Run()
+	defer h.Stop()
+
+	c := testutil.NewMockClient("alice")
+	h.Register(c, "general")
+	time.Sleep(100 * time.Millisecond)
+
+	h.RouteMessage(domain.Message{
+		Type: domain.MsgChat, Room: "general", User: "alice",
+		Text: "\n\t  hello\n\n\n\nworld  \n",
+	}, c)
+	time.Sleep(100 * time.Millisecond)
+
+	want := "hello\n\nworld"
+	history, _ := s.History("general", 50)
+	if len(history) != 1 || history[0].Text != want {
+		t.Fatalf("expected stored text %q, got %+v", want, history)
+	}
+
+	found := false
+	for _, m := range c.GetMessages() {
+		var decoded domain.Message
+		if err := json.Unmarshal(m, &decoded); err == nil && decoded.Type == domain.MsgChat {
+			found = decoded.Text == want
+		}
+	}
+	if !found {
+		t.Errorf("expected broadcast text %q", want)
+	}
+}
+
+func TestHubDeliveryReceipt(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	sender := testutil.NewMockClient("alice")
+	h.Register(sender, "general")
+	for _, name := range []string{"bob", "carol", "dave"} {
+		h.Register(testutil.NewMockClient(name), "general")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	h.RouteMessage(domain.Message{
+		ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice",
+		Text: "hello", Receipt: true,
+	}, sender)
+	time.Sleep(100 * time.Millisecond)
+
+	var receipt *domain.DeliveredMessage
+	for _, m := range sender.GetMessages() {
+		var dm domain.DeliveredMessage
+		if err := json.Unmarshal(m, &dm); err == nil && dm.Type == domain.MsgDelivered {
+			receipt = &dm
+		}
+	}
+	if receipt == nil {
+		t.Fatal("expected delivered receipt")
+	}
+	// Three other members; the sender is not counted.
+	if receipt.Count != 3 || receipt.ID != "m1" || receipt.Room != "general" {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+}
+
+func TestHubReactionLimits(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50, WithReactionLimits(2, 3))
+	go h.Run()
+	defer h.Stop()
+
+	c := testutil.NewMockClient("alice")
+	h.Register(c, "general")
+	time.Sleep(100 * time.Millisecond)
+
+	react := func(messageID, emoji string) {
+		h.RouteMessage(domain.Message{
+			Type: domain.MsgReact, Room: "general", User: "alice",
+			MessageID: messageID, Emoji: emoji,
+		}, c)
+	}
+	lastError := func() domain.ErrorMessage {
+		var last domain.ErrorMessage
+		for _, m := range c.GetMessages() {
+			var em domain.ErrorMessage
+			if err := json.Unmarshal(m, &em); err == nil && em.Type == domain.MsgError {
+				last = em
+			}
+		}
+		return last
+	}
+
+	// Two distinct emoji on m1 is the per-message cap.
+	react("m1", "👍")
+	react("m1", "🎉")
+	time.Sleep(50 * time.Millisecond)
+	if em := lastError(); em.Code != "" {
+		t.Fatalf("unexpected error within cap: %+v", em)
+	}
+	react("m1", "❤️")
+	time.Sleep(50 * time.Millisecond)
+	if em := lastError(); em.Code != domain.ErrCodeReactionEmojiLimit {
+		t.Fatalf("expected %s, got %+v", domain.ErrCodeReactionEmojiLimit, em)
+	}
+
+	// Third reaction overall reaches the per-user cap; the fourth is rejected.
+	react("m2", "👍")
+	time.Sleep(50 * time.Millisecond)
+	react("m3", "👍")
+	time.Sleep(50 * time.Millisecond)
+	if em := lastError(); em.Code != domain.ErrCodeReactionUserLimit {
+		t.Fatalf("expected %s, got %+v", domain.ErrCodeReactionUserLimit, em)
+	}
+
+	reactions := 0
+	for _, m := range c.GetMessages() {
+		var decoded domain.Message
+		if err := json.Unmarshal(m, &decoded); err == nil && decoded.Type == domain.MsgReact {
+			reactions++
+		}
+	}
+	if reactions != 3 {
+		t.Errorf("expected 3 reaction broadcasts, got %d", reactions)
+	}
+}
+
+func TestHubTypePolicy(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	policy := domain.TypePolicy{
+		Persist: map[string]bool{domain.MsgChat: true, domain.MsgSystem: true},
+		History: map[string]bool{domain.MsgChat: true},
+	}
+	h := New(s, 100, 50, WithTypePolicy(policy))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgSystem, Room: "general", Text: "maintenance"}, alice)
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}, alice)
+
+	stored, _ := s.History("general", 50)
+	if len(stored) != 2 {
+		t.Fatalf("expected system and chat persisted, got %d", len(stored))
+	}
+
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general")
+
+	for _, m := range bob.GetMessages() {
+		var hm domain.HistoryMessage
+		if err := json.Unmarshal(m, &hm); err != nil || hm.Type != domain.MsgHistory {
+			continue
+		}
+		if len(hm.Messages) != 1 || hm.Messages[0].Type != domain.MsgChat {
+			t.Errorf("expected only chat in history, got %+v", hm.Messages)
+		}
+		return
+	}
+	t.Error("expected history message on join")
+}
+
+func TestHubPersistsRoomEvents(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	policy := domain.TypePolicy{Persist: domain.ParseTypeSet("chat,join,leave,system")}
+	h := New(s, 100, 50, WithTypePolicy(policy))
+	go h.Run()
+	defer h.Stop()
+
+	before := time.Now().Add(-time.Second)
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}, alice)
+
+	stored, err := s.History("general", 50)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(stored) != 2 || stored[0].Type != domain.MsgJoin || stored[0].User != "alice" {
+		t.Fatalf("expected alice's join before her chat, got %+v", stored)
+	}
+	if stored[0].Timestamp.Before(before) {
+		t.Errorf("expected the join's server timestamp, got %v", stored[0].Timestamp)
+	}
+
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general")
+	for _, m := range bob.GetMessages() {
+		var hm domain.HistoryMessage
+		if json.Unmarshal(m, &hm) == nil && hm.Type == domain.MsgHistory {
+			if len(hm.Messages) != 2 || hm.Messages[0].Type != domain.MsgJoin {
+				t.Errorf("expected the join replayed in history, got %+v", hm.Messages)
+			}
+			return
+		}
+	}
+	t.Error("expected history message on join")
+}
+
+func TestHubRoomModes(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := store.NewSQLite(path)
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	h := New(s, 100, 50)
+	go h.Run()
+
+	alice := testutil.NewMockClient("alice")
+	h.registerSync(RegisterRequest{Client: alice, Room: "scratch", Mode: domain.RoomModeEphemeral})
+	h.registerSync(RegisterRequest{Client: alice, Room: "archive", Mode: domain.RoomModePersistent})
+	for _, room := range []string{"scratch", "archive"} {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: room, User: "alice", Text: "hi"}, alice)
+	}
+	h.UnregisterSync(alice, "scratch")
+	h.UnregisterSync(alice, "archive")
+
+	if h.RoomInfo("scratch") != nil {
+		t.Error("expected empty ephemeral room to be deleted")
+	}
+	if h.RoomInfo("archive") == nil {
+		t.Error("expected empty persistent room to survive")
+	}
+	h.Stop()
+	s.Close()
+
+	// Reopen the database to check what was actually stored.
+	s, err = store.NewSQLite(path)
+	if err != nil {
+		t.Fatalf("reopen sqlite: %v", err)
+	}
+	defer s.Close()
+	if msgs, _ := s.History("scratch", 50); len(msgs) != 0 {
+		t.Errorf("expected no history for ephemeral room, got %d", len(msgs))
+	}
+	if msgs, _ := s.History("archive", 50); len(msgs) != 1 {
+		t.Errorf("expected 1 message for persistent room, got %d", len(msgs))
+	}
+}
+
+func TestHubSyncHelpersReturnAfterStop(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	h.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		// The request is buffered but never handled; the helper must not hang.
+		h.RegisterSync(testutil.NewMockClient("alice"), "general")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RegisterSync blocked after hub stopped")
+	}
+}
+
+func TestHubPipelineRejectsWithCode(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	block := domain.StageFunc(func(msg *domain.Message) error {
+		if strings.Contains(msg.Text, "spam") {
+			return &domain.StageError{Code: "blocked", Message: "message blocked"}
+		}
+		return nil
+	})
+	shout := domain.StageFunc(func(msg *domain.Message) error {
+		msg.Text = strings.ToUpper(msg.Text)
+		return nil
+	})
+	h := New(s, 100, 50, WithPipeline(block, shout))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "buy spam"}, alice)
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hello"}, alice)
+
+	stored, _ := s.History("general", 50)
+	if len(stored) != 1 || stored[0].Text != "HELLO" {
+		t.Fatalf("expected only the transformed message stored, got %+v", stored)
+	}
+
+	for _, m := range alice.GetMessages() {
+		var em domain.ErrorMessage
+		if json.Unmarshal(m, &em) == nil && em.Type == domain.MsgError {
+			if em.Code != "blocked" {
+				t.Errorf("expected blocked code, got %+v", em)
+			}
+			return
+		}
+	}
+	t.Error("expected rejection error for sender")
+}
+
+func TestHubWordFilter(t *testing.T) {
+	t.Parallel()
+	f := domain.NewWordFilter([]string{"darn"})
+	for _, mode := range []string{domain.FilterMask, domain.FilterReject} {
+		s := testutil.NewMockStore()
+		h := New(s, 100, 50, WithPipeline(domain.WordFilterStage(f, mode)))
+		go h.Run()
+
+		alice := testutil.NewMockClient("alice")
+		h.RegisterSync(alice, "general")
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "Darn it"}, alice)
+		h.Stop()
+
+		stored, _ := s.History("general", 50)
+		rejected := false
+		for _, m := range alice.GetMessages() {
+			var em domain.ErrorMessage
+			if json.Unmarshal(m, &em) == nil && em.Type == domain.MsgError {
+				rejected = em.Code == domain.ErrCodeMessageFiltered
+			}
+		}
+		switch mode {
+		case domain.FilterMask:
+			if len(stored) != 1 || stored[0].Text != "**** it" {
+				t.Errorf("mask: expected masked text stored, got %+v", stored)
+			}
+		case domain.FilterReject:
+			if len(stored) != 0 {
+				t.Errorf("reject: expected nothing stored, got %+v", stored)
+			}
+			if !rejected {
+				t.Error("reject: expected a message_filtered error")
+			}
+		}
+	}
+}
+
+// stuckConn ignores drain requests, standing in for a peer that never
+// finishes closing.
+type stuckConn struct {
+	drained, closed atomic.Bool
+}
+
+func (c *stuckConn) Drain()       { c.drained.Store(true) }
+func (c *stuckConn) Close() error { c.closed.Store(true); return nil }
+
+func TestHubShutdownForceClosesAfterDeadline(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+
+	conn := &stuckConn{}
+	h.TrackConn(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !conn.drained.Load() {
+		t.Error("expected a graceful drain first")
+	}
+	if !conn.closed.Load() {
+		t.Error("expected the connection to be force-closed at the deadline")
+	}
+}
+
+func TestHubAnnounceReachesEveryRoom(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "random")
+
+	h.Announce("server shutting down")
+	ids := map[string]bool{}
+	for _, c := range []*testutil.MockClient{alice, bob} {
+		found := false
+		for _, m := range c.GetMessages() {
+			var msg domain.Message
+			if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem && msg.Text == "server shutting down" {
+				found = true
+				ids[msg.ID] = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected shutdown notice", c.Username())
+		}
+	}
+	if len(ids) != 2 || ids[""] {
+		t.Errorf("expected each room's notice to have its own id, got %v", ids)
+	}
+}
+
+func TestHubRejectsJoinWhenRoomFull(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50, WithMaxRoomUsers(2))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	carol := testutil.NewMockClient("carol")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	h.RegisterSync(carol, "general")
+
+	if em := lastError(carol); em.Code != domain.ErrCodeRoomFull || em.Message != "room full" {
+		t.Errorf("expected room full error, got %+v", em)
+	}
+	if info := h.RoomInfo("general"); info.UserCount != 2 {
+		t.Errorf("expected 2 members, got %d", info.UserCount)
+	}
+
+	// A slot frees up once someone leaves.
+	h.UnregisterSync(bob, "general")
+	h.RegisterSync(carol, "general")
+	if info := h.RoomInfo("general"); info.UserCount != 2 {
+		t.Errorf("expected carol to get in after bob left, got %d members", info.UserCount)
+	}
+}
+
+func TestHubRoomInfoCountsMessages(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	for _, text := range []string{"one", "two", "three"} {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: text}, alice)
+	}
+
+	stored, _ := s.History("general", 100)
+	if info := h.RoomInfo("general"); info.MessageCount != len(stored) || info.MessageCount != 3 {
+		t.Errorf("expected message count 3 matching the store, got %d (store has %d)", info.MessageCount, len(stored))
+	}
+}
+
+func TestHubAcksSenderBeforeBroadcast(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	for i, cid := range []string{"c1", "c2", "c3"} {
+		if i == 2 {
+			s.FailSaves(errors.New("disk full"))
+		}
+		h.RouteMessageSync(domain.Message{ID: "m" + cid, Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi", ClientMsgID: cid}, alice)
+	}
+	h.RouteMessageSync(domain.Message{ID: "plain", Type: domain.MsgChat, Room: "general", User: "alice", Text: "no ack"}, alice)
+	time.Sleep(50 * time.Millisecond)
+
+	var acks []string
+	ackAt := map[string]int{}
+	chatAt := map[string]int{}
+	for i, m := range alice.GetMessages() {
+		var ack domain.AckMessage
+		json.Unmarshal(m, &ack)
+		switch ack.Type {
+		case domain.MsgAck, domain.MsgNack:
+			acks = append(acks, ack.Type+":"+ack.ClientMsgID+":"+ack.ID)
+			ackAt["m"+ack.ClientMsgID] = i
+		case domain.MsgChat:
+			if strings.Contains(string(m), "client_msg_id") {
+				t.Errorf("client_msg_id leaked into the broadcast: %s", m)
+			}
+			chatAt[ack.ID] = i
+		}
+	}
+	if want := "ack:c1:mc1 ack:c2:mc2 nack:c3:"; strings.Join(acks, " ") != want {
+		t.Errorf("got acks %v, want %s", acks, want)
+	}
+	for id, i := range ackAt {
+		if c, ok := chatAt[id]; !ok || c < i {
+			t.Errorf("expected the ack for %s ahead of the sender's copy", id)
+		}
+	}
+	if _, ok := chatAt["plain"]; !ok {
+		t.Error("expected the message without client_msg_id broadcast")
+	}
+}
+
+func TestHubRoomRateLimitThrottlesOnlyTheBusyRoom(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	sink := &testutil.MockDeadLetterSink{}
+	h := New(s, 100, 50, WithRoomRateLimit(5), WithDeadLetters(sink))
+	go h.Run()
+	defer h.Stop()
+
+	// Several senders together flood one room; the cap is per room, not
+	// per sender.
+	var spammers []*testutil.MockClient
+	for _, name := range []string{"alice", "bob", "carol"} {
+		c := testutil.NewMockClient(name)
+		h.RegisterSync(c, "busy")
+		spammers = append(spammers, c)
+	}
+	dave := testutil.NewMockClient("dave")
+	h.RegisterSync(dave, "quiet")
+
+	for i := range 30 {
+		c := spammers[i%len(spammers)]
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "busy", User: c.Name, Text: "spam"}, c)
+	}
+	for range 3 {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "quiet", User: "dave", Text: "hi"}, dave)
+	}
+
+	busy, _ := s.History("busy", 100)
+	if len(busy) < 5 || len(busy) > 6 {
+		t.Errorf("expected about 5 messages through the busy room's burst, got %d", len(busy))
+	}
+	if quiet, _ := s.History("quiet", 100); len(quiet) != 3 {
+		t.Errorf("expected the quiet room unaffected, got %d messages", len(quiet))
+	}
+	throttled := 0
+	for _, c := range spammers {
+		if lastError(c).Code == domain.ErrCodeRateLimited {
+			throttled++
+		}
+	}
+	if throttled != len(spammers) {
+		t.Errorf("expected every spammer to get rate_limited, got %d of %d", throttled, len(spammers))
+	}
+	records := sink.Records()
+	if len(records) != 30-len(busy) {
+		t.Errorf("expected a dead letter per throttled message, got %d for %d", len(records), 30-len(busy))
+	}
+	for _, r := range records {
+		if r.Reason != deadletter.ReasonRoomRateLimited || r.Room != "busy" {
+			t.Errorf("unexpected dead letter: %+v", r)
+			break
+		}
+	}
+	if em := lastError(dave); em.Code != "" {
+		t.Errorf("expected no error in the quiet room, got %+v", em)
+	}
+}
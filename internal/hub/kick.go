@@ -0,0 +1,132 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// DefaultKickBan is how long a kicked user is kept out of the room.
+const DefaultKickBan = 5 * time.Minute
+
+// Join refusals.
+var (
+	ErrRoomFull   = errors.New("room full")
+	ErrBanned     = errors.New("banned from room")
+	ErrRoomClosed = errors.New("room closed")
+)
+
+// Moderator is implemented by connections that know whether they
+// authenticated as a moderator, such as *client.Client. Moderator rights
+// come only from this, never from the username, which the client picks.
+type Moderator interface {
+	IsModerator() bool
+}
+
+// isModerator reports whether c authenticated as a moderator.
+func isModerator(c Client) bool {
+	m, ok := c.(Moderator)
+	return ok && m.IsModerator()
+}
+
+// WithKickBan sets how long a kicked user may not rejoin the room. Zero
+// lets them straight back in.
+func WithKickBan(d time.Duration) Option {
+	return func(h *Hub) {
+		h.kickBan = d
+	}
+}
+
+// Kick removes every connection of username from the room, bans the user
+// from rejoining until the ban expires, and tells the room. It returns the
+// removed clients, or nil if the user was not in the room. Like Leave, it is
+// applied in order with the room's broadcasts.
+func (r *Room) Kick(username string, ban time.Duration) []Client {
+	var kicked []Client
+	r.do(func() { kicked = r.kick(username, ban) })
+	return kicked
+}
+
+func (r *Room) kick(username string, ban time.Duration) []Client {
+	r.mu.Lock()
+	var kicked []Client
+	for c := range r.clients {
+		if c.Username() == username {
+			kicked = append(kicked, c)
+			delete(r.clients, c)
+		}
+	}
+	r.countMembers(-int64(len(kicked)))
+	if ban > 0 {
+		r.bans.add(r.name, username, time.Now().Add(ban))
+	}
+	r.mu.Unlock()
+	if len(kicked) == 0 {
+		return nil
+	}
+
+	r.emitPresenceLeft(username, 0)
+	r.emit(domain.Message{Type: domain.MsgLeave, Room: r.name, User: username})
+	r.emit(domain.Message{Type: domain.MsgSystem, Room: r.name, User: username, Text: username + " was kicked"})
+	return kicked
+}
+
+// banList records kicked users and when their bans end, per room. A hub's
+// rooms share its list, so a ban outlives a room dropped while empty and
+// applies again when the room is started anew.
+type banList struct {
+	mu    sync.Mutex
+	until map[banKey]time.Time
+}
+
+type banKey struct{ room, user string }
+
+func newBanList() *banList {
+	return &banList{until: make(map[banKey]time.Time)}
+}
+
+// add bans user from room until the given time, and forgets expired bans.
+func (b *banList) add(room, user string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for k, t := range b.until {
+		if now.After(t) {
+			delete(b.until, k)
+		}
+	}
+	b.until[banKey{room, user}] = until
+}
+
+// banned reports whether user is currently banned from room.
+func (b *banList) banned(room, user string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := banKey{room, user}
+	until, ok := b.until[k]
+	if ok && time.Now().After(until) {
+		delete(b.until, k)
+		return false
+	}
+	return ok
+}
+
+// handleKick lets a moderator kick a user, named in To, out of a room.
+func (h *Hub) handleKick(r *Room, req MessageRequest) {
+	if !isModerator(req.Sender) {
+		sendErrorCode(req.Sender, domain.ErrCodeForbidden, "only a moderator can kick users")
+		return
+	}
+	target := req.Message.To
+	kicked := r.Kick(target, h.kickBan)
+	if kicked == nil {
+		sendError(req.Sender, "user not in room: "+target)
+		return
+	}
+	for _, c := range kicked {
+		rejectJoin(c, r.name, domain.ErrCodeKicked, "kicked from room")
+	}
+	h.dropIfEmpty(r)
+}
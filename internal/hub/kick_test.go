@@ -0,0 +1,112 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubKickRemovesAndBansUser(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	mod := &testutil.MockClient{Name: "mod", Moderator: true}
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(mod, "general")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	kick := func(sender *testutil.MockClient, target string) {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgKick, Room: "general", User: sender.Username(), To: target}, sender)
+	}
+
+	kick(alice, "bob")
+	if em := lastError(alice); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a non-moderator, got %+v", em)
+	}
+	// Going by a moderator's name grants nothing.
+	impostor := testutil.NewMockClient("mod")
+	kick(impostor, "bob")
+	if em := lastError(impostor); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a client named like a moderator, got %+v", em)
+	}
+
+	kick(mod, "bob")
+	if em := lastError(bob); em.Code != domain.ErrCodeKicked {
+		t.Fatalf("expected bob to get kicked, got %+v", em)
+	}
+	if n := h.RoomInfo("general").UserCount; n != 2 {
+		t.Errorf("expected 2 users after the kick, got %d", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var notice string
+	for _, m := range alice.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem {
+			notice = msg.Text
+		}
+	}
+	if notice != "bob was kicked" {
+		t.Errorf("expected kick notice, got %q", notice)
+	}
+
+	h.RegisterSync(bob, "general")
+	if em := lastError(bob); em.Code != domain.ErrCodeBanned {
+		t.Fatalf("expected banned on rejoin, got %+v", em)
+	}
+	if n := h.RoomInfo("general").UserCount; n != 2 {
+		t.Errorf("expected the banned user to stay out, got %d users", n)
+	}
+}
+
+func TestHubKickWithoutBanAllowsRejoin(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50, WithKickBan(0))
+	go h.Run()
+	defer h.Stop()
+
+	mod := &testutil.MockClient{Name: "mod", Moderator: true}
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(mod, "general")
+	h.RegisterSync(bob, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgKick, Room: "general", User: "mod", To: "bob"}, mod)
+
+	h.RegisterSync(bob, "general")
+	if n := h.RoomInfo("general").UserCount; n != 2 {
+		t.Errorf("expected bob back in the room, got %d users", n)
+	}
+}
+
+func TestHubKickBanOutlivesEmptiedRoom(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	// The moderator kicks from outside the room, so it empties.
+	mod := &testutil.MockClient{Name: "mod", Moderator: true}
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgKick, Room: "general", User: "mod", To: "bob"}, mod)
+	if h.RoomInfo("general") != nil {
+		t.Fatal("expected the emptied room to be dropped")
+	}
+
+	h.RegisterSync(bob, "general")
+	if em := lastError(bob); em.Code != domain.ErrCodeBanned {
+		t.Fatalf("expected banned on rejoin, got %+v", em)
+	}
+	if info := h.RoomInfo("general"); info != nil && info.UserCount != 0 {
+		t.Errorf("expected the banned user to stay out, got %d users", info.UserCount)
+	}
+	// The ban is per room.
+	h.RegisterSync(bob, "random")
+	if n := h.RoomInfo("random").UserCount; n != 1 {
+		t.Errorf("expected bob in another room, got %d users", n)
+	}
+}
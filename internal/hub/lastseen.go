@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// touch records that user was active at t.
+func (h *Hub) touch(user string, t time.Time) {
+	if user == "" {
+		return
+	}
+	h.seenMu.Lock()
+	h.lastSeen[user] = t
+	h.seenMu.Unlock()
+}
+
+// persistLastSeen saves a user's last-seen time, if the store keeps them.
+func (h *Hub) persistLastSeen(user string) {
+	ls, ok := h.store.(store.LastSeenStore)
+	if !ok {
+		return
+	}
+	h.seenMu.Lock()
+	t, seen := h.lastSeen[user]
+	h.seenMu.Unlock()
+	if !seen {
+		return
+	}
+	if err := ls.SetLastSeen(user, t); err != nil {
+		slog.Error("save last seen", "user", user, "err", err)
+	}
+}
+
+// LastSeen returns when a user last sent a message or left a room, and false
+// if the user has not been seen. Times recorded since the hub started are
+// used first; otherwise the store is consulted, if it keeps them.
+func (h *Hub) LastSeen(user string) (time.Time, bool, error) {
+	h.seenMu.Lock()
+	t, ok := h.lastSeen[user]
+	h.seenMu.Unlock()
+	if ok {
+		return t, true, nil
+	}
+	ls, ok := h.store.(store.LastSeenStore)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := ls.GetLastSeen(user)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, !t.IsZero(), nil
+}
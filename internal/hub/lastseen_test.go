@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubLastSeenSurvivesRestart(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	h := New(s, 100, 50)
+	go h.Run()
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+
+	if _, ok, _ := h.LastSeen("alice"); ok {
+		t.Error("expected alice unseen before she sends anything")
+	}
+	before := time.Now().UTC()
+
+	// Readers race the event loop's updates.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				h.LastSeen("alice")
+			}
+		}()
+	}
+	for range 10 {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}, alice)
+	}
+	wg.Wait()
+
+	seen, ok, err := h.LastSeen("alice")
+	if err != nil || !ok || seen.Before(before) {
+		t.Fatalf("expected alice seen after %v, got %v %v %v", before, seen, ok, err)
+	}
+	h.UnregisterSync(alice, "general")
+	h.Stop()
+
+	restarted := New(s, 100, 50)
+	go restarted.Run()
+	defer restarted.Stop()
+	if got, ok, err := restarted.LastSeen("alice"); err != nil || !ok || got.Before(seen) {
+		t.Errorf("expected persisted last seen at or after %v, got %v %v %v", seen, got, ok, err)
+	}
+	if _, ok, _ := restarted.LastSeen("bob"); ok {
+		t.Error("expected bob never seen")
+	}
+}
@@ -0,0 +1,212 @@
+package hub
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// ErrBusy is returned by TryRegisterMode when too many registrations are
+// already waiting for the event loop.
+var ErrBusy = errors.New("server busy")
+
+// loadShedder tracks whether the hub is in "busy" mode. It enters busy mode
+// when queue depth or connection count reaches its high-water mark, and only
+// leaves once both are at or below their low-water marks, so the mode does
+// not flap around a single threshold. A zero high-water mark disables that
+// signal.
+type loadShedder struct {
+	queueHigh, queueLow int
+	connHigh, connLow   int
+	busy                bool
+}
+
+// update re-evaluates the mode for the given load and reports whether the
+// hub is busy.
+func (l *loadShedder) update(queue, conns int) bool {
+	over := (l.queueHigh > 0 && queue >= l.queueHigh) ||
+		(l.connHigh > 0 && conns >= l.connHigh)
+	under := (l.queueHigh == 0 || queue <= l.queueLow) &&
+		(l.connHigh == 0 || conns <= l.connLow)
+	switch {
+	case over:
+		l.busy = true
+	case under:
+		l.busy = false
+	}
+	return l.busy
+}
+
+// lowWater defaults a low-water mark to half the high-water mark.
+func lowWater(high, low int) int {
+	if low <= 0 || low >= high {
+		return high / 2
+	}
+	return low
+}
+
+// WithLoadShedding enables busy mode. queueHigh and connHigh are the
+// high-water marks for hub queue depth and live connections; queueLow and
+// connLow are where normal operation resumes and default to half the
+// high-water mark. A zero high-water mark disables that signal.
+func WithLoadShedding(queueHigh, queueLow, connHigh, connLow int) Option {
+	return func(h *Hub) {
+		h.load.queueHigh = queueHigh
+		h.load.queueLow = lowWater(queueHigh, queueLow)
+		h.load.connHigh = connHigh
+		h.load.connLow = lowWater(connHigh, connLow)
+	}
+}
+
+// queueDepth returns the number of requests waiting for the event loop.
+func (h *Hub) queueDepth() int {
+	return len(h.register) + len(h.unregister) + len(h.message)
+}
+
+// WithMaxConnections caps open WebSocket connections across the server at n,
+// so a connection storm cannot spawn unbounded pump goroutines. Handlers
+// reserve a slot with AcquireConn before upgrading. Zero is unlimited.
+func WithMaxConnections(n int) Option {
+	return func(h *Hub) {
+		if n > 0 {
+			h.connSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// AcquireConn reserves a connection slot, or reports false when all
+// WithMaxConnections slots are taken. A successful call must be paired with
+// ReleaseConn once the connection closes.
+func (h *Hub) AcquireConn() bool {
+	if h.connSlots == nil {
+		return true
+	}
+	select {
+	case h.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReleaseConn frees a slot reserved by AcquireConn.
+func (h *Hub) ReleaseConn() {
+	if h.connSlots == nil {
+		return
+	}
+	select {
+	case <-h.connSlots:
+	default:
+	}
+}
+
+func (h *Hub) connCount() int {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	return len(h.conns)
+}
+
+// Busy reports whether the hub is shedding load. While busy, new connections
+// should be refused and non-essential broadcasts (join and leave
+// notifications and roster diffs) are suppressed; chat is still delivered.
+// Rooms that skipped roster diffs get a full presence snapshot once the hub
+// is no longer busy.
+func (h *Hub) Busy() bool {
+	queue, conns := h.queueDepth(), h.connCount()
+	h.loadMu.Lock()
+	was := h.load.busy
+	busy := h.load.update(queue, conns)
+	h.loadMu.Unlock()
+	if was && !busy {
+		// Busy is called from room goroutines, so don't wait on rooms here.
+		go h.resyncPresence()
+	}
+	return busy
+}
+
+// resyncPresence catches up the members of rooms that skipped roster diffs
+// while the hub was busy.
+func (h *Hub) resyncPresence() {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+	for _, r := range rooms {
+		r.resyncPresence()
+	}
+}
+
+// Stats returns a snapshot of the hub's load and mode.
+func (h *Hub) Stats() domain.Stats {
+	mode := domain.ModeNormal
+	if h.Busy() {
+		mode = domain.ModeBusy
+	}
+	h.mu.RLock()
+	rooms := len(h.rooms)
+	h.mu.RUnlock()
+	conns := h.connCount()
+	return domain.Stats{
+		Mode:                 mode,
+		Connections:          conns,
+		MaxConnections:       cap(h.connSlots),
+		QueueDepth:           h.queueDepth(),
+		PendingRegistrations: len(h.register),
+		Rooms:                rooms,
+		ControlFrameErrors:   h.controlFrameErrors.Load(),
+
+		Clients:        conns,
+		Memberships:    h.members.Load(),
+		MessagesRouted: h.routed.Load(),
+		UptimeSeconds:  int64(time.Since(h.started).Seconds()),
+		Goroutines:     runtime.NumGoroutine(),
+
+		DroppedMessages: h.dropped.Load(),
+	}
+}
+
+// WithMaxPendingRegistrations makes TryRegisterMode refuse joins once n
+// registrations are waiting for the event loop, instead of blocking the
+// caller until there is room in the queue. Zero keeps the blocking behavior.
+func WithMaxPendingRegistrations(n int) Option {
+	return func(h *Hub) {
+		h.maxPendingRegs = n
+	}
+}
+
+// TryRegisterMode is RegisterMode for callers that must not stall, such as a
+// client's read loop. With a pending-registration limit configured it returns
+// ErrBusy rather than waiting when the limit is reached or the queue is full.
+func (h *Hub) TryRegisterMode(client Client, room, mode string) error {
+	return h.TryRegister(RegisterRequest{Client: client, Room: room, Mode: mode})
+}
+
+// TryRegister is TryRegisterMode for a full registration request, such as
+// one carrying a room password. The password is checked or hashed in the
+// caller's goroutine before the request is queued.
+func (h *Hub) TryRegister(req RegisterRequest) error {
+	h.preparePassword(&req)
+	if h.maxPendingRegs <= 0 {
+		h.register <- req
+		return nil
+	}
+	if len(h.register) >= h.maxPendingRegs {
+		return ErrBusy
+	}
+	select {
+	case h.register <- req:
+		return nil
+	default:
+		return ErrBusy
+	}
+}
+
+// RecordControlFrameError counts a connection dropped for sending a malformed
+// control frame, reported in Stats.
+func (h *Hub) RecordControlFrameError() {
+	h.controlFrameErrors.Add(1)
+}
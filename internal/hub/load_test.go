@@ -0,0 +1,131 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/deadletter"
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestLoadShedderHysteresis(t *testing.T) {
+	t.Parallel()
+	l := loadShedder{queueHigh: 100, queueLow: 50}
+
+	steps := []struct {
+		queue int
+		want  bool
+	}{
+		{10, false},
+		{99, false},
+		{100, true}, // high-water mark reached
+		{75, true},  // still above low-water mark
+		{50, false}, // receded to low-water mark
+		{75, false}, // below high-water mark again
+	}
+	for _, s := range steps {
+		if got := l.update(s.queue, 0); got != s.want {
+			t.Errorf("queue %d: expected busy=%v, got %v", s.queue, s.want, got)
+		}
+	}
+}
+
+func TestLoadShedderConnections(t *testing.T) {
+	t.Parallel()
+	l := loadShedder{connHigh: 4, connLow: 2}
+	if !l.update(0, 4) {
+		t.Error("expected busy at connection high-water mark")
+	}
+	if !l.update(0, 3) {
+		t.Error("expected busy above connection low-water mark")
+	}
+	if l.update(0, 2) {
+		t.Error("expected normal at connection low-water mark")
+	}
+}
+
+func TestLoadSheddingDisabledByDefault(t *testing.T) {
+	t.Parallel()
+	var l loadShedder
+	if l.update(1000, 1000) {
+		t.Error("expected load shedding disabled with zero thresholds")
+	}
+}
+
+func TestLowWaterDefault(t *testing.T) {
+	t.Parallel()
+	if got := lowWater(100, 0); got != 50 {
+		t.Errorf("expected default low-water 50, got %d", got)
+	}
+	if got := lowWater(100, 80); got != 80 {
+		t.Errorf("expected explicit low-water 80, got %d", got)
+	}
+	if got := lowWater(100, 150); got != 50 {
+		t.Errorf("expected invalid low-water to default to 50, got %d", got)
+	}
+}
+
+func TestTryRegisterRefusesWhenSaturated(t *testing.T) {
+	t.Parallel()
+	// The event loop is not running, so registrations stay queued.
+	h := New(testutil.NewMockStore(), 100, 50, WithMaxPendingRegistrations(3))
+
+	for i := 0; i < 3; i++ {
+		if err := h.TryRegisterMode(testutil.NewMockClient("alice"), "general", domain.RoomModeDefault); err != nil {
+			t.Fatalf("registration %d: unexpected error %v", i, err)
+		}
+	}
+	if err := h.TryRegisterMode(testutil.NewMockClient("bob"), "general", domain.RoomModeDefault); err != ErrBusy {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+	if got := h.Stats().PendingRegistrations; got != 3 {
+		t.Errorf("expected 3 pending registrations, got %d", got)
+	}
+}
+
+func TestRouteMessageDropsWhenQueueFull(t *testing.T) {
+	t.Parallel()
+	sink := &testutil.MockDeadLetterSink{}
+	// The event loop is not running, so messages stay queued.
+	h := New(testutil.NewMockStore(), 100, 50, WithDeadLetters(sink))
+	alice := testutil.NewMockClient("alice")
+	msg := domain.Message{Type: domain.MsgChat, Room: "general", Text: "hi"}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < hubChannelBuffer+5; i++ {
+			h.RouteMessage(msg, alice)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RouteMessage blocked on a full queue")
+	}
+
+	if got := h.Stats().DroppedMessages; got != 5 {
+		t.Errorf("expected 5 dropped messages, got %d", got)
+	}
+	records := sink.Records()
+	if len(records) != 5 {
+		t.Fatalf("expected 5 dead letters, got %d", len(records))
+	}
+	if r := records[0]; r.Reason != deadletter.ReasonHubQueueFull || r.Room != "general" || r.User != "alice" {
+		t.Errorf("unexpected dead letter: %+v", r)
+	}
+	if em := lastError(alice); em.Code != domain.ErrCodeServerBusy {
+		t.Errorf("expected the sender told server_busy, got %+v", em)
+	}
+
+	// A message that asked for an ack is nacked instead.
+	bob := testutil.NewMockClient("bob")
+	h.RouteMessage(domain.Message{Type: domain.MsgChat, Room: "general", Text: "hi", ClientMsgID: "c1"}, bob)
+	var ack domain.AckMessage
+	if msgs := bob.GetMessages(); len(msgs) != 1 || json.Unmarshal(msgs[0], &ack) != nil ||
+		ack.Type != domain.MsgNack || ack.ClientMsgID != "c1" {
+		t.Errorf("expected a nack for c1, got %q", msgs)
+	}
+}
@@ -0,0 +1,42 @@
+package hub
+
+import "github.com/devaloi/chatterbox/internal/domain"
+
+// SetLocked freezes or unfreezes posting in the room and reports whether
+// the state changed. Joins, leaves and presence are unaffected.
+func (r *Room) SetLocked(locked bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.locked != locked
+	r.locked = locked
+	return changed
+}
+
+// Locked reports whether posting in the room is frozen.
+func (r *Room) Locked() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.locked
+}
+
+// handleLock applies a lock or unlock request from a moderator and tells
+// the room with a system notice.
+func (h *Hub) handleLock(r *Room, req MessageRequest) {
+	if !isModerator(req.Sender) {
+		sendErrorCode(req.Sender, domain.ErrCodeForbidden, "only a moderator can lock a room")
+		return
+	}
+	user := req.Sender.Username()
+
+	locked := req.Message.Type == domain.MsgLock
+	if !r.SetLocked(locked) {
+		return
+	}
+	text := "room unlocked by " + user
+	if locked {
+		text = "room locked by " + user
+	}
+	r.broadcastEvent(domain.Message{
+		Type: domain.MsgSystem, Room: r.name, User: user, Text: text, Timestamp: req.Message.Timestamp,
+	})
+}
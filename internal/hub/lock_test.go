@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func lastError(c *testutil.MockClient) domain.ErrorMessage {
+	var last domain.ErrorMessage
+	for _, m := range c.GetMessages() {
+		var em domain.ErrorMessage
+		if json.Unmarshal(m, &em) == nil && em.Type == domain.MsgError {
+			last = em
+		}
+	}
+	return last
+}
+
+func TestHubLockFreezesChat(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := &testutil.MockClient{Name: "alice", Moderator: true}
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general") // creating the room grants bob nothing
+	h.RegisterSync(alice, "general")
+	chat := func(text string) {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "bob", Text: text}, bob)
+	}
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgLock, Room: "general", User: "bob"}, bob)
+	if em := lastError(bob); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a non-moderator, got %+v", em)
+	}
+	// Nor does going by a moderator's name.
+	impostor := testutil.NewMockClient("alice")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgLock, Room: "general", User: "alice"}, impostor)
+	if em := lastError(impostor); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a client named like a moderator, got %+v", em)
+	}
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgLock, Room: "general", User: "alice"}, alice)
+	chat("while locked")
+	if em := lastError(bob); em.Code != domain.ErrCodeRoomLocked {
+		t.Fatalf("expected room_locked, got %+v", em)
+	}
+
+	// Joins still work while locked.
+	carol := testutil.NewMockClient("carol")
+	h.RegisterSync(carol, "general")
+	if pm := lastPresence(t, carol); len(pm.Users) != 3 {
+		t.Errorf("expected carol to see 3 users, got %v", pm.Users)
+	}
+
+	h.RouteMessageSync(domain.Message{Type: domain.MsgUnlock, Room: "general", User: "alice"}, alice)
+	chat("after unlock")
+	time.Sleep(50 * time.Millisecond)
+
+	stored, _ := s.History("general", 50)
+	if len(stored) != 1 || stored[0].Text != "after unlock" {
+		t.Errorf("expected only the post-unlock chat stored, got %+v", stored)
+	}
+	var notices []string
+	for _, m := range bob.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem {
+			notices = append(notices, msg.Text)
+		}
+	}
+	if len(notices) != 2 || notices[0] != "room locked by alice" || notices[1] != "room unlocked by alice" {
+		t.Errorf("expected lock and unlock notices, got %v", notices)
+	}
+}
+
+func TestHubModeratorCanLock(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "general")
+	mod := &testutil.MockClient{Name: "mod", Moderator: true}
+	h.RouteMessageSync(domain.Message{Type: domain.MsgLock, Room: "general", User: "mod"}, mod)
+
+	h.mu.RLock()
+	r := h.rooms["general"]
+	h.mu.RUnlock()
+	if !r.Locked() {
+		t.Error("expected a moderator outside the room to lock it")
+	}
+}
@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// notifyMentions sends a mention notification to every connection of each
+// user @-mentioned in a chat message, whether or not they are in the room,
+// so clients can highlight it or alert a user looking elsewhere. Members of
+// a private room are the only ones told about mentions in it. Users do not
+// get notified of their own mentions. The notification may arrive before
+// the message itself, which is broadcast asynchronously.
+func (h *Hub) notifyMentions(r *Room, msg domain.Message) {
+	names := domain.ParseMentions(msg.Text)
+	if len(names) == 0 {
+		return
+	}
+	data, err := domain.Encode(domain.MentionMessage{
+		Type:      domain.MsgMention,
+		Room:      msg.Room,
+		From:      msg.User,
+		MessageID: msg.ID,
+	})
+	if err != nil {
+		slog.Error("encode mention", "room", msg.Room, "err", err)
+		return
+	}
+
+	var targets []Client
+	h.connsMu.Lock()
+	for _, name := range names {
+		if name == msg.User {
+			continue
+		}
+		for c := range h.users[name] {
+			targets = append(targets, c)
+		}
+	}
+	h.connsMu.Unlock()
+
+	r.mu.RLock()
+	private := r.passwordHash != ""
+	members := r.clients
+	for _, c := range targets {
+		if !private || members[c] {
+			c.Send(data)
+		}
+	}
+	r.mu.RUnlock()
+}
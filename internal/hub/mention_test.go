@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+// trackedClient is a MockClient the hub can track as a live connection, so
+// it is found by username.
+type trackedClient struct{ *testutil.MockClient }
+
+func (trackedClient) Close() error { return nil }
+
+func track(h *Hub, name string) *testutil.MockClient {
+	c := testutil.NewMockClient(name)
+	h.TrackConn(trackedClient{c})
+	return c
+}
+
+func mentions(c *testutil.MockClient) []domain.MentionMessage {
+	var out []domain.MentionMessage
+	for _, m := range c.GetMessages() {
+		var mm domain.MentionMessage
+		if json.Unmarshal(m, &mm) == nil && mm.Type == domain.MsgMention {
+			out = append(out, mm)
+		}
+	}
+	return out
+}
+
+func TestHubNotifiesMentionedUsers(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := track(h, "alice")
+	bob := track(h, "bob")
+	carol := track(h, "carol")
+	dave := track(h, "dave")
+	h.RegisterSync(trackedClient{alice}, "general")
+	h.RegisterSync(trackedClient{bob}, "general")
+
+	msg := domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "@bob, @carol. and @alice"}
+	h.RouteMessageSync(msg, trackedClient{alice})
+	time.Sleep(50 * time.Millisecond)
+
+	want := domain.MentionMessage{Type: domain.MsgMention, Room: "general", From: "alice", MessageID: "m1"}
+	if got := mentions(bob); len(got) != 1 || got[0] != want {
+		t.Errorf("expected bob notified in the room, got %+v", got)
+	}
+	if got := mentions(carol); len(got) != 1 || got[0] != want {
+		t.Errorf("expected carol notified outside the room, got %+v", got)
+	}
+	if got := mentions(alice); len(got) != 0 {
+		t.Errorf("expected no notification for a self-mention, got %+v", got)
+	}
+	if got := mentions(dave); len(got) != 0 {
+		t.Errorf("expected dave not notified, got %+v", got)
+	}
+}
+
+func TestHubMentionsInPrivateRoomsStayInside(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := track(h, "alice")
+	bob := track(h, "bob")
+	h.registerSync(RegisterRequest{Client: trackedClient{alice}, Room: "secret", Password: "hunter2"})
+
+	h.RouteMessageSync(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "secret", User: "alice", Text: "@bob"}, trackedClient{alice})
+	time.Sleep(50 * time.Millisecond)
+	if got := mentions(bob); len(got) != 0 {
+		t.Errorf("expected no notification for a non-member of a private room, got %+v", got)
+	}
+}
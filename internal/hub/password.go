@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// CheckPassword reports whether password lets a client into the room. Rooms
+// without a password admit everyone.
+func (r *Room) CheckPassword(password string) bool {
+	return r.passwordHash == "" || domain.CheckPassword(r.passwordHash, password)
+}
+
+// Private reports whether the room needs a password to join. The hash is
+// only set while the room is started, under the hub lock.
+func (r *Room) Private() bool {
+	return r.passwordHash != ""
+}
+
+// preparePassword does the slow part of a password join in the caller's
+// goroutine, before req reaches the event loop: it checks req.Password
+// against the room's current hash, or hashes it for a room the request may
+// create. The event loop then only compares hashes, so password guesses
+// cannot stall it. If the stored password cannot be read, or the new one
+// hashed, req.passwordErr is set and the join is refused.
+func (h *Hub) preparePassword(req *RegisterRequest) {
+	req.checkedHash, req.passwordOK, req.newHash, req.passwordErr = "", false, "", nil
+	if req.Password == "" {
+		return
+	}
+	hash, err := h.roomPasswordHash(req.Room)
+	if err != nil {
+		slog.Error("load room password", "room", req.Room, "err", err)
+		req.passwordErr = err
+		return
+	}
+	if hash != "" {
+		req.checkedHash = hash
+		req.passwordOK = domain.CheckPassword(hash, req.Password)
+		return
+	}
+	if req.newHash, err = domain.HashPassword(req.Password); err != nil {
+		slog.Error("hash room password", "room", req.Room, "err", err)
+		req.passwordErr = err
+	}
+}
+
+// recheckPassword prepares req again off the event loop, after the room's
+// password changed since it was checked, and queues it once more.
+func (h *Hub) recheckPassword(req RegisterRequest) {
+	h.preparePassword(&req)
+	select {
+	case h.register <- req:
+	case <-h.quit:
+	}
+}
+
+// roomPasswordHash returns the password hash of a live room, or the one
+// the store holds for a room that is not live.
+func (h *Hub) roomPasswordHash(name string) (string, error) {
+	h.mu.RLock()
+	r, ok := h.rooms[name]
+	hash := ""
+	if ok {
+		hash = r.passwordHash
+	}
+	h.mu.RUnlock()
+	if ok {
+		return hash, nil
+	}
+	ps, ok := h.store.(store.RoomPasswordStore)
+	if !ok {
+		return "", nil
+	}
+	return ps.RoomPassword(name)
+}
+
+// storedPassword returns the hash stored for a room about to be started
+// with mode, so a room recreated under the name of a private one keeps its
+// password. Ephemeral rooms keep nothing. It does store I/O, so callers
+// must not hold h.mu. On error the room must not be started: it could
+// otherwise come back public, or with someone else's password.
+func (h *Hub) storedPassword(name, mode string) (string, error) {
+	ps, ok := h.store.(store.RoomPasswordStore)
+	if !ok || mode == domain.RoomModeEphemeral {
+		return "", nil
+	}
+	hash, err := ps.RoomPassword(name)
+	if err != nil {
+		slog.Error("load room password", "room", name, "err", err)
+		return "", err
+	}
+	return hash, nil
+}
+
+// savePassword stores the password a creator set on a newly started room.
+func (h *Hub) savePassword(r *Room) {
+	ps, ok := h.store.(store.RoomPasswordStore)
+	if !ok || r.mode == domain.RoomModeEphemeral {
+		return
+	}
+	if err := ps.SetRoomPassword(r.name, r.passwordHash); err != nil {
+		slog.Error("save room password", "room", r.name, "err", err)
+	}
+}
+
+// RoomPrivate reports whether a room needs a password to join: a live room
+// with a password, or a room whose password the store still holds after the
+// room itself has gone.
+func (h *Hub) RoomPrivate(name string) (bool, error) {
+	h.mu.RLock()
+	r, ok := h.rooms[name]
+	private := ok && r.Private()
+	h.mu.RUnlock()
+	if private {
+		return true, nil
+	}
+	ps, ok := h.store.(store.RoomPasswordStore)
+	if !ok {
+		return false, nil
+	}
+	hash, err := ps.RoomPassword(name)
+	if err != nil {
+		return false, err
+	}
+	return hash != "", nil
+}
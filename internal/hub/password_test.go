@@ -0,0 +1,247 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubPasswordProtectedRoom(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	join := func(c Client, password string) {
+		h.registerSync(RegisterRequest{Client: c, Room: "secret", Password: password})
+	}
+	alice := testutil.NewMockClient("alice")
+	join(alice, "hunter2") // creates the room and sets its password
+
+	bob := testutil.NewMockClient("bob")
+	join(bob, "wrong")
+	if em := lastError(bob); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password for a wrong password, got %+v", em)
+	}
+	carol := testutil.NewMockClient("carol")
+	join(carol, "")
+	if em := lastError(carol); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password for a missing password, got %+v", em)
+	}
+	if n := h.RoomInfo("secret").UserCount; n != 1 {
+		t.Fatalf("expected only alice in the room, got %d members", n)
+	}
+
+	dave := testutil.NewMockClient("dave")
+	join(dave, "hunter2")
+	if em := lastError(dave); em.Code != "" {
+		t.Errorf("expected the right password to be accepted, got %+v", em)
+	}
+	if n := h.RoomInfo("secret").UserCount; n != 2 {
+		t.Errorf("expected 2 members, got %d", n)
+	}
+
+	// Public rooms ignore passwords entirely.
+	erin := testutil.NewMockClient("erin")
+	h.RegisterSync(erin, "general")
+	h.registerSync(RegisterRequest{Client: bob, Room: "general", Password: "anything"})
+	if info := h.RoomInfo("general"); info.UserCount != 2 {
+		t.Errorf("expected a password on a public room to be ignored, got %d members", info.UserCount)
+	}
+}
+
+func TestHubRoomPasswordOutlivesRoom(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.registerSync(RegisterRequest{Client: alice, Room: "secret", Password: "hunter2"})
+	h.UnregisterSync(alice, "secret")
+	if h.RoomInfo("secret") != nil {
+		t.Fatal("expected the empty room to be removed")
+	}
+
+	// Recreating the room does not let a new creator pick a new password.
+	bob := testutil.NewMockClient("bob")
+	h.registerSync(RegisterRequest{Client: bob, Room: "secret", Password: "letmein"})
+	if em := lastError(bob); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password, got %+v", em)
+	}
+	if h.RoomInfo("secret") != nil {
+		t.Error("expected the refused creator's room to be removed again")
+	}
+	h.registerSync(RegisterRequest{Client: bob, Room: "secret", Password: "hunter2"})
+	if info := h.RoomInfo("secret"); info == nil || info.UserCount != 1 {
+		t.Errorf("expected bob to join with the original password")
+	}
+}
+
+func TestHubRechecksPasswordPreparedForAnotherHash(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	// Both joins are prepared before the room exists, so their passwords
+	// are hashed rather than checked; the event loop hands them back to be
+	// checked against the hash alice sets.
+	bob := testutil.NewMockClient("bob")
+	carol := testutil.NewMockClient("carol")
+	early := func(c Client, password string) RegisterRequest {
+		req := RegisterRequest{Client: c, Room: "secret", Password: password, Done: make(chan struct{})}
+		h.preparePassword(&req)
+		return req
+	}
+	bobReq, carolReq := early(bob, "hunter2"), early(carol, "letmein")
+	h.registerSync(RegisterRequest{Client: testutil.NewMockClient("alice"), Room: "secret", Password: "hunter2"})
+
+	for _, req := range []RegisterRequest{bobReq, carolReq} {
+		h.register <- req
+		h.wait(req.Done)
+	}
+	if em := lastError(bob); em.Code != "" {
+		t.Errorf("expected bob's password to be accepted, got %+v", em)
+	}
+	if em := lastError(carol); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password for carol, got %+v", em)
+	}
+	if n := h.RoomInfo("secret").UserCount; n != 2 {
+		t.Errorf("expected alice and bob in the room, got %d members", n)
+	}
+}
+
+func TestHubListRoomsMarksPrivateRooms(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	h.registerSync(RegisterRequest{Client: testutil.NewMockClient("alice"), Room: "secret", Password: "hunter2"})
+	h.RegisterSync(testutil.NewMockClient("bob"), "general")
+
+	private := map[string]bool{}
+	for _, r := range h.ListRooms() {
+		private[r.Name] = r.Private
+	}
+	if !private["secret"] || private["general"] {
+		t.Errorf("expected only secret to be private, got %v", private)
+	}
+	if !h.RoomInfo("secret").Private || h.RoomInfo("general").Private {
+		t.Error("expected RoomInfo to flag only the protected room")
+	}
+
+	// Rooms with only stored history keep their flag.
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "vault", User: "carol", Text: "hi"})
+	s.SetRoomPassword("vault", "hash")
+	rooms, err := h.AllRooms()
+	if err != nil {
+		t.Fatalf("all rooms: %v", err)
+	}
+	var vault domain.Room
+	for _, r := range rooms {
+		if r.Name == "vault" {
+			vault = r
+		}
+	}
+	if !vault.Private {
+		t.Errorf("expected the stored vault room to be private, got %+v", vault)
+	}
+}
+
+func TestHubPostKeepsDroppedRoomPrivate(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	h.registerSync(RegisterRequest{Client: alice, Room: "secret", Password: "hunter2"})
+	h.UnregisterSync(alice, "secret")
+	if h.RoomInfo("secret") != nil {
+		t.Fatal("expected the empty room to be removed")
+	}
+
+	if _, err := h.Post(domain.Message{Type: domain.MsgChat, Room: "secret", User: "mallory", Text: "mine now"}); !errors.Is(err, ErrPrivateRoom) {
+		t.Errorf("expected ErrPrivateRoom posting to a dropped private room, got %v", err)
+	}
+	bob := testutil.NewMockClient("bob")
+	h.registerSync(RegisterRequest{Client: bob, Room: "secret"})
+	if em := lastError(bob); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password joining without a password, got %+v", em)
+	}
+
+	// A room created ahead of time under the name keeps the password too.
+	if _, err := h.CreateRoom("secret", "taken over"); err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	carol := testutil.NewMockClient("carol")
+	h.registerSync(RegisterRequest{Client: carol, Room: "secret"})
+	if em := lastError(carol); em.Code != domain.ErrCodeBadPassword {
+		t.Errorf("expected bad_password joining a recreated room, got %+v", em)
+	}
+}
+
+// unreadablePasswordStore fails to read room passwords and records any it
+// is asked to save.
+type unreadablePasswordStore struct {
+	*testutil.MockStore
+	saved []string
+}
+
+func (s *unreadablePasswordStore) RoomPassword(string) (string, error) {
+	return "", errors.New("disk error")
+}
+
+func (s *unreadablePasswordStore) SetRoomPassword(room, hash string) error {
+	s.saved = append(s.saved, room)
+	return nil
+}
+
+func TestHubRefusesJoinWhenStoredPasswordUnreadable(t *testing.T) {
+	t.Parallel()
+	s := &unreadablePasswordStore{MockStore: testutil.NewMockStore()}
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	// Neither joiner may start the room: it may be private, and the second
+	// would otherwise replace its password.
+	bob := testutil.NewMockClient("bob")
+	h.registerSync(RegisterRequest{Client: bob, Room: "secret"})
+	carol := testutil.NewMockClient("carol")
+	h.registerSync(RegisterRequest{Client: carol, Room: "secret", Password: "letmein"})
+	for _, c := range []*testutil.MockClient{bob, carol} {
+		if em := lastError(c); em.Code != domain.ErrCodeInternal {
+			t.Errorf("expected internal_error for %s, got %+v", c.Username(), em)
+		}
+	}
+	if h.RoomInfo("secret") != nil {
+		t.Error("expected the room not to be started")
+	}
+	if len(s.saved) != 0 {
+		t.Errorf("expected no password saved, got %v", s.saved)
+	}
+	if _, err := h.CreateRoom("secret", ""); err == nil {
+		t.Error("expected CreateRoom to fail too")
+	}
+}
@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// pollBufferSize is how many recent messages a room keeps for long-poll
+// clients. A poller that falls further behind skips the older messages.
+const pollBufferSize = 256
+
+// pollBuffer numbers the messages routed to a room and keeps the most
+// recent ones so long-poll clients can catch up between requests.
+type pollBuffer struct {
+	mu   sync.Mutex
+	seq  uint64           // sequence number of the newest message
+	msgs []domain.Message // newest last, at most pollBufferSize
+	wake chan struct{}    // closed and replaced whenever a message is added
+}
+
+// add appends msg under the next sequence number and wakes waiting pollers.
+func (b *pollBuffer) add(msg domain.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	b.msgs = append(b.msgs, msg)
+	if len(b.msgs) > pollBufferSize {
+		b.msgs = b.msgs[len(b.msgs)-pollBufferSize:]
+	}
+	if b.wake != nil {
+		close(b.wake)
+		b.wake = nil
+	}
+}
+
+// subscribe returns the buffered messages after seq after, the latest
+// sequence number, and a channel closed when the next message arrives.
+func (b *pollBuffer) subscribe(after uint64) ([]domain.Message, uint64, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs := []domain.Message{}
+	if after < b.seq {
+		n := min(b.seq-after, uint64(len(b.msgs)))
+		msgs = append(msgs, b.msgs[uint64(len(b.msgs))-n:]...)
+	}
+	if b.wake == nil {
+		b.wake = make(chan struct{})
+	}
+	return msgs, b.seq, b.wake
+}
+
+// Poll returns the messages routed to room after sequence number after. If
+// there are none yet it waits until one arrives, timeout passes, or ctx is
+// done, and then returns whatever it has, possibly nothing. An after beyond
+// the room's latest sequence (for example after the room was recreated)
+// returns immediately so the caller can reset its cursor. Private rooms
+// return ErrPrivateRoom, since a poller never gives a password.
+func (h *Hub) Poll(ctx context.Context, room string, after uint64, timeout time.Duration) (domain.PollResult, error) {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	private := ok && r.Private()
+	h.mu.RUnlock()
+	if !ok {
+		return domain.PollResult{}, domain.ErrRoomNotFound
+	}
+	if private {
+		return domain.PollResult{}, ErrPrivateRoom
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		msgs, seq, wake := r.poll.subscribe(after)
+		res := domain.PollResult{Room: room, Messages: msgs, Seq: seq}
+		if len(msgs) > 0 || after > seq {
+			return res, nil
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return res, nil
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-h.quit:
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// Post errors.
+var (
+	// ErrPrivateRoom is returned for a password-protected room, which only
+	// members who joined with the password may post to or read.
+	ErrPrivateRoom = errors.New("room is private")
+	// ErrStopped is returned when the hub stops before handling the message.
+	ErrStopped = errors.New("hub stopped")
+)
+
+// PostError is the hub's rejection of a posted message, with the error code
+// a WebSocket sender would have received.
+type PostError struct {
+	Code    string
+	Message string
+}
+
+func (e *PostError) Error() string {
+	return e.Message
+}
+
+// poster stands in for the sender of a message posted without a
+// connection. It records the error the hub sends back, or the message as
+// routed.
+type poster struct {
+	user string
+	msg  domain.Message
+	err  error
+}
+
+func (p *poster) Username() string { return p.user }
+
+func (p *poster) Send(data []byte) {
+	var em domain.ErrorMessage
+	if json.Unmarshal(data, &em) == nil && em.Type == domain.MsgError {
+		p.err = &PostError{Code: em.Code, Message: em.Message}
+	}
+}
+
+// Post routes a chat message from a sender without a connection, such as a
+// REST caller, into its room. A room that does not exist is started for the
+// message alone, as if its sender had joined and left: it is not recorded as
+// a persistent room and is dropped again once the last post using it is
+// handled. Post
+// blocks until the hub has persisted the message and returns it as
+// broadcast, after the pipeline has run. A message the hub rejects is
+// reported as a *PostError.
+func (h *Hub) Post(msg domain.Message) (domain.Message, error) {
+	if domain.IsDMRoom(msg.Room) {
+		return domain.Message{}, domain.ErrRoomNotFound
+	}
+	private, err := h.RoomPrivate(msg.Room)
+	if err != nil {
+		return domain.Message{}, err
+	}
+	if private {
+		return domain.Message{}, ErrPrivateRoom
+	}
+	r, err := h.holdPostRoom(msg.Room)
+	if err != nil {
+		return domain.Message{}, err
+	}
+	defer h.releasePostRoom(r)
+
+	p := &poster{user: msg.User}
+	msg.Receipt = false
+	done := make(chan struct{})
+	select {
+	case h.message <- MessageRequest{Message: msg, Sender: p, Done: done}:
+	case <-h.quit:
+		return domain.Message{}, ErrStopped
+	}
+	select {
+	case <-done:
+	case <-h.quit:
+		return domain.Message{}, ErrStopped
+	}
+	if p.err != nil {
+		return domain.Message{}, p.err
+	}
+	return p.msg, nil
+}
+
+// holdPostRoom returns the live room for Post, starting a default-mode room
+// if none is live under name, and keeps it from being dropped until
+// releasePostRoom, so concurrent posts can share a room one of them started.
+// It returns ErrPrivateRoom if the room was made private since Post checked.
+func (h *Hub) holdPostRoom(name string) (*Room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[name]
+	switch {
+	case ok && r.Private():
+		return nil, ErrPrivateRoom
+	case !ok && !h.hasRoomSpaceLocked():
+		return nil, ErrMaxRooms
+	case !ok:
+		r = h.startRoom(name, domain.RoomModeDefault)
+	}
+	r.mu.Lock()
+	r.posting++
+	r.mu.Unlock()
+	return r, nil
+}
+
+// releasePostRoom lets go of a room held by holdPostRoom, dropping it if
+// nothing else keeps it.
+func (h *Hub) releasePostRoom(r *Room) {
+	r.mu.Lock()
+	r.posting--
+	r.mu.Unlock()
+	h.dropIfEmpty(r)
+}
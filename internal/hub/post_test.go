@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+func TestHubPostToUnknownRoomLeavesNoRoomBehind(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := New(s, 1, 50)
+	go h.Run()
+	defer h.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := h.Post(domain.Message{ID: fmt.Sprintf("m%d", i), Type: domain.MsgChat, Room: "scratch", User: "bot", Text: "hi"}); err != nil {
+			t.Fatalf("post %d: %v", i, err)
+		}
+	}
+	if h.RoomInfo("scratch") != nil {
+		t.Error("expected the room started for the post to be dropped")
+	}
+	if rooms, _ := s.Rooms(); len(rooms) != 0 {
+		t.Errorf("expected no persistent room recorded, got %+v", rooms)
+	}
+	if msgs, _ := s.History("scratch", 10); len(msgs) != 3 {
+		t.Errorf("expected the posts kept in history, got %d", len(msgs))
+	}
+
+	// The room slot is free again for a room created ahead of time.
+	if _, err := h.CreateRoom("ops", ""); err != nil {
+		t.Errorf("expected the room limit to be free after posting, got %v", err)
+	}
+}
+
+func TestHubConcurrentPostsShareTransientRoom(t *testing.T) {
+	t.Parallel()
+	h := New(nil, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	const n = 500
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := h.Post(domain.Message{ID: fmt.Sprintf("m%d", i), Type: domain.MsgChat, Room: "scratch", User: "bot", Text: "hi"})
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("post: %v", err)
+	}
+	if h.RoomInfo("scratch") != nil {
+		t.Error("expected the room dropped after the last post")
+	}
+}
@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// userConnsLocked counts user's connections in the room. The caller holds
+// r.mu.
+func (r *Room) userConnsLocked(user string) int {
+	n := 0
+	for c := range r.clients {
+		if c.Username() == user {
+			n++
+		}
+	}
+	return n
+}
+
+// emitPresenceAdd tells every member but c that c's user is in the room. It
+// is sent for the user's first connection, and for every later one when
+// connection counts are shown. Runs on the room goroutine.
+func (r *Room) emitPresenceAdd(c Client, conns int) {
+	if conns > 1 && !r.presenceConnections {
+		return
+	}
+	diff := domain.PresenceDiff{Type: domain.MsgPresenceAdd, Room: r.name, User: c.Username()}
+	if name := displayName(c); name != c.Username() {
+		diff.Name = name
+	}
+	if s := statusOf(c); s != domain.StatusOnline {
+		diff.Status = s
+	}
+	if r.presenceConnections {
+		diff.Connections = conns
+	}
+	r.emitPresenceDiff(diff, c)
+}
+
+// emitPresenceLeft updates members after one of user's connections left,
+// leaving conns behind: a presence_remove once the last one has gone, or,
+// when connection counts are shown, a presence_add with the new count.
+// Runs on the room goroutine.
+func (r *Room) emitPresenceLeft(user string, conns int) {
+	switch {
+	case conns == 0:
+		r.emitPresenceDiff(domain.PresenceDiff{Type: domain.MsgPresenceRemove, Room: r.name, User: user}, nil)
+	case r.presenceConnections:
+		r.emitPresenceDiff(domain.PresenceDiff{Type: domain.MsgPresenceAdd, Room: r.name, User: user, Connections: conns}, nil)
+	}
+}
+
+// skipPresence records that a roster diff was skipped while shedding load.
+func (r *Room) skipPresence() {
+	r.mu.Lock()
+	r.presenceStale = true
+	r.mu.Unlock()
+}
+
+// resyncPresence sends every member a full presence snapshot if roster diffs
+// were skipped while shedding load. It runs on the room goroutine, after
+// anything already queued.
+func (r *Room) resyncPresence() {
+	r.post(func() {
+		r.mu.Lock()
+		if !r.presenceStale {
+			r.mu.Unlock()
+			return
+		}
+		r.presenceStale = false
+		presence := r.presenceLocked()
+		r.mu.Unlock()
+		if presence != nil {
+			r.fanOut(broadcastReq{data: presence})
+		}
+	})
+}
+
+// emitPresenceDiff sends diff to every member except skip. Diffs and
+// connection counts describe this instance's members only, so, like the
+// snapshots they update, they are not published to other instances.
+func (r *Room) emitPresenceDiff(diff domain.PresenceDiff, skip Client) {
+	data, err := domain.Encode(diff)
+	if err != nil {
+		slog.Error("encode presence diff", "room", r.name, "err", err)
+		return
+	}
+	r.fanOut(broadcastReq{data: data, skip: skip})
+}
@@ -0,0 +1,160 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+// presenceFrames splits what a client received into full presence
+// snapshots and presence diffs.
+func presenceFrames(c *testutil.MockClient) (snapshots []domain.PresenceMessage, diffs []domain.PresenceDiff) {
+	for _, m := range c.GetMessages() {
+		var envelope struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(m, &envelope)
+		switch envelope.Type {
+		case domain.MsgPresence:
+			var pm domain.PresenceMessage
+			json.Unmarshal(m, &pm)
+			snapshots = append(snapshots, pm)
+		case domain.MsgPresenceAdd, domain.MsgPresenceRemove:
+			var d domain.PresenceDiff
+			json.Unmarshal(m, &d)
+			diffs = append(diffs, d)
+		}
+	}
+	return snapshots, diffs
+}
+
+func TestRoomPresenceDiffs(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	r.Join(alice)
+	bob := testutil.NewMockClient("bob")
+	r.Join(bob)
+
+	// The joiner gets the full roster and no diffs.
+	snapshots, diffs := presenceFrames(bob)
+	if len(snapshots) != 1 || len(snapshots[0].Users) != 2 {
+		t.Fatalf("expected bob to get one full snapshot, got %+v", snapshots)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diffs for the joiner, got %+v", diffs)
+	}
+
+	// A second connection for bob changes nothing for alice; only the last
+	// one leaving removes him.
+	bobTab := testutil.NewMockClient("bob")
+	r.Join(bobTab)
+	r.Leave(bob)
+	r.Leave(bobTab)
+
+	snapshots, diffs = presenceFrames(alice)
+	if len(snapshots) != 1 {
+		t.Errorf("expected alice to get only her own join snapshot, got %d", len(snapshots))
+	}
+	want := []domain.PresenceDiff{
+		{Type: domain.MsgPresenceAdd, Room: "test", User: "bob"},
+		{Type: domain.MsgPresenceRemove, Room: "test", User: "bob"},
+	}
+	if len(diffs) != len(want) || diffs[0] != want[0] || diffs[1] != want[1] {
+		t.Errorf("expected alice to get %+v, got %+v", want, diffs)
+	}
+}
+
+func TestRoomPresenceDiffsWithConnectionCounts(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	r.presenceConnections = true
+	go r.Run()
+	defer r.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	r.Join(alice)
+	tab1 := testutil.NewMockClient("bob")
+	tab2 := testutil.NewMockClient("bob")
+	r.Join(tab1)
+	r.Join(tab2)
+	r.Leave(tab1)
+
+	_, diffs := presenceFrames(alice)
+	counts := []int{}
+	for _, d := range diffs {
+		if d.Type != domain.MsgPresenceAdd || d.User != "bob" {
+			t.Fatalf("unexpected diff %+v", d)
+		}
+		counts = append(counts, d.Connections)
+	}
+	if len(counts) != 3 || counts[0] != 1 || counts[1] != 2 || counts[2] != 1 {
+		t.Errorf("expected bob's count to go 1, 2, 1, got %v", counts)
+	}
+}
+
+func TestRoomPresenceDiffsStayLocal(t *testing.T) {
+	t.Parallel()
+	relay := &relayRecorder{}
+	r := NewRoom("test", nil, 50)
+	r.broadcaster = relay
+	go r.Run()
+	defer r.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	r.Join(alice)
+	bob := testutil.NewMockClient("bob")
+	r.Join(bob)
+	r.Leave(bob)
+
+	if relay.published(domain.MsgPresenceAdd) || relay.published(domain.MsgPresenceRemove) {
+		t.Error("expected instance-local presence diffs not to be published")
+	}
+	if _, diffs := presenceFrames(alice); len(diffs) != 2 {
+		t.Errorf("expected alice to get bob's add and remove, got %+v", diffs)
+	}
+}
+
+func TestRoomPresenceResyncsAfterShedding(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50, WithLoadShedding(0, 0, 3, 1))
+	go h.Run()
+	defer h.Stop()
+
+	alice := track(h, "alice")
+	h.RegisterSync(alice, "general")
+
+	// Three connections put the hub in busy mode, so bob's join sends
+	// alice no diff.
+	bob := testutil.NewMockClient("bob")
+	untrackBob := h.TrackConn(trackedClient{bob})
+	untrackCarol := h.TrackConn(trackedClient{testutil.NewMockClient("carol")})
+	h.RegisterSync(bob, "general")
+	if _, diffs := presenceFrames(alice); len(diffs) != 0 {
+		t.Fatalf("expected no diffs while shedding, got %+v", diffs)
+	}
+
+	// Once load drops, alice is sent the full roster.
+	untrackBob()
+	untrackCarol()
+	if h.Busy() {
+		t.Fatal("expected the hub back to normal")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		snapshots, _ := presenceFrames(alice)
+		if n := len(snapshots); n > 1 && len(snapshots[n-1].Users) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a full snapshot with bob after recovery, got %+v", snapshots)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+)
+
+// Reaction limit errors returned by reactions.add.
+var (
+	errReactionEmojiLimit = errors.New("too many distinct reactions on message")
+	errReactionUserLimit  = errors.New("reaction limit reached")
+)
+
+// reactions tracks emoji reactions on a room's messages so per-message and
+// per-user caps can be enforced. A limit of zero or less means unlimited.
+type reactions struct {
+	mu              sync.Mutex
+	byMessage       map[string]map[string]map[string]bool // message id -> emoji -> users
+	perUser         map[string]int
+	maxEmojiPerMsg  int
+	maxPerUserTotal int
+}
+
+func newReactions(maxEmojiPerMsg, maxPerUserTotal int) *reactions {
+	return &reactions{
+		byMessage:       make(map[string]map[string]map[string]bool),
+		perUser:         make(map[string]int),
+		maxEmojiPerMsg:  maxEmojiPerMsg,
+		maxPerUserTotal: maxPerUserTotal,
+	}
+}
+
+// add records user's emoji reaction on messageID. It reports false without
+// an error if the user had already added the same reaction.
+func (rx *reactions) add(messageID, user, emoji string) (bool, error) {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+
+	emojis := rx.byMessage[messageID]
+	if emojis[emoji][user] {
+		return false, nil
+	}
+	if rx.maxPerUserTotal > 0 && rx.perUser[user] >= rx.maxPerUserTotal {
+		return false, errReactionUserLimit
+	}
+	if _, exists := emojis[emoji]; !exists && rx.maxEmojiPerMsg > 0 && len(emojis) >= rx.maxEmojiPerMsg {
+		return false, errReactionEmojiLimit
+	}
+
+	if emojis == nil {
+		emojis = make(map[string]map[string]bool)
+		rx.byMessage[messageID] = emojis
+	}
+	if emojis[emoji] == nil {
+		emojis[emoji] = make(map[string]bool)
+	}
+	emojis[emoji][user] = true
+	rx.perUser[user]++
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"strings"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// Renamer is a Client whose display name can be changed mid-session. The
+// username stays the client's identity; the display name is what others see.
+type Renamer interface {
+	Client
+	DisplayName() string
+	SetDisplayName(name string)
+}
+
+// displayName returns the name to show for c, falling back to its username.
+func displayName(c Client) string {
+	if rn, ok := c.(Renamer); ok {
+		if name := rn.DisplayName(); name != "" {
+			return name
+		}
+	}
+	return c.Username()
+}
+
+// WithUniqueNames rejects renames to a name another connected user already
+// goes by, either as username or display name, ignoring case.
+func WithUniqueNames(enabled bool) Option {
+	return func(h *Hub) {
+		h.uniqueNames = enabled
+	}
+}
+
+// Rename sets c's display name and sends every room c is in a rename notice,
+// a system message saying who is now known as what, and a refreshed presence
+// snapshot. The name is cleaned with
+// domain.CleanDisplayName; renaming to one's own username clears the display
+// name. With unique names enforced, a name in use by another connected user
+// fails with domain.ErrNameTaken.
+func (h *Hub) Rename(c Renamer, name string) error {
+	name, err := domain.CleanDisplayName(name)
+	if err != nil {
+		return err
+	}
+	if name == c.Username() {
+		name = ""
+	}
+
+	// The check and the update happen under connsMu so two clients cannot
+	// both claim the same name.
+	h.connsMu.Lock()
+	if h.uniqueNames && name != "" && h.nameTakenLocked(c.Username(), name) {
+		h.connsMu.Unlock()
+		return domain.ErrNameTaken
+	}
+	old := displayName(c)
+	c.SetDisplayName(name)
+	h.connsMu.Unlock()
+
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+	for _, r := range rooms {
+		r.Renamed(c, old)
+	}
+	return nil
+}
+
+// nameTakenLocked reports whether a tracked user other than self goes by
+// name. The caller holds h.connsMu.
+func (h *Hub) nameTakenLocked(self, name string) bool {
+	for user, clients := range h.users {
+		if user == self {
+			continue
+		}
+		if strings.EqualFold(user, name) {
+			return true
+		}
+		for cl := range clients {
+			if strings.EqualFold(displayName(cl), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+// relayRecorder is a broadcaster that delivers locally and records the
+// type of every frame it would have published to other instances.
+type relayRecorder struct {
+	mu    sync.Mutex
+	types []string
+}
+
+func (b *relayRecorder) Broadcast(_ string, data []byte, deliver func([]byte)) {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &frame)
+	b.mu.Lock()
+	b.types = append(b.types, frame.Type)
+	b.mu.Unlock()
+	deliver(data)
+}
+
+func (b *relayRecorder) published(typ string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Contains(b.types, typ)
+}
+
+func TestHubRenameNotifiesRoom(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+
+	if err := h.Rename(alice, "  Alice L. "); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var notice, system *domain.Message
+	for _, m := range bob.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgRename {
+			notice = &msg
+		}
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgSystem {
+			system = &msg
+		}
+	}
+	if notice == nil || notice.User != "alice" || notice.Name != "Alice L." || notice.Room != "general" {
+		t.Fatalf("expected rename notice for alice, got %+v", notice)
+	}
+	if system == nil || system.Text != "alice is now known as Alice L." {
+		t.Errorf("expected a system message announcing the new name, got %+v", system)
+	}
+	pm := lastPresence(t, bob)
+	if pm.Names["alice"] != "Alice L." || len(pm.Users) != 2 {
+		t.Errorf("expected presence with alice's new name, got %+v", pm)
+	}
+
+	// Renaming back to the username clears the display name.
+	if err := h.Rename(alice, "alice"); err != nil {
+		t.Fatalf("rename back: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pm := lastPresence(t, bob); pm.Names != nil {
+		t.Errorf("expected no display names, got %v", pm.Names)
+	}
+
+	if err := h.Rename(alice, "   "); err != domain.ErrInvalidName {
+		t.Errorf("expected ErrInvalidName for blank name, got %v", err)
+	}
+}
+
+func TestHubRenameKeepsPresenceLocal(t *testing.T) {
+	t.Parallel()
+	relay := &relayRecorder{}
+	h := New(testutil.NewMockStore(), 100, 50, WithBroadcaster(relay))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	if err := h.Rename(alice, "Alice L."); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if !relay.published(domain.MsgRename) {
+		t.Error("expected the rename notice to reach other instances")
+	}
+	if relay.published(domain.MsgPresence) {
+		t.Error("expected the instance-local presence snapshot not to be published")
+	}
+	if pm := lastPresence(t, bob); pm.Names["alice"] != "Alice L." {
+		t.Errorf("expected local members to get the new snapshot, got %+v", pm)
+	}
+}
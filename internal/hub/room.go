@@ -1,10 +1,18 @@
 package hub
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/devaloi/chatterbox/internal/broadcast"
 	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/ratelimit"
 	"github.com/devaloi/chatterbox/internal/store"
 )
 
@@ -17,59 +25,371 @@ type Client interface {
 	Send(data []byte)
 }
 
+// broadcastReq is a message queued for fan-out to every client in the room,
+// or, when op is set, a membership change to apply in queue order.
+type broadcastReq struct {
+	data []byte
+	// onDelivered, if set, is called after fan-out with the number of
+	// recipients, not counting sender.
+	onDelivered func(count int)
+	sender      Client
+	skip        Client // not sent to, if set
+
+	op *roomOp
+}
+
+// roomOp is a change run on the room goroutine, between the fan-outs queued
+// before and after it. Whoever claims it first runs it: the room goroutine,
+// or the caller once the room has stopped.
+type roomOp struct {
+	fn      func()
+	claimed atomic.Bool
+	done    chan struct{}
+}
+
+func (op *roomOp) run() {
+	if !op.claimed.CompareAndSwap(false, true) {
+		return
+	}
+	defer close(op.done)
+	op.fn()
+}
+
 // Room manages a set of clients and broadcasts messages to them.
 type Room struct {
 	name      string
 	clients   map[Client]bool
+	watchers  map[Client]bool // relays getting broadcasts as non-members; guarded by mu
 	mu        sync.RWMutex
-	broadcast chan []byte
+	broadcast chan broadcastReq
 	store     store.Store
 	history   int
 	quit      chan struct{}
 	stopOnce  sync.Once
+	reactions *reactions
+	policy    domain.TypePolicy
+	joinOrder JoinOrder
+	// busy, if set, reports whether the server is shedding load; join and
+	// leave notifications and roster diffs are skipped while it returns true.
+	busy  func() bool
+	mode  string // domain.RoomMode*
+	topic string // guarded by mu
+
+	presenceConnections bool // include per-user connection counts in presence
+	presenceStale       bool // roster diffs were skipped while busy; guarded by mu
+	maxClients          int  // joins beyond this are refused; 0 is unlimited
+
+	passwordHash string   // set at creation; empty for a public room
+	admitting    int      // joins and watches queued but not applied; guarded by mu
+	posting      int      // Posts holding the room open; guarded by mu
+	bans         *banList // kicked users; shared with the hub's other rooms
+
+	poll pollBuffer // recent routed messages for long-poll clients
+
+	// broadcaster carries broadcasts to members, including those on other
+	// instances; local deliveries are queued on broadcast.
+	broadcaster broadcast.Broadcaster
+
+	createdAt time.Time // set while the room is started, under the hub lock
+	locked    bool      // chat is rejected while set; guarded by mu
+	closed    bool      // set by removeAll; later joins fail; guarded by mu
+
+	lastActive atomic.Int64 // unix nanos of the last join, leave or broadcast
+
+	// members, if set, counts memberships across the hub's rooms.
+	members *atomic.Int64
+
+	// onCrash, if set, is called from Run when the broadcast loop has
+	// panicked too often to keep restarting it.
+	onCrash func()
+
+	// limiter caps chat messages accepted across all senders; nil when
+	// unlimited. Only used from the hub's event loop.
+	limiter *ratelimit.Bucket
+
+	// sendTimeout bounds how long a fan-out waits on its members' sends.
+	sendTimeout time.Duration
+	sendMu      sync.Mutex
+	sending     map[Client]bool // members with a fan-out send in progress
 }
 
 // NewRoom creates a new room with the given name and message store.
 func NewRoom(name string, s store.Store, historyLimit int) *Room {
-	return &Room{
+	r := &Room{
 		name:      name,
 		clients:   make(map[Client]bool),
-		broadcast: make(chan []byte, roomBroadcastBuffer),
+		watchers:  make(map[Client]bool),
+		bans:      newBanList(),
+		broadcast: make(chan broadcastReq, roomBroadcastBuffer),
 		store:     s,
 		history:   historyLimit,
 		quit:      make(chan struct{}),
+		reactions: newReactions(0, 0),
+		policy:    domain.DefaultTypePolicy(),
+
+		broadcaster: broadcast.Local{},
+		createdAt:   time.Now().UTC(),
+		sendTimeout: defaultSendTimeout,
+		sending:     make(map[Client]bool),
 	}
+	r.touch()
+	return r
 }
 
+// maxRoomRestarts bounds how many times in a row a room's broadcast loop is
+// restarted after a panic before the room is closed.
+const maxRoomRestarts = 3
+
 // Run starts the room's broadcast loop. Should be called as a goroutine.
-// Uses panic recovery so one room crash doesn't bring down the whole server.
+// Uses panic recovery so one room crash doesn't bring down the whole server:
+// the loop is restarted, and if it panics maxRoomRestarts times in a row
+// without completing a fan-out in between, onCrash is called and Run returns.
 func (r *Room) Run() {
+	failures := 0
+	for {
+		fanouts, panicked := r.runLoop()
+		if !panicked {
+			return
+		}
+		if fanouts > 0 {
+			failures = 0
+		}
+		failures++
+		if failures > maxRoomRestarts {
+			slog.Error("room broadcast loop keeps panicking, closing room", "room", r.name)
+			if r.onCrash != nil {
+				r.onCrash()
+			}
+			return
+		}
+		slog.Warn("restarting room broadcast loop", "room", r.name, "attempt", failures)
+	}
+}
+
+// runLoop runs the broadcast loop until the room stops or a fan-out panics,
+// and reports how many fan-outs completed.
+func (r *Room) runLoop() (fanouts int, panicked bool) {
 	defer func() {
 		if rv := recover(); rv != nil {
-			log.Printf("room %s: recovered from panic: %v", r.name, rv)
+			slog.Error("room recovered from panic", "room", r.name, "panic", rv)
+			panicked = true
 		}
 	}()
 
 	for {
 		select {
-		case msg := <-r.broadcast:
-			// Copy client list under lock, then send outside lock to avoid
-			// holding the read lock while calling into client Send methods
-			// (which may block or acquire their own locks).
-			r.mu.RLock()
-			clients := make([]Client, 0, len(r.clients))
-			for c := range r.clients {
-				clients = append(clients, c)
+		case req := <-r.broadcast:
+			if req.op != nil {
+				req.op.run()
+			} else {
+				r.fanOut(req)
 			}
-			r.mu.RUnlock()
+			fanouts++
+		case <-r.quit:
+			return fanouts, false
+		}
+	}
+}
+
+// fanOutWorkers bounds how many member sends one fan-out runs at once.
+const fanOutWorkers = 16
+
+// defaultSendTimeout is how long a fan-out waits for its sends before the
+// room moves on without the members still blocked in Send.
+const defaultSendTimeout = 100 * time.Millisecond
+
+// sendJob is one member send in a fan-out.
+type sendJob struct {
+	client  Client
+	encoded []byte // the frame in the client's codec, for a FrameEncoder
+}
+
+// sendResult reports one member send from a fan-out worker.
+type sendResult struct {
+	client Client
+	panic  any // recovered from Send, if it panicked
+}
 
-			for _, c := range clients {
-				c.Send(msg)
+// fanOut sends a queued broadcast to every member, several at a time, so a
+// member blocked in Send cannot hold up the rest. It waits up to sendTimeout
+// for the sends to finish. A member still blocked after that is skipped by
+// later fan-outs until its Send returns, which keeps each member's frames in
+// order, and a Disconnecter is closed with CloseSlowConsumer so it does not
+// carry on with frames missing.
+func (r *Room) fanOut(req broadcastReq) {
+	// Copy client list under lock, then send outside lock to avoid
+	// holding the read lock while calling into client Send methods
+	// (which may block or acquire their own locks).
+	r.mu.RLock()
+	clients := make([]Client, 0, len(r.clients)+len(r.watchers))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	for c := range r.watchers {
+		clients = append(clients, c)
+	}
+	r.mu.RUnlock()
+
+	targets := clients[:0]
+	var slow []Client
+	r.sendMu.Lock()
+	for _, c := range clients {
+		if c == req.skip {
+			continue
+		}
+		if r.sending[c] {
+			slow = append(slow, c)
+			continue
+		}
+		r.sending[c] = true
+		targets = append(targets, c)
+	}
+	r.sendMu.Unlock()
+
+	// A member still blocked on an earlier broadcast misses this one.
+	// Rather than leave a silent gap in its stream, disconnect it so it
+	// reconnects and reloads history.
+	for _, c := range slow {
+		slog.Warn("client still blocked on an earlier broadcast, disconnecting", "room", r.name, "user", c.Username())
+		if d, ok := c.(Disconnecter); ok {
+			d.Disconnect(domain.CloseSlowConsumer, "too slow")
+		}
+	}
+
+	// Members sharing a codec share one encoding of the frame.
+	encoded := make(map[domain.Codec][]byte)
+	jobs := make(chan sendJob, len(targets))
+	for _, c := range targets {
+		job := sendJob{client: c}
+		if fe, ok := c.(FrameEncoder); ok && fe.Codec() != domain.JSON {
+			codec := fe.Codec()
+			data, done := encoded[codec]
+			if !done {
+				var err error
+				if data, err = codec.Marshal(json.RawMessage(req.data)); err != nil {
+					slog.Error("encode broadcast", "room", r.name, "codec", codec.Name(), "err", err)
+				}
+				encoded[codec] = data
 			}
+			job.encoded = data
+		}
+		jobs <- job
+	}
+	close(jobs)
+
+	pending := len(jobs)
+	// Buffered for every send, so workers never block on a fan-out that
+	// has stopped waiting.
+	results := make(chan sendResult, pending)
+	for range min(pending, fanOutWorkers) {
+		go func() {
+			for job := range jobs {
+				results <- r.send(job, req.data)
+			}
+		}()
+	}
+
+	delivered := 0
+	timeout := time.NewTimer(r.sendTimeout)
+	defer timeout.Stop()
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case res := <-results:
+			if res.panic != nil {
+				// Re-raised on the room goroutine so Run restarts the loop.
+				// Sends still running finish on their own.
+				panic(res.panic)
+			}
+			if res.client != req.sender {
+				delivered++
+			}
+		case <-timeout.C:
+			slog.Warn("broadcast timed out waiting for clients", "room", r.name, "pending", pending)
+			break wait
+		}
+	}
+	if req.onDelivered != nil {
+		req.onDelivered(delivered)
+	}
+}
+
+// send hands data to the job's client, already encoded when the job
+// carries an encoding, recovering a panic from Send so the fan-out can
+// re-raise it, and frees the client for later fan-outs.
+func (r *Room) send(job sendJob, data []byte) (res sendResult) {
+	c := job.client
+	res.client = c
+	defer func() {
+		res.panic = recover()
+		r.sendMu.Lock()
+		delete(r.sending, c)
+		r.sendMu.Unlock()
+	}()
+	if job.encoded != nil {
+		c.(FrameEncoder).SendEncoded(data, job.encoded)
+	} else {
+		c.Send(data)
+	}
+	return res
+}
+
+// do runs fn on the room goroutine, in order with queued broadcasts, and
+// waits for it to finish. Once the room has stopped, fn runs on the caller
+// instead. fn must not queue on r.broadcast; it uses emit to broadcast.
+func (r *Room) do(fn func()) {
+	op := &roomOp{fn: fn, done: make(chan struct{})}
+	select {
+	case r.broadcast <- broadcastReq{op: op}:
+	case <-r.quit:
+		op.run()
+		return
+	}
+	select {
+	case <-op.done:
+	case <-r.quit:
+		op.run()
+		<-op.done
+	}
+}
+
+// post queues fn like do but returns without waiting for it to run. If the
+// room stops before fn has run, fn runs on another goroutine instead.
+func (r *Room) post(fn func()) {
+	op := &roomOp{fn: fn, done: make(chan struct{})}
+	select {
+	case r.broadcast <- broadcastReq{op: op}:
+	case <-r.quit:
+		op.run()
+		return
+	}
+	go func() {
+		select {
+		case <-op.done:
 		case <-r.quit:
-			return
+			op.run()
 		}
+	}()
+}
+
+// removeAll empties the room for good and returns the clients that were
+// in it. Joins that were already on their way fail with ErrRoomClosed
+// rather than landing in the dead room.
+func (r *Room) removeAll() []Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	clients := make([]Client, 0, len(r.clients)+len(r.watchers))
+	for c := range r.clients {
+		clients = append(clients, c)
+		delete(r.clients, c)
 	}
+	r.countMembers(-int64(len(clients)))
+	for c := range r.watchers {
+		clients = append(clients, c)
+		delete(r.watchers, c)
+	}
+	return clients
 }
 
 // Stop signals the room's broadcast loop to exit.
@@ -80,63 +400,328 @@ func (r *Room) Stop() {
 	})
 }
 
-// Join adds a client to the room and sends history + presence.
-func (r *Room) Join(c Client) {
+// JoinOrder selects the order of the snapshot frames a joining client
+// receives before any live room traffic.
+type JoinOrder int
+
+const (
+	// JoinOrderPresenceFirst sends presence, then history. This is the default,
+	// so clients know the roster before rendering past messages.
+	JoinOrderPresenceFirst JoinOrder = iota
+	// JoinOrderHistoryFirst sends history, then presence.
+	JoinOrderHistoryFirst
+)
+
+// ParseJoinOrder parses "presence-first" or "history-first".
+func ParseJoinOrder(s string) (JoinOrder, error) {
+	switch s {
+	case "", "presence-first":
+		return JoinOrderPresenceFirst, nil
+	case "history-first":
+		return JoinOrderHistoryFirst, nil
+	}
+	return 0, fmt.Errorf("invalid join order %q: want presence-first or history-first", s)
+}
+
+// Join adds a client to the room.
+//
+// Ordering contract: joins, leaves, kicks and broadcasts are applied one at
+// a time, in the order they were made, on the room goroutine, so every member
+// sees the room's events in the same FIFO order. The joiner first receives
+// its snapshot (presence and history, in the room's JoinOrder), then the
+// join notification for itself, and only then messages broadcast after it
+// joined; nothing queued before its join reaches it live.
+//
+// Join refuses, without adding the client, when the room is full
+// (ErrRoomFull) or the user is banned from it (ErrBanned). It returns
+// ErrRoomClosed if the room has been closed or failed while applying the
+// join.
+func (r *Room) Join(c Client) error {
+	return r.JoinSince(c, "")
+}
+
+// JoinSince is Join for a client resuming after a reconnect: its history
+// holds only the messages after sinceID, the last message it has. When
+// sinceID is empty or unknown, or more messages than the history limit have
+// arrived since, the usual latest history is sent instead.
+func (r *Room) JoinSince(c Client, sinceID string) error {
+	errc := make(chan error, 1)
+	r.admit(func() error { return r.join(c, sinceID) }, func(err error) { errc <- err })
+	return <-errc
+}
+
+// admit queues add, a join or watch, without waiting for it to be applied,
+// and passes its result to done from the goroutine that applied it. Until
+// then the room does not count as empty, so it is not dropped from under
+// the pending join. add must decrement r.admitting under r.mu.
+func (r *Room) admit(add func() error, done func(error)) {
+	r.mu.Lock()
+	r.admitting++
+	r.mu.Unlock()
+	r.post(func() { done(add()) })
+}
+
+// join applies a join on the room goroutine. The history is loaded before
+// r.mu is taken and the snapshot sent after it is released, so store reads
+// and slow clients do not hold up readers of the room.
+func (r *Room) join(c Client, sinceID string) error {
+	history := r.historyFrame(sinceID)
 	r.mu.Lock()
+	r.admitting--
+	if r.closed {
+		r.mu.Unlock()
+		return ErrRoomClosed
+	}
+	if r.clients[c] {
+		r.mu.Unlock()
+		r.sendPresence(c)
+		return nil
+	}
+	if r.bans.banned(r.name, c.Username()) {
+		r.mu.Unlock()
+		return ErrBanned
+	}
+	if r.maxClients > 0 && len(r.clients) >= r.maxClients {
+		r.mu.Unlock()
+		return ErrRoomFull
+	}
+	// The client must be in r.clients before the presence snapshot below is
+	// built, so a (re)joining client always sees itself in the roster.
 	r.clients[c] = true
+	r.countMembers(1)
+	r.touch()
+	conns := r.userConnsLocked(c.Username())
+	presence := r.presenceLocked()
 	r.mu.Unlock()
 
-	// Send message history to the joining client.
-	if r.store != nil {
-		msgs, err := r.store.History(r.name, r.history)
-		if err != nil {
-			log.Printf("room %s: history error: %v", r.name, err)
-		} else if len(msgs) > 0 {
-			hm := domain.HistoryMessage{
-				Type:     domain.MsgHistory,
-				Room:     r.name,
-				Messages: msgs,
-			}
-			data, err := domain.Encode(hm)
-			if err != nil {
-				log.Printf("room %s: encode history error: %v", r.name, err)
-			} else {
-				c.Send(data)
-			}
+	frames := [][]byte{presence, history}
+	if r.joinOrder == JoinOrderHistoryFirst {
+		frames = [][]byte{history, presence}
+	}
+	for _, data := range frames {
+		if data != nil {
+			c.Send(data)
 		}
 	}
 
-	// Broadcast join notification.
-	joinMsg := domain.Message{Type: domain.MsgJoin, Room: r.name, User: c.Username()}
-	data, err := domain.Encode(joinMsg)
+	// While shedding load neither the roster diff nor the join notification
+	// goes out; members get a full snapshot once the hub recovers.
+	if r.shedding() {
+		r.skipPresence()
+		return nil
+	}
+	r.emitPresenceAdd(c, conns)
+	r.emit(domain.Message{Type: domain.MsgJoin, Room: r.name, User: c.Username()})
+	return nil
+}
+
+// historyFrame encodes the room's history for a joiner, resuming after
+// sinceID if set, or returns nil when there is nothing to send.
+func (r *Room) historyFrame(sinceID string) []byte {
+	if r.store == nil || r.history <= 0 || r.mode == domain.RoomModeEphemeral {
+		return nil
+	}
+	msgs, err := r.loadHistory(sinceID)
 	if err != nil {
-		log.Printf("room %s: encode join error: %v", r.name, err)
-	} else {
-		r.broadcast <- data
+		slog.Error("load history", "room", r.name, "err", err)
+		return nil
 	}
+	msgs = r.filterHistory(store.ClampHistory(msgs, r.history))
+	if len(msgs) == 0 {
+		return nil
+	}
+	data, err := domain.Encode(domain.HistoryMessage{
+		Type:     domain.MsgHistory,
+		Room:     r.name,
+		Messages: msgs,
+	})
+	if err != nil {
+		slog.Error("encode history", "room", r.name, "err", err)
+		return nil
+	}
+	return data
+}
 
-	// Send presence to the joining client.
-	r.sendPresence(c)
+// loadHistory returns the messages after sinceID, or the latest messages
+// when that is not possible: no cursor, an unknown one, or too many messages
+// since it to fit the history limit.
+func (r *Room) loadHistory(sinceID string) ([]domain.Message, error) {
+	if sinceID != "" {
+		msgs, err := r.store.HistoryAfterID(r.name, sinceID, r.history)
+		switch {
+		case err == nil && len(msgs) < r.history:
+			return msgs, nil
+		case err != nil && !errors.Is(err, domain.ErrMessageNotFound):
+			return nil, err
+		}
+	}
+	return r.store.History(r.name, r.history)
+}
+
+func (r *Room) shedding() bool {
+	return r.busy != nil && r.busy()
+}
+
+// filterHistory drops stored messages whose type the policy excludes from
+// join history. Filtering happens after the limit is applied, so a room may
+// replay fewer than its history limit.
+func (r *Room) filterHistory(msgs []domain.Message) []domain.Message {
+	out := msgs[:0:0]
+	for _, m := range msgs {
+		if r.policy.IncludeInHistory(m.Type) {
+			out = append(out, m)
+		}
+	}
+	return out
 }
 
 // Leave removes a client from the room and broadcasts a leave notification.
+// Like Join, it is applied in order with the room's broadcasts: the client
+// still receives everything queued before it left.
 func (r *Room) Leave(c Client) {
+	r.do(func() { r.leave(c) })
+}
+
+// leave applies a leave on the room goroutine.
+func (r *Room) leave(c Client) {
 	r.mu.Lock()
-	delete(r.clients, c)
+	if r.watchers[c] {
+		delete(r.watchers, c)
+		r.mu.Unlock()
+		return
+	}
+	member := r.clients[c]
+	if member {
+		delete(r.clients, c)
+		r.countMembers(-1)
+	}
+	conns := r.userConnsLocked(c.Username())
 	r.mu.Unlock()
+	r.touch()
+
+	if r.shedding() {
+		if member {
+			r.skipPresence()
+		}
+		return
+	}
+	if member {
+		r.emitPresenceLeft(c.Username(), conns)
+	}
+	r.emit(domain.Message{Type: domain.MsgLeave, Room: r.name, User: c.Username()})
+}
+
+// broadcastEvent timestamps a room lifecycle event (a join, leave, or
+// system notice), saves it if the type policy persists its type, and
+// broadcasts it.
+func (r *Room) broadcastEvent(msg domain.Message) {
+	if data := r.encodeEvent(msg); data != nil {
+		r.Broadcast(data)
+	}
+}
+
+// emit is broadcastEvent for use on the room goroutine, by a change run with
+// do: local members get the event straight away rather than through the
+// queue the goroutine is draining.
+func (r *Room) emit(msg domain.Message) {
+	if data := r.encodeEvent(msg); data != nil {
+		r.touch()
+		r.broadcaster.Broadcast(r.name, data, func(data []byte) {
+			r.fanOut(broadcastReq{data: data})
+		})
+	}
+}
 
-	leaveMsg := domain.Message{Type: domain.MsgLeave, Room: r.name, User: c.Username()}
-	data, err := domain.Encode(leaveMsg)
+// encodeEvent timestamps and saves an event and returns it encoded, or nil
+// if encoding fails.
+func (r *Room) encodeEvent(msg domain.Message) []byte {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	r.saveEvent(msg)
+	data, err := domain.Encode(msg)
 	if err != nil {
-		log.Printf("room %s: encode leave error: %v", r.name, err)
-	} else {
-		r.broadcast <- data
+		slog.Error("encode event", "room", r.name, "user", msg.User, "type", msg.Type, "err", err)
+		return nil
+	}
+	return data
+}
+
+// saveEvent stores a lifecycle event so it is replayed in join history.
+// Ephemeral rooms keep nothing.
+func (r *Room) saveEvent(msg domain.Message) {
+	if r.store == nil || r.mode == domain.RoomModeEphemeral || !r.policy.ShouldPersist(msg.Type) {
+		return
+	}
+	if err := r.store.Save(msg); err != nil {
+		slog.Error("store save", "room", r.name, "user", msg.User, "type", msg.Type, "err", err)
 	}
 }
 
 // Broadcast sends a raw JSON message to all clients in the room.
 func (r *Room) Broadcast(data []byte) {
-	r.broadcast <- data
+	r.touch()
+	r.broadcaster.Broadcast(r.name, data, r.deliver)
+}
+
+// deliver queues data for this instance's members only.
+func (r *Room) deliver(data []byte) {
+	r.broadcast <- broadcastReq{data: data}
+}
+
+// sendAll queues data on every member's connection directly, bypassing the
+// room goroutine, so it has been handed to each client when sendAll returns.
+func (r *Room) sendAll(data []byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for c := range r.clients {
+		c.Send(data)
+	}
+}
+
+// BroadcastWithReceipt sends a raw JSON message to all clients in the room
+// and calls onDelivered from the room goroutine once fan-out is done, with
+// the number of clients other than sender that the message was sent to.
+// Only members on this instance are counted.
+func (r *Room) BroadcastWithReceipt(data []byte, sender Client, onDelivered func(count int)) {
+	r.touch()
+	r.broadcaster.Broadcast(r.name, data, func(data []byte) {
+		r.broadcast <- broadcastReq{data: data, sender: sender, onDelivered: onDelivered}
+	})
+}
+
+// React records a reaction and broadcasts it to the room. Repeating a
+// reaction already recorded is a no-op.
+func (r *Room) React(msg domain.Message) error {
+	added, err := r.reactions.add(msg.MessageID, msg.User, msg.Emoji)
+	if err != nil || !added {
+		return err
+	}
+	data, err := domain.Encode(msg)
+	if err != nil {
+		slog.Error("encode reaction", "room", r.name, "err", err)
+		return nil
+	}
+	r.Broadcast(data)
+	return nil
+}
+
+// countMembers adjusts the hub's membership count, if the room has one.
+func (r *Room) countMembers(delta int64) {
+	if r.members != nil {
+		r.members.Add(delta)
+	}
+}
+
+// touch records room activity for LRU eviction.
+func (r *Room) touch() {
+	r.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive returns when a client last joined or left the room or a
+// message was last broadcast to it.
+func (r *Room) LastActive() time.Time {
+	return time.Unix(0, r.lastActive.Load())
 }
 
 // ClientCount returns the number of connected clients.
@@ -151,10 +736,20 @@ func (r *Room) Name() string {
 	return r.name
 }
 
+// CreatedAt returns when the room was created. A room restored by
+// RestoreRooms keeps the time it was first created.
+func (r *Room) CreatedAt() time.Time {
+	return r.createdAt
+}
+
 // Users returns a list of usernames in the room.
 func (r *Room) Users() []string {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.usersLocked()
+}
+
+func (r *Room) usersLocked() []string {
 	users := make([]string, 0, len(r.clients))
 	for c := range r.clients {
 		users = append(users, c.Username())
@@ -162,16 +757,86 @@ func (r *Room) Users() []string {
 	return users
 }
 
+// namesLocked maps usernames to display names for members that have set one.
+func (r *Room) namesLocked() map[string]string {
+	var names map[string]string
+	for c := range r.clients {
+		if name := displayName(c); name != c.Username() {
+			if names == nil {
+				names = make(map[string]string)
+			}
+			names[c.Username()] = name
+		}
+	}
+	return names
+}
+
 func (r *Room) sendPresence(c Client) {
+	r.mu.RLock()
+	data := r.presenceLocked()
+	r.mu.RUnlock()
+	if data != nil {
+		c.Send(data)
+	}
+}
+
+// Renamed tells the room that c's display name changed from old. If c is a
+// member, everyone gets a rename notice, a system message, and a refreshed
+// presence snapshot. The snapshot only lists this instance's members, so it
+// goes to them alone rather than through the broadcaster.
+func (r *Room) Renamed(c Client, old string) {
+	r.mu.RLock()
+	if !r.clients[c] {
+		r.mu.RUnlock()
+		return
+	}
+	presence := r.presenceLocked()
+	r.mu.RUnlock()
+
+	notice := domain.Message{Type: domain.MsgRename, Room: r.name, User: c.Username(), Name: displayName(c)}
+	data, err := domain.Encode(notice)
+	if err != nil {
+		slog.Error("encode rename", "room", r.name, "err", err)
+		return
+	}
+	r.Broadcast(data)
+	r.broadcastEvent(domain.Message{
+		Type: domain.MsgSystem, Room: r.name, User: c.Username(),
+		Text: old + " is now known as " + displayName(c),
+	})
+	if presence != nil {
+		r.deliver(presence)
+	}
+}
+
+// presenceLocked encodes the room's presence snapshot. The caller holds r.mu.
+func (r *Room) presenceLocked() []byte {
+	users := r.usersLocked()
+	counts := make(map[string]int, len(users))
+	for _, u := range users {
+		counts[u]++
+	}
 	pm := domain.PresenceMessage{
-		Type:  domain.MsgPresence,
-		Room:  r.name,
-		Users: r.Users(),
+		Type:     domain.MsgPresence,
+		Room:     r.name,
+		Topic:    r.topic,
+		Users:    make([]string, 0, len(counts)),
+		Names:    r.namesLocked(),
+		Statuses: r.statusesLocked(),
+	}
+	for u := range counts {
+		pm.Users = append(pm.Users, u)
+	}
+	slices.Sort(pm.Users)
+	if r.presenceConnections {
+		for _, u := range pm.Users {
+			pm.Members = append(pm.Members, domain.PresenceMember{User: u, Connections: counts[u]})
+		}
 	}
 	data, err := domain.Encode(pm)
 	if err != nil {
-		log.Printf("room %s: encode presence error: %v", r.name, err)
-		return
+		slog.Error("encode presence", "room", r.name, "err", err)
+		return nil
 	}
-	c.Send(data)
+	return data
 }
@@ -1,11 +1,17 @@
 package hub
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
 	"github.com/devaloi/chatterbox/internal/testutil"
 )
 
@@ -127,3 +133,604 @@ func TestRoomHistoryOnJoin(t *testing.T) {
 		t.Error("expected history message on join")
 	}
 }
+
+func TestRoomJoinIdempotent(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	c := testutil.NewMockClient("alice")
+	r.Join(c)
+	r.Join(c)
+	time.Sleep(50 * time.Millisecond)
+
+	if r.ClientCount() != 1 {
+		t.Errorf("expected 1 client, got %d", r.ClientCount())
+	}
+
+	joins, presences := 0, 0
+	for _, m := range c.GetMessages() {
+		var decoded domain.Message
+		if err := json.Unmarshal(m, &decoded); err != nil {
+			continue
+		}
+		switch decoded.Type {
+		case domain.MsgJoin:
+			joins++
+		case domain.MsgPresence:
+			presences++
+		}
+	}
+	if joins != 1 {
+		t.Errorf("expected 1 join broadcast, got %d", joins)
+	}
+	if presences != 2 {
+		t.Errorf("expected presence resent on duplicate join, got %d", presences)
+	}
+}
+
+// overflowStore ignores the History limit, like a misbehaving custom store.
+type overflowStore struct {
+	*testutil.MockStore
+}
+
+func (s overflowStore) History(room string, limit int) ([]domain.Message, error) {
+	return s.MockStore.History(room, 1000)
+}
+
+func TestRoomHistoryClampedToLimit(t *testing.T) {
+	t.Parallel()
+	s := overflowStore{testutil.NewMockStore()}
+	for i := 0; i < 20; i++ {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "test", User: "system", Text: "msg"})
+	}
+
+	r := NewRoom("test", s, 5)
+	go r.Run()
+	defer r.Stop()
+
+	c := testutil.NewMockClient("alice")
+	r.Join(c)
+	time.Sleep(50 * time.Millisecond)
+
+	for _, m := range c.GetMessages() {
+		var hm domain.HistoryMessage
+		if err := json.Unmarshal(m, &hm); err == nil && hm.Type == domain.MsgHistory {
+			if len(hm.Messages) != 5 {
+				t.Errorf("expected history clamped to 5, got %d", len(hm.Messages))
+			}
+			return
+		}
+	}
+	t.Error("expected history message on join")
+}
+
+func TestRoomPresenceSnapshotIncludesJoiner(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	bob := testutil.NewMockClient("bob")
+	r.Join(bob)
+	alice := testutil.NewMockClient("alice")
+	r.Join(alice)
+
+	// The snapshot is sent synchronously by Join, so no wait is needed.
+	for _, m := range alice.GetMessages() {
+		var pm domain.PresenceMessage
+		if err := json.Unmarshal(m, &pm); err != nil || pm.Type != domain.MsgPresence {
+			continue
+		}
+		for _, u := range pm.Users {
+			if u == "alice" {
+				return
+			}
+		}
+		t.Fatalf("joiner missing from own presence snapshot: %v", pm.Users)
+	}
+	t.Fatal("expected presence snapshot on join")
+}
+
+func frameTypes(t *testing.T, frames [][]byte) []string {
+	t.Helper()
+	types := make([]string, 0, len(frames))
+	for _, f := range frames {
+		var m struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(f, &m); err != nil {
+			t.Fatalf("decode frame: %v", err)
+		}
+		types = append(types, m.Type)
+	}
+	return types
+}
+
+func TestRoomJoinFrameOrder(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		order JoinOrder
+		want  []string
+	}{
+		{JoinOrderPresenceFirst, []string{domain.MsgPresence, domain.MsgHistory, domain.MsgJoin, domain.MsgChat}},
+		{JoinOrderHistoryFirst, []string{domain.MsgHistory, domain.MsgPresence, domain.MsgJoin, domain.MsgChat}},
+	}
+	for _, tt := range tests {
+		s := testutil.NewMockStore()
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "test", User: "bob", Text: "earlier"})
+
+		r := NewRoom("test", s, 50)
+		r.joinOrder = tt.order
+		go r.Run()
+
+		alice := testutil.NewMockClient("alice")
+		r.Join(alice)
+		live, _ := domain.Encode(domain.Message{Type: domain.MsgChat, Room: "test", User: "bob", Text: "live"})
+		r.Broadcast(live)
+		time.Sleep(50 * time.Millisecond)
+		r.Stop()
+
+		got := frameTypes(t, alice.GetMessages())
+		if len(got) != len(tt.want) {
+			t.Fatalf("order %d: expected frames %v, got %v", tt.order, tt.want, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("order %d: expected frames %v, got %v", tt.order, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestRoomLiveMessagesNeverPrecedeSnapshot(t *testing.T) {
+	t.Parallel()
+	s := testutil.NewMockStore()
+	s.HistoryDelay = 20 * time.Millisecond
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "test", User: "bob", Text: "earlier"})
+
+	r := NewRoom("test", s, 50)
+	go r.Run()
+	defer r.Stop()
+
+	// Flood the room while alice joins; the slow history query widens the
+	// window in which a broadcast could overtake her snapshot.
+	stop := make(chan struct{})
+	live, _ := domain.Encode(domain.Message{Type: domain.MsgChat, Room: "test", User: "bob", Text: "live"})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.Broadcast(live)
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	alice := testutil.NewMockClient("alice")
+	r.Join(alice)
+	close(stop)
+	time.Sleep(50 * time.Millisecond)
+
+	got := frameTypes(t, alice.GetMessages())
+	if len(got) < 2 || got[0] != domain.MsgPresence || got[1] != domain.MsgHistory {
+		t.Errorf("expected presence then history first, got %v", got)
+	}
+}
+
+func lastPresence(t *testing.T, c *testutil.MockClient) domain.PresenceMessage {
+	t.Helper()
+	var last domain.PresenceMessage
+	for _, m := range c.GetMessages() {
+		var pm domain.PresenceMessage
+		if json.Unmarshal(m, &pm) == nil && pm.Type == domain.MsgPresence {
+			last = pm
+		}
+	}
+	if last.Type == "" {
+		t.Fatal("expected a presence message")
+	}
+	return last
+}
+
+func TestRoomPresenceConnectionCounts(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	r.presenceConnections = true
+	go r.Run()
+	defer r.Stop()
+
+	r.Join(testutil.NewMockClient("alice"))
+	r.Join(testutil.NewMockClient("bob"))
+	tab := testutil.NewMockClient("alice")
+	r.Join(tab)
+
+	pm := lastPresence(t, tab)
+	if len(pm.Users) != 2 || pm.Users[0] != "alice" || pm.Users[1] != "bob" {
+		t.Errorf("expected users [alice bob], got %v", pm.Users)
+	}
+	want := []domain.PresenceMember{{User: "alice", Connections: 2}, {User: "bob", Connections: 1}}
+	if len(pm.Members) != len(want) || pm.Members[0] != want[0] || pm.Members[1] != want[1] {
+		t.Errorf("expected members %v, got %v", want, pm.Members)
+	}
+}
+
+func TestRoomPresenceConnectionCountsOptIn(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	r.Join(testutil.NewMockClient("alice"))
+	tab := testutil.NewMockClient("alice")
+	r.Join(tab)
+
+	pm := lastPresence(t, tab)
+	if len(pm.Users) != 1 || pm.Members != nil {
+		t.Errorf("expected alice once and no members by default, got %+v", pm)
+	}
+}
+
+func TestRoomJoinSinceReplaysOnlyNewerMessages(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	for _, id := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		s.Save(domain.Message{ID: id, Type: domain.MsgChat, Room: "test", User: "bob", Text: id, Timestamp: time.Now()})
+	}
+
+	r := NewRoom("test", s, 3)
+	go r.Run()
+	defer r.Stop()
+
+	history := func(c *testutil.MockClient) string {
+		var ids []string
+		for _, m := range c.GetMessages() {
+			var hm domain.HistoryMessage
+			if json.Unmarshal(m, &hm) == nil && hm.Type == domain.MsgHistory {
+				for _, msg := range hm.Messages {
+					ids = append(ids, msg.ID)
+				}
+			}
+		}
+		return strings.Join(ids, ",")
+	}
+
+	tests := []struct {
+		sinceID string
+		want    string
+	}{
+		{"m3", "m4,m5"},
+		{"m5", ""},
+		{"", "m3,m4,m5"},     // no cursor: latest history
+		{"nope", "m3,m4,m5"}, // unknown cursor
+		{"m1", "m3,m4,m5"},   // more new messages than the limit
+	}
+	for _, tt := range tests {
+		c := testutil.NewMockClient("alice")
+		if err := r.JoinSince(c, tt.sinceID); err != nil {
+			t.Fatalf("join: %v", err)
+		}
+		if got := history(c); got != tt.want {
+			t.Errorf("since %q: got history [%s], want [%s]", tt.sinceID, got, tt.want)
+		}
+	}
+}
+
+// panickyClient panics while being sent a frame containing "boom", as long
+// as it has panics left.
+type panickyClient struct {
+	*testutil.MockClient
+	panics atomic.Int32
+}
+
+func (c *panickyClient) Send(data []byte) {
+	if bytes.Contains(data, []byte("boom")) && c.panics.Add(-1) >= 0 {
+		panic("malformed frame")
+	}
+	c.MockClient.Send(data)
+}
+
+func TestRoomRestartsAfterPanic(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", testutil.NewMockStore(), 50)
+	go r.Run()
+	defer r.Stop()
+
+	alice := &panickyClient{MockClient: testutil.NewMockClient("alice")}
+	alice.panics.Store(1)
+	bob := testutil.NewMockClient("bob")
+	r.Join(alice)
+	r.Join(bob)
+
+	r.Broadcast([]byte(`{"type":"chat","text":"boom"}`))
+	r.Broadcast([]byte(`{"type":"chat","text":"after"}`))
+	time.Sleep(50 * time.Millisecond)
+
+	for _, c := range []*testutil.MockClient{alice.MockClient, bob} {
+		got := false
+		for _, m := range c.GetMessages() {
+			got = got || bytes.Contains(m, []byte("after"))
+		}
+		if !got {
+			t.Errorf("%s: expected the broadcast after the panic to arrive", c.Username())
+		}
+	}
+}
+
+func TestHubClosesRoomThatKeepsPanicking(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := &panickyClient{MockClient: testutil.NewMockClient("alice")}
+	alice.panics.Store(100)
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+
+	for i := 0; i <= maxRoomRestarts; i++ {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "general", User: "bob", Text: "boom"}, bob)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if info := h.RoomInfo("general"); info != nil {
+		t.Errorf("expected the room to be removed, got %+v", info)
+	}
+	if em := lastError(bob); em.Code != domain.ErrCodeRoomClosed {
+		t.Errorf("expected room_closed for bob, got %+v", em)
+	}
+	if got := h.Stats().Memberships; got != 0 {
+		t.Errorf("expected no room memberships left, got %d", got)
+	}
+}
+
+// slowClient takes a moment over every frame, so the room goroutine falls
+// behind the broadcasts queued for it.
+type slowClient struct {
+	*testutil.MockClient
+}
+
+func (c *slowClient) Send(data []byte) {
+	time.Sleep(time.Millisecond)
+	c.MockClient.Send(data)
+}
+
+// liveEvents decodes the join, leave and chat frames a client received, as
+// "type:user:text", skipping presence and history snapshots.
+func liveEvents(c *testutil.MockClient) []string {
+	var events []string
+	for _, m := range c.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case domain.MsgJoin, domain.MsgLeave, domain.MsgChat:
+			events = append(events, msg.Type+":"+msg.User+":"+msg.Text)
+		}
+	}
+	return events
+}
+
+func TestRoomOrdersJoinsAndBroadcasts(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	observer := &slowClient{MockClient: testutil.NewMockClient("observer")}
+	r.Join(observer)
+
+	const n = 30
+	want := []string{"join:observer:"}
+	joiners := make([]*testutil.MockClient, n)
+	for i := range joiners {
+		name := fmt.Sprintf("user%d", i)
+		joiners[i] = testutil.NewMockClient(name)
+		r.Join(joiners[i])
+		data, _ := domain.Encode(domain.Message{Type: domain.MsgChat, Room: "test", User: name, Text: fmt.Sprint(i)})
+		r.Broadcast(data)
+		want = append(want, "join:"+name+":", "chat:"+name+":"+fmt.Sprint(i))
+	}
+	r.Leave(joiners[0])
+	want = append(want, "leave:user0:")
+	// Leave waits for everything queued before it, so all frames are in.
+
+	if got := liveEvents(observer.MockClient); !slices.Equal(got, want) {
+		t.Fatalf("observer saw events out of order:\n got %v\nwant %v", got, want)
+	}
+	// Each joiner's live traffic starts with its own join: nothing queued
+	// before it joined leaks in afterwards.
+	for i, c := range joiners {
+		from := 1 + 2*i
+		if got := liveEvents(c); len(got) == 0 || len(got) > len(want)-from || !slices.Equal(got, want[from:from+len(got)]) {
+			t.Errorf("user%d saw %v, want a run of %v", i, got, want[from:])
+		}
+	}
+}
+
+// blockingClient blocks in Send on chat frames until release is closed, like
+// a connection whose writer has stalled. It records the close code it is
+// disconnected with.
+type blockingClient struct {
+	*testutil.MockClient
+	release chan struct{}
+	closed  atomic.Int32
+}
+
+func (c *blockingClient) Send(data []byte) {
+	if bytes.Contains(data, []byte(`"chat"`)) {
+		<-c.release
+	}
+	c.MockClient.Send(data)
+}
+
+func (c *blockingClient) Disconnect(code int, reason string) {
+	c.closed.CompareAndSwap(0, int32(code))
+}
+
+func TestRoomFanOutDisconnectsBlockedClient(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	r.sendTimeout = 20 * time.Millisecond
+	go r.Run()
+	defer r.Stop()
+
+	stuck := &blockingClient{MockClient: testutil.NewMockClient("stuck"), release: make(chan struct{})}
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	r.Join(stuck)
+	r.Join(alice)
+	r.Join(bob)
+
+	start := time.Now()
+	for _, text := range []string{"one", "two", "three"} {
+		data, _ := domain.Encode(domain.Message{Type: domain.MsgChat, Room: "test", User: "bob", Text: text})
+		r.Broadcast(data)
+	}
+	want := []string{"chat:bob:one", "chat:bob:two", "chat:bob:three"}
+	for _, c := range []*testutil.MockClient{alice, bob} {
+		for !slices.Equal(chats(c), want) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("%s: expected %v promptly, got %v", c.Username(), want, chats(c))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The stuck client missed broadcasts, so it is told to reconnect rather
+	// than left with a gap in its stream.
+	if code := stuck.closed.Load(); code != domain.CloseSlowConsumer {
+		t.Errorf("expected the stuck client disconnected with %d, got %d", domain.CloseSlowConsumer, code)
+	}
+
+	// Once unblocked, it gets only the frame it was stuck on: the broadcasts
+	// it missed are not delivered out of order.
+	close(stuck.release)
+	deadline := time.Now().Add(time.Second)
+	for len(chats(stuck.MockClient)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := chats(stuck.MockClient); !slices.Equal(got, want[:1]) {
+		t.Errorf("expected the stuck client to get only %v, got %v", want[:1], got)
+	}
+}
+
+// chats returns the chat events among a client's live events.
+func chats(c *testutil.MockClient) []string {
+	var out []string
+	for _, e := range liveEvents(c) {
+		if strings.HasPrefix(e, "chat:") {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// countingCodec is msgpack that counts how many frames it encodes.
+type countingCodec struct {
+	domain.Codec
+	n *atomic.Int32
+}
+
+func (c countingCodec) Marshal(v any) ([]byte, error) {
+	c.n.Add(1)
+	return c.Codec.Marshal(v)
+}
+
+// encodingClient is a MockClient on a non-JSON codec that records the
+// encoded frames it is handed.
+type encodingClient struct {
+	*testutil.MockClient
+	codec   domain.Codec
+	encoded atomic.Int32
+}
+
+func (c *encodingClient) Codec() domain.Codec { return c.codec }
+
+func (c *encodingClient) SendEncoded(data, encoded []byte) {
+	c.encoded.Add(1)
+	c.MockClient.Send(data)
+}
+
+func TestRoomFanOutEncodesOncePerCodec(t *testing.T) {
+	t.Parallel()
+	r := NewRoom("test", nil, 50)
+	go r.Run()
+	defer r.Stop()
+
+	codec := countingCodec{Codec: domain.Msgpack, n: &atomic.Int32{}}
+	var members []*encodingClient
+	for _, name := range []string{"alice", "bob", "carol"} {
+		c := &encodingClient{MockClient: testutil.NewMockClient(name), codec: codec}
+		r.Join(c)
+		members = append(members, c)
+	}
+	r.Join(testutil.NewMockClient("dave")) // JSON, needs no encoding
+
+	before := codec.n.Load()
+	r.Broadcast([]byte(`{"type":"chat","room":"test","text":"hi"}`))
+	r.do(func() {}) // wait for the fan-out
+
+	if n := codec.n.Load() - before; n != 1 {
+		t.Errorf("expected one encoding for three members, got %d", n)
+	}
+	for _, c := range members {
+		if c.encoded.Load() == 0 {
+			t.Errorf("expected %s to get the shared encoding", c.Username())
+		}
+	}
+}
+
+func TestHubDoesNotWaitOnBusyRoomForJoin(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 10, 50)
+	go h.Run()
+	defer h.Stop()
+
+	h.RegisterSync(testutil.NewMockClient("alice"), "busy")
+	h.mu.RLock()
+	r := h.rooms["busy"]
+	h.mu.RUnlock()
+
+	// Hold up the room goroutine, as a backlog of slow fan-outs would.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go r.do(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	bob := testutil.NewMockClient("bob")
+	h.Register(bob, "busy")
+
+	done := make(chan struct{})
+	go func() {
+		h.RegisterSync(testutil.NewMockClient("carol"), "other")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("join to another room waited on the busy room")
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for !slices.Contains(r.Users(), "bob") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected bob to join once the room caught up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// ErrMaxRooms is returned by CreateRoom when the room limit is reached.
+var ErrMaxRooms = errors.New("max rooms reached")
+
+// CreateRoom creates an empty persistent room with a topic, ahead of anyone
+// joining it. When the store implements store.RoomStore the room is recorded
+// there too, and RestoreRooms brings it back after a restart. It returns
+// domain.ErrRoomExists if the name is taken.
+func (h *Hub) CreateRoom(name, topic string) (*domain.Room, error) {
+	// A room recreated under the name of a private one keeps its password.
+	stored, err := h.storedPassword(name, domain.RoomModePersistent)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.rooms[name]; ok {
+		return nil, domain.ErrRoomExists
+	}
+	if !h.hasRoomSpaceLocked() {
+		return nil, ErrMaxRooms
+	}
+	info := domain.Room{Name: name, Topic: topic, CreatedAt: time.Now().UTC()}
+	if rs, ok := h.store.(store.RoomStore); ok {
+		if err := rs.SaveRoom(info); err != nil {
+			return nil, err
+		}
+	}
+	r := h.startRoom(name, domain.RoomModePersistent)
+	r.topic = topic
+	r.createdAt = info.CreatedAt
+	r.passwordHash = stored
+	info.Private = r.Private()
+	return &info, nil
+}
+
+// CloseRoom force-closes a live room: it stops the room, removes it from the
+// hub, and disconnects its members with close code domain.CloseRoomClosed,
+// after a room_closed error. Members that cannot be disconnected are only
+// removed from the room. Stored history and any record kept by a RoomStore
+// are left alone. It returns domain.ErrRoomNotFound if no such room is live.
+func (h *Hub) CloseRoom(name string) error {
+	h.mu.Lock()
+	r, ok := h.rooms[name]
+	if !ok {
+		h.mu.Unlock()
+		return domain.ErrRoomNotFound
+	}
+	delete(h.rooms, name)
+	h.mu.Unlock()
+
+	r.Stop()
+	clients := r.removeAll()
+	for _, c := range clients {
+		rejectJoin(c, name, domain.ErrCodeRoomClosed, "room closed by an admin")
+		if d, ok := c.(Disconnecter); ok {
+			d.Disconnect(domain.CloseRoomClosed, "room closed")
+		}
+	}
+	slog.Info("room closed", "room", name, "clients", len(clients))
+	return nil
+}
+
+// RestoreRooms recreates the rooms recorded by CreateRoom in a RoomStore.
+// Call it once at startup, before clients connect.
+func (h *Hub) RestoreRooms() error {
+	rs, ok := h.store.(store.RoomStore)
+	if !ok {
+		return nil
+	}
+	rooms, err := rs.Rooms()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string, len(rooms))
+	for _, info := range rooms {
+		if hashes[info.Name], err = h.storedPassword(info.Name, domain.RoomModePersistent); err != nil {
+			return err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, info := range rooms {
+		if _, ok := h.rooms[info.Name]; ok {
+			continue
+		}
+		r := h.startRoom(info.Name, domain.RoomModePersistent)
+		r.topic = info.Topic
+		if !info.CreatedAt.IsZero() {
+			r.createdAt = info.CreatedAt
+		}
+		r.passwordHash = hashes[info.Name]
+	}
+	return nil
+}
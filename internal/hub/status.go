@@ -0,0 +1,91 @@
+package hub
+
+import "github.com/devaloi/chatterbox/internal/domain"
+
+// StatusSetter is a Client that carries a presence status. Clients that do
+// not implement it are always online.
+type StatusSetter interface {
+	Client
+	Status() string
+	SetStatus(state string)
+}
+
+// statusOf returns c's presence status.
+func statusOf(c Client) string {
+	if ss, ok := c.(StatusSetter); ok {
+		if s := ss.Status(); s != "" {
+			return s
+		}
+	}
+	return domain.StatusOnline
+}
+
+// statusRank orders statuses from most to least available; a user with
+// several connections is shown with their most available status.
+var statusRank = map[string]int{
+	domain.StatusOnline: 0,
+	domain.StatusBusy:   1,
+	domain.StatusAway:   2,
+}
+
+// SetStatus sets c's presence status and sends a refreshed presence
+// snapshot to every room c is in. Setting the current status again is a
+// no-op. An unknown status fails with domain.ErrInvalidStatus.
+func (h *Hub) SetStatus(c StatusSetter, state string) error {
+	if !domain.ValidStatus(state) {
+		return domain.ErrInvalidStatus
+	}
+	if statusOf(c) == state {
+		return nil
+	}
+	c.SetStatus(state)
+
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+	for _, r := range rooms {
+		r.StatusChanged(c)
+	}
+	return nil
+}
+
+// StatusChanged sends the room's local members a refreshed presence
+// snapshot if c is a member. Like the snapshot itself, it stays on this
+// instance.
+func (r *Room) StatusChanged(c Client) {
+	r.mu.RLock()
+	if !r.clients[c] {
+		r.mu.RUnlock()
+		return
+	}
+	presence := r.presenceLocked()
+	r.mu.RUnlock()
+	if presence != nil {
+		r.deliver(presence)
+	}
+}
+
+// statusesLocked maps usernames to status for members who are not online.
+func (r *Room) statusesLocked() map[string]string {
+	best := make(map[string]string)
+	for c := range r.clients {
+		s := statusOf(c)
+		if cur, ok := best[c.Username()]; !ok || statusRank[s] < statusRank[cur] {
+			best[c.Username()] = s
+		}
+	}
+	var statuses map[string]string
+	for user, s := range best {
+		if s == domain.StatusOnline {
+			continue
+		}
+		if statuses == nil {
+			statuses = make(map[string]string)
+		}
+		statuses[user] = s
+	}
+	return statuses
+}
@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubSetStatusUpdatesPresence(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+
+	if err := h.SetStatus(alice, domain.StatusAway); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pm := lastPresence(t, bob); pm.Statuses["alice"] != domain.StatusAway || len(pm.Statuses) != 1 {
+		t.Errorf("expected alice away, got %+v", pm.Statuses)
+	}
+
+	// A second connection that is still online makes alice online.
+	alice2 := testutil.NewMockClient("alice")
+	h.RegisterSync(alice2, "general")
+	if pm := lastPresence(t, alice2); pm.Statuses != nil {
+		t.Errorf("expected alice shown online with one online connection, got %+v", pm.Statuses)
+	}
+
+	if err := h.SetStatus(alice, "sleeping"); err != domain.ErrInvalidStatus {
+		t.Errorf("expected ErrInvalidStatus, got %v", err)
+	}
+}
+
+func TestHubSetStatusKeepsPresenceLocal(t *testing.T) {
+	t.Parallel()
+	relay := &relayRecorder{}
+	h := New(testutil.NewMockStore(), 100, 50, WithBroadcaster(relay))
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	if err := h.SetStatus(alice, domain.StatusBusy); err != nil {
+		t.Fatalf("set status: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if relay.published(domain.MsgPresence) {
+		t.Error("expected the instance-local presence snapshot not to be published")
+	}
+	if pm := lastPresence(t, bob); pm.Statuses["alice"] != domain.StatusBusy {
+		t.Errorf("expected local members to see alice busy, got %+v", pm.Statuses)
+	}
+}
@@ -0,0 +1,26 @@
+package hub
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// replyParentExists reports whether id names a message stored in the room,
+// so a chat may reply to it. Ephemeral rooms store nothing to reply to.
+func (h *Hub) replyParentExists(r *Room, id string) bool {
+	ts, ok := h.store.(store.ThreadStore)
+	if !ok || r.mode == domain.RoomModeEphemeral {
+		return false
+	}
+	thread, err := ts.Thread(id, 0)
+	if err != nil {
+		if !errors.Is(err, domain.ErrMessageNotFound) {
+			slog.Error("store lookup", "room", r.name, "reply_to", id, "err", err)
+		}
+		return false
+	}
+	return thread[0].Room == r.name
+}
@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubRepliesNeedParentInRoom(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	h := New(s, 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := testutil.NewMockClient("alice")
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(alice, "general")
+	h.RegisterSync(bob, "general")
+	h.RegisterSync(bob, "random")
+	h.RouteMessageSync(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "lunch?"}, alice)
+
+	reply := func(id, room, parent string) {
+		h.RouteMessageSync(domain.Message{ID: id, Type: domain.MsgChat, Room: room, User: "bob", Text: "sure", ReplyTo: parent}, bob)
+	}
+	reply("r0", "random", "m1")
+	if em := lastError(bob); em.Message != "reply parent not found" {
+		t.Fatalf("expected a reply across rooms to be refused, got %+v", em)
+	}
+	reply("r1", "general", "missing")
+	if em := lastError(bob); em.Message != "reply parent not found" {
+		t.Fatalf("expected a reply to an unknown message to be refused, got %+v", em)
+	}
+
+	reply("r2", "general", "m1")
+	time.Sleep(50 * time.Millisecond)
+	var got domain.Message
+	for _, m := range alice.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.ID == "r2" {
+			got = msg
+		}
+	}
+	if got.ReplyTo != "m1" {
+		t.Errorf("expected the broadcast reply to carry reply_to, got %+v", got)
+	}
+	if thread, err := s.Thread("m1", 10); err != nil || len(thread) != 2 || thread[1].ID != "r2" {
+		t.Errorf("expected only r2 stored as a reply, got %+v %v", thread, err)
+	}
+}
@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+)
+
+// Topic returns the room's topic.
+func (r *Room) Topic() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.topic
+}
+
+// SetTopic changes the room's topic and reports whether it changed.
+func (r *Room) SetTopic(topic string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.topic != topic
+	r.topic = topic
+	return changed
+}
+
+// handleTopic applies a topic change from a moderator and tells the room
+// with a topic message. Rooms recorded by CreateRoom keep the new topic
+// across restarts when the store supports it.
+func (h *Hub) handleTopic(r *Room, req MessageRequest) {
+	if !isModerator(req.Sender) {
+		sendErrorCode(req.Sender, domain.ErrCodeForbidden, "only a moderator can set the topic")
+		return
+	}
+	user := req.Sender.Username()
+
+	topic := req.Message.Text
+	if !r.SetTopic(topic) {
+		return
+	}
+	if ts, ok := h.store.(store.RoomTopicStore); ok && r.mode == domain.RoomModePersistent {
+		if err := ts.SetRoomTopic(r.name, topic); err != nil {
+			slog.Error("save room topic", "room", r.name, "err", err)
+		}
+	}
+	r.broadcastEvent(domain.Message{
+		Type: domain.MsgTopic, Room: r.name, User: user, Text: topic, Timestamp: req.Message.Timestamp,
+	})
+}
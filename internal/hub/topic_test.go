@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/store"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestHubSetTopic(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50)
+	go h.Run()
+	defer h.Stop()
+
+	alice := &testutil.MockClient{Name: "alice", Moderator: true}
+	bob := testutil.NewMockClient("bob")
+	h.RegisterSync(bob, "general") // creating the room grants bob nothing
+	h.RegisterSync(alice, "general")
+	topic := func(sender *testutil.MockClient, text string) {
+		h.RouteMessageSync(domain.Message{Type: domain.MsgTopic, Room: "general", User: sender.Username(), Text: text}, sender)
+	}
+
+	topic(bob, "Bob's room")
+	if em := lastError(bob); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a non-moderator, got %+v", em)
+	}
+	impostor := testutil.NewMockClient("alice")
+	topic(impostor, "Alice's room")
+	if em := lastError(impostor); em.Code != domain.ErrCodeForbidden {
+		t.Fatalf("expected forbidden for a client named like a moderator, got %+v", em)
+	}
+
+	topic(alice, "Daily standup")
+	time.Sleep(50 * time.Millisecond)
+	var got domain.Message
+	for _, m := range bob.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgTopic {
+			got = msg
+		}
+	}
+	if got.Text != "Daily standup" || got.User != "alice" {
+		t.Errorf("expected bob to get alice's topic message, got %+v", got)
+	}
+	if info := h.RoomInfo("general"); info == nil || info.Topic != "Daily standup" {
+		t.Errorf("expected topic in room info, got %+v", info)
+	}
+
+	// Late joiners see the topic in their presence snapshot.
+	carol := testutil.NewMockClient("carol")
+	h.RegisterSync(carol, "general")
+	if pm := lastPresence(t, carol); pm.Topic != "Daily standup" {
+		t.Errorf("expected topic in presence, got %q", pm.Topic)
+	}
+}
+
+func TestHubTopicSurvivesRestartForCreatedRooms(t *testing.T) {
+	t.Parallel()
+	s, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	h := New(s, 100, 50)
+	go h.Run()
+	if _, err := h.CreateRoom("eng", "Engineering"); err != nil {
+		t.Fatal(err)
+	}
+	mod := &testutil.MockClient{Name: "mod", Moderator: true}
+	h.RegisterSync(mod, "eng")
+	h.RouteMessageSync(domain.Message{Type: domain.MsgTopic, Room: "eng", User: "mod", Text: "Release week"}, mod)
+	h.Stop()
+
+	h2 := New(s, 100, 50)
+	if err := h2.RestoreRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if info := h2.RoomInfo("eng"); info == nil || info.Topic != "Release week" {
+		t.Errorf("expected restored room with the new topic, got %+v", info)
+	}
+}
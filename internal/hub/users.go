@@ -0,0 +1,37 @@
+package hub
+
+import "slices"
+
+// ConnectedUsers returns the sorted, deduplicated usernames of all tracked
+// connections. A user connected more than once is listed once.
+func (h *Hub) ConnectedUsers() []string {
+	h.connsMu.Lock()
+	users := make([]string, 0, len(h.users))
+	for name := range h.users {
+		users = append(users, name)
+	}
+	h.connsMu.Unlock()
+	slices.Sort(users)
+	return users
+}
+
+// UserConnected reports whether any tracked connection belongs to user.
+func (h *Hub) UserConnected(user string) bool {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	return len(h.users[user]) > 0
+}
+
+// RoomUsers returns the sorted, deduplicated usernames in a room, and false
+// if the room does not exist.
+func (h *Hub) RoomUsers(room string) ([]string, bool) {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	users := r.Users()
+	slices.Sort(users)
+	return slices.Compact(users), true
+}
@@ -0,0 +1,47 @@
+package hub
+
+// Relay is implemented by connections that can report whether they relay a
+// room for a federated peer, such as relay.Sink. A relay watches the rooms
+// it registers for instead of joining them (see Room.Watch), is not listed
+// among connected users, and is the only sender whose messages keep the
+// origin server id they carry.
+type Relay interface {
+	IsRelay() bool
+}
+
+// isRelay reports whether c relays rooms for a federated peer.
+func isRelay(c Client) bool {
+	r, ok := c.(Relay)
+	return ok && r.IsRelay()
+}
+
+// Watch adds c as a watcher: it gets the room's broadcasts like a member,
+// but no join snapshot, and is left out of presence, join and leave
+// notices and member counts. Leave removes it again. A watched room is not
+// dropped while empty. Like Join, it is applied in order with the room's
+// broadcasts, and it returns ErrRoomClosed if the room has been closed.
+func (r *Room) Watch(c Client) error {
+	errc := make(chan error, 1)
+	r.admit(func() error { return r.watch(c) }, func(err error) { errc <- err })
+	return <-errc
+}
+
+// watch applies a Watch on the room goroutine.
+func (r *Room) watch(c Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.admitting--
+	if r.closed {
+		return ErrRoomClosed
+	}
+	r.watchers[c] = true
+	return nil
+}
+
+// empty reports whether the room has neither members nor watchers, nor
+// joins on their way in or posts holding it.
+func (r *Room) empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients) == 0 && len(r.watchers) == 0 && r.admitting == 0 && r.posting == 0
+}
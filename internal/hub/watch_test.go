@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+// relayClient is a mock client that reports itself as a relay.
+type relayClient struct {
+	*testutil.MockClient
+}
+
+func (relayClient) IsRelay() bool { return true }
+
+func TestHubRelayWatchesWithoutMembership(t *testing.T) {
+	t.Parallel()
+	h := New(testutil.NewMockStore(), 100, 50, WithServerID("local"))
+	go h.Run()
+	defer h.Stop()
+
+	relay := relayClient{testutil.NewMockClient("relay-peer")}
+	h.RegisterSync(relay, "shared")
+	if info := h.RoomInfo("shared"); info == nil || info.UserCount != 0 {
+		t.Fatalf("expected a live room without members, got %+v", info)
+	}
+	alice := testutil.NewMockClient("alice")
+	h.RegisterSync(alice, "shared")
+	if pm := lastPresence(t, alice); len(pm.Users) != 1 || pm.Users[0] != "alice" {
+		t.Errorf("expected the relay left out of presence, got %v", pm.Users)
+	}
+	if n := h.Stats().Memberships; n != 1 {
+		t.Errorf("expected 1 membership, got %d", n)
+	}
+
+	// A client cannot claim another server's origin; a relay keeps it.
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "shared", User: "alice", Text: "spoofed", Origin: "peer"}, alice)
+	h.RouteMessageSync(domain.Message{Type: domain.MsgChat, Room: "shared", User: "bob", Text: "relayed", Origin: "peer"}, relay)
+	time.Sleep(50 * time.Millisecond)
+	origins := map[string]string{}
+	for _, m := range relay.GetMessages() {
+		var msg domain.Message
+		if json.Unmarshal(m, &msg) == nil && msg.Type == domain.MsgChat {
+			origins[msg.Text] = msg.Origin
+		}
+	}
+	if origins["spoofed"] != "local" || origins["relayed"] != "peer" {
+		t.Errorf("expected origins local and peer delivered to the watcher, got %v", origins)
+	}
+
+	// The watched room outlives its last member, and goes with the relay.
+	h.UnregisterSync(alice, "shared")
+	if h.RoomInfo("shared") == nil {
+		t.Fatal("expected the watched room to stay live")
+	}
+	h.UnregisterSync(relay, "shared")
+	if h.RoomInfo("shared") != nil {
+		t.Error("expected the room dropped once the relay left")
+	}
+	if _, seen, _ := h.LastSeen("relay-peer"); seen {
+		t.Error("expected no last-seen time for the relay")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/devaloi/chatterbox/internal/domain"
 	"github.com/devaloi/chatterbox/internal/handler"
 	"github.com/devaloi/chatterbox/internal/hub"
+	"github.com/devaloi/chatterbox/internal/relay"
 	"github.com/devaloi/chatterbox/internal/store"
 )
 
@@ -31,6 +32,7 @@ func setupServer(t *testing.T) (*httptest.Server, *hub.Hub, *store.SQLiteStore)
 	mux.HandleFunc("/health", handler.Health())
 	mux.HandleFunc("/api/rooms", handler.ListRooms(h))
 	mux.HandleFunc("/api/rooms/", handler.RoomInfo(h))
+	mux.HandleFunc("/api/users", handler.ListUsers(h))
 
 	server := httptest.NewServer(mux)
 	return server, h, s
@@ -253,3 +255,116 @@ func TestMultipleRooms(t *testing.T) {
 		}
 	}
 }
+
+func TestRelayFederatesRoom(t *testing.T) {
+	t.Parallel()
+	newInstance := func(id string) (*httptest.Server, *hub.Hub, *store.SQLiteStore) {
+		s, err := store.NewSQLite(":memory:")
+		if err != nil {
+			t.Fatalf("store: %v", err)
+		}
+		h := hub.New(s, 100, 50, hub.WithServerID(id))
+		go h.Run()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws", handler.ServeWSConfig(h, handler.WSConfig{RelayToken: "shared-secret"}))
+		return httptest.NewServer(mux), h, s
+	}
+
+	serverA, hubA, storeA := newInstance("a")
+	defer serverA.Close()
+	defer hubA.Stop()
+	defer storeA.Close()
+	serverB, hubB, storeB := newInstance("b")
+	defer serverB.Close()
+	defer hubB.Stop()
+	defer storeB.Close()
+
+	wsURL := func(s *httptest.Server) string { return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws" }
+	sinkA := relay.NewSink(hubA, "a", relay.Peer{Room: "shared", URL: wsURL(serverB), Token: "shared-secret"})
+	sinkB := relay.NewSink(hubB, "b", relay.Peer{Room: "shared", URL: wsURL(serverA), Token: "shared-secret"})
+	sinkA.Start()
+	defer sinkA.Stop()
+	sinkB.Start()
+	defer sinkB.Stop()
+
+	alice := dialWS(t, serverA.URL, "alice")
+	defer alice.Close()
+	bob := dialWS(t, serverB.URL, "bob")
+	defer bob.Close()
+
+	time.Sleep(300 * time.Millisecond) // let the sinks connect
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"shared"}`))
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"shared"}`))
+	// Neither relay, local or the peer's, is a member.
+	if users, _ := readUntilType(t, alice, "presence", 20)["users"].([]interface{}); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("expected only alice in presence, got %v", users)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := hubA.RoomInfo("shared").UserCount; n != 1 {
+		t.Errorf("expected 1 member on a, got %d", n)
+	}
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"shared","text":"hello from a"}`))
+	msg := readUntilType(t, bob, "chat", 20)
+	if msg["text"] != "hello from a" || msg["user"] != "alice" || msg["origin"] != "a" {
+		t.Errorf("unexpected relayed message: %v", msg)
+	}
+
+	// A client claiming to be from b still gets relayed as from a.
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","room":"shared","text":"not from b","origin":"b"}`))
+	msg = readUntilType(t, bob, "chat", 20)
+	if msg["text"] != "not from b" || msg["origin"] != "a" {
+		t.Errorf("expected a spoofed origin replaced and relayed, got %v", msg)
+	}
+
+	// The messages must not bounce back a second time.
+	time.Sleep(300 * time.Millisecond)
+	history, _ := storeA.History("shared", 50)
+	if len(history) != 2 {
+		t.Errorf("expected 2 messages on origin server, got %d", len(history))
+	}
+}
+
+func TestRESTUsers(t *testing.T) {
+	t.Parallel()
+	server, h, s := setupServer(t)
+	defer server.Close()
+	defer h.Stop()
+	defer s.Close()
+
+	joins := map[string]string{"carol": "general", "alice": "general", "bob": "random"}
+	for user, room := range joins {
+		conn := dialWS(t, server.URL, user)
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"join","room":"`+room+`"}`))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	getUsers := func(query string) domain.UserList {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/api/users" + query)
+		if err != nil {
+			t.Fatalf("get users: %v", err)
+		}
+		defer resp.Body.Close()
+		var list domain.UserList
+		json.NewDecoder(resp.Body).Decode(&list)
+		return list
+	}
+
+	if got := getUsers("").Users; strings.Join(got, ",") != "alice,bob,carol" {
+		t.Errorf("expected alice,bob,carol, got %v", got)
+	}
+	if got := getUsers("?room=general").Users; strings.Join(got, ",") != "alice,carol" {
+		t.Errorf("expected alice,carol in general, got %v", got)
+	}
+
+	page := getUsers("?limit=2")
+	if strings.Join(page.Users, ",") != "alice,bob" || page.Next != "bob" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page = getUsers("?limit=2&after=" + page.Next)
+	if strings.Join(page.Users, ",") != "carol" || page.Next != "" {
+		t.Errorf("unexpected second page: %+v", page)
+	}
+}
@@ -0,0 +1,171 @@
+// Package metrics exposes server counters in the Prometheus text format.
+package metrics
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OtherLabel is the room label shared by every room outside the tracked set.
+const OtherLabel = "other"
+
+// RoomLabels counts messages per room while bounding label cardinality: at
+// most maxRooms rooms get their own label and the rest are counted under
+// OtherLabel. Rooms are admitted first come until the set is full; after that
+// each refresh replaces the set with the rooms that were busiest since the
+// previous refresh. This keeps attacker-created rooms from growing the label
+// set without hiding the rooms that carry real traffic.
+type RoomLabels struct {
+	mu       sync.Mutex
+	maxRooms int
+	tracked  map[string]bool   // rooms with their own label
+	window   map[string]uint64 // messages per room since the last refresh
+	totals   map[string]uint64 // exported counters, keyed by label
+
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRoomLabels returns a tracker giving at most maxRooms rooms their own
+// label. A maxRooms of zero or less counts every room under OtherLabel.
+func NewRoomLabels(maxRooms int) *RoomLabels {
+	return &RoomLabels{
+		maxRooms: maxRooms,
+		tracked:  make(map[string]bool),
+		window:   make(map[string]uint64),
+		totals:   make(map[string]uint64),
+	}
+}
+
+// Observe counts one message routed to room.
+func (l *RoomLabels) Observe(room string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.window[room]++
+	if !l.tracked[room] && len(l.tracked) < l.maxRooms {
+		l.tracked[room] = true
+	}
+	l.totals[l.labelLocked(room)]++
+}
+
+// Label returns the label room is currently counted under.
+func (l *RoomLabels) Label(room string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.labelLocked(room)
+}
+
+func (l *RoomLabels) labelLocked(room string) string {
+	if l.tracked[room] {
+		return room
+	}
+	return OtherLabel
+}
+
+// Refresh replaces the tracked set with the busiest rooms since the last
+// refresh, ties broken by name, and starts a new window. When no messages
+// arrived in the window the set is left alone. Counters of rooms that drop
+// out are folded into OtherLabel, so at most maxRooms+1 series are ever
+// exported.
+func (l *RoomLabels) Refresh() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.window) == 0 {
+		return
+	}
+	rooms := make([]string, 0, len(l.window))
+	for room := range l.window {
+		rooms = append(rooms, room)
+	}
+	slices.SortFunc(rooms, func(a, b string) int {
+		if c := cmp.Compare(l.window[b], l.window[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	l.tracked = make(map[string]bool, l.maxRooms)
+	for _, room := range rooms[:min(len(rooms), max(l.maxRooms, 0))] {
+		l.tracked[room] = true
+	}
+	for label, n := range l.totals {
+		if label != OtherLabel && !l.tracked[label] {
+			l.totals[OtherLabel] += n
+			delete(l.totals, label)
+		}
+	}
+	l.window = make(map[string]uint64)
+}
+
+// Start refreshes the tracked set every interval until Stop is called. A
+// zero interval keeps the first rooms seen for good.
+func (l *RoomLabels) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	l.quit = make(chan struct{})
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.Refresh()
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic refreshes started by Start.
+func (l *RoomLabels) Stop() {
+	l.stopOnce.Do(func() {
+		if l.quit != nil {
+			close(l.quit)
+			<-l.done
+		}
+	})
+}
+
+// Totals returns a copy of the message counters, keyed by label.
+func (l *RoomLabels) Totals() map[string]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]uint64, len(l.totals))
+	for label, n := range l.totals {
+		out[label] = n
+	}
+	return out
+}
+
+// WriteTo writes the counters in the Prometheus text exposition format.
+func (l *RoomLabels) WriteTo(w io.Writer) (int64, error) {
+	totals := l.Totals()
+	labels := make([]string, 0, len(totals))
+	for label := range totals {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+
+	var b strings.Builder
+	b.WriteString("# HELP chatterbox_room_messages_total Messages routed per room; rooms outside the busiest are counted as \"other\".\n")
+	b.WriteString("# TYPE chatterbox_room_messages_total counter\n")
+	for _, label := range labels {
+		fmt.Fprintf(&b, "chatterbox_room_messages_total{room=\"%s\"} %d\n", escapeLabel(label), totals[label])
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// escapeLabel escapes a label value as the text format requires.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
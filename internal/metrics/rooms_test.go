@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRoomLabelsBoundCardinality(t *testing.T) {
+	t.Parallel()
+	l := NewRoomLabels(3)
+
+	// Ten rooms, room-i getting i+1 messages.
+	for i := 0; i < 10; i++ {
+		for j := 0; j <= i; j++ {
+			l.Observe(fmt.Sprintf("room-%d", i))
+		}
+	}
+	totals := l.Totals()
+	if len(totals) != 4 {
+		t.Fatalf("expected 3 rooms plus other, got %v", totals)
+	}
+	// The first three rooms seen were admitted; the rest went to other.
+	if totals["room-0"] != 1 || totals["room-2"] != 3 || totals[OtherLabel] != 55-6 {
+		t.Errorf("unexpected totals before refresh: %v", totals)
+	}
+
+	// A refresh re-chooses the busiest rooms of the window.
+	l.Refresh()
+	for _, room := range []string{"room-9", "room-8", "room-7"} {
+		if got := l.Label(room); got != room {
+			t.Errorf("expected %s to have its own label, got %s", room, got)
+		}
+	}
+	if got := l.Label("room-0"); got != OtherLabel {
+		t.Errorf("expected room-0 to fall back to other, got %s", got)
+	}
+
+	// The evicted rooms' counts moved to other, so no stale labels remain.
+	l.Observe("room-9")
+	l.Observe("room-0")
+	totals = l.Totals()
+	if totals["room-9"] != 1 || totals[OtherLabel] != 56 {
+		t.Errorf("unexpected totals after refresh: %v", totals)
+	}
+	if _, ok := totals["room-0"]; ok || len(totals) != 2 {
+		t.Errorf("expected evicted labels folded into other, got %v", totals)
+	}
+}
+
+func TestRoomLabelsWriteTo(t *testing.T) {
+	t.Parallel()
+	l := NewRoomLabels(1)
+	l.Observe(`we"ird`)
+	l.Observe("general")
+
+	var b strings.Builder
+	l.WriteTo(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE chatterbox_room_messages_total counter\n",
+		`chatterbox_room_messages_total{room="we\"ird"} 1` + "\n",
+		`chatterbox_room_messages_total{room="other"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
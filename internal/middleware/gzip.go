@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Gzip compresses responses for clients that send Accept-Encoding: gzip once
+// the body reaches minSize bytes; smaller bodies go out as they are. WebSocket
+// upgrades, partial content and responses that already set Content-Encoding
+// pass through untouched. A minSize of zero or less disables compression.
+func Gzip(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if minSize <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: w, minSize: minSize, status: http.StatusOK}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		// gzip;q=0 means the client refuses it.
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response until it knows whether the body
+// is big enough to compress, then commits the headers once.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if !gw.started {
+		gw.status = code
+	}
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if gw.started {
+		if gw.gz != nil {
+			return gw.gz.Write(p)
+		}
+		return gw.ResponseWriter.Write(p)
+	}
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) >= gw.minSize {
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers and the buffered body, compressing when compress is
+// set and the response allows it.
+func (gw *gzipWriter) start(compress bool) error {
+	gw.started = true
+	h := gw.Header()
+	if h.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		// Sniff from the plain bytes; net/http would see compressed ones.
+		h.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	if compress && gw.compressible() {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (gw *gzipWriter) compressible() bool {
+	h := gw.Header()
+	switch {
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	case gw.status == http.StatusNoContent, gw.status == http.StatusNotModified,
+		gw.status == http.StatusPartialContent, gw.status < http.StatusOK:
+		return false
+	}
+	return true
+}
+
+// close sends a body that never reached minSize and finishes the gzip stream.
+func (gw *gzipWriter) close() {
+	if !gw.started {
+		gw.start(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
+
+// Flush commits the response so far, so streaming handlers still stream.
+func (gw *gzipWriter) Flush() {
+	if !gw.started {
+		gw.start(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipWriter) Unwrap() http.ResponseWriter { return gw.ResponseWriter }
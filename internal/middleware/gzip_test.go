@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveGzip(t *testing.T, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	h := Gzip(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "999")
+		io.WriteString(w, body)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestGzipCompressesLargeBodies(t *testing.T) {
+	t.Parallel()
+	body := `{"rooms":[` + strings.Repeat(`{"name":"general"},`, 20) + `{}]}`
+	w := serveGzip(t, body, http.Header{"Accept-Encoding": {"br, gzip;q=0.8"}})
+
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected Content-Encoding gzip, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Encoding, got %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "" {
+		t.Errorf("expected Content-Length removed, got %q", got)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if string(plain) != body {
+		t.Errorf("decompressed body mismatch: %q", plain)
+	}
+}
+
+func TestGzipSkipsSmallBodies(t *testing.T) {
+	t.Parallel()
+	w := serveGzip(t, `{"rooms":[]}`, http.Header{"Accept-Encoding": {"gzip"}})
+
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("expected no Content-Encoding, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Encoding, got %q", got)
+	}
+	if w.Body.String() != `{"rooms":[]}` {
+		t.Errorf("expected plain body, got %q", w.Body.String())
+	}
+}
+
+func TestGzipRespectsAcceptEncoding(t *testing.T) {
+	t.Parallel()
+	body := strings.Repeat("x", 200)
+	for _, accept := range []string{"", "br", "gzip;q=0"} {
+		w := serveGzip(t, body, http.Header{"Accept-Encoding": {accept}})
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("Accept-Encoding %q: expected no Content-Encoding, got %q", accept, got)
+		}
+		if w.Body.String() != body {
+			t.Errorf("Accept-Encoding %q: expected plain body", accept)
+		}
+	}
+}
+
+func TestGzipSkipsWebSocketUpgrades(t *testing.T) {
+	t.Parallel()
+	w := serveGzip(t, strings.Repeat("x", 200), http.Header{
+		"Accept-Encoding": {"gzip"},
+		"Connection":      {"Upgrade"},
+		"Upgrade":         {"websocket"},
+	})
+
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("expected no Content-Encoding, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "" {
+		t.Errorf("expected no Vary on upgrade, got %q", got)
+	}
+}
+
+func TestGzipKeepsStatus(t *testing.T) {
+	t.Parallel()
+	h := Gzip(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"`+strings.Repeat("x", 100)+`"}`, http.StatusBadRequest)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("expected Content-Encoding gzip, got %q", got)
+	}
+}
@@ -1,7 +1,9 @@
 package middleware
 
 import (
-	"log"
+	"bufio"
+	"log/slog"
+	"net"
 	"net/http"
 	"time"
 )
@@ -16,12 +18,23 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// Logging logs each HTTP request with method, path, status, and duration.
+// Hijack lets WebSocket upgrades take over the connection through the
+// logging wrapper.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Logging logs each HTTP request with method, path, status, and duration,
+// plus the request id when RequestID runs before it.
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(rw, r)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, rw.status, time.Since(start))
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "status", rw.status, "duration", time.Since(start), "request_id", RequestIDFrom(r.Context()))
 	})
 }
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLoggingAllowsWebSocketUpgrade(t *testing.T) {
+	t.Parallel()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(Logging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mt, data, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(mt, data)
+		}
+	})))
+	defer srv.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial through Logging: %v (response %v)", err, resp)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected 101, got %d", resp.StatusCode)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+		t.Errorf("expected echoed ping, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveRequestID(t *testing.T, header string) (sent, seen string) {
+	t.Helper()
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFrom(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
+	if header != "" {
+		req.Header.Set(RequestIDHeader, header)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Header().Get(RequestIDHeader), seen
+}
+
+func TestRequestIDRoundTrips(t *testing.T) {
+	t.Parallel()
+	sent, seen := serveRequestID(t, "trace-abc-123")
+	if sent != "trace-abc-123" {
+		t.Errorf("expected header echoed, got %q", sent)
+	}
+	if seen != "trace-abc-123" {
+		t.Errorf("expected id in context, got %q", seen)
+	}
+}
+
+func TestRequestIDGeneratedWhenAbsent(t *testing.T) {
+	t.Parallel()
+	first, seen := serveRequestID(t, "")
+	if first == "" {
+		t.Fatal("expected a generated id")
+	}
+	if seen != first {
+		t.Errorf("expected context id %q to match header, got %q", first, seen)
+	}
+	second, _ := serveRequestID(t, "")
+	if second == first {
+		t.Errorf("expected distinct ids, got %q twice", first)
+	}
+}
+
+func TestRequestIDReplacesInvalidHeader(t *testing.T) {
+	t.Parallel()
+	for _, bad := range []string{"has space", strings.Repeat("x", maxRequestIDLen+1)} {
+		sent, _ := serveRequestID(t, bad)
+		if sent == bad || sent == "" {
+			t.Errorf("header %q: expected a generated id, got %q", bad, sent)
+		}
+	}
+}
+
+func TestRequestIDFromEmptyContext(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if id := RequestIDFrom(req.Context()); id != "" {
+		t.Errorf("expected empty id, got %q", id)
+	}
+}
@@ -0,0 +1,35 @@
+// Package ratelimit provides the token bucket behind per-client and
+// per-room message rate limits.
+package ratelimit
+
+import "time"
+
+// Bucket is a lazily refilled token bucket. Tokens are topped up from the
+// elapsed time on each call, so there is no timer or goroutine per bucket.
+// It is not safe for concurrent use; each user owns its bucket from a single
+// goroutine (a client's ReadPump, the hub's event loop).
+type Bucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+// New returns a full bucket allowing perSec messages a second, with bursts
+// of up to perSec.
+func New(perSec int) *Bucket {
+	return &Bucket{rate: float64(perSec), burst: float64(perSec), tokens: float64(perSec)}
+}
+
+// Allow takes a token if one is available at now.
+func (b *Bucket) Allow(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefills(t *testing.T) {
+	t.Parallel()
+	b := New(2)
+	now := time.Now()
+	if !b.Allow(now) || !b.Allow(now) {
+		t.Fatal("expected a full bucket to allow a burst of 2")
+	}
+	if b.Allow(now) {
+		t.Fatal("expected the third message in the same instant to be refused")
+	}
+	if !b.Allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected one token back after half a second")
+	}
+	if b.Allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected the bucket to be empty again")
+	}
+	// A long pause refills only up to the burst.
+	later := now.Add(time.Minute)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if b.Allow(later) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected refill capped at 2, got %d", allowed)
+	}
+}
@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/hub"
+)
+
+// redialDelay is how long a sink waits before reconnecting to its peer.
+const redialDelay = 2 * time.Second
+
+// Peer mirrors a local room to the same room on another chatterbox instance.
+type Peer struct {
+	Room string
+	URL  string // peer WebSocket endpoint, e.g. ws://peer:8080/ws
+	// Token, if set, is sent to the peer as a bearer token so it treats the
+	// sink as a relay rather than a room member; it must match the peer's
+	// RELAY_TOKEN.
+	Token string
+}
+
+// ParsePeers parses a comma-separated list of room=url pairs.
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		room, u, ok := strings.Cut(entry, "=")
+		if !ok || room == "" || u == "" {
+			return nil, fmt.Errorf("invalid relay peer %q: want room=url", entry)
+		}
+		peers = append(peers, Peer{Room: room, URL: u})
+	}
+	return peers, nil
+}
+
+// Sink federates one local room with the matching room on a peer server.
+//
+// It dials the peer's /ws endpoint, joins the mirrored room, and routes chat
+// messages it receives into the local hub. Messages are tagged with the
+// origin server id by the hub that first routed them; the sink never
+// re-injects a message whose origin is the local server, so a message
+// bounces at most once between two instances. The peer does the same in the
+// other direction, so each instance only reads from its peers.
+//
+// The sink watches the local room (see hub.Relay), so the room exists for
+// routing even before any local user joins, without the sink counting as a
+// member.
+type Sink struct {
+	hub      *hub.Hub
+	serverID string
+	peer     Peer
+	quit     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	wg       sync.WaitGroup
+}
+
+// NewSink creates a relay sink for peer. serverID must match the id the
+// local hub stamps on messages (hub.WithServerID).
+func NewSink(h *hub.Hub, serverID string, peer Peer) *Sink {
+	return &Sink{
+		hub:      h,
+		serverID: serverID,
+		peer:     peer,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Username identifies the sink on both sides of the relay.
+func (s *Sink) Username() string {
+	return "relay-" + s.serverID
+}
+
+// IsRelay marks the sink as a relay to the local hub, which lets it keep
+// the origin of the messages it routes.
+func (s *Sink) IsRelay() bool {
+	return true
+}
+
+// Send discards local broadcasts; the peer reads them from its own
+// connection into the local server.
+func (s *Sink) Send(data []byte) {}
+
+// Start watches the local room and begins relaying from the peer.
+func (s *Sink) Start() {
+	s.hub.Register(s, s.peer.Room)
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop disconnects from the peer and leaves the local room.
+func (s *Sink) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+		s.hub.Unregister(s, s.peer.Room)
+	})
+}
+
+func (s *Sink) run() {
+	defer s.wg.Done()
+	for {
+		if err := s.relay(); err != nil {
+			slog.Warn("relay", "room", s.peer.Room, "peer", s.peer.URL, "err", err)
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(redialDelay):
+		}
+	}
+}
+
+// relay runs a single peer connection until it fails or the sink stops.
+func (s *Sink) relay() error {
+	u, err := url.Parse(s.peer.URL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("user", s.Username())
+	u.RawQuery = q.Encode()
+
+	var header http.Header
+	if s.peer.Token != "" {
+		header = http.Header{"Authorization": {"Bearer " + s.peer.Token}}
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	s.conn = conn
+	s.mu.Unlock()
+	defer conn.Close()
+
+	join, err := domain.Encode(domain.Message{Type: domain.MsgJoin, Room: s.peer.Room})
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, join); err != nil {
+		return err
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+				return err
+			}
+		}
+		msg, err := domain.DecodeMessage(data)
+		if err != nil || msg.Type != domain.MsgChat {
+			continue
+		}
+		// Drop our own messages coming back and anything not yet stamped.
+		if msg.Origin == "" || msg.Origin == s.serverID {
+			continue
+		}
+		s.hub.RouteMessage(msg, s)
+	}
+}
+
+// NewServerID returns a random identifier for a server instance.
+func NewServerID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,27 @@
+package relay
+
+import "testing"
+
+func TestParsePeers(t *testing.T) {
+	t.Parallel()
+	peers, err := ParsePeers("general=ws://a:8080/ws, ops=ws://b:8080/ws")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(peers))
+	}
+	if peers[0].Room != "general" || peers[0].URL != "ws://a:8080/ws" {
+		t.Errorf("unexpected first peer: %+v", peers[0])
+	}
+	if peers[1].Room != "ops" || peers[1].URL != "ws://b:8080/ws" {
+		t.Errorf("unexpected second peer: %+v", peers[1])
+	}
+
+	if peers, err := ParsePeers(""); err != nil || len(peers) != 0 {
+		t.Errorf("expected no peers for empty string, got %v, %v", peers, err)
+	}
+	if _, err := ParsePeers("general"); err == nil {
+		t.Error("expected error for entry without url")
+	}
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// WithWriteBatch makes Save queue messages and write them in one transaction
+// once size are pending or every interval, whichever comes first. Reads that
+// touch messages flush the queue first, so batching never hides a saved
+// message from history, edits or search. A size below 2 writes each message
+// as it is saved.
+//
+// Save returns nil once a message is queued, before it is written, so a
+// successful Save is not durable: the message can still be lost in a crash,
+// or dropped as unwritable. Only the Save that fills a batch reports the
+// batch's write.
+func WithWriteBatch(size int, interval time.Duration) SQLiteOption {
+	return func(s *SQLiteStore) {
+		s.batchSize = size
+		s.batchEvery = interval
+	}
+}
+
+// maxFlushAttempts is how many flushes in a row may fail before the pending
+// messages are written one at a time, dropping those the database refuses,
+// so one bad message cannot wedge the queue.
+const maxFlushAttempts = 3
+
+func (s *SQLiteStore) batching() bool { return s.batchSize > 1 }
+
+// enqueue adds msg to the pending batch, or writes it along with the
+// batch when it fills the batch.
+func (s *SQLiteStore) enqueue(msg domain.Message) error {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	s.batchMu.Lock()
+	if len(s.pending)+1 < s.batchSize {
+		s.pending = append(s.pending, msg)
+		s.batchMu.Unlock()
+		return nil
+	}
+	s.batchMu.Unlock()
+	return s.flush(&msg)
+}
+
+// Flush writes every queued message in a single transaction. It is a no-op
+// when nothing is pending. If the transaction fails the batch goes back to
+// the front of the queue for the next flush and the error is returned. After
+// maxFlushAttempts failures in a row the messages are written one by one
+// instead, and only those that still fail are dropped.
+func (s *SQLiteStore) Flush() error {
+	return s.flush(nil)
+}
+
+// flush is Flush, writing last after the queued messages when it is set.
+// The error returned is then last's alone: last is not requeued when its
+// batch fails, since its Save reports the failure, and the other messages'
+// failures are only logged.
+func (s *SQLiteStore) flush(last *domain.Message) error {
+	// flushMu keeps batches committing in the order they were queued.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.batchMu.Lock()
+	queued := s.pending
+	s.pending = nil
+	s.batchMu.Unlock()
+	batch := queued
+	if last != nil {
+		batch = append(slices.Clip(queued), *last)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := s.writeBatch(batch)
+	if err == nil {
+		s.flushFailures = 0
+		return nil
+	}
+	s.flushFailures++
+	if s.flushFailures < maxFlushAttempts {
+		slog.Error("flush write batch, will retry", "messages", len(queued), "attempt", s.flushFailures, "err", err)
+		s.batchMu.Lock()
+		s.pending = append(queued, s.pending...)
+		s.batchMu.Unlock()
+		return err
+	}
+	s.flushFailures = 0
+	errs := s.writeEach(batch)
+	if last != nil {
+		return errs[len(batch)-1]
+	}
+	return errors.Join(errs...)
+}
+
+// writeBatch inserts batch in one transaction.
+func (s *SQLiteStore) writeBatch(batch []domain.Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, msg := range batch {
+		if _, err := s.insert(tx, msg, nil); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeEach inserts batch one message at a time, logging and dropping the
+// messages that fail. It returns each message's error.
+func (s *SQLiteStore) writeEach(batch []domain.Message) []error {
+	errs := make([]error, len(batch))
+	for i, msg := range batch {
+		if _, err := s.insert(s.db, msg, nil); err != nil {
+			slog.Error("dropping unwritable message", "room", msg.Room, "id", msg.ID, "err", err)
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// flushPending flushes queued writes before a read. A failed flush is logged
+// by Flush and does not fail the read.
+func (s *SQLiteStore) flushPending() {
+	if s.batching() {
+		s.Flush()
+	}
+}
+
+func (s *SQLiteStore) runBatchFlush() {
+	defer s.bg.Done()
+	ticker := time.NewTicker(s.batchEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.quit:
+			return
+		}
+	}
+}
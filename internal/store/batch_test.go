@@ -0,0 +1,184 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+func countRows(t *testing.T, s *SQLiteStore) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	return n
+}
+
+func TestSQLiteWriteBatchPersistsEverything(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := NewSQLite(path, WithWriteBatch(100, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+
+	for i := 0; i < 250; i++ {
+		if err := s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: fmt.Sprintf("msg %d", i), ID: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	// Full batches are written straight away; the rest wait for the timer.
+	if n := countRows(t, s); n < 200 {
+		t.Errorf("expected at least two full batches written, got %d rows", n)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for countRows(t, s) < 250 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timer never flushed the partial batch: %d rows", countRows(t, s))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Pending saves are visible to reads and survive Close.
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "late", ID: "late"})
+	if m, err := s.Message("general", "late"); err != nil || m.Text != "late" {
+		t.Errorf("expected a read to flush the pending save, got %+v, %v", m, err)
+	}
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "last", ID: "last"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s, err = NewSQLite(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	history, err := s.History("general", 1000)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(history) != 252 || history[0].Text != "msg 0" || history[251].Text != "last" {
+		t.Errorf("expected all 252 messages in order, got %d", len(history))
+	}
+}
+
+func benchmarkSave(b *testing.B, opts ...SQLiteOption) {
+	s, err := NewSQLite(filepath.Join(b.TempDir(), "chat.db"), opts...)
+	if err != nil {
+		b.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	msg := domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hello"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Save(msg); err != nil {
+			b.Fatalf("save: %v", err)
+		}
+	}
+	s.Flush()
+}
+
+func BenchmarkSQLiteSaveUnbatched(b *testing.B) { benchmarkSave(b) }
+
+func BenchmarkSQLiteSaveBatched(b *testing.B) {
+	benchmarkSave(b, WithWriteBatch(100, 50*time.Millisecond))
+}
+
+func TestSQLiteWriteBatchKeepsFailedBatch(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:", WithWriteBatch(100, time.Hour))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	// A trigger refuses inserts until it is dropped, like a transient
+	// database error.
+	if _, err := s.db.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON messages
+		BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	for i := range 3 {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: fmt.Sprint("msg ", i), ID: fmt.Sprint(i)})
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected the refused flush to fail")
+	}
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "msg 3", ID: "3"})
+
+	if _, err := s.db.Exec("DROP TRIGGER refuse"); err != nil {
+		t.Fatalf("drop trigger: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	history, err := s.History("general", 10)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(history) != 4 || history[0].ID != "0" || history[3].ID != "3" {
+		t.Errorf("expected all 4 messages in order after the retry, got %+v", history)
+	}
+}
+
+func TestSQLiteWriteBatchDropsOnlyUnwritableMessages(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:", WithWriteBatch(100, time.Hour))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.db.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON messages WHEN NEW.text = 'poison'
+		BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	for _, text := range []string{"before", "poison", "after"} {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: text, ID: text})
+	}
+	for range maxFlushAttempts {
+		s.Flush()
+	}
+	if n := countRows(t, s); n != 2 {
+		t.Errorf("expected the two good messages written, got %d rows", n)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected an empty queue once the bad message is dropped, got %v", err)
+	}
+}
+
+func TestSQLiteWriteBatchDoesNotRequeueFailedSave(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:", WithWriteBatch(3, time.Hour))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.db.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON messages
+		BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	for i := range 2 {
+		if err := s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "queued", ID: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("queue: %v", err)
+		}
+	}
+	// The third save fills the batch and reports its failed write.
+	if err := s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "failed", ID: "2"}); err == nil {
+		t.Fatal("expected the save that fills a refused batch to fail")
+	}
+
+	if _, err := s.db.Exec("DROP TRIGGER refuse"); err != nil {
+		t.Fatalf("drop trigger: %v", err)
+	}
+	history, _ := s.History("general", 10)
+	if len(history) != 2 || history[0].ID != "0" || history[1].ID != "1" {
+		t.Errorf("expected only the queued messages written, got %+v", history)
+	}
+}
@@ -0,0 +1,337 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// CachedStore wraps a Store so that concurrent and closely spaced History
+// calls for the same room share a single underlying query. Results are kept
+// for ttl and dropped as soon as a message is saved to that room, so joiners
+// never see history that is missing a message they could otherwise have seen.
+// Message counts are cached the same way. Rooms the wrapped store purges on
+// its own (see PurgeStore) are dropped too. All other methods pass through
+// to the wrapped Store.
+type CachedStore struct {
+	Store
+	ttl time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]map[int]cacheEntry
+	inflight map[historyKey]*historyCall
+	gens     map[string]uint64 // bumped on every save to a room
+	counts   map[string]countEntry
+}
+
+type countEntry struct {
+	n       int
+	expires time.Time
+}
+
+type historyKey struct {
+	room  string
+	limit int
+}
+
+type cacheEntry struct {
+	msgs    []domain.Message
+	expires time.Time
+}
+
+type historyCall struct {
+	done chan struct{}
+	msgs []domain.Message
+	err  error
+}
+
+// NewCachedStore returns s wrapped with a history cache that holds results for ttl.
+func NewCachedStore(s Store, ttl time.Duration) *CachedStore {
+	c := &CachedStore{
+		Store:    s,
+		ttl:      ttl,
+		entries:  make(map[string]map[int]cacheEntry),
+		inflight: make(map[historyKey]*historyCall),
+		gens:     make(map[string]uint64),
+		counts:   make(map[string]countEntry),
+	}
+	if ps, ok := s.(PurgeStore); ok {
+		ps.OnPurge(func(rooms []string) {
+			for _, room := range rooms {
+				c.invalidate(room)
+			}
+		})
+	}
+	return c
+}
+
+// Save persists the message and invalidates cached history for its room.
+func (c *CachedStore) Save(msg domain.Message) error {
+	err := c.Store.Save(msg)
+	c.invalidate(msg.Room)
+	return err
+}
+
+func (c *CachedStore) invalidate(room string) {
+	c.mu.Lock()
+	delete(c.entries, room)
+	delete(c.counts, room)
+	c.gens[room]++
+	c.mu.Unlock()
+}
+
+// SaveIdempotent deduplicates through the wrapped store when it supports
+// idempotency keys, falling back to a plain Save otherwise, and invalidates
+// cached history for the room.
+func (c *CachedStore) SaveIdempotent(msg domain.Message, key string) (string, error) {
+	is, ok := c.Store.(IdempotentStore)
+	if !ok {
+		return msg.ID, c.Save(msg)
+	}
+	id, err := is.SaveIdempotent(msg, key)
+	c.invalidate(msg.Room)
+	return id, err
+}
+
+// CountMessages returns a room's message count from the wrapped store, if it
+// can count, caching it until ttl passes or the room changes.
+func (c *CachedStore) CountMessages(room string) (int, error) {
+	cs, ok := c.Store.(CountStore)
+	if !ok {
+		return 0, nil
+	}
+	c.mu.Lock()
+	e, hit := c.counts[room]
+	gen := c.gens[room]
+	c.mu.Unlock()
+	if hit && time.Now().Before(e.expires) {
+		return e.n, nil
+	}
+
+	n, err := cs.CountMessages(room)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	// A save during the query would make n stale; don't cache it.
+	if c.gens[room] == gen {
+		c.counts[room] = countEntry{n: n, expires: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return n, nil
+}
+
+// SaveRoom records a room in the wrapped store, if it keeps room records.
+func (c *CachedStore) SaveRoom(room domain.Room) error {
+	if rs, ok := c.Store.(RoomStore); ok {
+		return rs.SaveRoom(room)
+	}
+	return nil
+}
+
+// Rooms returns the wrapped store's room records, if it keeps any.
+func (c *CachedStore) Rooms() ([]domain.Room, error) {
+	if rs, ok := c.Store.(RoomStore); ok {
+		return rs.Rooms()
+	}
+	return nil, nil
+}
+
+// MessageRooms returns the rooms the wrapped store holds messages for, if
+// it can list them.
+func (c *CachedStore) MessageRooms() ([]string, error) {
+	if ms, ok := c.Store.(MessageRoomStore); ok {
+		return ms.MessageRooms()
+	}
+	return nil, nil
+}
+
+// SetRoomPassword records a room password in the wrapped store, if it keeps
+// them.
+func (c *CachedStore) SetRoomPassword(room, hash string) error {
+	if ps, ok := c.Store.(RoomPasswordStore); ok {
+		return ps.SetRoomPassword(room, hash)
+	}
+	return nil
+}
+
+// HistoryMulti returns each room's history through the cache, so rooms with
+// fresh cached history are not queried again.
+func (c *CachedStore) HistoryMulti(rooms []string, limit int) (map[string][]domain.Message, error) {
+	out := make(map[string][]domain.Message, len(rooms))
+	for _, room := range rooms {
+		msgs, err := c.History(room, limit)
+		if err != nil {
+			return nil, err
+		}
+		if msgs == nil {
+			msgs = []domain.Message{}
+		}
+		out[room] = msgs
+	}
+	return out, nil
+}
+
+// Thread returns a message and its replies from the wrapped store.
+func (c *CachedStore) Thread(id string, limit int) ([]domain.Message, error) {
+	if ts, ok := c.Store.(ThreadStore); ok {
+		return ts.Thread(id, limit)
+	}
+	return nil, domain.ErrMessageNotFound
+}
+
+// SetRoomTopic updates a room's topic in the wrapped store, if it records
+// rooms.
+func (c *CachedStore) SetRoomTopic(room, topic string) error {
+	if ts, ok := c.Store.(RoomTopicStore); ok {
+		return ts.SetRoomTopic(room, topic)
+	}
+	return nil
+}
+
+// RoomPassword returns a room's password hash from the wrapped store.
+func (c *CachedStore) RoomPassword(room string) (string, error) {
+	if ps, ok := c.Store.(RoomPasswordStore); ok {
+		return ps.RoomPassword(room)
+	}
+	return "", nil
+}
+
+// SetLastSeen records a user's last-seen time in the wrapped store, if it
+// keeps them.
+func (c *CachedStore) SetLastSeen(user string, t time.Time) error {
+	if ls, ok := c.Store.(LastSeenStore); ok {
+		return ls.SetLastSeen(user, t)
+	}
+	return nil
+}
+
+// GetLastSeen returns a user's last-seen time from the wrapped store.
+func (c *CachedStore) GetLastSeen(user string) (time.Time, error) {
+	if ls, ok := c.Store.(LastSeenStore); ok {
+		return ls.GetLastSeen(user)
+	}
+	return time.Time{}, nil
+}
+
+// EditMessage edits a message in the wrapped store, if it supports edits,
+// and drops the room's cached history.
+func (c *CachedStore) EditMessage(room, id, text string) error {
+	es, ok := c.Store.(EditStore)
+	if !ok {
+		return domain.ErrMessageNotFound
+	}
+	err := es.EditMessage(room, id, text)
+	c.invalidate(room)
+	return err
+}
+
+// Message looks a message up in the wrapped store, if it supports edits.
+func (c *CachedStore) Message(room, id string) (domain.Message, error) {
+	if es, ok := c.Store.(EditStore); ok {
+		return es.Message(room, id)
+	}
+	return domain.Message{}, domain.ErrMessageNotFound
+}
+
+// DeleteMessage deletes a message in the wrapped store, if it supports
+// edits, and drops the room's cached history.
+func (c *CachedStore) DeleteMessage(room, id string) error {
+	es, ok := c.Store.(EditStore)
+	if !ok {
+		return domain.ErrMessageNotFound
+	}
+	err := es.DeleteMessage(room, id)
+	c.invalidate(room)
+	return err
+}
+
+// SoftDelete soft-deletes a message in the wrapped store, if it supports
+// that, and drops the room's cached history.
+func (c *CachedStore) SoftDelete(room, id string) error {
+	sd, ok := c.Store.(SoftDeleteStore)
+	if !ok {
+		return domain.ErrMessageNotFound
+	}
+	err := sd.SoftDelete(room, id)
+	c.invalidate(room)
+	return err
+}
+
+// DeleteRoom purges a room from the wrapped store and drops the room's
+// cached history. It returns errors.ErrUnsupported if the wrapped store
+// cannot purge rooms.
+func (c *CachedStore) DeleteRoom(room string) error {
+	rd, ok := c.Store.(RoomDeleteStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	err := rd.DeleteRoom(room)
+	c.invalidate(room)
+	return err
+}
+
+// EditHistory returns a message's prior versions from the wrapped store.
+func (c *CachedStore) EditHistory(id string) ([]domain.MessageEdit, error) {
+	if es, ok := c.Store.(EditStore); ok {
+		return es.EditHistory(id)
+	}
+	return nil, domain.ErrMessageNotFound
+}
+
+// Search searches the wrapped store, if it supports search. Results are not
+// cached.
+func (c *CachedStore) Search(room, query string, limit int) ([]domain.Message, error) {
+	if ss, ok := c.Store.(SearchStore); ok {
+		return ss.Search(room, query, limit)
+	}
+	return nil, nil
+}
+
+// History returns cached history when fresh, joins an identical in-flight
+// query when one is running, and otherwise queries the wrapped store.
+func (c *CachedStore) History(room string, limit int) ([]domain.Message, error) {
+	key := historyKey{room: room, limit: limit}
+
+	c.mu.Lock()
+	if e, ok := c.entries[room][limit]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return copyMessages(e.msgs), nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return copyMessages(call.msgs), call.err
+	}
+	call := &historyCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	gen := c.gens[room]
+	c.mu.Unlock()
+
+	call.msgs, call.err = c.Store.History(room, limit)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	// Only cache if no message was saved to the room while querying.
+	if call.err == nil && c.gens[room] == gen {
+		if c.entries[room] == nil {
+			c.entries[room] = make(map[int]cacheEntry)
+		}
+		c.entries[room][limit] = cacheEntry{msgs: call.msgs, expires: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return copyMessages(call.msgs), call.err
+}
+
+func copyMessages(msgs []domain.Message) []domain.Message {
+	if msgs == nil {
+		return nil
+	}
+	cp := make([]domain.Message, len(msgs))
+	copy(cp, msgs)
+	return cp
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+	"github.com/devaloi/chatterbox/internal/testutil"
+)
+
+func TestCachedStoreSharesConcurrentHistory(t *testing.T) {
+	t.Parallel()
+	mock := testutil.NewMockStore()
+	mock.HistoryDelay = 50 * time.Millisecond
+	mock.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"})
+	s := NewCachedStore(mock, time.Second)
+
+	const joiners = 50
+	var wg sync.WaitGroup
+	for i := 0; i < joiners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msgs, err := s.History("general", 50)
+			if err != nil || len(msgs) != 1 {
+				t.Errorf("history: got %d messages, err %v", len(msgs), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := mock.HistoryCalls(); calls > 2 {
+		t.Errorf("expected shared queries for %d joiners, got %d calls", joiners, calls)
+	}
+}
+
+func TestCachedStoreInvalidatesOnSave(t *testing.T) {
+	t.Parallel()
+	mock := testutil.NewMockStore()
+	s := NewCachedStore(mock, time.Minute)
+
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "one"})
+	if msgs, _ := s.History("general", 50); len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs, _ := s.History("general", 50); len(msgs) != 1 {
+		t.Fatalf("expected 1 cached message, got %d", len(msgs))
+	}
+	if calls := mock.HistoryCalls(); calls != 1 {
+		t.Errorf("expected second call to hit cache, got %d calls", calls)
+	}
+
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "bob", Text: "two"})
+	if msgs, _ := s.History("general", 50); len(msgs) != 2 {
+		t.Errorf("expected 2 messages after save, got %d", len(msgs))
+	}
+}
+
+func TestCachedStoreCountsMessages(t *testing.T) {
+	t.Parallel()
+	db, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer db.Close()
+	s := NewCachedStore(db, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"})
+	}
+	if n, err := s.CountMessages("general"); err != nil || n != 3 {
+		t.Fatalf("expected 3 messages, got %d (err %v)", n, err)
+	}
+
+	// A save drops the cached count.
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"})
+	if n, _ := s.CountMessages("general"); n != 4 {
+		t.Errorf("expected 4 messages after a save, got %d", n)
+	}
+	if n, _ := s.CountMessages("random"); n != 0 {
+		t.Errorf("expected an empty room to count 0, got %d", n)
+	}
+}
+
+func TestCachedStoreDropsPurgedRooms(t *testing.T) {
+	t.Parallel()
+	db, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer db.Close()
+	s := NewCachedStore(db, time.Minute)
+
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	s.Save(domain.Message{ID: "old", Type: domain.MsgChat, Room: "general", User: "alice", Text: "old", Timestamp: old})
+	if msgs, _ := s.History("general", 10); len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if n, _ := s.CountMessages("general"); n != 1 {
+		t.Fatalf("expected a count of 1, got %d", n)
+	}
+
+	// A retention sweep deletes behind the cache.
+	if n, err := db.DeleteOlderThan(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("expected 1 purged, got %d (err %v)", n, err)
+	}
+	if msgs, _ := s.History("general", 10); len(msgs) != 0 {
+		t.Errorf("expected purged history gone from the cache, got %d messages", len(msgs))
+	}
+	if n, _ := s.CountMessages("general"); n != 0 {
+		t.Errorf("expected a count of 0 after the purge, got %d", n)
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// WAL checkpoint modes accepted by WithCheckpoint, as defined by SQLite's
+// wal_checkpoint pragma.
+const (
+	CheckpointPassive  = "PASSIVE"
+	CheckpointFull     = "FULL"
+	CheckpointTruncate = "TRUNCATE"
+)
+
+// ParseCheckpointMode validates a checkpoint mode, case-insensitively.
+func ParseCheckpointMode(s string) (string, error) {
+	switch m := strings.ToUpper(s); m {
+	case CheckpointPassive, CheckpointFull, CheckpointTruncate:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid checkpoint mode %q: want PASSIVE, FULL or TRUNCATE", s)
+}
+
+// SQLiteOption configures optional SQLiteStore behavior.
+type SQLiteOption func(*SQLiteStore)
+
+// WithCheckpoint checkpoints the WAL every interval using mode, so the -wal
+// file does not grow without bound under sustained writes. PASSIVE never
+// blocks writers; TRUNCATE also shrinks the file back to zero bytes. A zero
+// interval leaves checkpointing to SQLite's automatic passive checkpoints.
+func WithCheckpoint(interval time.Duration, mode string) SQLiteOption {
+	return func(s *SQLiteStore) {
+		s.checkpointEvery = interval
+		s.checkpointMode = mode
+	}
+}
+
+// Checkpoint runs a WAL checkpoint in the given mode.
+func (s *SQLiteStore) Checkpoint(mode string) error {
+	if _, err := ParseCheckpointMode(mode); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(" + mode + ")")
+	return err
+}
+
+func (s *SQLiteStore) runCheckpoints() {
+	defer s.bg.Done()
+	ticker := time.NewTicker(s.checkpointEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Checkpoint(s.checkpointMode); err != nil {
+				slog.Warn("wal checkpoint", "err", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
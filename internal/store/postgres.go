@@ -0,0 +1,374 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// ErrNoPostgresDriver is returned by NewPostgres when the binary was built
+// without a PostgreSQL driver. Build with -tags postgres to include one.
+var ErrNoPostgresDriver = errors.New("postgres driver not built in (build with -tags postgres)")
+
+// PostgresStore implements Store, RoomStore, RoomPasswordStore and
+// IdempotentStore using PostgreSQL, with the same schema and ordering as
+// SQLiteStore, so several servers can share one database. Edits, deletes,
+// last-seen times, search and retention are SQLite-only.
+type PostgresStore struct {
+	db *sql.DB
+	// IdempotencyWindow bounds how long SaveIdempotent treats a key as used.
+	IdempotencyWindow time.Duration
+}
+
+// NewPostgres connects to the database at url and creates the schema if it
+// does not exist yet.
+func NewPostgres(url string) (*PostgresStore, error) {
+	if !slices.Contains(sql.Drivers(), "postgres") {
+		return nil, ErrNoPostgresDriver
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createPostgresTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db, IdempotencyWindow: DefaultIdempotencyWindow}, nil
+}
+
+func createPostgresTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id BIGSERIAL PRIMARY KEY,
+			room TEXT NOT NULL,
+			"user" TEXT NOT NULL,
+			text TEXT NOT NULL,
+			type TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			msg_id TEXT NOT NULL DEFAULT '',
+			reply_to TEXT NOT NULL DEFAULT ''
+		);
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to TEXT NOT NULL DEFAULT '';
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS idem_key TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idem
+		ON messages(room, "user", idem_key) WHERE idem_key IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to) WHERE reply_to != '';
+		CREATE INDEX IF NOT EXISTS idx_messages_room_created ON messages(room, created_at);
+		CREATE TABLE IF NOT EXISTS rooms (
+			name TEXT PRIMARY KEY,
+			topic TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS room_passwords (
+			room TEXT PRIMARY KEY,
+			hash TEXT NOT NULL
+		);
+		UPDATE messages SET room = lower(room), idem_key = NULL
+		WHERE room <> lower(room) AND room NOT LIKE 'dm:%';
+	`)
+	if err != nil {
+		return err
+	}
+	if err := lowercaseRoomKeys(db, "rooms", "name"); err != nil {
+		return err
+	}
+	return lowercaseRoomKeys(db, "room_passwords", "room")
+}
+
+// Save persists a message to the database.
+func (s *PostgresStore) Save(msg domain.Message) error {
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO messages (room, "user", text, type, created_at, msg_id, reply_to) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		msg.Room, msg.User, msg.Text, msg.Type, ts, msg.ID, msg.ReplyTo,
+	)
+	return err
+}
+
+// SaveIdempotent persists a message keyed by (room, user, key). A second save
+// with the same key inside IdempotencyWindow stores nothing and returns the
+// original message id, including when another server saved it concurrently.
+func (s *PostgresStore) SaveIdempotent(msg domain.Message, key string) (string, error) {
+	if key == "" {
+		return msg.ID, s.Save(msg)
+	}
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Free the key if its window has passed.
+	if _, err := tx.Exec(
+		`UPDATE messages SET idem_key = NULL WHERE room = $1 AND "user" = $2 AND idem_key = $3 AND created_at < $4`,
+		msg.Room, msg.User, key, time.Now().Add(-s.IdempotencyWindow),
+	); err != nil {
+		return "", err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO messages (room, "user", text, type, created_at, msg_id, idem_key, reply_to)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (room, "user", idem_key) WHERE idem_key IS NOT NULL DO NOTHING
+	`, msg.Room, msg.User, msg.Text, msg.Type, ts, msg.ID, key, msg.ReplyTo)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n > 0 {
+		return msg.ID, tx.Commit()
+	}
+
+	var origID string
+	err = tx.QueryRow(
+		`SELECT msg_id FROM messages WHERE room = $1 AND "user" = $2 AND idem_key = $3`,
+		msg.Room, msg.User, key,
+	).Scan(&origID)
+	if err != nil {
+		return "", err
+	}
+	return origID, tx.Commit()
+}
+
+// History returns the last `limit` messages for a room, oldest first.
+func (s *PostgresStore) History(room string, limit int) ([]domain.Message, error) {
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, "user", text, type, created_at, reply_to FROM (
+			SELECT * FROM messages
+			WHERE room = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		) newest
+		ORDER BY created_at ASC, id ASC
+	`, room, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// HistoryMulti returns the last `limit` messages of each room, oldest first,
+// in a single query.
+func (s *PostgresStore) HistoryMulti(rooms []string, limit int) (map[string][]domain.Message, error) {
+	out := make(map[string][]domain.Message, len(rooms))
+	if len(rooms) == 0 {
+		return out, nil
+	}
+	args := make([]any, 0, len(rooms)+1)
+	params := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		out[room] = []domain.Message{}
+		args = append(args, room)
+		params = append(params, "$"+strconv.Itoa(len(args)))
+	}
+	args = append(args, limit)
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, "user", text, type, created_at, reply_to FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY room ORDER BY created_at DESC, id DESC) AS n
+			FROM messages
+			WHERE room IN (`+strings.Join(params, ", ")+`)
+		) newest
+		WHERE n <= $`+strconv.Itoa(len(args))+`
+		ORDER BY created_at ASC, id ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		out[m.Room] = append(out[m.Room], m)
+	}
+	return out, nil
+}
+
+// HistoryAfterID returns up to `limit` messages saved to a room after the
+// message with the given id, oldest first, in insertion order.
+func (s *PostgresStore) HistoryAfterID(room, id string, limit int) ([]domain.Message, error) {
+	if id == "" {
+		return nil, domain.ErrMessageNotFound
+	}
+	var seq int64
+	err := s.db.QueryRow("SELECT id FROM messages WHERE room = $1 AND msg_id = $2", room, id).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, "user", text, type, created_at, reply_to FROM messages
+		WHERE room = $1 AND id > $2
+		ORDER BY id ASC
+		LIMIT $3
+	`, room, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// MessageRooms returns the distinct names of rooms with saved messages,
+// ordered by name.
+func (s *PostgresStore) MessageRooms() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT room FROM messages ORDER BY room")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, name)
+	}
+	return rooms, rows.Err()
+}
+
+// CountMessages returns how many messages are saved for a room.
+func (s *PostgresStore) CountMessages(room string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE room = $1", room).Scan(&n)
+	return n, err
+}
+
+// SaveRoom records a room created ahead of use.
+func (s *PostgresStore) SaveRoom(room domain.Room) error {
+	res, err := s.db.Exec(
+		"INSERT INTO rooms (name, topic, created_at) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING",
+		room.Name, room.Topic, createdAt(room),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrRoomExists
+	}
+	return nil
+}
+
+// Rooms returns all recorded rooms, ordered by name.
+func (s *PostgresStore) Rooms() ([]domain.Room, error) {
+	rows, err := s.db.Query("SELECT name, topic, created_at FROM rooms ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []domain.Room
+	for rows.Next() {
+		var r domain.Room
+		if err := rows.Scan(&r.Name, &r.Topic, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, r)
+	}
+	return rooms, rows.Err()
+}
+
+// DeleteRoom removes a room's messages, its room record and its password.
+func (s *PostgresStore) DeleteRoom(room string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM messages WHERE room = $1", room); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM rooms WHERE name = $1", room); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM room_passwords WHERE room = $1", room); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetRoomPassword records the password hash for a room, replacing any
+// earlier one.
+func (s *PostgresStore) SetRoomPassword(room, hash string) error {
+	_, err := s.db.Exec(
+		"INSERT INTO room_passwords (room, hash) VALUES ($1, $2) ON CONFLICT (room) DO UPDATE SET hash = excluded.hash",
+		room, hash,
+	)
+	return err
+}
+
+// RoomPassword returns a room's password hash, or "" if it has none.
+func (s *PostgresStore) RoomPassword(room string) (string, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT hash FROM room_passwords WHERE room = $1", room).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// SetRoomTopic updates the topic of a room recorded by SaveRoom.
+func (s *PostgresStore) SetRoomTopic(room, topic string) error {
+	_, err := s.db.Exec("UPDATE rooms SET topic = $1 WHERE name = $2", topic, room)
+	return err
+}
+
+// Thread returns the message with the given id followed by up to `limit` of
+// its direct replies, oldest first.
+func (s *PostgresStore) Thread(id string, limit int) ([]domain.Message, error) {
+	if id == "" {
+		return nil, domain.ErrMessageNotFound
+	}
+	var parent domain.Message
+	err := s.db.QueryRow(
+		`SELECT msg_id, room, "user", text, type, created_at, reply_to FROM messages WHERE msg_id = $1`, id,
+	).Scan(&parent.ID, &parent.Room, &parent.User, &parent.Text, &parent.Type, &parent.Timestamp, &parent.ReplyTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return []domain.Message{parent}, nil
+	}
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, "user", text, type, created_at, reply_to FROM messages
+		WHERE room = $1 AND reply_to = $2
+		ORDER BY id
+		LIMIT $3
+	`, parent.Room, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return append([]domain.Message{parent}, replies...), nil
+}
+
+// Close closes the database connection pool.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
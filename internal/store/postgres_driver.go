@@ -0,0 +1,6 @@
+//go:build postgres
+
+package store
+
+// The PostgreSQL driver is opt-in so default builds don't carry it.
+import _ "github.com/lib/pq"
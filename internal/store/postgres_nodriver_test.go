@@ -0,0 +1,15 @@
+//go:build !postgres
+
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewPostgresWithoutDriver(t *testing.T) {
+	t.Parallel()
+	if _, err := NewPostgres("postgres://localhost/chatterbox"); !errors.Is(err, ErrNoPostgresDriver) {
+		t.Errorf("expected ErrNoPostgresDriver, got %v", err)
+	}
+}
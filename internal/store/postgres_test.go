@@ -0,0 +1,140 @@
+//go:build postgres
+
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// newTestPostgres connects to DATABASE_URL, skipping the test when it is
+// unset or the database is unreachable.
+func newTestPostgres(t *testing.T) *PostgresStore {
+	t.Helper()
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	s, err := NewPostgres(url)
+	if err != nil {
+		t.Skipf("postgres unreachable: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPostgresSaveAndHistory(t *testing.T) {
+	t.Parallel()
+	s := newTestPostgres(t)
+	room := "pg-" + uuid.NewString()
+
+	now := time.Now().UTC()
+	for i, text := range []string{"msg1", "msg2", "msg3"} {
+		err := s.Save(domain.Message{
+			Type: domain.MsgChat, Room: room, User: "alice", Text: text,
+			Timestamp: now.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	history, err := s.History(room, 2)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(history) != 2 || history[0].Text != "msg2" || history[1].Text != "msg3" {
+		t.Errorf("expected the newest two oldest-first, got %+v", history)
+	}
+}
+
+func TestPostgresHistoryAfterID(t *testing.T) {
+	t.Parallel()
+	s := newTestPostgres(t)
+	room := "pg-" + uuid.NewString()
+
+	now := time.Now().UTC()
+	for _, id := range []string{"a", "b", "c"} {
+		s.Save(domain.Message{ID: id, Type: domain.MsgChat, Room: room, User: "alice", Text: id, Timestamp: now})
+	}
+
+	msgs, err := s.HistoryAfterID(room, "a", 10)
+	if err != nil {
+		t.Fatalf("history after id: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "b" || msgs[1].ID != "c" {
+		t.Errorf("expected b, c, got %+v", msgs)
+	}
+	if _, err := s.HistoryAfterID(room, "missing", 10); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestPostgresSaveRoom(t *testing.T) {
+	t.Parallel()
+	s := newTestPostgres(t)
+	room := domain.Room{Name: "pg-" + uuid.NewString(), Topic: "testing"}
+
+	if err := s.SaveRoom(room); err != nil {
+		t.Fatalf("save room: %v", err)
+	}
+	if err := s.SaveRoom(room); err != domain.ErrRoomExists {
+		t.Errorf("expected ErrRoomExists, got %v", err)
+	}
+}
+
+func TestPostgresRoomPassword(t *testing.T) {
+	t.Parallel()
+	s := newTestPostgres(t)
+	room := "pg-" + uuid.NewString()
+
+	if hash, err := s.RoomPassword(room); err != nil || hash != "" {
+		t.Fatalf("expected no password, got %q (err %v)", hash, err)
+	}
+	s.SetRoomPassword(room, "h1")
+	s.SetRoomPassword(room, "h2")
+	if hash, err := s.RoomPassword(room); err != nil || hash != "h2" {
+		t.Errorf("expected the latest hash, got %q (err %v)", hash, err)
+	}
+	if err := s.DeleteRoom(room); err != nil {
+		t.Fatalf("delete room: %v", err)
+	}
+	if hash, _ := s.RoomPassword(room); hash != "" {
+		t.Errorf("expected DeleteRoom to clear the password, got %q", hash)
+	}
+}
+
+func TestPostgresSaveIdempotent(t *testing.T) {
+	t.Parallel()
+	s := newTestPostgres(t)
+	room := "pg-" + uuid.NewString()
+
+	first := domain.Message{ID: "id-1", Type: domain.MsgChat, Room: room, User: "alice", Text: "hi"}
+	retry := first
+	retry.ID = "id-2"
+	if id, err := s.SaveIdempotent(first, "key-1"); err != nil || id != "id-1" {
+		t.Fatalf("save: got %q, %v", id, err)
+	}
+	if id, err := s.SaveIdempotent(retry, "key-1"); err != nil || id != "id-1" {
+		t.Errorf("expected the retry to return the original id, got %q, %v", id, err)
+	}
+	if history, _ := s.History(room, 50); len(history) != 1 {
+		t.Errorf("expected 1 stored message, got %d", len(history))
+	}
+
+	// Another user may reuse the key, and it is freed once the window ends.
+	other := domain.Message{ID: "id-3", Type: domain.MsgChat, Room: room, User: "bob", Text: "hi"}
+	if id, _ := s.SaveIdempotent(other, "key-1"); id != "id-3" {
+		t.Errorf("expected a new id for another user, got %q", id)
+	}
+	s.IdempotencyWindow = time.Nanosecond
+	again := domain.Message{ID: "id-4", Type: domain.MsgChat, Room: room, User: "alice", Text: "hi"}
+	if id, _ := s.SaveIdempotent(again, "key-1"); id != "id-4" {
+		t.Errorf("expected an expired key to allow a new save, got %q", id)
+	}
+}
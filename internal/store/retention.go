@@ -0,0 +1,128 @@
+package store
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+// retentionBatch bounds how many messages one purge transaction deletes, so
+// a large backlog is removed in short transactions that saves can slip
+// between.
+const retentionBatch = 500
+
+// WithRetention deletes messages older than maxAge, checking every interval.
+// A zero maxAge keeps messages forever.
+func WithRetention(maxAge, interval time.Duration) SQLiteOption {
+	return func(s *SQLiteStore) {
+		s.retentionAge = maxAge
+		s.retentionEvery = interval
+	}
+}
+
+// OnPurge registers fn to be called with the rooms that lost messages after
+// each DeleteOlderThan that deleted any, including retention sweeps.
+func (s *SQLiteStore) OnPurge(fn func(rooms []string)) {
+	s.purgeMu.Lock()
+	s.onPurge = append(s.onPurge, fn)
+	s.purgeMu.Unlock()
+}
+
+// DeleteOlderThan deletes messages created before t, along with their edit
+// history, and returns how many messages were deleted.
+func (s *SQLiteStore) DeleteOlderThan(t time.Time) (int, error) {
+	s.flushPending()
+	cutoff := t.UTC()
+	total := 0
+	purged := make(map[string]bool)
+	defer func() { s.notifyPurge(purged) }()
+	for {
+		n, err := s.deleteBatch(cutoff, purged)
+		total += n
+		if err != nil || n < retentionBatch {
+			return total, err
+		}
+	}
+}
+
+// notifyPurge passes the purged rooms to the OnPurge hooks.
+func (s *SQLiteStore) notifyPurge(purged map[string]bool) {
+	if len(purged) == 0 {
+		return
+	}
+	rooms := slices.Sorted(maps.Keys(purged))
+	s.purgeMu.Lock()
+	hooks := slices.Clone(s.onPurge)
+	s.purgeMu.Unlock()
+	for _, fn := range hooks {
+		fn(rooms)
+	}
+}
+
+// deleteBatch deletes one batch of messages created before cutoff and adds
+// their rooms to purged once the batch is committed.
+func (s *SQLiteStore) deleteBatch(cutoff time.Time, purged map[string]bool) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const batch = "SELECT id FROM messages WHERE created_at < ? ORDER BY id LIMIT ?"
+	rows, err := tx.Query("SELECT DISTINCT room FROM messages WHERE id IN ("+batch+")", cutoff, retentionBatch)
+	if err != nil {
+		return 0, err
+	}
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rooms = append(rooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM message_edits WHERE msg_id IN (SELECT msg_id FROM messages WHERE id IN ("+batch+"))",
+		cutoff, retentionBatch,
+	); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM messages WHERE id IN ("+batch+")", cutoff, retentionBatch)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, room := range rooms {
+		purged[room] = true
+	}
+	return int(n), nil
+}
+
+func (s *SQLiteStore) runRetention() {
+	defer s.bg.Done()
+	ticker := time.NewTicker(s.retentionEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// n counts the batches committed before any error.
+			n, err := s.DeleteOlderThan(time.Now().Add(-s.retentionAge))
+			if err != nil {
+				slog.Error("retention sweep failed", "purged", n, "err", err)
+				continue
+			}
+			slog.Info("retention sweep", "purged", n)
+		case <-s.quit:
+			return
+		}
+	}
+}
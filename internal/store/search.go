@@ -0,0 +1,100 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
+
+// createSearchIndex sets up an FTS5 index over message text, kept in sync
+// with the messages table by triggers. It reports false when the SQLite
+// build lacks FTS5, in which case Search falls back to LIKE.
+func createSearchIndex(db *sql.DB) (bool, error) {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&n); err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+	if _, err := db.Exec("CREATE VIRTUAL TABLE messages_fts USING fts5(text, content='messages', content_rowid='id')"); err != nil {
+		return false, nil
+	}
+	_, err := db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, text) VALUES (new.id, new.text);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, text) VALUES ('delete', old.id, old.text);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, text) VALUES ('delete', old.id, old.text);
+			INSERT INTO messages_fts(rowid, text) VALUES (new.id, new.text);
+		END;
+		INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+	`)
+	return err == nil, err
+}
+
+// Search returns up to `limit` of the newest messages in a room whose text
+// matches every word of query, oldest first.
+func (s *SQLiteStore) Search(room, query string, limit int) ([]domain.Message, error) {
+	s.flushPending()
+	words := strings.Fields(query)
+	if len(words) == 0 || limit <= 0 {
+		return nil, nil
+	}
+
+	var rows *sql.Rows
+	var err error
+	if s.fts {
+		rows, err = s.db.Query(`
+			SELECT m.msg_id, m.room, m.user, m.text, m.type, m.created_at, m.reply_to, m.deleted_at
+			FROM messages_fts f JOIN messages m ON m.id = f.rowid
+			WHERE messages_fts MATCH ? AND m.room = ? AND m.deleted_at IS NULL
+			ORDER BY m.id DESC
+			LIMIT ?
+		`, ftsQuery(words), room, limit)
+	} else {
+		where := []string{"room = ?", "deleted_at IS NULL"}
+		args := []any{room}
+		for _, w := range words {
+			where = append(where, `text LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(w)+"%")
+		}
+		rows, err = s.db.Query(`
+			SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM messages
+			WHERE `+strings.Join(where, " AND ")+`
+			ORDER BY id DESC
+			LIMIT ?
+		`, append(args, limit)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse to oldest-first order.
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// ftsQuery quotes each word as an FTS5 prefix string, so user input is only
+// ever matched as text and never parsed as query syntax (NEAR, OR, column
+// filters, and so on). A word matches any token it is a prefix of.
+func ftsQuery(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// likeEscaper escapes LIKE wildcards so they match literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
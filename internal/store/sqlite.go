@@ -2,6 +2,11 @@ package store
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -9,20 +14,74 @@ import (
 	"github.com/devaloi/chatterbox/internal/domain"
 )
 
+// DefaultIdempotencyWindow is how long an idempotency key blocks duplicate saves.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// DefaultBusyTimeout is how long a statement waits on a locked database
+// before failing with "database is locked".
+const DefaultBusyTimeout = 5 * time.Second
+
 // SQLiteStore implements Store using SQLite.
 type SQLiteStore struct {
 	db *sql.DB
+	// IdempotencyWindow bounds how long SaveIdempotent treats a key as used.
+	IdempotencyWindow time.Duration
+
+	busyTimeout     time.Duration
+	checkpointEvery time.Duration
+	checkpointMode  string
+	retentionAge    time.Duration
+	retentionEvery  time.Duration
+	purgeMu         sync.Mutex
+	onPurge         []func(rooms []string)
+
+	quit      chan struct{}  // closed by Close to stop background work
+	bg        sync.WaitGroup // background checkpoint and retention loops
+	closeOnce sync.Once
+
+	noEditHistory bool
+	fts           bool // messages_fts is available for Search
+
+	batchSize  int
+	batchEvery time.Duration
+	batchMu    sync.Mutex
+	flushMu    sync.Mutex
+	pending    []domain.Message // saved but not yet written, see WithWriteBatch
+	// flushFailures counts flushes failed in a row; guarded by flushMu.
+	flushFailures int
 }
 
 // NewSQLite opens or creates a SQLite database at the given path.
 // Use ":memory:" for an in-memory database.
-func NewSQLite(path string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite", path)
+//
+// The database runs in WAL mode behind a single connection: SQLite allows
+// one writer at a time, and sharing one connection queues writers in the
+// pool instead of letting them race for the write lock. The busy timeout
+// (see WithBusyTimeout) covers locks held from outside the pool, such as
+// another process or a backup tool.
+func NewSQLite(path string, opts ...SQLiteOption) (*SQLiteStore, error) {
+	s := &SQLiteStore{
+		IdempotencyWindow: DefaultIdempotencyWindow,
+		busyTimeout:       DefaultBusyTimeout,
+		checkpointMode:    CheckpointPassive,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s%s_pragma=busy_timeout(%d)", path, sep, s.busyTimeout.Milliseconds()))
 	if err != nil {
 		return nil, err
 	}
+	// One connection also keeps a ":memory:" database alive and shared; a
+	// second connection would open an empty database of its own.
+	db.SetMaxOpenConns(1)
 
-	// Enable WAL mode for better concurrent read performance.
+	// WAL lets readers outside the pool run alongside the writer.
 	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
 		db.Close()
 		return nil, err
@@ -33,7 +92,28 @@ func NewSQLite(path string) (*SQLiteStore, error) {
 		return nil, err
 	}
 
-	return &SQLiteStore{db: db}, nil
+	fts, err := createSearchIndex(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s.db = db
+	s.fts = fts
+	s.quit = make(chan struct{})
+	if s.checkpointEvery > 0 {
+		s.bg.Add(1)
+		go s.runCheckpoints()
+	}
+	if s.retentionAge > 0 && s.retentionEvery > 0 {
+		s.bg.Add(1)
+		go s.runRetention()
+	}
+	if s.batching() && s.batchEvery > 0 {
+		s.bg.Add(1)
+		go s.runBatchFlush()
+	}
+	return s, nil
 }
 
 func createTables(db *sql.DB) error {
@@ -48,26 +128,171 @@ func createTables(db *sql.DB) error {
 		);
 		CREATE INDEX IF NOT EXISTS idx_messages_room_created ON messages(room, created_at);
 	`)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema.
+	if err := addColumn(db, "msg_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "idem_key", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "reply_to", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "deleted_at", "DATETIME"); err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idem
+		ON messages(room, user, idem_key) WHERE idem_key IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to) WHERE reply_to != '';
+		CREATE TABLE IF NOT EXISTS rooms (
+			name TEXT PRIMARY KEY,
+			topic TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS message_edits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			msg_id TEXT NOT NULL,
+			text TEXT NOT NULL,
+			edited_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_edits_msg ON message_edits(msg_id);
+		CREATE TABLE IF NOT EXISTS room_passwords (
+			room TEXT PRIMARY KEY,
+			hash TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS last_seen (
+			user TEXT PRIMARY KEY,
+			seen_at DATETIME NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Room names are case-insensitive; fold rows saved before they were
+	// lowercased. A message whose idempotency key would then collide keeps
+	// its text and loses the key.
+	_, err = db.Exec(`
+		UPDATE OR IGNORE messages SET room = lower(room)
+		WHERE room <> lower(room) AND room NOT LIKE 'dm:%';
+		UPDATE messages SET room = lower(room), idem_key = NULL
+		WHERE room <> lower(room) AND room NOT LIKE 'dm:%';
+	`)
+	if err != nil {
+		return err
+	}
+	if err := lowercaseRoomKeys(db, "rooms", "name"); err != nil {
+		return err
+	}
+	return lowercaseRoomKeys(db, "room_passwords", "room")
+}
+
+// lowercaseRoomKeys lowercases a table's room-name primary key. When several
+// spellings of one room exist, the lowercase row is kept, or failing that
+// the first in byte order, and the others are dropped.
+func lowercaseRoomKeys(db *sql.DB, table, col string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		DELETE FROM %[1]s WHERE %[2]s <> lower(%[2]s) AND EXISTS (
+			SELECT 1 FROM %[1]s o
+			WHERE lower(o.%[2]s) = lower(%[1]s.%[2]s) AND o.%[2]s <> %[1]s.%[2]s
+			AND (o.%[2]s = lower(o.%[2]s) OR o.%[2]s < %[1]s.%[2]s)
+		)`, table, col))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("UPDATE %[1]s SET %[2]s = lower(%[2]s) WHERE %[2]s <> lower(%[2]s)", table, col))
 	return err
 }
 
-// Save persists a message to the database.
+// addColumn adds a column to the messages table unless it already exists.
+func addColumn(db *sql.DB, name, def string) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = ?", name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE messages ADD COLUMN " + name + " " + def)
+	return err
+}
+
+// Save persists a message to the database, or queues it when write
+// batching is enabled.
 func (s *SQLiteStore) Save(msg domain.Message) error {
+	if s.batching() {
+		return s.enqueue(msg)
+	}
+	_, err := s.insert(s.db, msg, nil)
+	return err
+}
+
+// SaveIdempotent persists a message keyed by (room, user, key). A second save
+// with the same key inside IdempotencyWindow stores nothing and returns the
+// original message id. Once the window has passed the key is released and
+// the save goes through as new.
+func (s *SQLiteStore) SaveIdempotent(msg domain.Message, key string) (string, error) {
+	if key == "" {
+		return msg.ID, s.Save(msg)
+	}
+	s.flushPending()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var origID string
+	var createdAt time.Time
+	err = tx.QueryRow(
+		"SELECT msg_id, created_at FROM messages WHERE room = ? AND user = ? AND idem_key = ?",
+		msg.Room, msg.User, key,
+	).Scan(&origID, &createdAt)
+	switch {
+	case err == nil && time.Since(createdAt) < s.IdempotencyWindow:
+		return origID, nil
+	case err == nil:
+		// Expired: free the key for this save.
+		if _, err := tx.Exec(
+			"UPDATE messages SET idem_key = NULL WHERE room = ? AND user = ? AND idem_key = ?",
+			msg.Room, msg.User, key,
+		); err != nil {
+			return "", err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", err
+	}
+
+	if _, err := s.insert(tx, msg, &key); err != nil {
+		return "", err
+	}
+	return msg.ID, tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *SQLiteStore) insert(db execer, msg domain.Message, key *string) (sql.Result, error) {
 	ts := msg.Timestamp
 	if ts.IsZero() {
 		ts = time.Now().UTC()
 	}
-	_, err := s.db.Exec(
-		"INSERT INTO messages (room, user, text, type, created_at) VALUES (?, ?, ?, ?, ?)",
-		msg.Room, msg.User, msg.Text, msg.Type, ts,
+	return db.Exec(
+		"INSERT INTO messages (room, user, text, type, created_at, msg_id, idem_key, reply_to) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.Room, msg.User, msg.Text, msg.Type, ts, msg.ID, key, msg.ReplyTo,
 	)
-	return err
 }
 
 // History returns the last `limit` messages for a room, oldest first.
 func (s *SQLiteStore) History(room string, limit int) ([]domain.Message, error) {
+	s.flushPending()
 	rows, err := s.db.Query(`
-		SELECT room, user, text, type, created_at FROM messages
+		SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM messages
 		WHERE room = ?
 		ORDER BY created_at DESC
 		LIMIT ?
@@ -75,28 +300,436 @@ func (s *SQLiteStore) History(room string, limit int) ([]domain.Message, error)
 	if err != nil {
 		return nil, err
 	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse to oldest-first order.
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// HistoryMulti returns the last `limit` messages of each room, oldest first,
+// in a single query.
+func (s *SQLiteStore) HistoryMulti(rooms []string, limit int) (map[string][]domain.Message, error) {
+	s.flushPending()
+	out := make(map[string][]domain.Message, len(rooms))
+	if len(rooms) == 0 {
+		return out, nil
+	}
+	args := make([]any, 0, len(rooms)+1)
+	for _, room := range rooms {
+		out[room] = []domain.Message{}
+		args = append(args, room)
+	}
+	args = append(args, limit)
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY room ORDER BY created_at DESC, id DESC) AS n
+			FROM messages
+			WHERE room IN (`+strings.Repeat("?, ", len(rooms)-1)+`?)
+		)
+		WHERE n <= ?
+		ORDER BY created_at ASC, id ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		out[m.Room] = append(out[m.Room], m)
+	}
+	return out, nil
+}
+
+// HistoryAfterID returns up to `limit` messages saved to a room after the
+// message with the given id, oldest first. Ordering follows insertion (the
+// row id), so messages with equal timestamps still page deterministically.
+func (s *SQLiteStore) HistoryAfterID(room, id string, limit int) ([]domain.Message, error) {
+	s.flushPending()
+	if id == "" {
+		return nil, domain.ErrMessageNotFound
+	}
+	var seq int64
+	err := s.db.QueryRow("SELECT id FROM messages WHERE room = ? AND msg_id = ?", room, id).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM messages
+		WHERE room = ? AND id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, room, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// SaveRoom records a room created ahead of use.
+func (s *SQLiteStore) SaveRoom(room domain.Room) error {
+	res, err := s.db.Exec(
+		"INSERT INTO rooms (name, topic, created_at) VALUES (?, ?, ?) ON CONFLICT(name) DO NOTHING",
+		room.Name, room.Topic, createdAt(room),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrRoomExists
+	}
+	return nil
+}
+
+// Rooms returns all recorded rooms, ordered by name.
+func (s *SQLiteStore) Rooms() ([]domain.Room, error) {
+	rows, err := s.db.Query("SELECT name, topic, created_at FROM rooms ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
+	var rooms []domain.Room
+	for rows.Next() {
+		var r domain.Room
+		if err := rows.Scan(&r.Name, &r.Topic, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, r)
+	}
+	return rooms, rows.Err()
+}
 
-	var msgs []domain.Message
+// MessageRooms returns the distinct names of rooms with saved messages,
+// ordered by name.
+func (s *SQLiteStore) MessageRooms() ([]string, error) {
+	s.flushPending()
+	rows, err := s.db.Query("SELECT DISTINCT room FROM messages ORDER BY room")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []string
 	for rows.Next() {
-		var m domain.Message
-		if err := rows.Scan(&m.Room, &m.User, &m.Text, &m.Type, &m.Timestamp); err != nil {
+		var name string
+		if err := rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		msgs = append(msgs, m)
+		rooms = append(rooms, name)
+	}
+	return rooms, rows.Err()
+}
+
+// CountMessages returns how many messages are saved for a room.
+func (s *SQLiteStore) CountMessages(room string) (int, error) {
+	s.flushPending()
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE room = ?", room).Scan(&n)
+	return n, err
+}
+
+// SetRoomPassword records the password hash for a room, replacing any
+// earlier one.
+func (s *SQLiteStore) SetRoomPassword(room, hash string) error {
+	_, err := s.db.Exec(
+		"INSERT INTO room_passwords (room, hash) VALUES (?, ?) ON CONFLICT(room) DO UPDATE SET hash = excluded.hash",
+		room, hash,
+	)
+	return err
+}
+
+// SetRoomTopic updates the topic of a room recorded by SaveRoom.
+func (s *SQLiteStore) SetRoomTopic(room, topic string) error {
+	_, err := s.db.Exec("UPDATE rooms SET topic = ? WHERE name = ?", topic, room)
+	return err
+}
+
+// RoomPassword returns a room's password hash, or "" if it has none.
+func (s *SQLiteStore) RoomPassword(room string) (string, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT hash FROM room_passwords WHERE room = ?", room).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// SetLastSeen records when a user was last active, replacing any earlier
+// time.
+func (s *SQLiteStore) SetLastSeen(user string, t time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO last_seen (user, seen_at) VALUES (?, ?) ON CONFLICT(user) DO UPDATE SET seen_at = excluded.seen_at",
+		user, t.UTC(),
+	)
+	return err
+}
+
+// GetLastSeen returns when a user was last active, or the zero time if the
+// user has never been seen.
+func (s *SQLiteStore) GetLastSeen(user string) (time.Time, error) {
+	var t time.Time
+	err := s.db.QueryRow("SELECT seen_at FROM last_seen WHERE user = ?", user).Scan(&t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return t, err
+}
+
+// WithBusyTimeout sets how long a statement waits on a locked database
+// before failing. A negative timeout fails at once.
+func WithBusyTimeout(d time.Duration) SQLiteOption {
+	return func(s *SQLiteStore) {
+		s.busyTimeout = max(d, 0)
+	}
+}
+
+// WithEditHistory controls whether EditMessage keeps the text each edit
+// replaces. It is on by default; when off, edits overwrite in place.
+func WithEditHistory(enabled bool) SQLiteOption {
+	return func(s *SQLiteStore) {
+		s.noEditHistory = !enabled
+	}
+}
+
+// EditMessage replaces a message's text. Unless edit history is disabled,
+// the previous text is first appended to message_edits, so the edit trail is
+// never overwritten.
+func (s *SQLiteStore) EditMessage(room, id, text string) error {
+	s.flushPending()
+	if id == "" {
+		return domain.ErrMessageNotFound
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prev string
+	err = tx.QueryRow("SELECT text FROM messages WHERE room = ? AND msg_id = ? AND deleted_at IS NULL", room, id).Scan(&prev)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.ErrMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.noEditHistory {
+		if _, err := tx.Exec(
+			"INSERT INTO message_edits (msg_id, text, edited_at) VALUES (?, ?, ?)",
+			id, prev, time.Now().UTC(),
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE messages SET text = ? WHERE room = ? AND msg_id = ?", text, room, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Message returns a saved message by id.
+func (s *SQLiteStore) Message(room, id string) (domain.Message, error) {
+	s.flushPending()
+	if id == "" {
+		return domain.Message{}, domain.ErrMessageNotFound
+	}
+	var m domain.Message
+	err := s.db.QueryRow(
+		"SELECT msg_id, room, user, text, type, created_at, reply_to FROM messages WHERE room = ? AND msg_id = ? AND deleted_at IS NULL",
+		room, id,
+	).Scan(&m.ID, &m.Room, &m.User, &m.Text, &m.Type, &m.Timestamp, &m.ReplyTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Message{}, domain.ErrMessageNotFound
+	}
+	return m, err
+}
+
+// Thread returns the message with the given id followed by up to `limit` of
+// its direct replies, oldest first.
+func (s *SQLiteStore) Thread(id string, limit int) ([]domain.Message, error) {
+	s.flushPending()
+	if id == "" {
+		return nil, domain.ErrMessageNotFound
+	}
+	parent, err := scanMessage(s.db.QueryRow(
+		"SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM messages WHERE msg_id = ?", id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return []domain.Message{parent}, nil
+	}
+	rows, err := s.db.Query(`
+		SELECT msg_id, room, user, text, type, created_at, reply_to, deleted_at FROM messages
+		WHERE room = ? AND reply_to = ?
+		ORDER BY id
+		LIMIT ?
+	`, parent.Room, id, limit)
+	if err != nil {
+		return nil, err
 	}
-	if err := rows.Err(); err != nil {
+	replies, err := scanMessages(rows)
+	if err != nil {
 		return nil, err
 	}
+	return append([]domain.Message{parent}, replies...), nil
+}
 
-	// Reverse to oldest-first order.
-	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
-		msgs[i], msgs[j] = msgs[j], msgs[i]
+// DeleteMessage removes a message and any edit history kept for it.
+func (s *SQLiteStore) DeleteMessage(room, id string) error {
+	s.flushPending()
+	if id == "" {
+		return domain.ErrMessageNotFound
 	}
-	return msgs, nil
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM messages WHERE room = ? AND msg_id = ?", room, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrMessageNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE msg_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteRoom removes everything stored for a room: its messages, their edit
+// history, its room record and its password.
+func (s *SQLiteStore) DeleteRoom(room string) error {
+	s.flushPending()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM message_edits WHERE msg_id IN (SELECT msg_id FROM messages WHERE room = ?)",
+		"DELETE FROM messages WHERE room = ?",
+		"DELETE FROM rooms WHERE name = ?",
+		"DELETE FROM room_passwords WHERE room = ?",
+	} {
+		if _, err := tx.Exec(q, room); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SoftDelete marks a message deleted without removing it. History, threads
+// and replays return it as a tombstone, it no longer matches searches and
+// cannot be edited, and its text and edit history stay in the database.
+func (s *SQLiteStore) SoftDelete(room, id string) error {
+	s.flushPending()
+	if id == "" {
+		return domain.ErrMessageNotFound
+	}
+	res, err := s.db.Exec(
+		"UPDATE messages SET deleted_at = ? WHERE room = ? AND msg_id = ? AND deleted_at IS NULL",
+		time.Now().UTC(), room, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrMessageNotFound
+	}
+	return nil
 }
 
-// Close closes the database connection.
+// EditHistory returns the prior versions of a message in the order they were
+// replaced. A message that was never edited has an empty history.
+func (s *SQLiteStore) EditHistory(id string) ([]domain.MessageEdit, error) {
+	s.flushPending()
+	if id == "" {
+		return nil, domain.ErrMessageNotFound
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE msg_id = ?", id).Scan(&n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, domain.ErrMessageNotFound
+	}
+
+	rows, err := s.db.Query("SELECT msg_id, text, edited_at FROM message_edits WHERE msg_id = ? ORDER BY id ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var edits []domain.MessageEdit
+	for rows.Next() {
+		var e domain.MessageEdit
+		if err := rows.Scan(&e.MessageID, &e.Text, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// scanMessages reads message rows selected as
+// (msg_id, room, user, text, type, created_at, reply_to, deleted_at) and
+// closes rows.
+func scanMessages(rows *sql.Rows) ([]domain.Message, error) {
+	defer rows.Close()
+	var msgs []domain.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// scanMessage reads one row selected like scanMessages does. A soft-deleted
+// message comes back as a tombstone: type "deleted" with its text cleared.
+func scanMessage(row interface{ Scan(...any) error }) (domain.Message, error) {
+	var m domain.Message
+	var deletedAt sql.NullTime
+	if err := row.Scan(&m.ID, &m.Room, &m.User, &m.Text, &m.Type, &m.Timestamp, &m.ReplyTo, &deletedAt); err != nil {
+		return domain.Message{}, err
+	}
+	if deletedAt.Valid {
+		m.Type = domain.MsgDeleted
+		m.Text = ""
+	}
+	return m, nil
+}
+
+// Close stops periodic checkpointing and retention sweeps, writes any
+// batched messages, checkpoints and truncates the WAL, and closes the
+// database connection.
 func (s *SQLiteStore) Close() error {
+	s.closeOnce.Do(func() { close(s.quit) })
+	s.bg.Wait()
+	s.Flush()
+	if err := s.Checkpoint(CheckpointTruncate); err != nil {
+		slog.Warn("wal checkpoint on close", "err", err)
+	}
 	return s.db.Close()
 }
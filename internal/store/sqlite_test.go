@@ -1,6 +1,14 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -87,6 +95,119 @@ func TestSQLiteRoomIsolation(t *testing.T) {
 	}
 }
 
+func TestSQLiteMessageRooms(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	if rooms, err := s.MessageRooms(); err != nil || len(rooms) != 0 {
+		t.Fatalf("expected no rooms in an empty store, got %v %v", rooms, err)
+	}
+	for _, room := range []string{"random", "general", "random", "archive"} {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: room, User: "alice", Text: "hi", Timestamp: time.Now()})
+	}
+	rooms, err := s.MessageRooms()
+	if err != nil {
+		t.Fatalf("message rooms: %v", err)
+	}
+	if want := []string{"archive", "general", "random"}; !slices.Equal(rooms, want) {
+		t.Errorf("got %v, want %v", rooms, want)
+	}
+}
+
+func TestSQLiteHistoryMulti(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := range 5 {
+		for _, room := range []string{"general", "random", "other"} {
+			s.Save(domain.Message{
+				ID: room + strconv.Itoa(i), Type: domain.MsgChat, Room: room, User: "alice",
+				Text: strconv.Itoa(i), Timestamp: base.Add(time.Duration(i) * time.Second),
+			})
+		}
+	}
+
+	history, err := s.HistoryMulti([]string{"general", "random", "empty"}, 3)
+	if err != nil {
+		t.Fatalf("history multi: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected an entry per requested room, got %v", history)
+	}
+	for _, room := range []string{"general", "random"} {
+		var texts []string
+		for _, m := range history[room] {
+			if m.Room != room {
+				t.Errorf("%s: got message from %s", room, m.Room)
+			}
+			texts = append(texts, m.Text)
+		}
+		if want := []string{"2", "3", "4"}; !slices.Equal(texts, want) {
+			t.Errorf("%s: got %v, want the newest three oldest first %v", room, texts, want)
+		}
+	}
+	if msgs, ok := history["empty"]; !ok || msgs == nil || len(msgs) != 0 {
+		t.Errorf("expected an empty slice for a room without history, got %#v", msgs)
+	}
+}
+
+func TestSQLiteThread(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for i, m := range []domain.Message{
+		{ID: "p", Room: "general", Text: "parent"},
+		{ID: "r1", Room: "general", Text: "first", ReplyTo: "p"},
+		{ID: "x", Room: "general", Text: "unrelated"},
+		{ID: "r2", Room: "general", Text: "second", ReplyTo: "p"},
+		{ID: "r3", Room: "general", Text: "nested", ReplyTo: "r1"},
+	} {
+		m.Type, m.User, m.Timestamp = domain.MsgChat, "alice", now.Add(time.Duration(i)*time.Second)
+		s.Save(m)
+	}
+
+	thread, err := s.Thread("p", 10)
+	if err != nil {
+		t.Fatalf("thread: %v", err)
+	}
+	var ids []string
+	for _, m := range thread {
+		ids = append(ids, m.ID)
+	}
+	if want := []string{"p", "r1", "r2"}; !slices.Equal(ids, want) {
+		t.Errorf("got %v, want the parent then its direct replies %v", ids, want)
+	}
+	if thread[1].ReplyTo != "p" {
+		t.Errorf("expected reply_to on replies, got %+v", thread[1])
+	}
+
+	if thread, err := s.Thread("p", 0); err != nil || len(thread) != 1 {
+		t.Errorf("expected only the parent for limit 0, got %v %v", thread, err)
+	}
+	if _, err := s.Thread("nope", 10); !errors.Is(err, domain.ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	history, _ := s.History("general", 50)
+	if len(history) != 5 || history[3].ReplyTo != "p" {
+		t.Errorf("expected history to carry reply_to, got %+v", history)
+	}
+}
+
 func TestSQLiteEmptyHistory(t *testing.T) {
 	t.Parallel()
 	s, err := NewSQLite(":memory:")
@@ -103,3 +224,596 @@ func TestSQLiteEmptyHistory(t *testing.T) {
 		t.Errorf("expected 0 messages, got %d", len(history))
 	}
 }
+
+func TestClampHistory(t *testing.T) {
+	t.Parallel()
+	msgs := []domain.Message{{Text: "1"}, {Text: "2"}, {Text: "3"}, {Text: "4"}}
+
+	got := ClampHistory(msgs, 2)
+	if len(got) != 2 || got[0].Text != "3" || got[1].Text != "4" {
+		t.Errorf("expected newest 2 messages, got %+v", got)
+	}
+	if got := ClampHistory(msgs, 10); len(got) != 4 {
+		t.Errorf("expected all 4 messages under limit, got %d", len(got))
+	}
+	for _, limit := range []int{0, -1} {
+		if got := ClampHistory(msgs, limit); len(got) != 0 {
+			t.Errorf("limit %d: expected empty, got %d", limit, len(got))
+		}
+	}
+}
+
+func TestSQLiteSaveIdempotent(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	first := domain.Message{ID: "id-1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}
+	retry := first
+	retry.ID = "id-2"
+
+	id1, err := s.SaveIdempotent(first, "key-1")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	id2, err := s.SaveIdempotent(retry, "key-1")
+	if err != nil {
+		t.Fatalf("save retry: %v", err)
+	}
+	if id1 != "id-1" || id2 != "id-1" {
+		t.Errorf("expected original id both times, got %q and %q", id1, id2)
+	}
+
+	history, _ := s.History("general", 50)
+	if len(history) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(history))
+	}
+	if history[0].ID != "id-1" {
+		t.Errorf("expected stored id id-1, got %q", history[0].ID)
+	}
+
+	// Another user may reuse the same key.
+	other := domain.Message{ID: "id-3", Type: domain.MsgChat, Room: "general", User: "bob", Text: "hi"}
+	if id, _ := s.SaveIdempotent(other, "key-1"); id != "id-3" {
+		t.Errorf("expected new id for other user, got %q", id)
+	}
+}
+
+func TestSQLiteSaveIdempotentWindowExpiry(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	s.IdempotencyWindow = time.Nanosecond
+
+	old := domain.Message{ID: "id-1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi",
+		Timestamp: time.Now().UTC().Add(-time.Minute)}
+	s.SaveIdempotent(old, "key-1")
+	again := domain.Message{ID: "id-2", Type: domain.MsgChat, Room: "general", User: "alice", Text: "hi"}
+	id, err := s.SaveIdempotent(again, "key-1")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if id != "id-2" {
+		t.Errorf("expected expired key to allow a new save, got %q", id)
+	}
+}
+
+func TestSQLiteHistoryAfterID(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	// Equal timestamps: ordering must come from insertion order.
+	now := time.Now().UTC()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Save(domain.Message{ID: id, Type: domain.MsgChat, Room: "general", User: "alice", Text: id, Timestamp: now})
+	}
+	s.Save(domain.Message{ID: "x", Type: domain.MsgChat, Room: "other", User: "alice", Text: "x", Timestamp: now})
+
+	msgs, err := s.HistoryAfterID("general", "b", 50)
+	if err != nil {
+		t.Fatalf("history after: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "c" || msgs[1].ID != "d" {
+		t.Errorf("expected [c d], got %+v", msgs)
+	}
+
+	if _, err := s.HistoryAfterID("other", "b", 50); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound for id in another room, got %v", err)
+	}
+}
+
+func walSize(t *testing.T, dbPath string) int64 {
+	t.Helper()
+	fi, err := os.Stat(dbPath + "-wal")
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	return fi.Size()
+}
+
+func TestSQLitePeriodicCheckpointBoundsWAL(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := NewSQLite(path, WithCheckpoint(20*time.Millisecond, CheckpointTruncate))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	text := strings.Repeat("x", 512)
+	for i := 0; i < 2000; i++ {
+		if err := s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: text}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	// Once writes stop, the next TRUNCATE checkpoint empties the WAL.
+	deadline := time.Now().Add(2 * time.Second)
+	for walSize(t, path) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("WAL not truncated by periodic checkpoint: %d bytes", walSize(t, path))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSQLiteLowercasesRoomNamesOnOpen(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := NewSQLite(path)
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	now := time.Now().UTC()
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "General", User: "alice", Text: "old", Timestamp: now})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "general", User: "bob", Text: "new", Timestamp: now.Add(time.Second)})
+	s.Save(domain.Message{ID: "m3", Type: domain.MsgChat, Room: "dm:Alice:bob", User: "alice", Text: "hi", Timestamp: now})
+	s.SaveIdempotent(domain.Message{ID: "m4", Type: domain.MsgChat, Room: "Random", User: "alice", Text: "once", Timestamp: now}, "k")
+	s.SaveIdempotent(domain.Message{ID: "m5", Type: domain.MsgChat, Room: "random", User: "alice", Text: "twice", Timestamp: now.Add(time.Second)}, "k")
+	s.SaveRoom(domain.Room{Name: "General", Topic: "old topic", CreatedAt: now})
+	s.SaveRoom(domain.Room{Name: "general", Topic: "new topic", CreatedAt: now})
+	s.SaveRoom(domain.Room{Name: "Lobby", CreatedAt: now})
+	s.SetRoomPassword("Secret", "hash")
+	s.Close()
+
+	s, err = NewSQLite(path)
+	if err != nil {
+		t.Fatalf("reopen sqlite: %v", err)
+	}
+	defer s.Close()
+
+	if msgs, _ := s.History("general", 10); len(msgs) != 2 || msgs[0].ID != "m1" || msgs[1].ID != "m2" {
+		t.Errorf("expected both spellings merged into general, got %+v", msgs)
+	}
+	if msgs, _ := s.History("random", 10); len(msgs) != 2 {
+		t.Errorf("expected colliding idempotent saves to be kept, got %+v", msgs)
+	}
+	if msgs, _ := s.History("dm:Alice:bob", 10); len(msgs) != 1 {
+		t.Errorf("expected DM room name untouched, got %+v", msgs)
+	}
+	rooms, err := s.Rooms()
+	if err != nil {
+		t.Fatalf("rooms: %v", err)
+	}
+	var names []string
+	for _, r := range rooms {
+		names = append(names, r.Name)
+		if r.Name == "general" && r.Topic != "new topic" {
+			t.Errorf("expected the lowercase room row to win, got topic %q", r.Topic)
+		}
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"general", "lobby"}) {
+		t.Errorf("expected [general lobby], got %v", names)
+	}
+	if hash, _ := s.RoomPassword("secret"); hash != "hash" {
+		t.Errorf("expected the password under secret, got %q", hash)
+	}
+}
+
+func TestSQLiteCloseCheckpoints(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := NewSQLite(path)
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "msg"})
+	}
+	if walSize(t, path) == 0 {
+		t.Fatal("expected writes to grow the WAL")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := walSize(t, path); n != 0 {
+		t.Errorf("expected empty WAL after close, got %d bytes", n)
+	}
+}
+
+func TestSQLiteConcurrentSaves(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	const writers, perWriter = 32, 50
+	errs := make(chan error, writers*perWriter)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				msg := domain.Message{ID: fmt.Sprintf("%d-%d", w, i), Type: domain.MsgChat, Room: "general", User: "alice", Text: "msg"}
+				if err := s.Save(msg); err != nil {
+					errs <- err
+				}
+				if _, err := s.History("general", 10); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent save: %v", err)
+	}
+	if n, err := s.CountMessages("general"); err != nil || n != writers*perWriter {
+		t.Errorf("expected %d messages, got %d, %v", writers*perWriter, n, err)
+	}
+}
+
+func TestSQLiteBusyTimeout(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	holder, err := NewSQLite(path)
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer holder.Close()
+	s, err := NewSQLite(path, WithBusyTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	// Another process holding the write lock makes saves wait, then fail.
+	tx, err := holder.db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM messages"); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	start := time.Now()
+	err = s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "msg"})
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Fatalf("expected a lock error, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("expected to wait out the busy timeout, failed after %v", waited)
+	}
+
+	tx.Rollback()
+	if err := s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "msg"}); err != nil {
+		t.Errorf("expected save once the lock is released, got %v", err)
+	}
+}
+
+func TestParseCheckpointMode(t *testing.T) {
+	t.Parallel()
+	if m, err := ParseCheckpointMode("truncate"); err != nil || m != CheckpointTruncate {
+		t.Errorf("expected TRUNCATE, got %q, %v", m, err)
+	}
+	if _, err := ParseCheckpointMode("RESTART"); err == nil {
+		t.Error("expected error for unsupported mode")
+	}
+}
+
+func TestSQLiteEditHistory(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "helo", Timestamp: time.Now().UTC()})
+	if err := s.EditMessage("general", "m1", "hello"); err != nil {
+		t.Fatalf("first edit: %v", err)
+	}
+	if err := s.EditMessage("general", "m1", "hello, world"); err != nil {
+		t.Fatalf("second edit: %v", err)
+	}
+
+	msgs, _ := s.History("general", 10)
+	if len(msgs) != 1 || msgs[0].Text != "hello, world" {
+		t.Errorf("expected the live message to show the latest text, got %+v", msgs)
+	}
+	edits, err := s.EditHistory("m1")
+	if err != nil {
+		t.Fatalf("edit history: %v", err)
+	}
+	if len(edits) != 2 || edits[0].Text != "helo" || edits[1].Text != "hello" {
+		t.Fatalf("expected prior versions [helo hello], got %+v", edits)
+	}
+	if edits[1].EditedAt.Before(edits[0].EditedAt) {
+		t.Errorf("expected edits in order, got %+v", edits)
+	}
+
+	if err := s.EditMessage("other", "m1", "x"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound for wrong room, got %v", err)
+	}
+	if _, err := s.EditHistory("nope"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound for unknown id, got %v", err)
+	}
+}
+
+func TestSQLiteEditHistoryDisabled(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:", WithEditHistory(false))
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "helo"})
+	if err := s.EditMessage("general", "m1", "hello"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if edits, err := s.EditHistory("m1"); err != nil || len(edits) != 0 {
+		t.Errorf("expected no edit history, got %+v, %v", edits, err)
+	}
+}
+
+func TestSQLiteDeleteMessage(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "v1"})
+	s.EditMessage("general", "m1", "v2")
+	if m, err := s.Message("general", "m1"); err != nil || m.User != "alice" || m.Text != "v2" {
+		t.Fatalf("expected m1 by alice, got %+v, %v", m, err)
+	}
+
+	if err := s.DeleteMessage("general", "m1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Message("general", "m1"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound after delete, got %v", err)
+	}
+	if err := s.DeleteMessage("general", "m1"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestSQLiteSoftDelete(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "general", User: "alice", Text: "oops secret"})
+	s.EditMessage("general", "m1", "oops secret v2")
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "general", User: "bob", Text: "hi", ReplyTo: "m1"})
+
+	if err := s.SoftDelete("general", "m1"); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	msgs, err := s.History("general", 10)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "m1" || msgs[0].Type != domain.MsgDeleted || msgs[0].Text != "" || msgs[1].ID != "m2" {
+		t.Fatalf("expected a tombstone in m1's place, got %+v", msgs)
+	}
+	if after, _ := s.HistoryAfterID("general", "m1", 10); len(after) != 1 || after[0].ID != "m2" {
+		t.Errorf("expected the tombstone to still anchor since_id, got %+v", after)
+	}
+	if thread, _ := s.Thread("m1", 10); len(thread) != 2 || thread[0].Type != domain.MsgDeleted {
+		t.Errorf("expected a tombstone thread parent, got %+v", thread)
+	}
+	if got, _ := s.Search("general", "secret", 10); len(got) != 0 {
+		t.Errorf("expected soft-deleted messages out of search, got %+v", got)
+	}
+	if _, err := s.Message("general", "m1"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound after soft delete, got %v", err)
+	}
+	if err := s.EditMessage("general", "m1", "revived"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound editing a deleted message, got %v", err)
+	}
+	if err := s.SoftDelete("general", "m1"); err != domain.ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound deleting twice, got %v", err)
+	}
+
+	// The row and its edits are kept for audit.
+	var text string
+	if err := s.db.QueryRow("SELECT text FROM messages WHERE msg_id = 'm1'").Scan(&text); err != nil || text != "oops secret v2" {
+		t.Errorf("expected the deleted text kept in the database, got %q, %v", text, err)
+	}
+	if edits, err := s.EditHistory("m1"); err != nil || len(edits) != 1 {
+		t.Errorf("expected edit history kept, got %+v, %v", edits, err)
+	}
+}
+
+func TestSQLiteDeleteRoom(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	s.SaveRoom(domain.Room{Name: "eng", Topic: "Engineering"})
+	s.SetRoomPassword("eng", "hash")
+	s.Save(domain.Message{ID: "m1", Type: domain.MsgChat, Room: "eng", User: "alice", Text: "one"})
+	s.Save(domain.Message{ID: "m2", Type: domain.MsgChat, Room: "general", User: "alice", Text: "two"})
+	if err := s.EditMessage("eng", "m1", "edited"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+
+	if err := s.DeleteRoom("eng"); err != nil {
+		t.Fatalf("delete room: %v", err)
+	}
+	if n, _ := s.CountMessages("eng"); n != 0 {
+		t.Errorf("expected eng messages gone, got %d", n)
+	}
+	if edits, _ := s.EditHistory("m1"); len(edits) != 0 {
+		t.Errorf("expected edit history gone, got %+v", edits)
+	}
+	if rooms, _ := s.Rooms(); len(rooms) != 0 {
+		t.Errorf("expected room record gone, got %+v", rooms)
+	}
+	if hash, _ := s.RoomPassword("eng"); hash != "" {
+		t.Errorf("expected password gone, got %q", hash)
+	}
+	if n, _ := s.CountMessages("general"); n != 1 {
+		t.Errorf("expected other rooms untouched, got %d messages in general", n)
+	}
+	if err := s.DeleteRoom("missing"); err != nil {
+		t.Errorf("expected deleting an unknown room to succeed, got %v", err)
+	}
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for i, text := range []string{"deploy went fine", "lunch?", "deploying again", "100% done", `a "quoted" OR NEAR word`} {
+		s.Save(domain.Message{
+			ID: string(rune('a' + i)), Type: domain.MsgChat, Room: "general", User: "alice", Text: text,
+			Timestamp: now.Add(time.Duration(i) * time.Second),
+		})
+	}
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "random", User: "bob", Text: "deploy elsewhere", Timestamp: now})
+
+	search := func(q string, limit int) []string {
+		t.Helper()
+		msgs, err := s.Search("general", q, limit)
+		if err != nil {
+			t.Fatalf("search %q: %v", q, err)
+		}
+		var texts []string
+		for _, m := range msgs {
+			texts = append(texts, m.Text)
+		}
+		return texts
+	}
+
+	if got := search("deploy", 10); len(got) != 2 || got[0] != "deploy went fine" || got[1] != "deploying again" {
+		t.Errorf("expected both deploy messages oldest-first, got %q", got)
+	}
+	if got := search("deploy", 1); len(got) != 1 || got[0] != "deploying again" {
+		t.Errorf("expected the newest match under a limit, got %q", got)
+	}
+	if got := search("deploy fine", 10); len(got) != 1 {
+		t.Errorf("expected every word to be required, got %q", got)
+	}
+	// Query syntax and quotes in user input are matched as plain text.
+	if got := search(`"quoted" OR`, 10); len(got) != 1 {
+		t.Errorf("expected a literal match, got %q", got)
+	}
+	if got := search("NEAR(", 10); len(got) != 1 {
+		t.Errorf("expected operators to match as words, got %q", got)
+	}
+
+	if err := s.EditMessage("general", "b", "lunch deploy"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if got := search("deploy", 10); len(got) != 3 {
+		t.Errorf("expected the edited message to be indexed, got %q", got)
+	}
+	if err := s.DeleteMessage("general", "a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := search("deploy", 10); len(got) != 2 {
+		t.Errorf("expected the deleted message to be unindexed, got %q", got)
+	}
+}
+
+func TestSQLiteSearchLikeFallback(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+	s.fts = false
+
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "100% done"})
+	s.Save(domain.Message{Type: domain.MsgChat, Room: "general", User: "alice", Text: "1000 done"})
+
+	msgs, err := s.Search("general", "100%", 10)
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Text != "100% done" {
+		t.Errorf("expected %% to match literally, got %+v", msgs)
+	}
+}
+
+func TestSQLiteDeleteOlderThan(t *testing.T) {
+	t.Parallel()
+	s, err := NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("new sqlite: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	old := now.Add(-48 * time.Hour)
+	// More than one purge batch of old messages.
+	for i := 0; i < retentionBatch+10; i++ {
+		s.Save(domain.Message{ID: fmt.Sprintf("old%d", i), Type: domain.MsgChat, Room: "general", User: "alice", Text: "old", Timestamp: old})
+	}
+	s.Save(domain.Message{ID: "new", Type: domain.MsgChat, Room: "general", User: "alice", Text: "new", Timestamp: now})
+	if err := s.EditMessage("general", "old0", "edited"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+
+	n, err := s.DeleteOlderThan(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("delete older than: %v", err)
+	}
+	if n != retentionBatch+10 {
+		t.Errorf("expected %d purged, got %d", retentionBatch+10, n)
+	}
+	history, _ := s.History("general", 1000)
+	if len(history) != 1 || history[0].ID != "new" {
+		t.Errorf("expected only the new message to remain, got %d", len(history))
+	}
+	var edits int
+	s.db.QueryRow("SELECT COUNT(*) FROM message_edits").Scan(&edits)
+	if edits != 0 {
+		t.Errorf("expected purged messages' edit history to go too, got %d rows", edits)
+	}
+}
@@ -1,6 +1,10 @@
 package store
 
-import "github.com/devaloi/chatterbox/internal/domain"
+import (
+	"time"
+
+	"github.com/devaloi/chatterbox/internal/domain"
+)
 
 // Store defines the message persistence interface.
 type Store interface {
@@ -8,6 +12,164 @@ type Store interface {
 	Save(msg domain.Message) error
 	// History returns the last `limit` messages for a room, oldest first.
 	History(room string, limit int) ([]domain.Message, error)
+	// HistoryAfterID returns up to `limit` messages saved to a room after the
+	// message with the given id, oldest first. It returns domain.ErrMessageNotFound
+	// if the room has no message with that id.
+	HistoryAfterID(room, id string, limit int) ([]domain.Message, error)
 	// Close releases any resources held by the store.
 	Close() error
 }
+
+// IdempotentStore is implemented by stores that can deduplicate saves by a
+// client-supplied key.
+type IdempotentStore interface {
+	// SaveIdempotent persists msg unless the same user already saved a
+	// message to the room with key within the store's window. It returns the
+	// id of the stored message: msg.ID for a new save, or the original
+	// message's id for a duplicate.
+	SaveIdempotent(msg domain.Message, key string) (string, error)
+}
+
+// MultiHistoryStore is implemented by stores that can fetch the recent
+// history of several rooms at once.
+type MultiHistoryStore interface {
+	// HistoryMulti returns the last `limit` messages of each room, oldest
+	// first, keyed by room. Every requested room has an entry; rooms without
+	// messages map to an empty slice.
+	HistoryMulti(rooms []string, limit int) (map[string][]domain.Message, error)
+}
+
+// RoomStore is implemented by stores that keep records of rooms created
+// ahead of use, so they survive restarts.
+type RoomStore interface {
+	// SaveRoom records a room, created at its CreatedAt or else now. It
+	// returns domain.ErrRoomExists if a room with the same name is already
+	// recorded.
+	SaveRoom(room domain.Room) error
+	// Rooms returns all recorded rooms with their creation times, ordered by
+	// name.
+	Rooms() ([]domain.Room, error)
+}
+
+// CountStore is implemented by stores that can count a room's saved
+// messages.
+type CountStore interface {
+	// CountMessages returns how many messages are saved for a room.
+	CountMessages(room string) (int, error)
+}
+
+// MessageRoomStore is implemented by stores that can list the rooms they
+// hold messages for, including rooms nobody is in any more.
+type MessageRoomStore interface {
+	// MessageRooms returns the distinct names of rooms with saved messages,
+	// ordered by name. Direct-message rooms (domain.DMRoom) are included.
+	MessageRooms() ([]string, error)
+}
+
+// RoomPasswordStore is implemented by stores that keep password hashes for
+// private rooms, so a room's password outlives the room itself.
+type RoomPasswordStore interface {
+	// SetRoomPassword records the password hash for a room.
+	SetRoomPassword(room, hash string) error
+	// RoomPassword returns a room's password hash, or "" for a public room.
+	RoomPassword(room string) (string, error)
+}
+
+// RoomTopicStore is implemented by stores that can change the topic of a
+// room recorded by a RoomStore.
+type RoomTopicStore interface {
+	// SetRoomTopic updates a recorded room's topic. Rooms that are not
+	// recorded are left alone.
+	SetRoomTopic(room, topic string) error
+}
+
+// LastSeenStore is implemented by stores that keep when each user was last
+// active, so last-seen times survive restarts.
+type LastSeenStore interface {
+	// SetLastSeen records when a user was last active.
+	SetLastSeen(user string, t time.Time) error
+	// GetLastSeen returns when a user was last active, or the zero time if
+	// the user has never been seen.
+	GetLastSeen(user string) (time.Time, error)
+}
+
+// EditStore is implemented by stores that support editing and deleting
+// saved messages.
+type EditStore interface {
+	// Message returns a saved message by id, or domain.ErrMessageNotFound if
+	// the room has no message with that id.
+	Message(room, id string) (domain.Message, error)
+	// EditMessage replaces the text of a message in a room. It returns
+	// domain.ErrMessageNotFound if the room has no message with that id.
+	EditMessage(room, id, text string) error
+	// EditHistory returns the prior versions of a message, oldest first, or
+	// domain.ErrMessageNotFound for an unknown id.
+	EditHistory(id string) ([]domain.MessageEdit, error)
+	// DeleteMessage removes a message and its edit history. It returns
+	// domain.ErrMessageNotFound if the room has no message with that id.
+	DeleteMessage(room, id string) error
+}
+
+// SoftDeleteStore is implemented by stores that can delete a message while
+// keeping it for audit.
+type SoftDeleteStore interface {
+	// SoftDelete marks a message deleted, so history returns it as a
+	// domain.MsgDeleted tombstone. It returns domain.ErrMessageNotFound if
+	// the room has no such message or it is already deleted.
+	SoftDelete(room, id string) error
+}
+
+// RoomDeleteStore is implemented by stores that can purge everything kept
+// for a room.
+type RoomDeleteStore interface {
+	// DeleteRoom removes a room's messages and their edit history, along
+	// with any record or password kept for the room. A room with nothing
+	// stored is not an error.
+	DeleteRoom(room string) error
+}
+
+// PurgeStore is implemented by stores that delete messages on their own,
+// such as a SQLiteStore with retention.
+type PurgeStore interface {
+	// OnPurge registers fn to be called with the rooms that lost messages
+	// after each purge that deleted any.
+	OnPurge(fn func(rooms []string))
+}
+
+// ThreadStore is implemented by stores that keep reply threads.
+type ThreadStore interface {
+	// Thread returns the message with the given id followed by up to
+	// `limit` of its direct replies, oldest first. A limit of zero returns
+	// only the message. It returns domain.ErrMessageNotFound for an unknown
+	// id.
+	Thread(id string, limit int) ([]domain.Message, error)
+}
+
+// SearchStore is implemented by stores that can search message text.
+type SearchStore interface {
+	// Search returns up to `limit` of the newest messages in a room whose
+	// text matches every word of query, oldest first.
+	Search(room, query string, limit int) ([]domain.Message, error)
+}
+
+// ClampHistory guards against stores that ignore the History limit. It keeps
+// at most the newest limit messages of an oldest-first slice, and returns nil
+// for a zero or negative limit.
+func ClampHistory(msgs []domain.Message, limit int) []domain.Message {
+	if limit <= 0 {
+		return nil
+	}
+	if len(msgs) > limit {
+		return msgs[len(msgs)-limit:]
+	}
+	return msgs
+}
+
+// createdAt is when SaveRoom records room as created: its CreatedAt, or now
+// if that is unset.
+func createdAt(room domain.Room) time.Time {
+	if room.CreatedAt.IsZero() {
+		return time.Now().UTC()
+	}
+	return room.CreatedAt
+}
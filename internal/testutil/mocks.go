@@ -1,16 +1,22 @@
 package testutil
 
 import (
+	"errors"
 	"sync"
+	"time"
 
+	"github.com/devaloi/chatterbox/internal/deadletter"
 	"github.com/devaloi/chatterbox/internal/domain"
 )
 
 // MockClient implements hub.Client for testing.
 type MockClient struct {
-	Name     string
-	messages [][]byte
-	mu       sync.Mutex
+	Name      string
+	Moderator bool // reported by IsModerator
+	display   string
+	status    string
+	messages  [][]byte
+	mu        sync.Mutex
 }
 
 // NewMockClient creates a new MockClient with the given name.
@@ -21,6 +27,37 @@ func NewMockClient(name string) *MockClient {
 // Username returns the mock client's name.
 func (m *MockClient) Username() string { return m.Name }
 
+// IsModerator reports whether the mock client has moderator rights.
+func (m *MockClient) IsModerator() bool { return m.Moderator }
+
+// DisplayName returns the display name set by SetDisplayName.
+func (m *MockClient) DisplayName() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.display
+}
+
+// SetDisplayName records the mock client's display name.
+func (m *MockClient) SetDisplayName(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.display = name
+}
+
+// Status returns the status set by SetStatus.
+func (m *MockClient) Status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// SetStatus records the mock client's presence status.
+func (m *MockClient) SetStatus(state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = state
+}
+
 // Send records a message sent to the mock client.
 func (m *MockClient) Send(data []byte) {
 	m.mu.Lock()
@@ -41,8 +78,12 @@ func (m *MockClient) GetMessages() [][]byte {
 
 // MockStore implements store.Store for testing.
 type MockStore struct {
-	mu       sync.Mutex
-	messages map[string][]domain.Message
+	mu           sync.Mutex
+	messages     map[string][]domain.Message
+	historyCalls int
+	saveErr      error
+	// HistoryDelay, if set, is slept inside History to simulate a slow query.
+	HistoryDelay time.Duration
 }
 
 // NewMockStore creates a new MockStore.
@@ -54,14 +95,29 @@ func NewMockStore() *MockStore {
 func (s *MockStore) Save(msg domain.Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.saveErr != nil {
+		return s.saveErr
+	}
 	s.messages[msg.Room] = append(s.messages[msg.Room], msg)
 	return nil
 }
 
+// FailSaves makes every later Save return err without storing; nil restores
+// normal saves.
+func (s *MockStore) FailSaves(err error) {
+	s.mu.Lock()
+	s.saveErr = err
+	s.mu.Unlock()
+}
+
 // History returns stored messages for a room.
 func (s *MockStore) History(room string, limit int) ([]domain.Message, error) {
+	if s.HistoryDelay > 0 {
+		time.Sleep(s.HistoryDelay)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.historyCalls++
 	msgs := s.messages[room]
 	if len(msgs) > limit {
 		msgs = msgs[len(msgs)-limit:]
@@ -69,5 +125,162 @@ func (s *MockStore) History(room string, limit int) ([]domain.Message, error) {
 	return msgs, nil
 }
 
+// HistoryAfterID returns stored messages for a room after the one with id.
+func (s *MockStore) HistoryAfterID(room, id string, limit int) ([]domain.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.messages[room]
+	for i, m := range msgs {
+		if id != "" && m.ID == id {
+			after := msgs[i+1:]
+			if len(after) > limit {
+				after = after[:limit]
+			}
+			return append([]domain.Message(nil), after...), nil
+		}
+	}
+	return nil, domain.ErrMessageNotFound
+}
+
+// HistoryCalls returns how many times History has been called.
+func (s *MockStore) HistoryCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.historyCalls
+}
+
 // Close is a no-op for the mock store.
 func (s *MockStore) Close() error { return nil }
+
+// MockDeadLetterSink implements deadletter.Sink for testing.
+type MockDeadLetterSink struct {
+	mu      sync.Mutex
+	records []deadletter.Record
+}
+
+// Record stores a dead-letter record.
+func (s *MockDeadLetterSink) Record(r deadletter.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+}
+
+// Records returns a copy of all recorded dead letters.
+func (s *MockDeadLetterSink) Records() []deadletter.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := make([]deadletter.Record, len(s.records))
+	copy(cp, s.records)
+	return cp
+}
+
+// MockConn is an in-memory implementation of client.Conn. Tests feed inbound
+// frames with Push and observe outbound frames with Written.
+type MockConn struct {
+	inbound   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	written   []MockFrame
+	notify    chan struct{}
+}
+
+// MockFrame is a frame written to a MockConn.
+type MockFrame struct {
+	Type int
+	Data []byte
+}
+
+// ErrMockConnClosed is returned by MockConn operations after Close.
+var ErrMockConnClosed = errors.New("mock conn closed")
+
+// NewMockConn creates a new MockConn.
+func NewMockConn() *MockConn {
+	return &MockConn{
+		inbound: make(chan []byte, 64),
+		closed:  make(chan struct{}),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues a text frame to be returned by ReadMessage.
+func (m *MockConn) Push(data []byte) {
+	m.inbound <- data
+}
+
+// ReadMessage blocks until a frame is pushed or the conn is closed.
+func (m *MockConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-m.inbound:
+		return 1, data, nil
+	case <-m.closed:
+		return 0, nil, ErrMockConnClosed
+	}
+}
+
+// WriteMessage records an outbound frame.
+func (m *MockConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-m.closed:
+		return ErrMockConnClosed
+	default:
+	}
+	m.mu.Lock()
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	m.written = append(m.written, MockFrame{Type: messageType, Data: cp})
+	m.mu.Unlock()
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Written returns a copy of all frames written so far.
+func (m *MockConn) Written() []MockFrame {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := make([]MockFrame, len(m.written))
+	copy(cp, m.written)
+	return cp
+}
+
+// WaitForFrames blocks until at least n frames have been written or the
+// timeout elapses, and returns the frames written so far.
+func (m *MockConn) WaitForFrames(n int, timeout time.Duration) []MockFrame {
+	deadline := time.After(timeout)
+	for {
+		if frames := m.Written(); len(frames) >= n {
+			return frames
+		}
+		select {
+		case <-m.notify:
+		case <-deadline:
+			return m.Written()
+		}
+	}
+}
+
+// SetReadDeadline is a no-op.
+func (m *MockConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is a no-op.
+func (m *MockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SetPongHandler is a no-op.
+func (m *MockConn) SetPongHandler(h func(appData string) error) {}
+
+// SetReadLimit is a no-op.
+func (m *MockConn) SetReadLimit(limit int64) {}
+
+// Close closes the conn, unblocking ReadMessage.
+func (m *MockConn) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	return nil
+}
+
+// Closed returns a channel that is closed when Close is called.
+func (m *MockConn) Closed() <-chan struct{} {
+	return m.closed
+}
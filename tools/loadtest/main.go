@@ -14,67 +14,140 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// options holds the command-line settings shared by every scenario.
+type options struct {
+	url        string
+	clients    int
+	room       string
+	messages   int
+	reconnect  float64
+	backoff    time.Duration
+	maxRetries int
+}
+
 func main() {
-	url := flag.String("url", "ws://localhost:8080/ws", "WebSocket server URL")
-	clients := flag.Int("clients", 10, "Number of concurrent clients")
-	room := flag.String("room", "loadtest", "Room to join")
-	messages := flag.Int("messages", 10, "Messages per client")
+	var o options
+	flag.StringVar(&o.url, "url", "ws://localhost:8080/ws", "WebSocket server URL")
+	flag.IntVar(&o.clients, "clients", 10, "Number of concurrent clients")
+	flag.StringVar(&o.room, "room", "loadtest", "Room to join")
+	flag.IntVar(&o.messages, "messages", 10, "Messages per client (history: messages seeded; presence: join/leave cycles)")
+	flag.Float64Var(&o.reconnect, "reconnect", 0, "Fraction of clients (0-1) that disconnect and reconnect mid-test (chat only)")
+	flag.DurationVar(&o.backoff, "backoff", 100*time.Millisecond, "Initial reconnect backoff, doubled on each failed attempt")
+	flag.IntVar(&o.maxRetries, "max-retries", 5, "Maximum dial attempts per (re)connect")
+	scenario := flag.String("scenario", "chat", "Scenario to run: chat, history, presence or dm")
 	flag.Parse()
 
-	log.Printf("Load test: %d clients, %d messages each, room=%s", *clients, *messages, *room)
+	switch *scenario {
+	case "chat":
+		runChat(o)
+	case "history":
+		runHistory(o)
+	case "presence":
+		runPresence(o)
+	case "dm":
+		runDM(o)
+	default:
+		log.Fatalf("unknown scenario %q: want chat, history, presence or dm", *scenario)
+	}
+}
+
+// runChat has every client join the room and send chat messages, optionally
+// reconnecting part way through.
+func runChat(o options) {
+	log.Printf("Load test: %d clients, %d messages each, room=%s", o.clients, o.messages, o.room)
 
 	var (
-		connected  int64
-		sent       int64
-		received   int64
-		errors     int64
-		latencies  []time.Duration
-		latencyMu  sync.Mutex
-		wg         sync.WaitGroup
+		connected       int64
+		sent            int64
+		received        int64
+		errors          int64
+		reconnected     int64
+		reconnectErrors int64
+		latencies       []time.Duration
+		latencyMu       sync.Mutex
+		closeCodes      = map[int]int{} // close frame status code -> count
+		closeMu         sync.Mutex
+		wg              sync.WaitGroup
 	)
 
 	start := time.Now()
 
-	for i := 0; i < *clients; i++ {
+	// Every client whose index falls inside the reconnect fraction drops its
+	// connection halfway through sending and reconnects with backoff.
+	reconnectEvery := 0
+	if o.reconnect > 0 {
+		reconnectEvery = int(math.Max(1, math.Round(1/o.reconnect)))
+	}
+
+	for i := 0; i < o.clients; i++ {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
 
 			user := fmt.Sprintf("user_%d", id)
-			wsURL := fmt.Sprintf("%s?user=%s", *url, user)
-			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			wsURL := fmt.Sprintf("%s?user=%s", o.url, user)
+
+			// connect dials, starts the read goroutine, and joins the room.
+			// The returned channel is closed when the read goroutine exits.
+			connect := func() (*websocket.Conn, chan struct{}, error) {
+				conn, err := dialWithBackoff(wsURL, o.backoff, o.maxRetries)
+				if err != nil {
+					return nil, nil, err
+				}
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for {
+						_, _, err := conn.ReadMessage()
+						if err != nil {
+							if ce, ok := err.(*websocket.CloseError); ok {
+								closeMu.Lock()
+								closeCodes[ce.Code]++
+								closeMu.Unlock()
+							}
+							return
+						}
+						atomic.AddInt64(&received, 1)
+					}
+				}()
+
+				joinMsg, _ := json.Marshal(map[string]string{"type": "join", "room": o.room})
+				conn.WriteMessage(websocket.TextMessage, joinMsg)
+				time.Sleep(100 * time.Millisecond)
+				return conn, done, nil
+			}
+
+			conn, done, err := connect()
 			if err != nil {
 				atomic.AddInt64(&errors, 1)
 				log.Printf("client %d: dial error: %v", id, err)
 				return
 			}
-			defer conn.Close()
 			atomic.AddInt64(&connected, 1)
+			defer func() { conn.Close() }()
+
+			reconnects := reconnectEvery > 0 && id%reconnectEvery == 0
 
-			// Read goroutine.
-			done := make(chan struct{})
-			go func() {
-				defer close(done)
-				for {
-					_, _, err := conn.ReadMessage()
+			// Send messages.
+			for j := 0; j < o.messages; j++ {
+				if reconnects && j == o.messages/2 {
+					conn.Close()
+					<-done
+					// Keep conn set for the deferred Close if the reconnect fails.
+					next, nextDone, err := connect()
 					if err != nil {
+						atomic.AddInt64(&reconnectErrors, 1)
+						log.Printf("client %d: reconnect error: %v", id, err)
 						return
 					}
-					atomic.AddInt64(&received, 1)
+					conn, done = next, nextDone
+					atomic.AddInt64(&reconnected, 1)
 				}
-			}()
 
-			// Join room.
-			joinMsg, _ := json.Marshal(map[string]string{"type": "join", "room": *room})
-			conn.WriteMessage(websocket.TextMessage, joinMsg)
-			time.Sleep(100 * time.Millisecond)
-
-			// Send messages.
-			for j := 0; j < *messages; j++ {
 				sendTime := time.Now()
 				chatMsg, _ := json.Marshal(map[string]string{
 					"type": "chat",
-					"room": *room,
+					"room": o.room,
 					"text": fmt.Sprintf("msg %d from %s", j, user),
 				})
 				if err := conn.WriteMessage(websocket.TextMessage, chatMsg); err != nil {
@@ -108,12 +181,48 @@ func main() {
 	fmt.Printf("Sent:        %d messages\n", sent)
 	fmt.Printf("Received:    %d messages\n", received)
 	fmt.Printf("Errors:      %d\n", errors)
+	if o.reconnect > 0 {
+		fmt.Printf("Reconnects:  %d (%d failed)\n", reconnected, reconnectErrors)
+	}
 	if len(latencies) > 0 {
 		fmt.Printf("Latency p50: %s\n", percentile(latencies, 50))
 		fmt.Printf("Latency p95: %s\n", percentile(latencies, 95))
 		fmt.Printf("Latency p99: %s\n", percentile(latencies, 99))
 	}
 	fmt.Printf("Throughput:  %.0f msgs/sec\n", float64(sent)/elapsed.Seconds())
+	if len(closeCodes) > 0 {
+		codes := make([]int, 0, len(closeCodes))
+		for code := range closeCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		fmt.Println("Close codes:")
+		for _, code := range codes {
+			fmt.Printf("  %d: %d\n", code, closeCodes[code])
+		}
+	}
+}
+
+// dialWithBackoff dials url, retrying with exponential backoff up to
+// maxAttempts times.
+func dialWithBackoff(url string, initial time.Duration, maxAttempts int) (*websocket.Conn, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	delay := initial
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
 }
 
 func percentile(sorted []time.Duration, p float64) time.Duration {
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameTimeout bounds how long a scenario waits for an expected frame.
+const frameTimeout = 10 * time.Second
+
+// frame is the part of a server frame the scenarios look at.
+type frame struct {
+	Type     string            `json:"type"`
+	To       string            `json:"to"`
+	Text     string            `json:"text"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// dial connects as user with the configured backoff.
+func dial(o options, user string) (*websocket.Conn, error) {
+	return dialWithBackoff(fmt.Sprintf("%s?user=%s", o.url, user), o.backoff, o.maxRetries)
+}
+
+// send writes v as a JSON text frame.
+func send(conn *websocket.Conn, v map[string]string) error {
+	data, _ := json.Marshal(v)
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// readUntil reads frames until one of type typ arrives, skipping the rest.
+func readUntil(conn *websocket.Conn, typ string) (frame, error) {
+	conn.SetReadDeadline(time.Now().Add(frameTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return frame{}, err
+		}
+		var f frame
+		if json.Unmarshal(data, &f) == nil && f.Type == typ {
+			return f, nil
+		}
+	}
+}
+
+// closeConn sends a normal close frame and closes the connection.
+func closeConn(conn *websocket.Conn) {
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+}
+
+// printPercentiles prints the p50, p95 and p99 of lats under label.
+func printPercentiles(label string, lats []time.Duration) {
+	if len(lats) == 0 {
+		return
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	fmt.Printf("%s p50: %s\n", label, percentile(lats, 50))
+	fmt.Printf("%s p95: %s\n", label, percentile(lats, 95))
+	fmt.Printf("%s p99: %s\n", label, percentile(lats, 99))
+}
+
+// runHistory seeds the room with messages, then has every client join it at
+// once and measures how long each waits for its history replay.
+func runHistory(o options) {
+	log.Printf("History test: seeding %d messages, then %d clients join room=%s", o.messages, o.clients, o.room)
+
+	seeder, err := dial(o, "seeder")
+	if err != nil {
+		log.Fatalf("seeder: dial error: %v", err)
+	}
+	send(seeder, map[string]string{"type": "join", "room": o.room})
+	for i := 0; i < o.messages; i++ {
+		if err := send(seeder, map[string]string{"type": "chat", "room": o.room, "text": fmt.Sprintf("seed %d", i)}); err != nil {
+			log.Fatalf("seeder: send error: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	closeConn(seeder)
+
+	var (
+		failures  int64
+		replayed  int64
+		latencies []time.Duration
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < o.clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			conn, err := dial(o, fmt.Sprintf("reader_%d", id))
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+				log.Printf("client %d: dial error: %v", id, err)
+				return
+			}
+			defer closeConn(conn)
+
+			joinTime := time.Now()
+			send(conn, map[string]string{"type": "join", "room": o.room})
+			f, err := readUntil(conn, "history")
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+				log.Printf("client %d: no history: %v", id, err)
+				return
+			}
+			lat := time.Since(joinTime)
+			atomic.AddInt64(&replayed, int64(len(f.Messages)))
+			mu.Lock()
+			latencies = append(latencies, lat)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Println("\n=== History Replay Results ===")
+	fmt.Printf("Duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Replays:     %d (%d failed)\n", len(latencies), failures)
+	if len(latencies) > 0 {
+		fmt.Printf("Messages:    %.1f per replay\n", float64(replayed)/float64(len(latencies)))
+	}
+	printPercentiles("Replay", latencies)
+	fmt.Printf("Throughput:  %.0f joins/sec\n", float64(len(latencies))/elapsed.Seconds())
+}
+
+// runPresence has every client join and leave the room repeatedly, timing
+// each join until its presence snapshot arrives, while an observer counts
+// the presence traffic the churn sends to a steady member.
+func runPresence(o options) {
+	log.Printf("Presence test: %d clients, %d join/leave cycles each, room=%s", o.clients, o.messages, o.room)
+
+	observer, err := dial(o, "observer")
+	if err != nil {
+		log.Fatalf("observer: dial error: %v", err)
+	}
+	send(observer, map[string]string{"type": "join", "room": o.room})
+	if _, err := readUntil(observer, "presence"); err != nil {
+		log.Fatalf("observer: no presence: %v", err)
+	}
+	observed := map[string]int{}
+	var observedMu sync.Mutex
+	observerDone := make(chan struct{})
+	go func() {
+		defer close(observerDone)
+		for {
+			_, data, err := observer.ReadMessage()
+			if err != nil {
+				return
+			}
+			var f frame
+			json.Unmarshal(data, &f)
+			observedMu.Lock()
+			observed[f.Type]++
+			observedMu.Unlock()
+		}
+	}()
+
+	var (
+		failures  int64
+		latencies []time.Duration
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < o.clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			conn, err := dial(o, fmt.Sprintf("churn_%d", id))
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+				log.Printf("client %d: dial error: %v", id, err)
+				return
+			}
+			defer closeConn(conn)
+
+			for j := 0; j < o.messages; j++ {
+				joinTime := time.Now()
+				send(conn, map[string]string{"type": "join", "room": o.room})
+				if _, err := readUntil(conn, "presence"); err != nil {
+					atomic.AddInt64(&failures, 1)
+					log.Printf("client %d: no presence: %v", id, err)
+					return
+				}
+				lat := time.Since(joinTime)
+				mu.Lock()
+				latencies = append(latencies, lat)
+				mu.Unlock()
+				send(conn, map[string]string{"type": "leave", "room": o.room})
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Let the last diffs reach the observer before counting.
+	time.Sleep(500 * time.Millisecond)
+	closeConn(observer)
+	<-observerDone
+
+	fmt.Println("\n=== Presence Churn Results ===")
+	fmt.Printf("Duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Cycles:      %d (%d failed)\n", len(latencies), failures)
+	printPercentiles("Join", latencies)
+	fmt.Printf("Throughput:  %.0f joins/sec\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Println("Observer received:")
+	types := make([]string, 0, len(observed))
+	for typ := range observed {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Printf("  %s: %d\n", typ, observed[typ])
+	}
+}
+
+// runDM connects every client, then has each send direct messages to the
+// next one, measuring delivery latency from the send time carried in the
+// message text. Senders' echoes are not counted.
+func runDM(o options) {
+	if o.clients < 2 {
+		log.Fatal("dm scenario needs at least 2 clients")
+	}
+	log.Printf("DM test: %d clients, %d messages each", o.clients, o.messages)
+
+	var (
+		sent      int64
+		delivered int64
+		failures  int64
+		rejected  int64
+		latencies []time.Duration
+		mu        sync.Mutex
+		readers   sync.WaitGroup
+	)
+	conns := make([]*websocket.Conn, o.clients)
+	for i := range conns {
+		conn, err := dial(o, fmt.Sprintf("dm_%d", i))
+		if err != nil {
+			atomic.AddInt64(&failures, 1)
+			log.Printf("client %d: dial error: %v", i, err)
+			continue
+		}
+		conns[i] = conn
+		user := fmt.Sprintf("dm_%d", i)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				var f frame
+				json.Unmarshal(data, &f)
+				switch f.Type {
+				case "dm":
+					nanos, err := strconv.ParseInt(f.Text, 10, 64)
+					if f.To != user || err != nil {
+						continue
+					}
+					atomic.AddInt64(&delivered, 1)
+					mu.Lock()
+					latencies = append(latencies, time.Since(time.Unix(0, nanos)))
+					mu.Unlock()
+				case "error":
+					atomic.AddInt64(&rejected, 1)
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(id int, conn *websocket.Conn) {
+			defer wg.Done()
+			to := fmt.Sprintf("dm_%d", (id+1)%o.clients)
+			for j := 0; j < o.messages; j++ {
+				err := send(conn, map[string]string{"type": "dm", "to": to, "text": strconv.FormatInt(time.Now().UnixNano(), 10)})
+				if err != nil {
+					atomic.AddInt64(&failures, 1)
+					return
+				}
+				atomic.AddInt64(&sent, 1)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	time.Sleep(500 * time.Millisecond)
+	for _, conn := range conns {
+		if conn != nil {
+			closeConn(conn)
+		}
+	}
+	readers.Wait()
+
+	fmt.Println("\n=== Direct Message Results ===")
+	fmt.Printf("Duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Sent:        %d messages\n", sent)
+	fmt.Printf("Delivered:   %d frames\n", delivered)
+	fmt.Printf("Rejected:    %d (error frames)\n", rejected)
+	fmt.Printf("Failures:    %d\n", failures)
+	printPercentiles("Latency", latencies)
+	fmt.Printf("Throughput:  %.0f msgs/sec\n", float64(sent)/elapsed.Seconds())
+}